@@ -0,0 +1,401 @@
+// +build linux darwin
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/butonic/ocis-overlay/overlay"
+)
+
+// benchWorkload runs one iteration of a workload in the directory of a
+// worker, timing every operation
+type benchWorkload func(w *benchWorker, i int)
+
+// benchWorkloads are the workloads of the bench subcommand in the order they
+// run for all
+var benchWorkloads = []struct {
+	name string
+	run  benchWorkload
+}{
+	{"metadata", benchMetadata},
+	{"stream", benchStream},
+	{"churn", benchChurn},
+	{"shared", benchShared},
+}
+
+// benchResult is printed by bench for every operation of a workload,
+// latencies are in milliseconds
+type benchResult struct {
+	Workload string  `json:"workload"`
+	Op       string  `json:"op"`
+	Count    int     `json:"count"`
+	Errors   int     `json:"errors"`
+	P50      float64 `json:"p50_ms"`
+	P90      float64 `json:"p90_ms"`
+	P99      float64 `json:"p99_ms"`
+	Max      float64 `json:"max_ms"`
+	// Bytes read or written, MiBPerSecond over the run of the workload
+	Bytes        int64   `json:"bytes,omitempty"`
+	MiBPerSecond float64 `json:"mib_per_s,omitempty"`
+}
+
+// benchConfig are the parameters of the workloads
+type benchConfig struct {
+	files int
+	size  int64
+	block int64
+	small int64
+}
+
+// benchWorker runs a workload in its own directory and collects the
+// latencies by operation
+type benchWorker struct {
+	*benchConfig
+	dir  string
+	buf  []byte
+	ops  []string
+	lat  map[string][]time.Duration
+	errs map[string]int
+	// bytes read or written by operation
+	bytes map[string]int64
+}
+
+func newBenchWorker(c *benchConfig, dir string) *benchWorker {
+	return &benchWorker{
+		benchConfig: c,
+		dir:         dir,
+		buf:         make([]byte, c.block),
+		lat:         make(map[string][]time.Duration),
+		errs:        make(map[string]int),
+		bytes:       make(map[string]int64),
+	}
+}
+
+// time runs fn as op and records its latency, the first error of an op is
+// printed
+func (w *benchWorker) time(op string, fn func() error) error {
+	if _, ok := w.lat[op]; !ok {
+		w.ops = append(w.ops, op)
+	}
+	start := time.Now()
+	err := fn()
+	w.lat[op] = append(w.lat[op], time.Since(start))
+	if err != nil {
+		if w.errs[op] == 0 {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		w.errs[op]++
+	}
+	return err
+}
+
+func (w *benchWorker) path(name string, i int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%d", name, i))
+}
+
+// benchMetadata creates a file and changes its metadata, the last files of
+// them are kept and listed every 64 iterations
+func benchMetadata(w *benchWorker, i int) {
+	p := w.path("m", i)
+	if w.time("create", func() error {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}) != nil {
+		return
+	}
+	w.time("stat", func() error {
+		_, err := os.Lstat(p)
+		return err
+	})
+	w.time("chmod", func() error {
+		return os.Chmod(p, 0600)
+	})
+	w.time("rename", func() error {
+		return os.Rename(p, p+".r")
+	})
+	if i%64 == 63 {
+		w.time("readdir", func() error {
+			_, err := ioutil.ReadDir(w.dir)
+			return err
+		})
+	}
+	if i >= w.files {
+		w.time("remove", func() error {
+			return os.Remove(w.path("m", i-w.files) + ".r")
+		})
+	}
+}
+
+// benchStream writes a big file in blocks and reads it back
+func benchStream(w *benchWorker, i int) {
+	p := w.path("s", i%2)
+	var f *os.File
+	if w.time("open", func() (err error) {
+		f, err = os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		return err
+	}) != nil {
+		return
+	}
+	for off := int64(0); off < w.size; off += w.block {
+		b := w.buf
+		if w.size-off < w.block {
+			b = b[:w.size-off]
+		}
+		if w.time("write", func() error {
+			_, err := f.Write(b)
+			return err
+		}) != nil {
+			break
+		}
+		w.bytes["write"] += int64(len(b))
+	}
+	if w.time("close", f.Close) != nil {
+		return
+	}
+	if w.time("open", func() (err error) {
+		f, err = os.Open(p)
+		return err
+	}) != nil {
+		return
+	}
+	defer f.Close()
+	for {
+		var n int
+		err := w.time("read", func() (err error) {
+			n, err = f.Read(w.buf)
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		})
+		w.bytes["read"] += int64(n)
+		if err != nil || n == 0 {
+			return
+		}
+	}
+}
+
+// benchChurn creates, reads and removes small files
+func benchChurn(w *benchWorker, i int) {
+	p := w.path("c", i)
+	if w.time("create", func() error {
+		return ioutil.WriteFile(p, w.buf[:w.small], 0644)
+	}) != nil {
+		return
+	}
+	w.bytes["create"] += w.small
+	w.time("read", func() error {
+		b, err := ioutil.ReadFile(p)
+		w.bytes["read"] += int64(len(b))
+		return err
+	})
+	w.time("remove", func() error {
+		return os.Remove(p)
+	})
+}
+
+// benchShared writes, reads and syncs blocks of -small bytes of a file all
+// workers share and lists their common directory, to stress the overlay with
+// parallel requests on the same nodes and handles. A written block is filled
+// with a byte derived from its index, a read of other data is an error.
+func benchShared(w *benchWorker, i int) {
+	p := filepath.Join(filepath.Dir(w.dir), "shared")
+	var f *os.File
+	if w.time("open", func() (err error) {
+		f, err = os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+		return err
+	}) != nil {
+		return
+	}
+	defer f.Close()
+	idx := rand.Intn(w.files)
+	b := w.buf[:w.small]
+	for j := range b {
+		b[j] = byte(idx%255 + 1)
+	}
+	if w.time("write", func() error {
+		_, err := f.WriteAt(b, int64(idx)*w.small)
+		return err
+	}) == nil {
+		w.bytes["write"] += w.small
+	}
+	idx = rand.Intn(w.files)
+	w.time("read", func() error {
+		r := make([]byte, w.small)
+		n, err := f.ReadAt(r, int64(idx)*w.small)
+		if err == io.EOF {
+			err = nil
+		}
+		w.bytes["read"] += int64(n)
+		for _, c := range r[:n] {
+			// blocks not written yet read as zeros
+			if c != 0 && c != byte(idx%255+1) {
+				return fmt.Errorf("block %d of %s has wrong data", idx, p)
+			}
+		}
+		return err
+	})
+	if i%16 == 15 {
+		w.time("fsync", f.Sync)
+		w.time("readdir", func() error {
+			_, err := ioutil.ReadDir(filepath.Dir(w.dir))
+			return err
+		})
+	}
+}
+
+// percentile returns the p-th percentile of the sorted latencies in
+// milliseconds
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// runBench runs the workload with concurrency workers in dir for duration
+// and returns the results by operation
+func runBench(name string, run benchWorkload, c *benchConfig, dir string, concurrency int, duration time.Duration) ([]benchResult, error) {
+	workers := make([]*benchWorker, concurrency)
+	for n := range workers {
+		d := filepath.Join(dir, fmt.Sprintf("%s-%d", name, n))
+		if err := os.Mkdir(d, 0755); err != nil {
+			return nil, err
+		}
+		workers[n] = newBenchWorker(c, d)
+	}
+	start := time.Now()
+	deadline := start.Add(duration)
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *benchWorker) {
+			defer wg.Done()
+			for i := 0; time.Now().Before(deadline); i++ {
+				run(w, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var ops []string
+	lat := make(map[string][]time.Duration)
+	results := make(map[string]*benchResult)
+	for _, w := range workers {
+		for _, op := range w.ops {
+			r := results[op]
+			if r == nil {
+				r = &benchResult{Workload: name, Op: op}
+				results[op] = r
+				ops = append(ops, op)
+			}
+			lat[op] = append(lat[op], w.lat[op]...)
+			r.Errors += w.errs[op]
+			r.Bytes += w.bytes[op]
+		}
+	}
+	all := make([]benchResult, 0, len(ops))
+	for _, op := range ops {
+		r, l := results[op], lat[op]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		r.Count = len(l)
+		r.P50, r.P90, r.P99 = percentile(l, 0.5), percentile(l, 0.9), percentile(l, 0.99)
+		r.Max = percentile(l, 1)
+		if r.Bytes > 0 {
+			r.MiBPerSecond = float64(r.Bytes) / (1 << 20) / elapsed.Seconds()
+		}
+		all = append(all, *r)
+	}
+	return all, nil
+}
+
+// bench runs the bench subcommand and returns the exit code: 0 if all
+// operations succeeded, 1 if some failed and 2 for usage errors. Every
+// workload runs in a temporary directory in the mount that is removed
+// afterwards, the latencies of its operations are printed as JSON lines.
+func bench(args []string) int {
+	fset := newCommandFlags("bench", "[-workload metadata,stream,churn,shared] [-duration 10s] [-concurrency 4] MOUNTPOINT")
+	workload := fset.String("workload", "all", "comma separated workloads to run: metadata creates, stats, renames and lists files, stream writes and reads big files, churn creates, reads and removes small files, shared writes and reads blocks of one file from all workers")
+	duration := fset.Duration("duration", 10*time.Second, "how long to run each workload")
+	concurrency := fset.Int("concurrency", 4, "number of workers running a workload in parallel, each in its own directory")
+	files := fset.Int("files", 1000, "number of files a metadata worker keeps in its directory, and of blocks of the shared file")
+	size := fset.String("size", "64MiB", "size of the files of the stream workload")
+	block := fset.String("block", "128KiB", "size of the reads and writes of the stream workload")
+	small := fset.String("small", "4KiB", "size of the files of the churn workload and of the blocks of the shared workload")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() != 1 || *concurrency < 1 || *files < 1 || *duration <= 0 {
+		fset.Usage()
+		return 2
+	}
+	c := &benchConfig{files: *files}
+	var err error
+	for _, s := range []struct {
+		spec string
+		v    *int64
+	}{{*size, &c.size}, {*block, &c.block}, {*small, &c.small}} {
+		if *s.v, err = overlay.ParseSize(s.spec); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if c.small > c.block {
+		c.block = c.small
+	}
+	var run []int
+	for _, name := range strings.Split(*workload, ",") {
+		found := false
+		for i, w := range benchWorkloads {
+			if name == w.name || name == "all" {
+				run, found = append(run, i), true
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "unknown workload %q\n", name)
+			return 2
+		}
+	}
+
+	dir, err := ioutil.TempDir(fset.Arg(0), "bench-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	code := 0
+	for _, i := range run {
+		w := benchWorkloads[i]
+		results, err := runBench(w.name, w.run, c, dir, *concurrency, *duration)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, r := range results {
+			if r.Errors > 0 {
+				code = 1
+			}
+			printJSON(r)
+		}
+	}
+	return code
+}
@@ -0,0 +1,64 @@
+// +build linux darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/butonic/ocis-overlay/overlay"
+)
+
+// check runs the check subcommand and returns the exit code: 0 if healthy, 1
+// if not and 2 for usage errors. With -control the running overlay checks
+// itself, including its remote backend, otherwise the mount is checked from
+// this process.
+func check(args []string) int {
+	fset := newCommandFlags("check", "[-control SOCKET] [-timeout 10s] [MOUNTPOINT]")
+	control := fset.String("control", "", "ask the overlay listening on this control socket, which also checks the remote backend")
+	timeout := fset.Duration("timeout", 10*time.Second, "fail if the check takes longer")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() > 1 || (*control == "" && fset.NArg() == 0) {
+		fset.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var h overlay.Health
+	var err error
+	if *control != "" {
+		h, err = controlHealth(ctx, *control)
+	} else {
+		h = overlay.Health{Healthy: true, Mount: "ok"}
+		if err = overlay.CheckMount(ctx, fset.Arg(0)); err != nil {
+			h = overlay.Health{Mount: err.Error()}
+			err = nil
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printJSON(h)
+	if !h.Healthy {
+		return 1
+	}
+	return 0
+}
+
+// controlHealth sends the health command to the control socket at path
+func controlHealth(ctx context.Context, path string) (overlay.Health, error) {
+	resp, err := controlCall(ctx, path, overlay.ControlRequest{Command: overlay.CmdHealth})
+	if err != nil {
+		return overlay.Health{}, err
+	}
+	if resp.Health == nil {
+		return overlay.Health{}, fmt.Errorf("no health in the response")
+	}
+	return *resp.Health, nil
+}
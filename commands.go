@@ -0,0 +1,287 @@
+// +build linux darwin
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+
+	"github.com/butonic/ocis-overlay/overlay"
+)
+
+// commands are the subcommands besides mount, they return the exit code
+var commands = map[string]func(args []string) int{
+	"umount":   umount,
+	"status":   status,
+	"stats":    stats,
+	"trash":    trash,
+	"snapshot": snapshot,
+	"dedup":    dedup,
+	"check":    check,
+	"replay":   replay,
+	"bench":    bench,
+}
+
+// controlTimeout limits the control commands of subcommands
+const controlTimeout = time.Minute
+
+// newCommandFlags returns the flag set of a subcommand, usage is shown on
+// errors
+func newCommandFlags(name string, usage string) *flag.FlagSet {
+	fset := flag.NewFlagSet(name, flag.ContinueOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], name, usage)
+		fset.PrintDefaults()
+	}
+	return fset
+}
+
+// controlCall sends req to the control socket at path and returns the
+// response, an error in the response is returned as error
+func controlCall(ctx context.Context, path string, req overlay.ControlRequest) (overlay.ControlResponse, error) {
+	var resp overlay.ControlResponse
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return resp, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if err = json.NewEncoder(c).Encode(req); err != nil {
+		return resp, err
+	}
+	if err = json.NewDecoder(bufio.NewReader(c)).Decode(&resp); err != nil {
+		return resp, err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// printJSON prints v as one line of JSON
+func printJSON(v interface{}) {
+	json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// umount unmounts an overlay. With -control it shuts down cleanly and waits
+// for requests in flight, like on SIGTERM, otherwise it unmounts like
+// fusermount -u.
+func umount(args []string) int {
+	fset := newCommandFlags("umount", "[-control SOCKET] MOUNTPOINT")
+	control := fset.String("control", "", "shut the overlay listening on this control socket down cleanly")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() > 1 || (*control == "" && fset.NArg() == 0) {
+		fset.Usage()
+		return 2
+	}
+	var err error
+	if *control != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+		defer cancel()
+		_, err = controlCall(ctx, *control, overlay.ControlRequest{Command: overlay.CmdUnmount})
+	} else {
+		err = fuse.Unmount(fset.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// mountStatus is printed by status for every overlay
+type mountStatus struct {
+	Mountpoint string         `json:"mountpoint"`
+	Source     string         `json:"source"`
+	Health     overlay.Health `json:"health"`
+}
+
+// status lists the mounted overlays, or the given mountpoints, with the
+// result of a health check. It fails if one is unhealthy or not mounted.
+func status(args []string) int {
+	fset := newCommandFlags("status", "[MOUNTPOINT...]")
+	timeout := fset.Duration("timeout", 10*time.Second, "maximum duration of the health check of a mount")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	mounts, err := overlayMounts()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if fset.NArg() > 0 {
+		byPath := make(map[string]mountEntry, len(mounts))
+		for _, m := range mounts {
+			byPath[m.mountpoint] = m
+		}
+		mounts = mounts[:0]
+		for _, p := range fset.Args() {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			m, ok := byPath[abs]
+			if !ok {
+				printJSON(mountStatus{Mountpoint: abs, Health: overlay.Health{Mount: "not mounted"}})
+				continue
+			}
+			mounts = append(mounts, m)
+		}
+	}
+	code := 0
+	if fset.NArg() > len(mounts) {
+		code = 1
+	}
+	for _, m := range mounts {
+		s := mountStatus{Mountpoint: m.mountpoint, Source: m.source, Health: overlay.Health{Healthy: true, Mount: "ok"}}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		if err := overlay.CheckMount(ctx, m.mountpoint); err != nil {
+			s.Health = overlay.Health{Mount: err.Error()}
+			code = 1
+		}
+		cancel()
+		printJSON(s)
+	}
+	return code
+}
+
+// stats prints the metrics and the running uploads of an overlay
+func stats(args []string) int {
+	fset := newCommandFlags("stats", "-control SOCKET")
+	control := fset.String("control", "", "control socket of the overlay")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if *control == "" || fset.NArg() > 0 {
+		fset.Usage()
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	metrics, err := controlCall(ctx, *control, overlay.ControlRequest{Command: overlay.CmdMetrics})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	uploads, err := controlCall(ctx, *control, overlay.ControlRequest{Command: overlay.CmdUploads})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	metrics.Uploads = uploads.Uploads
+	printJSON(metrics)
+	return 0
+}
+
+// trash lists the trash of a user or restores entries of it, named like in
+// the .trash directory of the mount
+func trash(args []string) int {
+	fset := newCommandFlags("trash", "list|restore -control SOCKET [-uid UID] [NAME...]")
+	control := fset.String("control", "", "control socket of the overlay")
+	uid := fset.Int("uid", os.Getuid(), "user whose trash to list or restore from")
+	if len(args) == 0 || (args[0] != "list" && args[0] != "restore") {
+		fset.Usage()
+		return 2
+	}
+	cmd := args[0]
+	if err := fset.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *control == "" || (cmd == "list") != (fset.NArg() == 0) {
+		fset.Usage()
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	if cmd == "list" {
+		resp, err := controlCall(ctx, *control, overlay.ControlRequest{Command: overlay.CmdTrash, Value: strconv.Itoa(*uid)})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, t := range resp.Trash {
+			printJSON(t)
+		}
+		return 0
+	}
+	code := 0
+	for _, name := range fset.Args() {
+		value := strconv.Itoa(*uid) + " " + name
+		if _, err := controlCall(ctx, *control, overlay.ControlRequest{Command: overlay.CmdRestore, Value: value}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// snapshot creates, deletes or lists the snapshots of the upper layer of an
+// overlay
+func snapshot(args []string) int {
+	fset := newCommandFlags("snapshot", "create|delete|list -control SOCKET [NAME]")
+	control := fset.String("control", "", "control socket of the overlay")
+	if len(args) == 0 || (args[0] != "create" && args[0] != "delete" && args[0] != "list") {
+		fset.Usage()
+		return 2
+	}
+	cmd := args[0]
+	if err := fset.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *control == "" || (cmd == "list") != (fset.NArg() == 0) || fset.NArg() > 1 {
+		fset.Usage()
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	value := strings.TrimSpace(cmd + " " + fset.Arg(0))
+	resp, err := controlCall(ctx, *control, overlay.ControlRequest{Command: overlay.CmdSnapshot, Value: value})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, s := range resp.Snapshots {
+		printJSON(s)
+	}
+	return 0
+}
+
+// dedup prints the counters of the content deduplication of an overlay
+func dedup(args []string) int {
+	fset := newCommandFlags("dedup", "-control SOCKET")
+	control := fset.String("control", "", "control socket of the overlay")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if *control == "" || fset.NArg() > 0 {
+		fset.Usage()
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	resp, err := controlCall(ctx, *control, overlay.ControlRequest{Command: overlay.CmdDedup})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printJSON(resp.Dedup)
+	return 0
+}
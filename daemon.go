@@ -0,0 +1,137 @@
+// +build linux darwin
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+	"github.com/butonic/ocis-overlay/overlay"
+)
+
+// daemonEnv is set for the background process started by daemonize
+const daemonEnv = "OCIS_OVERLAY_DAEMON_CHILD"
+
+// shutdownTimeout is how long in-flight requests may take after an unmount
+// was requested
+const shutdownTimeout = 30 * time.Second
+
+// readyFd is the file descriptor the background process reports readiness on
+const readyFd = 3
+
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// daemonize starts the current binary again in a new session and waits until
+// the background process reports that the mount is ready. It never returns.
+func daemonize() {
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	devnull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = devnull
+	cmd.Stdout = devnull
+	cmd.Stderr = devnull
+	cmd.ExtraFiles = []*os.File{w} // becomes readyFd
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+	w.Close()
+
+	msg, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		log.Fatalf("daemon exited before the mount was ready")
+	}
+	if msg = strings.TrimSpace(msg); msg != "ok" {
+		log.Fatalf("daemon failed: %s", msg)
+	}
+	loog.Info("main", "daemon running", "pid", cmd.Process.Pid)
+	os.Exit(0)
+}
+
+// notifyReady tells the waiting parent process or systemd that the mount is
+// ready or failed
+func notifyReady(err error) {
+	if err != nil {
+		sdNotify("STATUS=" + err.Error())
+	} else {
+		sdNotify("READY=1")
+	}
+	if !isDaemonChild() {
+		return
+	}
+	f := os.NewFile(readyFd, "ready")
+	defer f.Close()
+	if err != nil {
+		fmt.Fprintln(f, err)
+		return
+	}
+	fmt.Fprintln(f, "ok")
+}
+
+func writePidFile(path string) error {
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// listenControl listens on the unix socket at path, a stale socket of a
+// previous run is replaced
+func listenControl(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// shutdownOnSignal shuts the filesystem down on SIGINT and SIGTERM so fs.Serve
+// can drain in-flight requests and return. If the mount is busy another
+// signal retries.
+func shutdownOnSignal(filesys *overlay.FS, mountpoint string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range sigs {
+			loog.Info("main", "unmounting", "signal", sig, "mountpoint", mountpoint)
+			if err := shutdown(filesys); err != nil {
+				loog.Error("main", "unmount failed", "mountpoint", mountpoint, "error", err)
+			}
+		}
+	}()
+}
+
+// shutdown shuts filesys down and gives in-flight requests shutdownTimeout
+// to finish
+func shutdown(filesys *overlay.FS) error {
+	sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return filesys.Shutdown(ctx)
+}
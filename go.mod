@@ -1,9 +1,18 @@
 module github.com/butonic/ocis-overlay
 
-go 1.14
+go 1.22
 
 require (
 	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
+	github.com/hirochachacha/go-smb2 v1.1.0
+	github.com/klauspost/compress v1.18.0
 	github.com/pkg/xattr v0.4.1
-	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
+	golang.org/x/sys v0.10.0
+	golang.org/x/text v0.13.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/geoffgarside/ber v1.2.0 // indirect
+	golang.org/x/crypto v0.10.0 // indirect
 )
@@ -0,0 +1,180 @@
+package loog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Log levels, ordered by severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses one of debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger writes leveled log entries as text or JSON lines. Entries belong to a
+// subsystem, e.g. xattr or rename, which can be enabled selectively.
+type Logger struct {
+	mu         sync.Mutex
+	out        io.Writer
+	level      Level
+	json       bool
+	subsystems map[string]bool // nil enables all subsystems
+}
+
+// New returns a logger writing entries of at least level to out
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{out: out, level: level}
+}
+
+// SetOutput sets the destination of the log entries
+func (l *Logger) SetOutput(out io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out = out
+}
+
+// SetLevel sets the minimum level of entries to write
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+}
+
+// SetJSON switches between text and JSON lines output
+func (l *Logger) SetJSON(json bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.json = json
+}
+
+// EnableSubsystems restricts logging to the given subsystems. Without
+// arguments all subsystems are logged. Warnings and errors are always logged.
+func (l *Logger) EnableSubsystems(subsystems ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(subsystems) == 0 {
+		l.subsystems = nil
+		return
+	}
+	l.subsystems = make(map[string]bool, len(subsystems))
+	for _, s := range subsystems {
+		l.subsystems[s] = true
+	}
+}
+
+// Enabled reports whether an entry of level for subsystem would be written
+func (l *Logger) Enabled(level Level, subsystem string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enabled(level, subsystem)
+}
+
+func (l *Logger) enabled(level Level, subsystem string) bool {
+	if level < l.level {
+		return false
+	}
+	return level >= LevelWarn || l.subsystems == nil || l.subsystems[subsystem]
+}
+
+// Log writes an entry with alternating key value pairs as fields
+func (l *Logger) Log(level Level, subsystem string, msg string, kv ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.enabled(level, subsystem) {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if l.json {
+		entry := map[string]interface{}{
+			"time":      now,
+			"level":     level.String(),
+			"subsystem": subsystem,
+			"msg":       msg,
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			entry[fmt.Sprint(kv[i])] = jsonValue(kv[i+1])
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			b = []byte(fmt.Sprintf(`{"level":"error","msg":"cannot marshal log entry: %v"}`, err))
+		}
+		l.out.Write(append(b, '\n'))
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s [%s] %s", now, strings.ToUpper(level.String()), subsystem, msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+	}
+	b.WriteByte('\n')
+	io.WriteString(l.out, b.String())
+}
+
+// jsonValue makes values that do not marshal well, like errors, readable
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+// std is the logger used by the package level functions
+var std = New(os.Stderr, LevelInfo)
+
+// Default returns the logger used by the package level functions
+func Default() *Logger {
+	return std
+}
+
+// Debug logs at LevelDebug with the default logger
+func Debug(subsystem string, msg string, kv ...interface{}) {
+	std.Log(LevelDebug, subsystem, msg, kv...)
+}
+
+// Info logs at LevelInfo with the default logger
+func Info(subsystem string, msg string, kv ...interface{}) {
+	std.Log(LevelInfo, subsystem, msg, kv...)
+}
+
+// Warn logs at LevelWarn with the default logger
+func Warn(subsystem string, msg string, kv ...interface{}) {
+	std.Log(LevelWarn, subsystem, msg, kv...)
+}
+
+// Error logs at LevelError with the default logger
+func Error(subsystem string, msg string, kv ...interface{}) {
+	std.Log(LevelError, subsystem, msg, kv...)
+}
@@ -7,75 +7,383 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
-	"time"
+	"path/filepath"
+	"strings"
 
 	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
 
+	"github.com/butonic/ocis-overlay/loog"
 	"github.com/butonic/ocis-overlay/overlay"
 )
 
-var (
-	latency time.Duration
-)
+var configFile string
 
+// flags mirror the config keys with dashes instead of underscores. Only flags
+// set on the command line are applied, they override the config file and
+// the environment.
 func init() {
-	flag.DurationVar(&latency, "latency", 0,
-		"add an artificial latency to every fuse handler on every call")
+	d := overlay.DefaultConfig()
+	flag.StringVar(&configFile, "config", "",
+		"YAML config file with the settings below, keys use underscores instead of dashes. Environment variables like "+overlay.EnvPrefix+"ATTR_TIMEOUT override it")
+	flag.String("latency", d.Latency,
+		"add an artificial latency to fuse handlers on every call, either a duration for all handlers or op=duration pairs like read=20ms,write=50ms,lookup=5ms,default=1ms")
+	flag.Duration("latency-jitter", d.LatencyJitter,
+		"spread of the artificial latency")
+	flag.String("latency-distribution", d.LatencyDistribution,
+		"distribution of the latency jitter: fixed, uniform or normal")
+	flag.String("faults", d.Faults,
+		"comma separated faults to inject, op:errno:percent% or op:errno:every=n, e.g. write:EIO:every=100,getxattr:ENOTSUP:5%")
+	flag.String("space-limit", d.SpaceLimit,
+		"simulate a disk of this size, size[:errno] e.g. 10MiB or 1GiB:EDQUOT: statfs reports it, writes beyond it and creates once it is used up fail with ENOSPC or the errno")
+	flag.String("xattr-mode", d.XattrMode,
+		"where to store extended attributes: passthrough (backing fs, in-memory fallback) or memory")
+	flag.String("xattr-security", d.XattrSecurity,
+		"how to handle security.* and trusted.* xattrs like SELinux labels: passthrough (backing fs only, errors are returned), deny (hidden, setting fails with ENOTSUP) or synthesize (in-memory only, lost on remount)")
+	flag.Bool("persist-xattrs", d.PersistXattrs,
+		"save xattrs kept in memory, because of -xattr-mode memory or a backing fs without xattr support, to .ocis-overlay in ROOT so they survive remounts")
+	flag.Bool("op-journal", d.OpJournal,
+		"journal creates, writes, renames and removes in .ocis-overlay in ROOT and finish or roll back the ones a crash interrupted on the next mount")
+	flag.Bool("dedup", d.Dedup,
+		"let files written to ROOT share their data with files of the same content, on file systems like btrfs and XFS")
+	flag.String("compression", d.Compression,
+		"compress files written to ROOT once they are closed: off, zstd (fast to read), deflate (fast to write), gzip (checksummed) or none (only decompress files compressed before)")
+	flag.String("compression-exclude", d.CompressionExclude,
+		"comma separated extensions of files -compression leaves as they are")
+	flag.String("encryption-key", d.EncryptionKey,
+		"encrypt files written to ROOT with this master key of 64 hex digits, open files are kept decrypted in memory, env:NAME and keyring:ACCOUNT as for -backend-token")
+	flag.Bool("encrypt-names", d.EncryptNames,
+		"encrypt the names of files and directories in ROOT as well, needs -encryption-key")
+	flag.Int("max-xattr-size", d.MaxXattrSize,
+		"maximum size of xattr values in bytes, setting bigger ones fails with E2BIG, 0 uses the kernel limit of 64KiB")
+	flag.Duration("attr-timeout", d.AttrTimeout,
+		"how long attributes and directory entries may be cached, 0 disables caching")
+	flag.Bool("watch", d.Watch,
+		"watch the backing directories with inotify so changes made by others show up right away, linux only")
+	flag.Duration("node-sweep-interval", d.NodeSweep,
+		"how often nodes of files removed behind the back of the mount are dropped, 0 disables the sweeper")
+	flag.String("lower", strings.Join(d.Lowers, ":"),
+		"colon separated read-only lower directories, top-down, turns ROOT into the writable upper layer of a copy-on-write overlay")
+	flag.Bool("mknod", d.Mknod,
+		"allow creating FIFOs, sockets and device nodes")
+	flag.String("hide", strings.Join(d.Hide, ":"),
+		"colon separated glob patterns of names to hide, e.g. .sync_*.db:*.part:.~lock.*, hidden names are not listed, cannot be looked up and cannot be created")
+	flag.String("show", strings.Join(d.Show, ":"),
+		"colon separated glob patterns of names that are never hidden, exceptions to -hide")
+	flag.String("normalize", d.Normalize,
+		"create names in this Unicode normalization form, nfc or nfd, and find entries by both forms, so names from macOS and Linux clients match")
+	flag.String("uid-map", d.UIDMap,
+		"comma separated mount:backing uid pairs, e.g. 1000:33 shows files owned by uid 33 as owned by 1000 and chown to 1000 sets 33")
+	flag.String("gid-map", d.GIDMap,
+		"comma separated mount:backing gid pairs, like -uid-map")
+	flag.Bool("default-permissions", d.DefaultPermissions,
+		"let the kernel check the permission bits on every operation instead of the overlay on access(2)")
+	flag.Bool("allow-other", d.AllowOther,
+		"let other users access the mount, needs user_allow_other in /etc/fuse.conf when not running as root")
+	flag.Bool("allow-root", d.AllowRoot,
+		"only let root access the mount besides the user running the overlay, use with -allow-other=false")
+	flag.Bool("async-read", d.AsyncRead,
+		"let the kernel send several reads of a file handle at once")
+	flag.Bool("nonempty", d.NonEmpty,
+		"allow mounting over a non-empty directory, ROOT usually is one")
+	flag.Int("max-readahead", d.MaxReadahead,
+		"maximum bytes the kernel prefetches for sequential reads, 0 keeps the kernel default")
+	flag.String("volume-name", d.VolumeName,
+		"volume name shown by macOS, defaults to OCISOverlay")
+	flag.Bool("as-caller", d.AsCaller,
+		"create new files owned by the calling process, needs root or CAP_CHOWN")
+	flag.Bool("writeback-cache", d.WritebackCache,
+		"let the kernel cache writes and send them in larger batches")
+	flag.Bool("keep-cache", d.KeepCache,
+		"keep the kernel page cache across opens, it is invalidated when the backing file changes")
+	flag.Bool("direct-io", d.DirectIO,
+		"bypass the kernel page cache for all files, not only the ones opened with O_DIRECT")
+	flag.Bool("executables", d.Executables,
+		"tune for running programs from the mount: keep the page cache of binaries and libraries across opens and report a larger st_blksize")
+	flag.Int("max-open-files", d.MaxOpenFiles,
+		"maximum number of backing files kept open for handles, idle ones are closed and reopened on demand. 0 is unlimited")
+	flag.Int64("read-all-max", d.ReadAllMax,
+		"read files up to this size whole on the first read of an open file and answer the following reads from memory, 0 disables it")
+	flag.Bool("serialize", d.Serialize,
+		"answer one request at a time instead of in parallel, to tell races in the overlay from other bugs")
+	flag.Int64("write-coalesce", d.WriteCoalesce,
+		"buffer writes smaller than this many bytes per open file and write them in chunks of this size in the background, 0 writes through")
+	flag.Int("write-flushers", d.WriteFlushers,
+		"number of goroutines writing the chunks of -write-coalesce")
+	flag.Bool("ocis-metadata", d.OcisMetadata,
+		"maintain the user.ocis.* xattrs of the oCIS decomposedfs storage driver on all files and directories")
+	flag.Bool("verify-checksums", d.VerifyChecksums,
+		"check files against their checksums when they are opened for reading and fail with EIO if they do not match, needs -ocis-metadata")
+	flag.Bool("etags", d.Etags,
+		"maintain an etag in the "+overlay.EtagAttr+" xattr of every changed file and propagate a new etag to all parent directories")
+	flag.Bool("treesize", d.TreeSize,
+		"maintain the total size and the latest mtime below every directory in the "+overlay.TreeSizeAttr+" and "+overlay.TreeMtimeAttr+" xattrs")
+	flag.Duration("propagation-delay", d.PropagationDelay,
+		"collect changes for this long before propagating etags and tree sizes in one batch, 0 propagates every change right away")
+	flag.String("events", d.Events,
+		"publish CloudEvents for every change to nats://host:port/subject or POST them to an http(s) URL")
+	flag.String("av-scan", d.AVScan,
+		"scan files written to ROOT for viruses when they are closed, with clamd at clamd://host:port or clamd:///path/to/clamd.sock or with an ICAP server at icap://host:port/service")
+	flag.String("av-policy", d.AVPolicy,
+		"what to do with infected files: quarantine moves them to .ocis-overlay/quarantine in ROOT, delete deletes them, log only logs them")
+	flag.String("audit-log", d.AuditLog,
+		"append a JSON line for every operation on files to this file, with uid, gid and pid of the caller, path, result and bytes read and written per open")
+	flag.Bool("audit-mutations-only", d.AuditMutationsOnly,
+		"only audit operations that change something, not opens and reads")
+	flag.Int64("audit-max-size", d.AuditMaxSize,
+		"rotate the audit log when it grows bigger than this many bytes, 0 disables the rotation")
+	flag.Int("audit-max-files", d.AuditMaxFiles,
+		"number of rotated audit logs to keep")
+	flag.String("otlp-endpoint", d.OTLPEndpoint,
+		"export a span of every fuse request and the backend calls made for it to this OTLP/HTTP endpoint of an OpenTelemetry collector, e.g. http://localhost:4318")
+	flag.Duration("slow-op-threshold", d.SlowOpThreshold,
+		"log fuse requests taking this long or longer with duration, operation, path and the number of requests in flight, 0 disables it")
+	flag.String("record", d.Record,
+		"record every fuse request with its arguments, data hashes, timing and result to this file, replay it with the replay command")
+	flag.Bool("trash", d.Trash,
+		"move removed files into a per-user trash instead of deleting them")
+	flag.Duration("trash-max-age", d.TrashMaxAge,
+		"purge trash entries older than this, 0 keeps them forever")
+	flag.Int64("trash-max-size", d.TrashMaxSize,
+		"purge the oldest trash entries of a user while the trash is larger than this many bytes, 0 is unlimited")
+	flag.Bool("versions", d.Versions,
+		"keep the previous content of a file when it is truncated or first written to after opening it")
+	flag.Int("versions-max", d.VersionsMax,
+		"maximum number of versions kept per file, 0 is unlimited")
+	flag.Duration("versions-max-age", d.VersionsMaxAge,
+		"prune versions older than this, 0 keeps them forever")
+	flag.String("backend", d.Backend,
+		"mount a remote store instead of ROOT, dav://host/path or davs://host/path for a WebDAV endpoint like davs://cloud.example.com/remote.php/dav/files/einstein, ocis://host for all spaces of an oCIS user, s3://host/bucket/prefix for an S3 bucket, smb://server/share/path for an SMB share, smb+mount://server/share/path for an SMB share mounted already, manifest+https://host/path for the files listed in a manifest")
+	flag.String("backend-user", d.BackendUser,
+		"user for basic auth against the backend")
+	flag.String("backend-password", d.BackendPassword,
+		"password for basic auth against the backend")
+	flag.String("backend-token", d.BackendToken,
+		"bearer token for the backend, used instead of user and password. env:NAME reads it from an environment variable, keyring:ACCOUNT from the keyring")
+	flag.String("backend-refresh-token", d.BackendRefreshToken,
+		"refresh token to get a new bearer token with before it expires, env:NAME and keyring:ACCOUNT as for -backend-token")
+	flag.String("backend-token-url", d.BackendTokenURL,
+		"token endpoint of the OpenID Connect provider the refresh token is redeemed at, e.g. https://host/konnect/v1/token")
+	flag.String("backend-client-id", d.BackendClientID,
+		"OpenID Connect client id sent with the refresh token")
+	flag.String("backend-users", d.BackendUsers,
+		"file with the backend credentials of the local users, one \"uid token\" or \"uid user password\" per line, so one mount serves each of them their own files")
+	flag.String("backend-flakiness", d.BackendFlakiness,
+		"simulate an unreliable network to the backend, e.g. drop=1%,timeout=0.5%:30s,5xx=2%:10:503,slowstart=20s")
+	flag.String("backend-retry", d.BackendRetry,
+		"retry policies of backend calls failing with transient errors as class=attempts[:backoff[:max]], classes are read, write and namespace, e.g. read=5:50ms:1s,namespace=3")
+	flag.Int64("block-cache-size", d.BlockCacheSize,
+		"bytes of remote file content cached in memory, 0 disables the cache")
+	flag.String("block-cache-dir", d.BlockCacheDir,
+		"keep blocks of remote files pushed out of memory in this directory, it is emptied on start")
+	flag.Int64("block-cache-disk-size", d.BlockCacheDiskSize,
+		"bytes of remote file content kept in -block-cache-dir")
+	flag.String("offline-dir", d.OfflineDir,
+		"keep working while the backend is unreachable: serve cached data and queue changes in this directory until it is back")
+	flag.String("conflict-policy", d.ConflictPolicy,
+		"what flushing a file changed behind the mount while it was written does: overwrite (last writer wins), fail (EBUSY) or copy (upload to a conflicted copy next to it)")
+	flag.Int64("read-ahead", d.ReadAhead,
+		"maximum bytes of a remote file fetched ahead into the block cache while it is read sequentially, 0 disables read-ahead")
+	flag.Bool("daemon", d.Daemon,
+		"run in the background once the mount is ready")
+	flag.String("pidfile", d.PidFile,
+		"write the process id to this file")
+	flag.String("control", d.Control,
+		"listen for JSON control commands on this unix socket: latency, faults, space, kill, flakiness, flush, nodes, metrics, uploads, health and unmount")
+	flag.String("admin", d.Admin,
+		"serve /healthz and the /debug pages with pprof on this address, e.g. localhost:9180")
+	flag.String("log-level", d.LogLevel,
+		"minimum level to log: debug, info, warn or error. Every fuse call is logged at debug")
+	flag.String("log-format", d.LogFormat,
+		"log output format: text or json")
+	flag.String("log-subsystems", d.LogSubsystems,
+		"comma separated subsystems to log, empty logs all of "+strings.Join(overlay.LogSubsystems, ", "))
+}
+
+// loadConfig merges the defaults, the config file, the environment and the
+// flags set on the command line, in that order
+func loadConfig() (*overlay.Config, error) {
+	cfg := overlay.DefaultConfig()
+	var err error
+	if configFile != "" {
+		cfg, err = overlay.LoadConfig(configFile)
+	} else {
+		err = cfg.ApplyEnv()
+	}
+	if err != nil {
+		return nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && err == nil {
+			err = cfg.Set(strings.Replace(f.Name, "-", "_", -1), f.Value.String())
+		}
+	})
+	if flag.NArg() == 1 {
+		cfg.Root = flag.Arg(0)
+	}
+	return cfg, err
 }
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s ROOT\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [mount] [flags] ROOT\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [mount] -config FILE, with root set in FILE\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [mount] SOURCE MOUNTPOINT -o key=value,..., as mount helper\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s umount [-control SOCKET] MOUNTPOINT\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s status [MOUNTPOINT...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s stats -control SOCKET\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s trash list|restore -control SOCKET [-uid UID] [NAME...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s snapshot create|delete|list -control SOCKET [NAME]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s dedup -control SOCKET\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s check [-control SOCKET] [MOUNTPOINT]\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
 func main() {
 	flag.Usage = usage
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(filepath.Base(os.Args[0]), "mount.") {
+		if cmd, ok := commands[args[0]]; ok {
+			os.Exit(cmd(args[1:]))
+		}
+		if args[0] == "mount" {
+			args = args[1:]
+		}
+	}
 
-	if flag.NArg() != 1 {
+	var cfg *overlay.Config
+	var err error
+	if isMountHelper(append([]string{os.Args[0]}, args...)) {
+		cfg, err = mountHelperConfig(args)
+	} else {
+		flag.CommandLine.Parse(args)
+		cfg, err = loadConfig()
+		if err == nil && flag.NArg() > 1 {
+			usage()
+			os.Exit(2)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Root == "" {
 		usage()
 		os.Exit(2)
 	}
-	mountpoint := flag.Arg(0)
 
-	if err := os.Chdir(mountpoint); err != nil {
-		log.Fatal(err)
+	level, err := loog.ParseLevel(cfg.LogLevel)
+	if err != nil || (cfg.LogFormat != "text" && cfg.LogFormat != "json") {
+		usage()
+		os.Exit(2)
+	}
+	loog.Default().SetLevel(level)
+	loog.Default().SetJSON(cfg.LogFormat == "json")
+	if cfg.LogSubsystems != "" {
+		loog.Default().EnableSubsystems(strings.Split(cfg.LogSubsystems, ",")...)
 	}
 
-	log.Println("changed into dir!")
-
-	c, err := fuse.Mount(
-		".",
-		fuse.FSName("ocis-overlay"),
-		fuse.Subtype("ocis-overlay-fs"),
-		fuse.VolumeName("OCISOverlay"),
-		fuse.AllowNonEmptyMount(),
-		fuse.AllowOther(),
-	)
+	// resolve paths before daemonizing and changing into the mountpoint
+	for i, l := range cfg.Lowers {
+		if cfg.Lowers[i], err = filepath.Abs(l); err != nil {
+			log.Fatal(err)
+		}
+	}
+	options, err := cfg.MountOptions()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer c.Close()
-
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
+	mountpoint, err := filepath.Abs(cfg.Root)
+	if err != nil {
 		log.Fatal(err)
 	}
+	options.Mountpoint = mountpoint
+	if options.AuditLog != "" {
+		if options.AuditLog, err = filepath.Abs(options.AuditLog); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if options.BlockCacheDir != "" {
+		if options.BlockCacheDir, err = filepath.Abs(options.BlockCacheDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if options.OfflineDir != "" {
+		if options.OfflineDir, err = filepath.Abs(options.OfflineDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if options.Record != "" {
+		if options.Record, err = filepath.Abs(options.Record); err != nil {
+			log.Fatal(err)
+		}
+	}
+	pidFile := cfg.PidFile
+	if pidFile != "" {
+		if pidFile, err = filepath.Abs(pidFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	controlSocket := cfg.Control
+	if controlSocket != "" {
+		if controlSocket, err = filepath.Abs(controlSocket); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	log.Println("mounted!")
+	if cfg.Daemon && !isDaemonChild() {
+		daemonize()
+	}
+	activated := activatedListeners()
 
-	err = fs.Serve(c, overlay.NewFS(
-		latency,
-	))
+	m, err := overlay.Mount(context.Background(), options)
 	if err != nil {
+		notifyReady(err)
 		log.Fatal(err)
 	}
 
+	if pidFile != "" {
+		if err := writePidFile(pidFile); err != nil {
+			loog.Error("main", "could not write pid file", "error", err)
+		}
+		defer os.Remove(pidFile)
+	}
+	shutdownOnSignal(m.FS, mountpoint)
+	control := activated["control"]
+	if control == nil && controlSocket != "" {
+		if control, err = listenControl(controlSocket); err != nil {
+			notifyReady(err)
+			fuse.Unmount(mountpoint)
+			log.Fatal(err)
+		}
+	}
+	if control != nil {
+		defer control.Close()
+		go m.FS.ServeControl(control, func() error {
+			loog.Info("main", "unmounting", "control", control.Addr(), "mountpoint", mountpoint)
+			return shutdown(m.FS)
+		})
+	}
+	admin := activated["admin"]
+	if admin == nil && cfg.Admin != "" {
+		if admin, err = net.Listen("tcp", cfg.Admin); err != nil {
+			notifyReady(err)
+			fuse.Unmount(mountpoint)
+			log.Fatal(err)
+		}
+	}
+	if admin != nil {
+		defer admin.Close()
+		go m.FS.ServeAdmin(admin)
+	}
+	notifyReady(nil)
+	watchdog(mountpoint)
+
+	if err = m.Wait(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,120 @@
+// +build linux darwin
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/butonic/ocis-overlay/overlay"
+)
+
+// ignoredMountOptions are generic options mount(8), fstab and systemd pass to
+// every helper, they mean nothing to the overlay
+var ignoredMountOptions = map[string]bool{
+	"rw": true, "defaults": true, "auto": true, "noauto": true, "user": true, "nouser": true,
+	"users": true, "nofail": true, "_netdev": true, "dev": true, "nodev": true, "suid": true,
+	"nosuid": true, "exec": true, "noexec": true, "async": true, "atime": true, "noatime": true,
+	"relatime": true, "norelatime": true, "strictatime": true,
+}
+
+// isMountHelper reports whether the binary was run as a mount helper: as
+// mount.fuse.ocis-overlay by mount(8), or by mount.fuse with the source and
+// the mountpoint in front of the options.
+func isMountHelper(args []string) bool {
+	if strings.HasPrefix(filepath.Base(args[0]), "mount.") {
+		return true
+	}
+	return len(args) > 2 && !strings.HasPrefix(args[1], "-") && !strings.HasPrefix(args[2], "-")
+}
+
+// mountHelperConfig turns `SOURCE MOUNTPOINT [-o OPTIONS]` into a config. The
+// options are config keys separated by commas, either key=value or a bare key
+// for true, dashes may be used instead of underscores. config=FILE loads a
+// config file first. SOURCE is a backend URL, or the mountpoint itself or a
+// placeholder like ocis-overlay because the overlay covers the directory it is
+// mounted on. The overlay runs in the background like other mount helpers
+// unless daemon=false is given.
+func mountHelperConfig(args []string) (*overlay.Config, error) {
+	var positional, opts []string
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "-o" && i+1 < len(args):
+			i++
+			opts = append(opts, strings.Split(args[i], ",")...)
+		case strings.HasPrefix(a, "-o"):
+			opts = append(opts, strings.Split(a[2:], ",")...)
+		case a == "-n" || a == "-s" || a == "-v" || a == "-f":
+			// no mtab, sloppy, verbose, fake: all handled by mount(8)
+		case strings.HasPrefix(a, "-"):
+			return nil, fmt.Errorf("unknown mount helper argument %q", a)
+		default:
+			positional = append(positional, a)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, fmt.Errorf("usage: mount.fuse.ocis-overlay SOURCE MOUNTPOINT [-o OPTIONS]")
+	}
+	source, mountpoint := positional[0], positional[1]
+
+	// like on the command line the config file and the environment come
+	// first, the other options override them
+	cfg := overlay.DefaultConfig()
+	configFile := ""
+	for _, o := range opts {
+		if strings.HasPrefix(o, "config=") {
+			configFile = strings.TrimPrefix(o, "config=")
+		}
+	}
+	var err error
+	if configFile != "" {
+		cfg, err = overlay.LoadConfig(configFile)
+	} else {
+		err = cfg.ApplyEnv()
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg.Daemon = true
+	for _, o := range opts {
+		key, value := o, "true"
+		if i := strings.Index(o, "="); i >= 0 {
+			key, value = o[:i], o[i+1:]
+		}
+		if strings.HasPrefix(key, "x-") {
+			// x-systemd.automount and friends are for other programs
+			continue
+		}
+		key = strings.Replace(key, "-", "_", -1)
+		switch {
+		case key == "" || key == "config" || ignoredMountOptions[key]:
+		case key == "ro":
+			return nil, fmt.Errorf("read-only mounts are not supported")
+		default:
+			if err = cfg.Set(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cfg.Root = mountpoint
+	switch {
+	case strings.Contains(source, "://"):
+		cfg.Backend = source
+	case source == "ocis-overlay" || source == "none":
+	default:
+		src, err := filepath.Abs(source)
+		if err != nil {
+			return nil, err
+		}
+		mp, err := filepath.Abs(mountpoint)
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Clean(src) != filepath.Clean(mp) {
+			return nil, fmt.Errorf("source %s must be the mountpoint, the overlay covers the directory it is mounted on", source)
+		}
+	}
+	return cfg, nil
+}
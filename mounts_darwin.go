@@ -0,0 +1,47 @@
+// +build darwin
+
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountEntry is a mounted overlay
+type mountEntry struct {
+	source     string
+	mountpoint string
+}
+
+// overlayMounts lists the mounted overlays with getfsstat
+func overlayMounts() ([]mountEntry, error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]unix.Statfs_t, n)
+	if n, err = unix.Getfsstat(buf, unix.MNT_NOWAIT); err != nil {
+		return nil, err
+	}
+	var mounts []mountEntry
+	for _, s := range buf[:n] {
+		source := cString(s.Mntfromname[:])
+		if source != "ocis-overlay" && !strings.HasPrefix(source, "ocis-overlay@") {
+			continue
+		}
+		mounts = append(mounts, mountEntry{source: source, mountpoint: cString(s.Mntonname[:])})
+	}
+	return mounts, nil
+}
+
+func cString(b []int8) string {
+	s := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c == 0 {
+			break
+		}
+		s = append(s, byte(c))
+	}
+	return string(s)
+}
@@ -0,0 +1,61 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mountEntry is a mounted overlay
+type mountEntry struct {
+	source     string
+	mountpoint string
+}
+
+// overlayMounts lists the mounted overlays from the mount table
+func overlayMounts() ([]mountEntry, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []mountEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || !isOverlayMount(unescapeMount(fields[0]), fields[2]) {
+			continue
+		}
+		mounts = append(mounts, mountEntry{source: unescapeMount(fields[0]), mountpoint: unescapeMount(fields[1])})
+	}
+	return mounts, s.Err()
+}
+
+// isOverlayMount reports whether a mount table entry is an overlay, by the
+// default FSName or Subtype of Mount
+func isOverlayMount(source string, fstype string) bool {
+	return source == "ocis-overlay" || strings.HasPrefix(fstype, "fuse.ocis-overlay")
+}
+
+// unescapeMount decodes the octal escapes of spaces, tabs, newlines and
+// backslashes in the mount table
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,157 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"bazil.org/fuse"
+)
+
+// xattrs of POSIX ACLs, stored in the binary format of the Linux kernel
+const (
+	PosixACLAccessAttr  = "system.posix_acl_access"
+	PosixACLDefaultAttr = "system.posix_acl_default"
+)
+
+// tags of POSIX ACL entries
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclVersion   = 2
+	aclEntrySize = 8
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// acl is a parsed POSIX ACL xattr
+type acl []aclEntry
+
+func isACLAttr(name string) bool {
+	return name == PosixACLAccessAttr || name == PosixACLDefaultAttr
+}
+
+func parseACL(b []byte) (acl, error) {
+	if len(b) < 4 || (len(b)-4)%aclEntrySize != 0 {
+		return nil, fmt.Errorf("invalid acl of %d bytes", len(b))
+	}
+	if v := binary.LittleEndian.Uint32(b); v != aclVersion {
+		return nil, fmt.Errorf("unsupported acl version %d", v)
+	}
+	entries := make(acl, 0, (len(b)-4)/aclEntrySize)
+	for b = b[4:]; len(b) > 0; b = b[aclEntrySize:] {
+		entries = append(entries, aclEntry{
+			tag:  binary.LittleEndian.Uint16(b),
+			perm: binary.LittleEndian.Uint16(b[2:]),
+			id:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return entries, nil
+}
+
+func (a acl) bytes() []byte {
+	b := make([]byte, 4+len(a)*aclEntrySize)
+	binary.LittleEndian.PutUint32(b, aclVersion)
+	for i, e := range a {
+		p := b[4+i*aclEntrySize:]
+		binary.LittleEndian.PutUint16(p, e.tag)
+		binary.LittleEndian.PutUint16(p[2:], e.perm)
+		binary.LittleEndian.PutUint32(p[4:], e.id)
+	}
+	return b
+}
+
+// mapACL translates the ids of named users and groups in an ACL xattr
+// between the backing store and the mount. Values that cannot be parsed are
+// returned unchanged, the backing filesystem rejects them.
+func (f *FS) mapACL(value []byte, toMount bool) []byte {
+	if f.uidMap == nil && f.gidMap == nil {
+		return value
+	}
+	a, err := parseACL(value)
+	if err != nil {
+		return value
+	}
+	for i, e := range a {
+		switch {
+		case e.tag == aclUser && toMount:
+			a[i].id = f.uidMap.mount(e.id)
+		case e.tag == aclUser:
+			a[i].id = f.uidMap.backing(e.id)
+		case e.tag == aclGroup && toMount:
+			a[i].id = f.gidMap.mount(e.id)
+		case e.tag == aclGroup:
+			a[i].id = f.gidMap.backing(e.id)
+		}
+	}
+	return a.bytes()
+}
+
+// permitted checks mask like the kernel does for files with an access ACL.
+// The owner gets the owner entry, then named users and all matching group
+// entries limited by the mask entry, everyone else the other entry. All ids
+// are as seen in the mount.
+func (a acl) permitted(mode os.FileMode, uid uint32, gid uint32,
+	caller fuse.Header, groups []uint32, mask uint32) bool {
+	if caller.Uid == 0 {
+		return mask&accessExec == 0 || mode.IsDir() || mode&0111 != 0
+	}
+	aclMaskPerm := uint32(7)
+	for _, e := range a {
+		if e.tag == aclMask {
+			aclMaskPerm = uint32(e.perm)
+		}
+	}
+	grants := func(perm uint16) bool {
+		return mask&uint32(perm)&7 == mask
+	}
+	for _, e := range a {
+		if e.tag == aclUserObj && caller.Uid == uid {
+			return grants(e.perm)
+		}
+	}
+	for _, e := range a {
+		if e.tag == aclUser && caller.Uid == e.id {
+			return grants(e.perm & uint16(aclMaskPerm))
+		}
+	}
+	inGroup := false
+	for _, e := range a {
+		var g uint32
+		switch e.tag {
+		case aclGroupObj:
+			g = gid
+		case aclGroup:
+			g = e.id
+		default:
+			continue
+		}
+		if caller.Gid != g && !inGroups(g, groups) {
+			continue
+		}
+		inGroup = true
+		if grants(e.perm & uint16(aclMaskPerm)) {
+			return true
+		}
+	}
+	if inGroup {
+		return false
+	}
+	for _, e := range a {
+		if e.tag == aclOther {
+			return grants(e.perm)
+		}
+	}
+	return false
+}
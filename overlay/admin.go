@@ -0,0 +1,130 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// healthTimeout limits a health check, a hung mount fails it
+const healthTimeout = 10 * time.Second
+
+// ServeAdmin serves the admin HTTP endpoints on l until it is closed:
+//
+//	/healthz         the Health as JSON, with status 503 if unhealthy
+//	/debug/pprof/    the runtime profiles of net/http/pprof
+//	/debug/vars      the expvar gauges
+//	/debug/nodes     the nodes known to the kernel
+//	/debug/handles   the open handles of local files
+//	/debug/xattrs    the size of the in-memory xattr store
+func (f *FS) ServeAdmin(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", f.serveHealth)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/nodes", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, f.nodeInfos())
+	})
+	mux.HandleFunc("/debug/handles", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, f.handleInfos())
+	})
+	mux.HandleFunc("/debug/xattrs", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, f.xattrStats())
+	})
+	return http.Serve(l, mux)
+}
+
+func writeDebugJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(v)
+}
+
+// handleInfo describes an open handle of a local file
+type handleInfo struct {
+	Path string `json:"path"`
+	// UID and PID of the process that opened the file
+	UID          uint32 `json:"uid"`
+	PID          uint32 `json:"pid"`
+	BytesRead    int64  `json:"bytes_read"`
+	BytesWritten int64  `json:"bytes_written"`
+	// FileOpen is false while the backing file is closed to stay within
+	// the fd budget
+	FileOpen bool `json:"file_open"`
+}
+
+func (f *FS) handleInfos() []handleInfo {
+	var handles []*Handle
+	for _, n := range f.registry.all() {
+		n.lock.Lock()
+		for h := range n.flushers {
+			handles = append(handles, h)
+		}
+		n.lock.Unlock()
+	}
+	infos := make([]handleInfo, 0, len(handles))
+	for _, h := range handles {
+		f.fds.lock.Lock()
+		open := h.f != nil
+		f.fds.lock.Unlock()
+		infos = append(infos, handleInfo{
+			Path:         h.node.getRealPath(),
+			UID:          h.caller.Uid,
+			PID:          h.caller.Pid,
+			BytesRead:    atomic.LoadInt64(&h.bytesRead),
+			BytesWritten: atomic.LoadInt64(&h.bytesWritten),
+			FileOpen:     open,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+	return infos
+}
+
+// xattrStoreStats is the size of the in-memory xattr store
+type xattrStoreStats struct {
+	Mode      XattrMode `json:"mode"`
+	Persisted bool      `json:"persisted"`
+	Files     int       `json:"files"`
+	Xattrs    int       `json:"xattrs"`
+	Bytes     int       `json:"bytes"`
+}
+
+func (f *FS) xattrStats() xattrStoreStats {
+	s := xattrStoreStats{Mode: f.xattrMode, Persisted: f.persistXattrs}
+	f.xlock.RLock()
+	defer f.xlock.RUnlock()
+	for _, attrs := range f.xattrs {
+		if len(attrs) > 0 {
+			s.Files++
+		}
+		for name, v := range attrs {
+			s.Xattrs++
+			s.Bytes += len(name) + len(v)
+		}
+	}
+	return s
+}
+
+func (f *FS) serveHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+	h := f.Health(ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if !h.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
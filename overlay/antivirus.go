@@ -0,0 +1,321 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+const (
+	// quarantineDir is the directory below the metaDir infected files are
+	// moved to
+	quarantineDir = "quarantine"
+	// scanTimeout limits a scan, including sending the file
+	scanTimeout = 5 * time.Minute
+	// scanChunk is the size of the chunks a file is streamed in
+	scanChunk = 64 << 10
+)
+
+// EventFileInfected reports a written file a virus was found in. oCIS
+// reports them as the result of its virusscan postprocessing step.
+const EventFileInfected = "FileInfected"
+
+// AVPolicy selects what happens to a written file a virus was found in
+type AVPolicy string
+
+const (
+	// AVQuarantine moves infected files to the quarantine below the metaDir
+	AVQuarantine AVPolicy = "quarantine"
+	// AVDelete deletes infected files
+	AVDelete AVPolicy = "delete"
+	// AVLog only logs infected files and reports them as events
+	AVLog AVPolicy = "log"
+)
+
+// ParseAVPolicy parses a policy, empty is AVQuarantine
+func ParseAVPolicy(s string) (AVPolicy, error) {
+	switch p := AVPolicy(s); p {
+	case "":
+		return AVQuarantine, nil
+	case AVQuarantine, AVDelete, AVLog:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown antivirus policy %q", s)
+}
+
+// Scanner scans the content of files for viruses
+type Scanner interface {
+	// Scan reads r, the content of the file name, and returns the name of
+	// the virus found in it, empty if it is clean
+	Scan(name string, r io.Reader) (string, error)
+}
+
+// NewScanner returns a scanner for the endpoint u. clamd://host:port and
+// clamd:///path/to/clamd.sock stream files to clamd, icap://host:port/service
+// sends them to an ICAP server with RESPMOD.
+func NewScanner(u string) (Scanner, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	switch pu.Scheme {
+	case "clamd":
+		if pu.Host == "" {
+			return &clamdScanner{network: "unix", addr: pu.Path}, nil
+		}
+		return &clamdScanner{network: "tcp", addr: hostPort(pu.Host, "3310")}, nil
+	case "icap":
+		pu.Host = hostPort(pu.Host, "1344")
+		return &icapScanner{url: pu}, nil
+	default:
+		return nil, fmt.Errorf("unsupported antivirus endpoint %q, expected clamd:// or icap://", u)
+	}
+}
+
+// hostPort adds port to host if it has none
+func hostPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// clamdScanner streams files to clamd with the INSTREAM command
+type clamdScanner struct {
+	network string
+	addr    string
+}
+
+func (s *clamdScanner) Scan(name string, r io.Reader) (string, error) {
+	c, err := net.DialTimeout(s.network, s.addr, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(scanTimeout))
+	if _, err = c.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+scanChunk)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := c.Write(buf[:4+n]); werr != nil {
+				// clamd closes the connection when the stream exceeds its
+				// StreamMaxLength, the reply tells
+				break
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	c.Write([]byte{0, 0, 0, 0})
+	reply, err := bufio.NewReader(c).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	// stream: OK, stream: NAME FOUND or ... ERROR
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// icapScanner sends files to an ICAP server as the body of an HTTP response
+// with RESPMOD. The server answers 204 for clean files, infected ones are
+// replaced, and the infection is named in a header.
+type icapScanner struct {
+	url *url.URL
+}
+
+// icapInfectionHeaders name the virus in the answers of common ICAP servers
+var icapInfectionHeaders = []string{"X-Infection-Found", "X-Virus-Id", "X-Violations-Found"}
+
+func (s *icapScanner) Scan(name string, r io.Reader) (string, error) {
+	c, err := net.DialTimeout("tcp", s.url.Host, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(scanTimeout))
+
+	req := "GET /" + url.PathEscape(name) + " HTTP/1.1\r\nHost: ocis-overlay\r\n\r\n"
+	res := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nTransfer-Encoding: chunked\r\n\r\n"
+	w := bufio.NewWriterSize(c, scanChunk+16)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n%s%s",
+		s.url.String(), s.url.Host, len(req), len(req)+len(res), req, res)
+	buf := make([]byte, scanChunk)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err = w.Flush(); err != nil {
+		return "", err
+	}
+
+	tr := textproto.NewReader(bufio.NewReader(c))
+	status, err := tr.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	h, err := tr.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return "", fmt.Errorf("icap: invalid status %q", status)
+	}
+	code, _ := strconv.Atoi(fields[1])
+	switch {
+	case code == 204:
+		return "", nil
+	case code == 200:
+		for _, k := range icapInfectionHeaders {
+			if v := h.Get(k); v != "" {
+				return icapThreat(v), nil
+			}
+		}
+		// the server replaced the file without naming a virus
+		return "unknown", nil
+	}
+	return "", fmt.Errorf("icap: %s", status)
+}
+
+// icapThreat returns the name of the virus of an infection header, e.g.
+// "Type=0; Resolution=2; Threat=Eicar-Test-Signature;"
+func icapThreat(v string) string {
+	for _, f := range strings.Split(v, ";") {
+		if kv := strings.SplitN(strings.TrimSpace(f), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "Threat") {
+			return kv[1]
+		}
+	}
+	return strings.TrimSpace(v)
+}
+
+// antivirus scans the files written to a local mount
+type antivirus struct {
+	// scanned, infected and failed count the scans, first for the
+	// alignment of atomic operations
+	scanned  uint64
+	infected uint64
+	failed   uint64
+
+	scanner Scanner
+	policy  AVPolicy
+}
+
+// scanWritten scans the file at the upper path p after a handle that wrote
+// to it was closed. It returns false if the file was infected and removed
+// by the policy.
+func (f *FS) scanWritten(p string) bool {
+	av := f.antivirus
+	if av == nil {
+		return true
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return true
+	}
+	virus, err := av.scanner.Scan(filepath.Base(p), file)
+	file.Close()
+	if err != nil {
+		atomic.AddUint64(&av.failed, 1)
+		loog.Error(logFS, "could not scan file for viruses", "path", p, "error", err)
+		return true
+	}
+	atomic.AddUint64(&av.scanned, 1)
+	if virus == "" {
+		return true
+	}
+	atomic.AddUint64(&av.infected, 1)
+	loog.Warn(logFS, "virus found in file", "path", p, "virus", virus, "policy", av.policy)
+	f.emit(EventFileInfected, p, "")
+	switch av.policy {
+	case AVQuarantine:
+		err = f.quarantine(p)
+	case AVDelete:
+		err = os.Remove(p)
+	default:
+		return true
+	}
+	if err != nil {
+		loog.Error(logFS, "could not remove infected file", "path", p, "policy", av.policy, "error", err)
+		return true
+	}
+	f.registry.remove(p)
+	f.forgetListings(filepath.Dir(p))
+	f.invalidateEntry(filepath.Dir(p), filepath.Base(p))
+	return false
+}
+
+// quarantine moves the file at p to the quarantine, under a unique name that
+// keeps the one it had
+func (f *FS) quarantine(p string) error {
+	dir := f.metaPath(quarantineDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z")+"-"+newUUID()[:8]+"-"+filepath.Base(p))
+	if err := os.Rename(p, dst); err != nil {
+		return err
+	}
+	os.Chmod(dst, 0400)
+	loog.Info(logFS, "quarantined infected file", "path", p, "quarantine", dst)
+	return nil
+}
+
+// AVStats are the counters of the virus scans
+type AVStats struct {
+	Scanned  uint64 `json:"scanned"`
+	Infected uint64 `json:"infected"`
+	Failed   uint64 `json:"failed"`
+}
+
+// avStats returns the counters of the virus scans, nil if files are not
+// scanned
+func (f *FS) avStats() *AVStats {
+	av := f.antivirus
+	if av == nil {
+		return nil
+	}
+	return &AVStats{
+		Scanned:  atomic.LoadUint64(&av.scanned),
+		Infected: atomic.LoadUint64(&av.infected),
+		Failed:   atomic.LoadUint64(&av.failed),
+	}
+}
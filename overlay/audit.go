@@ -0,0 +1,187 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// OpRelease records of the audit log carry the bytes read and written
+// through the handle, the other operations on files are recorded when they
+// are answered. Lookups, attributes, listings and reading xattrs are not
+// recorded.
+
+// AuditRecord is a line of the audit log. Paths are relative to the mount.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// UID, GID and PID of the calling process, for OpRelease the ones of
+	// the process that opened the file
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	PID uint32 `json:"pid"`
+	Op  Op     `json:"op"`
+	// Path is the file operated on, Target the new path of a rename or
+	// link, the target of a symlink or the name of an xattr
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	// Result is ok or the error returned to the caller
+	Result       string `json:"result"`
+	BytesRead    int64  `json:"bytes_read,omitempty"`
+	BytesWritten int64  `json:"bytes_written,omitempty"`
+}
+
+// auditLog appends records as JSON lines to a file and rotates it
+type auditLog struct {
+	mutationsOnly bool
+	maxSize       int64
+	maxFiles      int
+
+	lock sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+// newAuditLog opens the audit log at path for appending. Once it grows over
+// maxSize bytes it is renamed to path.1, older ones to path.2 and so on up
+// to maxFiles, 0 disables the rotation.
+func newAuditLog(path string, maxSize int64, maxFiles int, mutationsOnly bool) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize, maxFiles: maxFiles, mutationsOnly: mutationsOnly}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, fi.Size()
+	return nil
+}
+
+// rotate shifts the old logs and starts a new one, l.lock must be held
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	for i := l.maxFiles - 1; i > 0; i-- {
+		os.Rename(l.path+"."+strconv.Itoa(i), l.path+"."+strconv.Itoa(i+1))
+	}
+	if l.maxFiles > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+func (l *auditLog) write(r *AuditRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err = l.rotate(); err != nil {
+			loog.Error(logFS, "could not rotate the audit log, auditing stopped", "path", l.path, "error", err)
+			l.file = nil
+			return
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		loog.Error(logFS, "could not write the audit log", "path", l.path, "error", err)
+	}
+}
+
+// closeAuditLog closes the audit log, later records are dropped
+func (f *FS) closeAuditLog() {
+	if f.auditLog == nil {
+		return
+	}
+	f.auditLog.lock.Lock()
+	defer f.auditLog.lock.Unlock()
+	if f.auditLog.file != nil {
+		f.auditLog.file.Close()
+		f.auditLog.file = nil
+	}
+}
+
+// callerOf returns the header of the request ctx belongs to
+func callerOf(ctx context.Context) fuse.Header {
+	h, _ := ctx.Value(callerKey{}).(fuse.Header)
+	return h
+}
+
+// audit records op on p by the caller of the request of ctx, also in the
+// span of the request
+func (f *FS) audit(ctx context.Context, op Op, p string, target string, err error) {
+	if s := spanOf(ctx); s != nil {
+		s.setAudit(p, target)
+	}
+	r := requestOf(ctx)
+	if r != nil {
+		r.Op, r.Path, r.Target = op, p, target
+	}
+	if f.auditLog == nil || f.auditLog.mutationsOnly && op == OpOpen {
+		return
+	}
+	if r == nil {
+		f.writeAudit(callerOf(ctx), op, p, target, err, 0, 0)
+		return
+	}
+	// the auditInterceptor writes the record once the request is answered
+	r.audited, r.auditErr = true, err
+}
+
+// auditAnswered records the change audited for the answered request r
+func (f *FS) auditAnswered(r *Request) {
+	f.writeAudit(r.Caller, r.Op, r.Path, r.Target, r.auditErr, 0, 0)
+}
+
+// auditRelease records the I/O through a handle when it is released
+func (f *FS) auditRelease(caller fuse.Header, p string, read int64, written int64) {
+	if f.auditLog == nil || f.auditLog.mutationsOnly && written == 0 {
+		return
+	}
+	f.writeAudit(caller, OpRelease, p, "", nil, read, written)
+}
+
+func (f *FS) writeAudit(caller fuse.Header, op Op, p string, target string, err error, read int64, written int64) {
+	r := &AuditRecord{
+		Time:         time.Now().UTC(),
+		UID:          caller.Uid,
+		GID:          caller.Gid,
+		PID:          caller.Pid,
+		Op:           op,
+		Path:         p,
+		Target:       target,
+		Result:       "ok",
+		BytesRead:    read,
+		BytesWritten: written,
+	}
+	if err != nil {
+		r.Result = err.Error()
+	}
+	f.auditLog.write(r)
+}
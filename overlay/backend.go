@@ -0,0 +1,83 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BackendFactory returns the Backend for a -backend URL of the scheme it is
+// registered for. creds authenticate the requests, they may be nil.
+type BackendFactory func(u *url.URL, creds *Credentials) (Backend, error)
+
+// XattrBackend is implemented by backends that store xattrs of their own.
+// They are read from the file infos of Stat and ReadDir, which provide them
+// with a method Xattrs() map[string][]byte, like the virtual xattrs of
+// WebDAV. The virtual ones stay read-only.
+type XattrBackend interface {
+	SetXattr(ctx context.Context, name string, attr string, value []byte) error
+	RemoveXattr(ctx context.Context, name string, attr string) error
+}
+
+// ReadOnlyBackend is implemented by backends that cannot be changed, the
+// overlay is mounted read-only for them
+type ReadOnlyBackend interface {
+	ReadOnly() bool
+}
+
+// backends are the registered BackendFactory by scheme
+var backends = struct {
+	lock      sync.RWMutex
+	factories map[string]BackendFactory
+}{factories: make(map[string]BackendFactory)}
+
+// RegisterBackend makes the backend of factory available to -backend URLs
+// with scheme. Stores other than the built-in ones register in an init
+// func of their package, like database/sql drivers. It panics if scheme is
+// registered already.
+func RegisterBackend(scheme string, factory BackendFactory) {
+	backends.lock.Lock()
+	defer backends.lock.Unlock()
+	scheme = strings.ToLower(scheme)
+	if _, ok := backends.factories[scheme]; ok {
+		panic("backend " + scheme + " registered twice")
+	}
+	backends.factories[scheme] = factory
+}
+
+// BackendSchemes returns the registered schemes, sorted
+func BackendSchemes() []string {
+	backends.lock.RLock()
+	defer backends.lock.RUnlock()
+	schemes := make([]string, 0, len(backends.factories))
+	for s := range backends.factories {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewBackend returns the Backend for a URL from the factory registered for
+// its scheme: dav:// and davs:// select WebDAV over http and https, ocis://
+// and ocis+http:// the spaces of an oCIS instance, s3:// and s3+http:// a
+// bucket of an S3 store, smb:// an SMB share and smb+mount:// a mounted
+// one, and manifest+https:// and manifest+http:// the files listed by a
+// manifest. creds authenticate the requests, they may be nil.
+func NewBackend(rawurl string, creds *Credentials) (Backend, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	backends.lock.RLock()
+	factory := backends.factories[strings.ToLower(u.Scheme)]
+	backends.lock.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("unsupported backend %q, expected one of %s://", rawurl, strings.Join(BackendSchemes(), "://, "))
+	}
+	return factory(u, creds)
+}
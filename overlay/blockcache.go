@@ -0,0 +1,313 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// blockID identifies a block of a version of a remote file, in the tree of
+// uid on a multi-user mount
+type blockID struct {
+	uid     uint32
+	name    string
+	version string
+	idx     int64
+}
+
+// blockCache keeps recently read blocks of remote files, least recently used
+// blocks are dropped first. Blocks dropped from memory move to the disk
+// tier if there is one. All blocks of a file are dropped when it changes.
+type blockCache struct {
+	lock   sync.Mutex
+	max    int64
+	size   int64
+	lru    *list.List
+	blocks map[blockID]*list.Element
+	// files are the cached blocks by file name, in memory and on disk
+	files map[string]map[blockID]bool
+	// loading are closed once the blocks being read are cached
+	loading map[blockID]chan struct{}
+
+	// disk is the second tier, nil if disabled. disk hits and misses are
+	// counted in diskHits.
+	disk     *diskTier
+	diskHits *cacheCounter
+}
+
+type cachedBlock struct {
+	id   blockID
+	data []byte
+}
+
+func newBlockCache(max int64) *blockCache {
+	return &blockCache{
+		max:     max,
+		lru:     list.New(),
+		blocks:  make(map[blockID]*list.Element),
+		files:   make(map[string]map[blockID]bool),
+		loading: make(map[blockID]chan struct{}),
+	}
+}
+
+// get returns the block id from memory or from the disk tier
+func (c *blockCache) get(id blockID) ([]byte, bool) {
+	c.lock.Lock()
+	if e, ok := c.blocks[id]; ok {
+		c.lru.MoveToFront(e)
+		c.lock.Unlock()
+		return e.Value.(*cachedBlock).data, true
+	}
+	c.lock.Unlock()
+	if c.disk == nil {
+		return nil, false
+	}
+	data := c.disk.get(id)
+	if c.diskHits != nil {
+		c.diskHits.count(data != nil)
+	}
+	if data == nil {
+		return nil, false
+	}
+	c.put(id, data)
+	return data, true
+}
+
+// load returns the block id if it is cached. Otherwise it returns a channel
+// that is closed when the reader of the block is done, or nil if the caller
+// is to read it and call loaded afterwards.
+func (c *blockCache) load(id blockID) ([]byte, bool, chan struct{}) {
+	if data, ok := c.get(id); ok {
+		return data, true, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.blocks[id]; ok {
+		return e.Value.(*cachedBlock).data, true, nil
+	}
+	if loading, ok := c.loading[id]; ok {
+		return nil, false, loading
+	}
+	c.loading[id] = make(chan struct{})
+	return nil, false, nil
+}
+
+// loaded wakes up the readers waiting for the block id
+func (c *blockCache) loaded(id blockID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if loading, ok := c.loading[id]; ok {
+		close(loading)
+		delete(c.loading, id)
+	}
+}
+
+// put caches the block id in memory, the blocks it pushes out move to disk
+func (c *blockCache) put(id blockID, data []byte) {
+	c.lock.Lock()
+	if _, ok := c.blocks[id]; ok || int64(len(data)) > c.max {
+		c.lock.Unlock()
+		return
+	}
+	c.blocks[id] = c.lru.PushFront(&cachedBlock{id: id, data: data})
+	c.size += int64(len(data))
+	c.index(id)
+	var evicted []*cachedBlock
+	for c.size > c.max {
+		e := c.lru.Back()
+		b := c.lru.Remove(e).(*cachedBlock)
+		delete(c.blocks, b.id)
+		c.size -= int64(len(b.data))
+		if c.disk == nil {
+			c.unindex(b.id)
+		}
+		evicted = append(evicted, b)
+	}
+	c.lock.Unlock()
+	if c.disk == nil {
+		return
+	}
+	for _, b := range evicted {
+		for _, dropped := range c.disk.put(b.id, b.data) {
+			c.lock.Lock()
+			if _, ok := c.blocks[dropped]; !ok {
+				c.unindex(dropped)
+			}
+			c.lock.Unlock()
+		}
+	}
+}
+
+// index records that the block id is cached, c.lock must be held
+func (c *blockCache) index(id blockID) {
+	ids := c.files[id.name]
+	if ids == nil {
+		ids = make(map[blockID]bool)
+		c.files[id.name] = ids
+	}
+	ids[id] = true
+}
+
+// unindex records that the block id is gone, c.lock must be held
+func (c *blockCache) unindex(id blockID) {
+	if ids := c.files[id.name]; ids != nil {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(c.files, id.name)
+		}
+	}
+}
+
+// dropFile drops all blocks of the file name, e.g. when it was written,
+// removed or changed in the backend
+func (c *blockCache) dropFile(name string) {
+	c.lock.Lock()
+	ids := c.files[name]
+	delete(c.files, name)
+	for id := range ids {
+		if e, ok := c.blocks[id]; ok {
+			c.lru.Remove(e)
+			delete(c.blocks, id)
+			c.size -= int64(len(e.Value.(*cachedBlock).data))
+		}
+	}
+	c.lock.Unlock()
+	if c.disk != nil {
+		for id := range ids {
+			c.disk.remove(id)
+		}
+	}
+}
+
+// reset drops all blocks
+func (c *blockCache) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lru.Init()
+	c.blocks = make(map[blockID]*list.Element)
+	c.files = make(map[string]map[blockID]bool)
+	c.size = 0
+	if c.disk != nil {
+		c.disk.reset()
+	}
+}
+
+// diskTier keeps blocks pushed out of memory in files of a directory, least
+// recently used ones are removed first. The directory is emptied on start,
+// the index is not persisted.
+type diskTier struct {
+	dir string
+
+	lock   sync.Mutex
+	max    int64
+	size   int64
+	lru    *list.List
+	blocks map[blockID]*list.Element
+}
+
+type diskBlock struct {
+	id   blockID
+	size int64
+}
+
+// newDiskTier empties dir and keeps up to max bytes of blocks in it
+func newDiskTier(dir string, max int64) (*diskTier, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.block"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		os.Remove(name)
+	}
+	return &diskTier{dir: dir, max: max, lru: list.New(), blocks: make(map[blockID]*list.Element)}, nil
+}
+
+func (d *diskTier) path(id blockID) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s\x00%d", id.uid, id.name, id.version, id.idx)))
+	return filepath.Join(d.dir, hex.EncodeToString(h[:])+".block")
+}
+
+func (d *diskTier) get(id blockID) []byte {
+	d.lock.Lock()
+	e, ok := d.blocks[id]
+	if ok {
+		d.lru.MoveToFront(e)
+	}
+	d.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	data, err := ioutil.ReadFile(d.path(id))
+	if err != nil {
+		d.remove(id)
+		return nil
+	}
+	return data
+}
+
+// put writes the block id and returns the blocks removed to make room
+func (d *diskTier) put(id blockID, data []byte) (dropped []blockID) {
+	if int64(len(data)) > d.max {
+		return []blockID{id}
+	}
+	d.lock.Lock()
+	if e, ok := d.blocks[id]; ok {
+		// promoted to memory before
+		d.lru.MoveToFront(e)
+		d.lock.Unlock()
+		return nil
+	}
+	d.lock.Unlock()
+	if err := ioutil.WriteFile(d.path(id), data, 0600); err != nil {
+		loog.Warn(logRemote, "could not write block to the disk cache", "path", id.name, "block", id.idx, "error", err)
+		return []blockID{id}
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.blocks[id]; ok {
+		return nil
+	}
+	d.blocks[id] = d.lru.PushFront(&diskBlock{id: id, size: int64(len(data))})
+	d.size += int64(len(data))
+	for d.size > d.max {
+		b := d.lru.Remove(d.lru.Back()).(*diskBlock)
+		delete(d.blocks, b.id)
+		d.size -= b.size
+		os.Remove(d.path(b.id))
+		dropped = append(dropped, b.id)
+	}
+	return dropped
+}
+
+func (d *diskTier) remove(id blockID) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if e, ok := d.blocks[id]; ok {
+		d.size -= d.lru.Remove(e).(*diskBlock).size
+		delete(d.blocks, id)
+		os.Remove(d.path(id))
+	}
+}
+
+func (d *diskTier) reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for id := range d.blocks {
+		os.Remove(d.path(id))
+	}
+	d.lru.Init()
+	d.blocks = make(map[blockID]*list.Element)
+	d.size = 0
+}
@@ -0,0 +1,187 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// dataVersion identifies the content of a backing file the kernel may have in
+// its page cache
+type dataVersion struct {
+	mtime time.Time
+	size  int64
+}
+
+// Serve serves the overlay on c. Serving through the FS lets it notify the
+// kernel when backing files change behind its back. Pending propagations are
+// flushed when it returns.
+func (f *FS) Serve(c *fuse.Conn) error {
+	config := &fs.Config{WithContext: f.withRequest(withCaller), Debug: f.debug}
+	if f.tracer != nil {
+		config.WithContext = f.withRequest(f.tracer.withSpan)
+	}
+	f.server = fs.New(c, config)
+	defer close(f.served)
+	defer f.flushTraces()
+	defer f.closeAuditLog()
+	defer f.flushPropagation()
+	defer f.saveXattrs()
+	return f.server.Serve(f)
+}
+
+// checkData compares fi with the last known version of the node's content
+// and invalidates the kernel page cache if the backing file was changed by
+// someone else. It reports whether cached pages are still valid.
+func (n *Node) checkData(fi os.FileInfo) (valid bool) {
+	if !fi.Mode().IsRegular() {
+		return false
+	}
+	v := dataVersion{mtime: fi.ModTime(), size: fi.Size()}
+	if n.fs.codecs != nil {
+		// the copy of an open encrypted file is saved with its mtime
+		if pv, ok := n.fs.codecs.plainVersion(fi); ok {
+			v = pv
+		} else {
+			v.size = n.fs.contentSize(n.resolvedPath(), fi)
+		}
+	}
+	n.alock.Lock()
+	known := !n.data.mtime.IsZero()
+	valid = known && (n.data == v || n.localWrite)
+	if known && n.data != v && !n.localWrite && !n.directWrite {
+		n.foreign++
+	}
+	n.data = v
+	n.localWrite = false
+	n.alock.Unlock()
+	if known {
+		n.fs.stats.pageCache.count(valid)
+	}
+	if known && !valid {
+		n.fs.invalidateData(n)
+	}
+	return valid
+}
+
+// wroteData records a change made through the mount, the kernel already has
+// it in its page cache
+func (n *Node) wroteData() {
+	n.alock.Lock()
+	n.localWrite = true
+	n.alock.Unlock()
+	n.forgetWhole()
+}
+
+// wroteDirect records a change made through a handle that bypasses the page
+// cache, the pages the kernel has of the file are stale
+func (n *Node) wroteDirect() {
+	n.alock.Lock()
+	n.directWrite = true
+	n.alock.Unlock()
+	n.forgetWhole()
+}
+
+// invalidateWritten drops the pages the kernel cached of a file written
+// through n: its own if they were bypassed, and those of the other nodes
+// of hard links to it, which the kernel knows as separate files. Mappings
+// of the file, e.g. by sqlite or of a running binary, see the changes then.
+func (f *FS) invalidateWritten(n *Node) {
+	n.alock.Lock()
+	direct := n.directWrite
+	n.directWrite = false
+	n.alock.Unlock()
+	if direct {
+		f.invalidateData(n)
+	}
+	if n.inode == 0 {
+		return
+	}
+	for _, p := range f.registry.linkPaths(n.inode) {
+		for _, other := range f.registry.get(p) {
+			if other != n && other.inode == n.inode {
+				f.invalidateData(other)
+			}
+		}
+	}
+}
+
+// forgetWhole drops the small files read whole by the handles of n
+func (n *Node) forgetWhole() {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	for h := range n.flushers {
+		h.forgetWhole()
+	}
+}
+
+// invalidateData drops the cached pages of n. The notification is sent
+// asynchronously because the kernel may hold locks of the node while it waits
+// for the current request.
+func (f *FS) invalidateData(n *Node) {
+	n.forgetWhole()
+	if f.server == nil {
+		return
+	}
+	go func() {
+		err := f.server.InvalidateNodeData(n)
+		if err != nil && err != fuse.ErrNotCached {
+			loog.Warn(logIO, "could not invalidate page cache", "path", n.getRealPath(), "error", err)
+			return
+		}
+		loog.Debug(logIO, "invalidated page cache", "path", n.getRealPath(), "error", err)
+	}()
+}
+
+// execBlockSize is the st_blksize of regular files with Options.Executables,
+// the largest read the kernel sends. Loaders and package managers size
+// their reads by it, every read is a round trip.
+const execBlockSize = 128 << 10
+
+// keepExecutable reports whether the page cache of a file opened with
+// flags, fuse flags ff, is kept in the mode for executables: binaries and
+// shared libraries are opened read-only, for exec or with an execute bit
+func (f *FS) keepExecutable(ff fuse.OpenFlags, flags int, fi os.FileInfo) bool {
+	if !f.executables || flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+		return false
+	}
+	return openExec != 0 && ff&openExec != 0 || fi.Mode()&0111 != 0
+}
+
+// directIO reports whether the kernel should bypass its page cache for a
+// file opened with flags. O_DIRECT is not passed on to the backing file, the
+// buffers of fuse requests do not meet its alignment requirements. Binaries
+// are always executed through the page cache, the kernel maps them.
+func (f *FS) directIO(flags fuse.OpenFlags) bool {
+	if openExec != 0 && flags&openExec != 0 {
+		return false
+	}
+	return f.directIOAll || openDirect != 0 && flags&openDirect != 0
+}
+
+// writebackFlags adapts open flags for the writeback cache, which needs to
+// read pages of files that are only opened for writing
+func (f *FS) writebackFlags(flags int) int {
+	if f.writebackCache && flags&os.O_WRONLY != 0 {
+		flags = flags&^os.O_WRONLY | os.O_RDWR
+	}
+	return flags
+}
+
+// openWriteback calls open with flags adapted for the writeback cache and
+// falls back to the original flags if the file cannot be read
+func (f *FS) openWriteback(open func(flags int) (File, error), flags int) (File, error) {
+	wf := f.writebackFlags(flags)
+	if wf != flags {
+		file, err := open(wf)
+		if !os.IsPermission(err) {
+			return file, err
+		}
+	}
+	return open(flags)
+}
@@ -0,0 +1,227 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"os"
+	"sync"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// maxQueuedChunks is the number of chunks a handle may have waiting for the
+// flushers before its writes block
+const maxQueuedChunks = 8
+
+// writeCoalescer buffers the small writes of a handle and writes them to the
+// backing file in chunks aligned to size, on the flusher pool. The chunks of
+// a handle are written one at a time in the order they were buffered.
+// Buffered data is written before anything reads the backing file: reads,
+// attributes, truncates, flushes, fsyncs and the release of the handle.
+type writeCoalescer struct {
+	h    *Handle
+	size int64
+
+	lock sync.Mutex
+	// idle is signaled whenever a queued chunk was written
+	idle *sync.Cond
+	// buf is the data buffered at off that is not queued yet
+	off int64
+	buf []byte
+	// queue are the chunks waiting to be written, running is set while a
+	// flusher or a drain writes them
+	queue   []writeChunk
+	running bool
+	// err is the first failed write, it fails the next write, flush or
+	// fsync of the handle
+	err error
+}
+
+type writeChunk struct {
+	off  int64
+	data []byte
+}
+
+// coalesceWrites buffers the writes of h if coalescing is enabled and the
+// backing file was opened for writing with flags, but not with O_SYNC
+func (f *FS) coalesceWrites(h *Handle, flags int) {
+	if f.writeCoalesce <= 0 || flags&(os.O_WRONLY|os.O_RDWR) == 0 || flags&os.O_SYNC != 0 {
+		return
+	}
+	c := &writeCoalescer{h: h, size: f.writeCoalesce}
+	c.idle = sync.NewCond(&c.lock)
+	h.writes = c
+}
+
+// startFlushers starts n goroutines writing the queued chunks of handles
+func (f *FS) startFlushers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	f.flushPool = make(chan *writeCoalescer, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for c := range f.flushPool {
+				c.run()
+			}
+		}()
+	}
+}
+
+// write buffers data written at off. Writes of a whole chunk or more are
+// written right away, after the data buffered before.
+func (c *writeCoalescer) write(off int64, data []byte) error {
+	c.lock.Lock()
+	if err := c.err; err != nil {
+		c.err = nil
+		c.lock.Unlock()
+		return err
+	}
+	if len(c.buf) > 0 && off != c.off+int64(len(c.buf)) {
+		c.queueBuf()
+	}
+	if int64(len(data)) >= c.size {
+		c.queueBuf()
+		c.wait()
+		err := c.err
+		c.err = nil
+		c.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		_, err = c.h.writeAt(data, off)
+		return err
+	}
+	if len(c.buf) == 0 {
+		c.off = off
+	}
+	c.buf = append(c.buf, data...)
+	// everything up to the last aligned boundary is queued, the rest waits
+	// for the following writes
+	end := c.off + int64(len(c.buf))
+	if boundary := end - end%c.size; boundary > c.off {
+		n := boundary - c.off
+		c.queue = append(c.queue, writeChunk{off: c.off, data: c.buf[:n]})
+		c.off, c.buf = boundary, append([]byte(nil), c.buf[n:]...)
+	}
+	for c.running && len(c.queue) > maxQueuedChunks {
+		c.idle.Wait()
+	}
+	schedule := !c.running && len(c.queue) > 0
+	if schedule {
+		c.running = true
+	}
+	c.lock.Unlock()
+	if schedule {
+		c.h.fs.flushPool <- c
+	}
+	return nil
+}
+
+// queueBuf queues the buffered data, c.lock must be held
+func (c *writeCoalescer) queueBuf() {
+	if len(c.buf) == 0 {
+		return
+	}
+	c.queue = append(c.queue, writeChunk{off: c.off, data: c.buf})
+	c.buf = nil
+}
+
+// wait writes the queued chunks itself if no flusher is at it, and waits
+// until all are written. c.lock must be held.
+func (c *writeCoalescer) wait() {
+	if !c.running && len(c.queue) > 0 {
+		c.running = true
+		c.lock.Unlock()
+		c.run()
+		c.lock.Lock()
+	}
+	for c.running {
+		c.idle.Wait()
+	}
+}
+
+// run writes the queued chunks in order
+func (c *writeCoalescer) run() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.queue) > 0 {
+		chunk := c.queue[0]
+		c.queue = c.queue[1:]
+		c.lock.Unlock()
+		_, err := c.h.writeAt(chunk.data, chunk.off)
+		c.lock.Lock()
+		if err != nil {
+			loog.Warn(logIO, "buffered write failed", "path", c.h.name,
+				"offset", chunk.off, "size", len(chunk.data), "error", err)
+			if c.err == nil {
+				c.err = err
+			}
+		}
+		c.idle.Broadcast()
+	}
+	c.running = false
+	c.idle.Broadcast()
+}
+
+// drain writes all buffered data to the backing file
+func (c *writeCoalescer) drain() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queueBuf()
+	c.wait()
+}
+
+// failed returns and clears the error of a failed buffered write
+func (c *writeCoalescer) failed() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.err
+	c.err = nil
+	return err
+}
+
+// sync drains the buffered writes of h and returns the error of a failed one
+func (h *Handle) sync() error {
+	if h.writes == nil {
+		return nil
+	}
+	h.writes.drain()
+	return h.writes.failed()
+}
+
+// drainWrites writes the buffered data of all handles of n to the backing
+// file, e.g. before it is read or truncated
+func (n *Node) drainWrites() {
+	for _, h := range n.coalescing() {
+		h.writes.drain()
+	}
+}
+
+// syncWrites is drainWrites for fsync, it returns the first error of a
+// failed buffered write
+func (n *Node) syncWrites() error {
+	var err error
+	for _, h := range n.coalescing() {
+		if e := h.sync(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// coalescing returns the handles of n that buffer writes
+func (n *Node) coalescing() []*Handle {
+	if n.fs.writeCoalesce <= 0 {
+		return nil
+	}
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	var handles []*Handle
+	for h := range n.flushers {
+		if h.writes != nil {
+			handles = append(handles, h)
+		}
+	}
+	return handles
+}
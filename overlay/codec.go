@@ -0,0 +1,470 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/butonic/ocis-overlay/loog"
+	"github.com/pkg/xattr"
+)
+
+const (
+	// overlayXattrPrefix names the xattrs the overlay keeps on backing files
+	// for itself, they are not visible through the mount
+	overlayXattrPrefix = "user.ocis-overlay."
+	// codecAttr marks an encoded file with "codec size stored": the codecs
+	// it was encoded with joined by +, the size of the content and the size
+	// of the backing file. A backing file of another size was changed
+	// behind the mount, the mark is stale.
+	codecAttr = overlayXattrPrefix + "codec"
+	// plainDir is the directory below the metaDir compressed files opened
+	// for reading are decompressed to
+	plainDir = "plain"
+	// codecQueue is how many released files may wait for the encoder, more
+	// are encoded when they are released again
+	codecQueue = 1024
+)
+
+// codecs compress the files of the upper layer of a local mount once they
+// are released, see encodeFile, or encrypt them when they are written, see
+// plainCopy. A compressed file is decompressed in place when it is opened
+// for writing and to a file below plainDir when it is opened for reading,
+// an encrypted file is only ever decrypted to memory.
+type codecs struct {
+	compression Compression
+	exclude     map[string]bool
+	// enc is nil without encryption
+	enc   *encryption
+	queue chan string
+	locks pathLocks
+	// warned is set once encoding failed because the backing file system
+	// has no xattrs
+	warned int32
+
+	// plain are the decrypted copies of the open encrypted files by the
+	// backing file they were read from or last saved to
+	plainLock sync.Mutex
+	plain     map[fileID]*plainCopy
+}
+
+// pathLocks serialize the opens of a path with encoding and decoding it
+type pathLocks struct {
+	lock  sync.Mutex
+	paths map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// acquire locks p and returns the func that unlocks it
+func (l *pathLocks) acquire(p string) func() {
+	l.lock.Lock()
+	if l.paths == nil {
+		l.paths = make(map[string]*pathLock)
+	}
+	pl := l.paths[p]
+	if pl == nil {
+		pl = &pathLock{}
+		l.paths[p] = pl
+	}
+	pl.refs++
+	l.lock.Unlock()
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.lock.Lock()
+		if pl.refs--; pl.refs == 0 {
+			delete(l.paths, p)
+		}
+		l.lock.Unlock()
+	}
+}
+
+// startCodecs starts the encoder of a local mount, enc is nil without
+// encryption. It fails if the files cannot be encrypted, see
+// checkEncryption.
+func (f *FS) startCodecs(compression Compression, exclude map[string]bool, enc *encryption) error {
+	c := &codecs{compression: compression, exclude: exclude, enc: enc, queue: make(chan string, codecQueue)}
+	if enc != nil {
+		if err := f.checkEncryption(); err != nil {
+			return err
+		}
+	}
+	// files decoded for readers of an earlier mount
+	os.RemoveAll(f.metaPath(plainDir))
+	f.codecs = c
+	go func() {
+		for p := range c.queue {
+			f.encodeFile(p)
+		}
+	}()
+	return nil
+}
+
+// lockPath serializes encoding and opening the upper path p, the returned
+// func unlocks it
+func (f *FS) lockPath(p string) func() {
+	if f.codecs == nil {
+		return func() {}
+	}
+	return f.codecs.locks.acquire(p)
+}
+
+// queueEncode hands the file at the upper path p to the encoder once a
+// handle of it was released. Encrypted mounts compress files when they
+// encrypt them.
+func (f *FS) queueEncode(p string) {
+	c := f.codecs
+	if c == nil || c.enc != nil || !c.compresses() {
+		return
+	}
+	select {
+	case c.queue <- p:
+	default:
+		loog.Debug(logFS, "encoder queue full, skipping file", "path", p)
+	}
+}
+
+// codecMark is the value of codecAttr
+type codecMark struct {
+	codec  string
+	size   int64
+	stored int64
+}
+
+func (m codecMark) String() string {
+	return fmt.Sprintf("%s %d %d", m.codec, m.size, m.stored)
+}
+
+// readCodecMark returns the mark of the backing file p with info fi, ok is
+// false if it is not encoded
+func readCodecMark(p string, fi os.FileInfo) (m codecMark, ok bool) {
+	if !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return m, false
+	}
+	v, err := xattr.Get(p, codecAttr)
+	if err != nil {
+		return m, false
+	}
+	if _, err = fmt.Sscanf(string(v), "%s %d %d", &m.codec, &m.size, &m.stored); err != nil {
+		return m, false
+	}
+	return m, m.stored == fi.Size()
+}
+
+// staleMark fails with EIO for the backing file p if its mark m, which
+// readCodecMark did not accept, is stale and files are encrypted: the file
+// was changed behind the mount, its content can neither be decrypted nor
+// passed off as plaintext.
+func (f *FS) staleMark(p string, m codecMark) error {
+	if m.codec == "" || !f.encrypting() {
+		return nil
+	}
+	loog.Warn(logFS, "encrypted file changed behind the mount, it cannot be read", "path", p, "mark", m)
+	return &os.PathError{Op: "decrypt", Path: p, Err: syscall.EIO}
+}
+
+// contentSize returns the size of the content of the backing file p with
+// info fi, which differs from the size of the file if it is encoded. The
+// content of an encrypted file that is open is its decrypted copy. An
+// encrypted file changed behind the mount keeps the size it had, it fails to
+// read.
+func (f *FS) contentSize(p string, fi os.FileInfo) int64 {
+	if f.codecs != nil {
+		if v, ok := f.codecs.plainVersion(fi); ok {
+			return v.size
+		}
+		if m, ok := readCodecMark(p, fi); ok || m.codec != "" && f.encrypting() {
+			return m.size
+		}
+	}
+	return fi.Size()
+}
+
+// encodeWriter writes through the encoders of a file, Close closes them
+// from the outermost in
+type encodeWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (e *encodeWriter) Close() error {
+	for _, c := range e.closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encoder returns the writer that compresses the content written to it if
+// compress is set and encrypts it if encryption is enabled, then writes it
+// to w. It returns the codec of the mark and the wrapped file key, nil
+// without encryption.
+func (c *codecs) encoder(w io.Writer, compress bool) (*encodeWriter, string, []byte, error) {
+	e := &encodeWriter{Writer: w}
+	var names []string
+	var wrapped []byte
+	if c.enc != nil {
+		s, key, err := c.enc.sealer(w)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		e.Writer, e.closers = s, []io.Closer{s}
+		names, wrapped = []string{cipherAES256GCM}, key
+	}
+	if compress {
+		z, err := compressor(c.compression, e.Writer)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		e.Writer, e.closers = z, append([]io.Closer{z}, e.closers...)
+		names = append([]string{string(c.compression)}, names...)
+	}
+	return e, strings.Join(names, "+"), wrapped, nil
+}
+
+// decoder returns the reader of the content of the backing file p encoded
+// as m, reading the encoded data from r
+func (c *codecs) decoder(r io.Reader, p string, m codecMark) (io.Reader, error) {
+	names := strings.Split(m.codec, "+")
+	for i := len(names) - 1; i >= 0; i-- {
+		switch name := names[i]; name {
+		case cipherAES256GCM:
+			if c.enc == nil {
+				return nil, fmt.Errorf("%s is encrypted and no encryption key is set", p)
+			}
+			wrapped, err := xattr.Get(p, keyAttr)
+			if err != nil {
+				return nil, err
+			}
+			if r, err = c.enc.opener(r, wrapped); err != nil {
+				return nil, err
+			}
+		default:
+			d, err := decompressor(Compression(name), r)
+			if err != nil {
+				return nil, err
+			}
+			r = d
+		}
+	}
+	return r, nil
+}
+
+// transcode writes the content of src transformed by code to a new file in
+// the directory dir with the metadata of src and returns its path and size
+func (f *FS) transcode(ctx context.Context, dir string, src string, fi os.FileInfo, code func(w io.Writer, r io.Reader) error) (string, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+	return f.transcodeFrom(ctx, dir, in, src, fi, code)
+}
+
+// transcodeFrom is transcode for the content read from r
+func (f *FS) transcodeFrom(ctx context.Context, dir string, r io.Reader, src string, fi os.FileInfo, code func(w io.Writer, r io.Reader) error) (string, int64, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", 0, err
+	}
+	out, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		return "", 0, err
+	}
+	err = code(out, &ctxReader{ctx: ctx, r: r})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	var tfi os.FileInfo
+	if err == nil {
+		tfi, err = os.Stat(out.Name())
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 0, err
+	}
+	os.Chmod(out.Name(), fi.Mode().Perm())
+	copyMetadata(out.Name(), src, fi)
+	f.copyxattrs(out.Name(), src)
+	return out.Name(), tfi.Size(), nil
+}
+
+// decodeTo returns a transcode func that decodes the backing file p
+// encoded as m
+func (c *codecs) decodeTo(p string, m codecMark) func(w io.Writer, r io.Reader) error {
+	return func(w io.Writer, r io.Reader) error {
+		d, err := c.decoder(r, p, m)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, d)
+		return err
+	}
+}
+
+// replaceFile renames tmp over the backing file p if p is still the file
+// described by fi
+func (f *FS) replaceFile(p string, tmp string, fi os.FileInfo) error {
+	now, err := os.Lstat(p)
+	if err == nil && (!os.SameFile(fi, now) || now.Size() != fi.Size() || !now.ModTime().Equal(fi.ModTime())) {
+		err = fmt.Errorf("%s changed meanwhile", p)
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f.unlinkedXattrs(fi)
+	return nil
+}
+
+// encoded writes the content read from r, compressed if compress is set and
+// encrypted if encryption is enabled, to a new file below the metaDir. The
+// file gets the metadata of the backing file src with info fi and the mark
+// of its codecs, it is returned with the mark.
+func (f *FS) encoded(ctx context.Context, r io.Reader, src string, fi os.FileInfo, compress bool) (string, codecMark, error) {
+	c := f.codecs
+	var m codecMark
+	var wrapped []byte
+	tmp, stored, err := f.transcodeFrom(ctx, f.metaPath(copyUpTmp), r, src, fi, func(w io.Writer, r io.Reader) error {
+		e, name, key, err := c.encoder(w, compress)
+		if err != nil {
+			return err
+		}
+		m.codec, wrapped = name, key
+		if m.size, err = io.Copy(e, r); err != nil {
+			return err
+		}
+		return e.Close()
+	})
+	if err != nil {
+		return "", m, err
+	}
+	m.stored = stored
+	if wrapped != nil {
+		err = xattr.Set(tmp, keyAttr, []byte(base64.StdEncoding.EncodeToString(wrapped)))
+	}
+	if err == nil {
+		err = xattr.Set(tmp, codecAttr, []byte(m.String()))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", m, err
+	}
+	return tmp, m, nil
+}
+
+// encodeFile replaces the released file at the upper path p with a
+// compressed copy. Files that are open or hard linked are left as they are,
+// and so are the files compression skips or does not make smaller.
+func (f *FS) encodeFile(p string) {
+	c := f.codecs
+	unlock := c.locks.acquire(p)
+	defer unlock()
+	if f.openFile(p) {
+		return
+	}
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	if _, nlink, ok := statID(fi); !ok || nlink > 1 {
+		return
+	}
+	if _, ok := readCodecMark(p, fi); ok || !c.compressible(p, fi.Size()) {
+		return
+	}
+	in, err := os.Open(p)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	tmp, m, err := f.encoded(context.Background(), in, p, fi, true)
+	if _, ok := err.(*xattr.Error); ok {
+		if atomic.CompareAndSwapInt32(&c.warned, 0, 1) {
+			loog.Warn(logFS, "cannot mark encoded files, the backing file system needs xattr support", "path", p, "error", err)
+		}
+		return
+	}
+	if err != nil {
+		loog.Warn(logFS, "could not encode file", "path", p, "error", err)
+		return
+	}
+	if m.stored >= m.size {
+		os.Remove(tmp)
+		return
+	}
+	if err = f.replaceFile(p, tmp, fi); err != nil {
+		loog.Debug(logFS, "could not encode file", "path", p, "error", err)
+		return
+	}
+	loog.Debug(logFS, "encoded file", "path", p, "codec", m.codec, "size", m.size, "stored", m.stored)
+}
+
+// decodeInPlace replaces the compressed backing file p with its content
+// before it is changed, the path must be locked
+func (f *FS) decodeInPlace(ctx context.Context, p string) error {
+	tmp, fi, err := f.decode(ctx, p, copyUpTmp)
+	if tmp == "" || err != nil {
+		return err
+	}
+	return f.replaceFile(p, tmp, fi)
+}
+
+// decodedCopy decompresses the backing file p to a file below plainDir for
+// reading and returns its path, empty if p is not encoded
+func (f *FS) decodedCopy(ctx context.Context, p string) (string, error) {
+	tmp, _, err := f.decode(ctx, p, plainDir)
+	return tmp, err
+}
+
+// decode decodes the backing file p to a file in dir below the metaDir and
+// returns its path and the info of p, an empty path if p is not encoded
+func (f *FS) decode(ctx context.Context, p string, dir string) (string, os.FileInfo, error) {
+	if f.codecs == nil {
+		return "", nil, nil
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return "", nil, nil
+	}
+	m, ok := readCodecMark(p, fi)
+	if !ok {
+		return "", nil, f.staleMark(p, m)
+	}
+	tmp, _, err := f.transcode(ctx, f.metaPath(dir), p, fi, f.codecs.decodeTo(p, m))
+	if err != nil {
+		return "", nil, err
+	}
+	xattr.Remove(tmp, codecAttr)
+	xattr.Remove(tmp, keyAttr)
+	return tmp, fi, nil
+}
+
+// ctxReader stops reading once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(b []byte) (int, error) {
+	if err := interrupted(r.ctx); err != nil {
+		return 0, err
+	}
+	return r.r.Read(b)
+}
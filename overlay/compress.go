@@ -0,0 +1,107 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects the codec the files of the upper layer are stored
+// with
+type Compression string
+
+const (
+	// CompressionOff stores files as they are written
+	CompressionOff Compression = "off"
+	// CompressionNone stores new files as they are written but still
+	// decompresses the files compressed before
+	CompressionNone Compression = "none"
+	// CompressionDeflate stores files as raw deflate streams at the fastest
+	// level
+	CompressionDeflate Compression = "deflate"
+	// CompressionGzip stores files as gzip streams at the default level,
+	// smaller and checksummed
+	CompressionGzip Compression = "gzip"
+	// CompressionZstd stores files as zstd streams at the default level,
+	// smaller than deflate and much faster to read
+	CompressionZstd Compression = "zstd"
+)
+
+// ParseCompression parses a codec, empty is CompressionOff
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case "":
+		return CompressionOff, nil
+	case CompressionOff, CompressionNone, CompressionDeflate, CompressionGzip, CompressionZstd:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown compression %q", s)
+}
+
+// DefaultCompressionExclude are the extensions of files that are compressed
+// already
+const DefaultCompressionExclude = ".7z,.br,.bz2,.gz,.jpeg,.jpg,.lz4,.mkv,.mov,.mp3,.mp4,.png,.webp,.xz,.zip,.zst"
+
+// ParseExtensions parses a comma separated list of file extensions like
+// ".zip,jpg", the leading dot is optional and case is ignored
+func ParseExtensions(s string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+			exts["."+strings.TrimPrefix(e, ".")] = true
+		}
+	}
+	return exts
+}
+
+// compressMinSize skips smaller files
+const compressMinSize = 4096
+
+// compresses reports whether released files are compressed
+func (c *codecs) compresses() bool {
+	switch c.compression {
+	case CompressionDeflate, CompressionGzip, CompressionZstd:
+		return true
+	}
+	return false
+}
+
+// compressible reports whether the file p of size bytes is compressed
+func (c *codecs) compressible(p string, size int64) bool {
+	return c.compresses() && size >= compressMinSize && !c.exclude[strings.ToLower(filepath.Ext(p))]
+}
+
+// compressor returns a writer that compresses to w with codec
+func compressor(codec Compression, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CompressionDeflate:
+		return flate.NewWriter(w, flate.BestSpeed)
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("cannot compress with %q", codec)
+}
+
+// decompressor returns a reader that decompresses r compressed with codec
+func decompressor(codec Compression, r io.Reader) (io.Reader, error) {
+	switch codec {
+	case CompressionDeflate:
+		return flate.NewReader(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		// a decoder without concurrency decodes in the calling goroutine,
+		// so it does not need to be closed
+		return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("cannot decompress %q", codec)
+}
@@ -0,0 +1,37 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestCompressors checks that every codec reads back what it wrote
+func TestCompressors(t *testing.T) {
+	content := bytes.Repeat([]byte("compress me "), 1000)
+	for _, codec := range []Compression{CompressionDeflate, CompressionGzip, CompressionZstd} {
+		var buf bytes.Buffer
+		w, err := compressor(codec, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(content); err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if buf.Len() >= len(content) {
+			t.Errorf("%s: %d bytes compressed to %d", codec, len(content), buf.Len())
+		}
+		r, err := decompressor(codec, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: read back %d bytes, %v, want %d", codec, len(got), err, len(content))
+		}
+	}
+}
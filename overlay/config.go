@@ -0,0 +1,483 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is prepended to the upper cased config keys to get the names of
+// the environment variables that override them, e.g. OCIS_OVERLAY_ATTR_TIMEOUT
+const EnvPrefix = "OCIS_OVERLAY_"
+
+// Config is the configuration of a mount. The keys are the names of the
+// command line flags with underscores instead of dashes, durations are
+// strings like 1s.
+type Config struct {
+	// Root is the directory to mount over itself
+	Root   string   `yaml:"root"`
+	Lowers []string `yaml:"lower"`
+	Mknod  bool     `yaml:"mknod"`
+	Hide   []string `yaml:"hide"`
+	Show   []string `yaml:"show"`
+	// UIDMap and GIDMap are comma separated mount:backing id pairs
+	UIDMap   string `yaml:"uid_map"`
+	GIDMap   string `yaml:"gid_map"`
+	AsCaller bool   `yaml:"as_caller"`
+	// DefaultPermissions lets the kernel check permissions
+	DefaultPermissions bool `yaml:"default_permissions"`
+	// Normalize is the Unicode normalization form of new names, nfc or nfd
+	Normalize string `yaml:"normalize"`
+
+	// mount options, see MountOptions
+	AllowOther   bool   `yaml:"allow_other"`
+	AllowRoot    bool   `yaml:"allow_root"`
+	AsyncRead    bool   `yaml:"async_read"`
+	NonEmpty     bool   `yaml:"nonempty"`
+	MaxReadahead int    `yaml:"max_readahead"`
+	VolumeName   string `yaml:"volume_name"`
+
+	Latency             string        `yaml:"latency"`
+	LatencyJitter       time.Duration `yaml:"latency_jitter"`
+	LatencyDistribution string        `yaml:"latency_distribution"`
+	Faults              string        `yaml:"faults"`
+	SpaceLimit          string        `yaml:"space_limit"`
+
+	XattrMode       string        `yaml:"xattr_mode"`
+	XattrSecurity   string        `yaml:"xattr_security"`
+	MaxXattrSize    int           `yaml:"max_xattr_size"`
+	PersistXattrs   bool          `yaml:"persist_xattrs"`
+	OpJournal       bool          `yaml:"op_journal"`
+	Dedup           bool          `yaml:"dedup"`
+	AttrTimeout     time.Duration `yaml:"attr_timeout"`
+	NodeSweep       time.Duration `yaml:"node_sweep_interval"`
+	Watch           bool          `yaml:"watch"`
+	WritebackCache  bool          `yaml:"writeback_cache"`
+	KeepCache       bool          `yaml:"keep_cache"`
+	DirectIO        bool          `yaml:"direct_io"`
+	Executables     bool          `yaml:"executables"`
+	MaxOpenFiles    int           `yaml:"max_open_files"`
+	Serialize       bool          `yaml:"serialize"`
+	ReadAllMax      int64         `yaml:"read_all_max"`
+	WriteCoalesce   int64         `yaml:"write_coalesce"`
+	WriteFlushers   int           `yaml:"write_flushers"`
+	OcisMetadata    bool          `yaml:"ocis_metadata"`
+	VerifyChecksums bool          `yaml:"verify_checksums"`
+	Etags           bool          `yaml:"etags"`
+	TreeSize        bool          `yaml:"treesize"`
+
+	PropagationDelay time.Duration `yaml:"propagation_delay"`
+	// Events is the nats:// or http(s):// endpoint events are published to
+	Events string `yaml:"events"`
+	// AVScan is the clamd:// or icap:// endpoint written files are scanned
+	// with, AVPolicy what happens to infected ones
+	AVScan   string `yaml:"av_scan"`
+	AVPolicy string `yaml:"av_policy"`
+
+	AuditLog           string `yaml:"audit_log"`
+	AuditMutationsOnly bool   `yaml:"audit_mutations_only"`
+	AuditMaxSize       int64  `yaml:"audit_max_size"`
+	AuditMaxFiles      int    `yaml:"audit_max_files"`
+
+	// OTLPEndpoint is the http(s):// endpoint of an OpenTelemetry collector
+	OTLPEndpoint    string        `yaml:"otlp_endpoint"`
+	SlowOpThreshold time.Duration `yaml:"slow_op_threshold"`
+	Record          string        `yaml:"record"`
+
+	Trash        bool          `yaml:"trash"`
+	TrashMaxAge  time.Duration `yaml:"trash_max_age"`
+	TrashMaxSize int64         `yaml:"trash_max_size"`
+
+	Versions       bool          `yaml:"versions"`
+	VersionsMax    int           `yaml:"versions_max"`
+	VersionsMaxAge time.Duration `yaml:"versions_max_age"`
+
+	Compression string `yaml:"compression"`
+	// CompressionExclude is a comma separated list of file extensions
+	CompressionExclude string `yaml:"compression_exclude"`
+	// EncryptionKey is a ReadSecret spec of a ParseMasterKey key
+	EncryptionKey string `yaml:"encryption_key"`
+	EncryptNames  bool   `yaml:"encrypt_names"`
+
+	// Backend is the URL of a remote store to mount instead of root,
+	// dav://host/path or davs://host/path for WebDAV, ocis://host for the
+	// spaces of an oCIS user
+	Backend         string `yaml:"backend"`
+	BackendUser     string `yaml:"backend_user"`
+	BackendPassword string `yaml:"backend_password"`
+	// BackendToken and BackendRefreshToken are ReadSecret specs
+	BackendToken        string `yaml:"backend_token"`
+	BackendRefreshToken string `yaml:"backend_refresh_token"`
+	// BackendTokenURL is the token endpoint of the OpenID Connect provider
+	// the refresh token is redeemed at
+	BackendTokenURL string `yaml:"backend_token_url"`
+	BackendClientID string `yaml:"backend_client_id"`
+	// BackendUsers is a LoadUserCredentials file, it makes the mount serve
+	// every user listed with their own credentials
+	BackendUsers string `yaml:"backend_users"`
+	// BackendFlakiness is a ParseFlakiness spec
+	BackendFlakiness string `yaml:"backend_flakiness"`
+	// BackendRetry is a ParseRetry spec
+	BackendRetry       string `yaml:"backend_retry"`
+	BlockCacheSize     int64  `yaml:"block_cache_size"`
+	BlockCacheDir      string `yaml:"block_cache_dir"`
+	BlockCacheDiskSize int64  `yaml:"block_cache_disk_size"`
+	ReadAhead          int64  `yaml:"read_ahead"`
+	OfflineDir         string `yaml:"offline_dir"`
+	ConflictPolicy     string `yaml:"conflict_policy"`
+
+	Daemon  bool   `yaml:"daemon"`
+	PidFile string `yaml:"pidfile"`
+	// Control is the path of the unix control socket, see ServeControl
+	Control string `yaml:"control"`
+	// Admin is the address of the admin HTTP listener, see ServeAdmin
+	Admin string `yaml:"admin"`
+
+	LogLevel      string `yaml:"log_level"`
+	LogFormat     string `yaml:"log_format"`
+	LogSubsystems string `yaml:"log_subsystems"`
+}
+
+// DefaultConfig returns the configuration used for unset keys
+func DefaultConfig() *Config {
+	return &Config{
+		AllowOther:          true,
+		AsyncRead:           true,
+		NonEmpty:            true,
+		LatencyDistribution: string(Fixed),
+		XattrMode:           string(XattrPassthrough),
+		XattrSecurity:       string(XattrPolicyPassthrough),
+		ConflictPolicy:      string(ConflictOverwrite),
+		AVPolicy:            string(AVQuarantine),
+		Compression:         string(CompressionOff),
+		CompressionExclude:  DefaultCompressionExclude,
+		AttrTimeout:         time.Second,
+		NodeSweep:           5 * time.Minute,
+		ReadAllMax:          64 << 10,
+		WriteFlushers:       4,
+		BlockCacheSize:      64 << 20,
+		BlockCacheDiskSize:  1 << 30,
+		ReadAhead:           4 << 20,
+		AuditMaxSize:        100 << 20,
+		AuditMaxFiles:       5,
+		LogLevel:            "info",
+		LogFormat:           "text",
+	}
+}
+
+// LoadConfig reads the YAML file at path over the defaults and applies the
+// environment overrides
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	if err = c.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ApplyEnv overrides keys with the environment variables set for them
+func (c *Config) ApplyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("yaml")
+		if value, ok := os.LookupEnv(EnvPrefix + strings.ToUpper(key)); ok {
+			if err := setField(v.Field(i), value); err != nil {
+				return fmt.Errorf("invalid %s%s: %v", EnvPrefix, strings.ToUpper(key), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Set sets key from a string like the command line flags do. Lists are
+// colon separated.
+func (c *Config) Set(key string, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("yaml") == key {
+			if err := setField(v.Field(i), value); err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown config key %q", key)
+}
+
+func setField(f reflect.Value, value string) error {
+	switch f.Interface().(type) {
+	case string:
+		f.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case []string:
+		var l []string
+		if value != "" {
+			l = strings.Split(value, ":")
+		}
+		f.Set(reflect.ValueOf(l))
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// MountOptions returns the mount options of the configuration, the
+// mountpoint is Root
+func (c *Config) MountOptions() (MountOptions, error) {
+	o, err := c.Options()
+	if err != nil {
+		return MountOptions{}, err
+	}
+	if c.MaxReadahead < 0 || int64(c.MaxReadahead) > math.MaxUint32 {
+		return MountOptions{}, fmt.Errorf("max readahead must be between 0 and %d", uint32(math.MaxUint32))
+	}
+	return MountOptions{
+		Options:      o,
+		Mountpoint:   c.Root,
+		VolumeName:   c.VolumeName,
+		AllowOther:   c.AllowOther,
+		AllowRoot:    c.AllowRoot,
+		MaxReadahead: uint32(c.MaxReadahead),
+		SyncRead:     !c.AsyncRead,
+		RequireEmpty: !c.NonEmpty,
+	}, nil
+}
+
+// Options returns the filesystem options of the configuration
+func (c *Config) Options() (Options, error) {
+	o := Options{
+		AttrTimeout:     c.AttrTimeout,
+		Lowers:          c.Lowers,
+		Mknod:           c.Mknod,
+		Hide:            c.Hide,
+		Show:            c.Show,
+		MaxXattrSize:    c.MaxXattrSize,
+		Watch:           c.Watch,
+		PersistXattrs:   c.PersistXattrs,
+		OpJournal:       c.OpJournal,
+		Dedup:           c.Dedup,
+		AsCaller:        c.AsCaller,
+		WritebackCache:  c.WritebackCache,
+		KeepCache:       c.KeepCache,
+		DirectIO:        c.DirectIO,
+		Executables:     c.Executables,
+		MaxOpenFiles:    c.MaxOpenFiles,
+		Serialize:       c.Serialize,
+		ReadAllMax:      c.ReadAllMax,
+		WriteCoalesce:   c.WriteCoalesce,
+		WriteFlushers:   c.WriteFlushers,
+		OcisMetadata:    c.OcisMetadata,
+		VerifyChecksums: c.VerifyChecksums,
+		Etags:           c.Etags,
+		TreeSize:        c.TreeSize,
+
+		PropagationDelay:   c.PropagationDelay,
+		NodeSweepInterval:  c.NodeSweep,
+		DefaultPermissions: c.DefaultPermissions,
+
+		Trash:        c.Trash,
+		TrashMaxAge:  c.TrashMaxAge,
+		TrashMaxSize: c.TrashMaxSize,
+
+		Versions:       c.Versions,
+		VersionsMax:    c.VersionsMax,
+		VersionsMaxAge: c.VersionsMaxAge,
+
+		BlockCacheSize:     c.BlockCacheSize,
+		BlockCacheDir:      c.BlockCacheDir,
+		BlockCacheDiskSize: c.BlockCacheDiskSize,
+		ReadAhead:          c.ReadAhead,
+		OfflineDir:         c.OfflineDir,
+
+		AuditLog:           c.AuditLog,
+		AuditMutationsOnly: c.AuditMutationsOnly,
+		AuditMaxSize:       c.AuditMaxSize,
+		AuditMaxFiles:      c.AuditMaxFiles,
+
+		OTLPEndpoint:    c.OTLPEndpoint,
+		SlowOpThreshold: c.SlowOpThreshold,
+		Record:          c.Record,
+	}
+	var err error
+	if o.Latency, err = ParseLatency(c.Latency); err != nil {
+		return o, err
+	}
+	o.Latency.Jitter = c.LatencyJitter
+	if o.Latency.Distribution, err = ParseDistribution(c.LatencyDistribution); err != nil {
+		return o, err
+	}
+	if o.Faults, err = ParseFaults(c.Faults); err != nil {
+		return o, err
+	}
+	if o.Space, err = ParseSpace(c.SpaceLimit); err != nil {
+		return o, err
+	}
+	if o.BackendFlakiness, err = ParseFlakiness(c.BackendFlakiness); err != nil {
+		return o, err
+	}
+	if o.BackendRetry, err = ParseRetry(c.BackendRetry); err != nil {
+		return o, err
+	}
+	if err = CheckPatterns(c.Hide); err != nil {
+		return o, err
+	}
+	if err = CheckPatterns(c.Show); err != nil {
+		return o, err
+	}
+	if o.Normalization, err = ParseNormalization(c.Normalize); err != nil {
+		return o, err
+	}
+	if o.UIDMap, err = ParseIDMap(c.UIDMap); err != nil {
+		return o, err
+	}
+	if o.GIDMap, err = ParseIDMap(c.GIDMap); err != nil {
+		return o, err
+	}
+	if c.Events != "" {
+		if o.Events, err = NewEventSink(c.Events); err != nil {
+			return o, err
+		}
+	}
+	if c.AVScan != "" {
+		if c.Backend != "" {
+			return o, fmt.Errorf("virus scans need a local mount")
+		}
+		if o.Scanner, err = NewScanner(c.AVScan); err != nil {
+			return o, err
+		}
+	}
+	if o.AVPolicy, err = ParseAVPolicy(c.AVPolicy); err != nil {
+		return o, err
+	}
+	if c.Backend != "" {
+		if len(c.Lowers) > 0 {
+			return o, fmt.Errorf("lower layers cannot be used with a backend")
+		}
+		creds, err := NewCredentials(c.BackendUser, c.BackendPassword, c.BackendToken)
+		if err != nil {
+			return o, err
+		}
+		if c.BackendRefreshToken != "" {
+			if c.BackendTokenURL == "" {
+				return o, fmt.Errorf("a refresh token needs a token endpoint")
+			}
+			if err = creds.SetRefresh(c.BackendTokenURL, c.BackendClientID, c.BackendRefreshToken); err != nil {
+				return o, err
+			}
+		}
+		if o.Backend, err = NewBackend(c.Backend, creds); err != nil {
+			return o, err
+		}
+		if c.BackendUsers != "" {
+			if !c.AllowOther {
+				return o, fmt.Errorf("a multi-user mount needs allow_other")
+			}
+			users, err := LoadUserCredentials(c.BackendUsers)
+			if err != nil {
+				return o, err
+			}
+			o.UserBackends = make(map[uint32]Backend, len(users))
+			for uid, uc := range users {
+				if o.UserBackends[uid], err = NewBackend(c.Backend, uc); err != nil {
+					return o, err
+				}
+			}
+		}
+	} else if c.BackendFlakiness != "" {
+		return o, fmt.Errorf("backend flakiness needs a backend")
+	} else if c.BackendUsers != "" {
+		return o, fmt.Errorf("backend users need a backend")
+	}
+	if o.XattrSecurity, err = ParseXattrPolicy(c.XattrSecurity); err != nil {
+		return o, err
+	}
+	if o.ConflictPolicy, err = ParseConflictPolicy(c.ConflictPolicy); err != nil {
+		return o, err
+	}
+	if o.Compression, err = ParseCompression(c.Compression); err != nil {
+		return o, err
+	}
+	o.CompressionExclude = ParseExtensions(c.CompressionExclude)
+	if c.EncryptionKey != "" {
+		if c.Backend != "" {
+			return o, fmt.Errorf("encryption needs a local mount")
+		}
+		key, err := ReadSecret(c.EncryptionKey)
+		if err != nil {
+			return o, err
+		}
+		if o.EncryptionKey, err = ParseMasterKey(key); err != nil {
+			return o, err
+		}
+		o.EncryptNames = c.EncryptNames
+	} else if c.EncryptNames {
+		return o, fmt.Errorf("encrypted names need an encryption key")
+	}
+	if o.EncryptNames && len(c.Lowers) > 0 {
+		return o, fmt.Errorf("encrypted names cannot be used with lower layers")
+	}
+	if c.VerifyChecksums && !c.OcisMetadata {
+		return o, fmt.Errorf("checksum verification needs the oCIS metadata, files written without it keep stale checksums")
+	}
+	if c.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.OTLPEndpoint); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			return o, fmt.Errorf("unsupported OTLP endpoint %q, expected http:// or https://", c.OTLPEndpoint)
+		}
+	}
+	if c.SlowOpThreshold < 0 {
+		return o, fmt.Errorf("slow operation threshold must not be negative")
+	}
+	if c.AuditMaxSize < 0 || c.AuditMaxFiles < 0 {
+		return o, fmt.Errorf("audit max size and files must not be negative")
+	}
+	if c.MaxXattrSize < 0 || c.MaxXattrSize > xattrSizeMax {
+		return o, fmt.Errorf("max xattr size must be between 0 and %d", xattrSizeMax)
+	}
+	switch XattrMode(c.XattrMode) {
+	case XattrPassthrough, XattrMemory:
+		o.XattrMode = XattrMode(c.XattrMode)
+	default:
+		return o, fmt.Errorf("unknown xattr mode %q", c.XattrMode)
+	}
+	return o, nil
+}
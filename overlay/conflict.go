@@ -0,0 +1,161 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// ConflictPolicy selects what a flush does with a file that was changed
+// behind the mount while it was open and written through it
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite lets the last writer win, the other change is lost
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictFail fails the flush with EBUSY. Remote changes that were
+	// never flushed are uploaded to a conflicted copy when the file is
+	// closed.
+	ConflictFail ConflictPolicy = "fail"
+	// ConflictCopy keeps both on remote mounts: the changes are uploaded to
+	// a conflicted copy next to the file instead of over the other change.
+	// Local mounts write in place, the conflict is only logged.
+	ConflictCopy ConflictPolicy = "copy"
+)
+
+// ParseConflictPolicy parses a policy, empty is ConflictOverwrite
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case "":
+		return ConflictOverwrite, nil
+	case ConflictOverwrite, ConflictFail, ConflictCopy:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// conflictName returns the name of the conflicted copy of p for a change
+// made at t, next to p
+func conflictName(p string, t time.Time) string {
+	ext := path.Ext(p)
+	if strings.HasPrefix(path.Base(p), ".") && path.Base(p) == ext {
+		ext = ""
+	}
+	return strings.TrimSuffix(p, ext) + " (conflicted copy " + t.Format("2006-01-02 150405") + ")" + ext
+}
+
+// baseVersion returns the version of the remote file a local copy of n is
+// made from. It is looked up in the backend when conflicts are checked, the
+// cached info may be older than the content that is downloaded.
+func (n *remoteNode) baseVersion(ctx context.Context) string {
+	if n.fs.conflictPolicy != ConflictOverwrite && !n.fs.isOffline() {
+		n.invalidate()
+		if fi, err := n.info(ctx); err == nil {
+			return version(fi)
+		}
+	}
+	if fi := n.cachedInfo(); fi != nil {
+		return version(fi)
+	}
+	return ""
+}
+
+// target returns the path the local copy of h is uploaded to: the file,
+// or its conflicted copy if the file changed in the backend since the copy
+// was made. final is set for the last upload of the handle, a conflict
+// fails the others with EBUSY under ConflictFail. h.lock must be held.
+func (h *remoteHandle) target(ctx context.Context, final bool) (string, error) {
+	f, p := h.node.fs, h.node.path()
+	if h.conflict != "" {
+		return h.conflict, nil
+	}
+	if f.conflictPolicy == ConflictOverwrite || h.base == "" {
+		return p, nil
+	}
+	var remote os.FileInfo
+	err := f.retry(ctx, RetryRead, "stat", p, func() (err error) {
+		remote, err = h.node.backend.Stat(ctx, p)
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) && errnoOf(err) != syscall.ENOENT {
+		return "", err
+	}
+	// a file removed in the backend is created again
+	if remote == nil || remote.IsDir() || version(remote) == h.base {
+		return p, nil
+	}
+	if f.conflictPolicy == ConflictFail && !final {
+		loog.Warn(logRemote, "file changed in the backend, failing the flush", "path", p)
+		return "", fuse.Errno(syscall.EBUSY)
+	}
+	h.conflict = conflictName(p, time.Now())
+	loog.Warn(logRemote, "file changed in the backend, uploading to a conflicted copy", "path", p, "conflict", h.conflict)
+	return h.conflict, nil
+}
+
+// uploaded records that the local copy of h was uploaded to target, h.lock
+// must be held
+func (h *remoteHandle) uploaded(ctx context.Context, target string) {
+	n := h.node
+	if target != n.path() {
+		n.fs.rtree.RLock()
+		parent := n.parent
+		n.fs.rtree.RUnlock()
+		if parent != nil {
+			parent.invalidate()
+		}
+		return
+	}
+	n.invalidate()
+	if n.fs.conflictPolicy == ConflictOverwrite {
+		return
+	}
+	// the upload is the base of the next one
+	h.base = ""
+	if fi, err := n.info(ctx); err == nil {
+		h.base = version(fi)
+	}
+}
+
+// conflicted reports whether the backing file of h was changed behind the
+// mount since h was opened or last flushed, after h wrote to it. Changes
+// are noticed by the mtime and size of the file, with -watch as soon as
+// they happen, otherwise on the next flush.
+func (h *Handle) conflicted(file File) bool {
+	if h.fs.conflictPolicy == ConflictOverwrite || h.node == nil || atomic.LoadInt32(&h.written) == 0 {
+		return false
+	}
+	if fi, err := file.Stat(); err == nil {
+		h.node.checkData(fi)
+	}
+	h.node.alock.Lock()
+	defer h.node.alock.Unlock()
+	if h.node.foreign == h.seen {
+		return false
+	}
+	h.seen = h.node.foreign
+	return true
+}
+
+// resolveConflict applies the conflict policy to the flush of h. The writes
+// of a handle go to the backing file in place, so only ConflictFail can
+// keep the other change from being mixed with them: it fails the flush
+// with EBUSY. The other policies log the conflict.
+func (h *Handle) resolveConflict() error {
+	if h.fs.conflictPolicy == ConflictFail {
+		loog.Warn(logIO, "file changed behind the mount, failing the flush", "path", h.name)
+		return fuse.Errno(syscall.EBUSY)
+	}
+	loog.Warn(logIO, "file changed behind the mount while it was written", "path", h.name)
+	return nil
+}
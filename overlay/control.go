@@ -0,0 +1,327 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// Control commands accepted on the control socket
+const (
+	// CmdLatency replaces the latency with a -latency spec, Jitter and
+	// Distribution are kept unless given as "spec jitter distribution"
+	CmdLatency = "latency"
+	// CmdFaults replaces the injected faults with a -faults spec. "off"
+	// pauses fault injection, "on" resumes it.
+	CmdFaults = "faults"
+	// CmdSpace replaces the simulated space with a -space-limit spec and
+	// starts counting the written bytes again, "off" disables it
+	CmdSpace = "space"
+	// CmdKill arms a kill point given as point[:n], the process kills
+	// itself the nth time it passes it. "off" disarms it.
+	CmdKill = "kill"
+	// CmdFlakiness replaces the simulated network flakiness of a remote
+	// backend with a -backend-flakiness spec, "off" disables it
+	CmdFlakiness = "flakiness"
+	// CmdFlush drops all cached attributes, listings and pages
+	CmdFlush = "flush"
+	// CmdNodes lists the nodes known to the kernel
+	CmdNodes = "nodes"
+	// CmdMetrics returns the size of the node table
+	CmdMetrics = "metrics"
+	// CmdUploads lists the running uploads to a remote backend
+	CmdUploads = "uploads"
+	// CmdTrash lists the trash of the uid given as value
+	CmdTrash = "trash"
+	// CmdRestore restores an entry from the trash, the value is the uid and
+	// the name of the entry in the .trash directory separated by a space
+	CmdRestore = "restore"
+	// CmdToken replaces the token of a remote backend with a -backend-token
+	// spec, "refresh" or no value refreshes it with the refresh token. On a
+	// multi-user mount "uid spec" replaces the token of a user.
+	CmdToken = "token"
+	// CmdSnapshot manages the snapshots of the upper layer: "create NAME",
+	// "delete NAME" or "list"
+	CmdSnapshot = "snapshot"
+	// CmdDedup returns the counters of the content deduplication
+	CmdDedup = "dedup"
+	// CmdHealth checks the mount and the remote backend, see Health
+	CmdHealth = "health"
+	// CmdUnmount unmounts the filesystem, fs.Serve returns once in-flight
+	// requests are done
+	CmdUnmount = "unmount"
+)
+
+// ControlRequest is a command sent to the control socket, one JSON object
+// per line
+type ControlRequest struct {
+	Command string `json:"command"`
+	Value   string `json:"value,omitempty"`
+}
+
+// ControlResponse answers a ControlRequest, one JSON object per line
+type ControlResponse struct {
+	Error     string         `json:"error,omitempty"`
+	Nodes     []NodeInfo     `json:"nodes,omitempty"`
+	Metrics   *Metrics       `json:"metrics,omitempty"`
+	Uploads   []UploadInfo   `json:"uploads,omitempty"`
+	Health    *Health        `json:"health,omitempty"`
+	Trash     []TrashInfo    `json:"trash,omitempty"`
+	Snapshots []SnapshotInfo `json:"snapshots,omitempty"`
+	Dedup     *DedupStats    `json:"dedup,omitempty"`
+}
+
+// Metrics are counters of a running overlay
+type Metrics struct {
+	// Nodes known to the kernel and the Paths they have
+	Nodes int `json:"nodes"`
+	Paths int `json:"paths"`
+	// SweptNodes counts the paths dropped because they vanished from the
+	// backing store
+	SweptNodes uint64 `json:"swept_nodes"`
+	// Offline is set while the remote backend is unreachable, Queued counts
+	// the changes waiting for it
+	Offline bool `json:"offline,omitempty"`
+	Queued  int  `json:"queued,omitempty"`
+	// ChecksumMismatches counts the files that did not match their
+	// checksums with -verify-checksums
+	ChecksumMismatches uint64 `json:"checksum_mismatches,omitempty"`
+	// Antivirus are the counters of -av-scan
+	Antivirus *AVStats `json:"antivirus,omitempty"`
+}
+
+// NodeInfo describes a node known to the kernel
+type NodeInfo struct {
+	Path       string   `json:"path"`
+	LowerPaths []string `json:"lower_paths,omitempty"`
+	Inode      uint64   `json:"inode"`
+	Dir        bool     `json:"dir"`
+}
+
+// UploadInfo describes a running upload to a remote backend
+type UploadInfo struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Uploaded int64     `json:"uploaded"`
+	Started  time.Time `json:"started"`
+}
+
+// ServeControl answers control requests on l until it is closed. unmount is
+// called for CmdUnmount.
+func (f *FS) ServeControl(l net.Listener, unmount func() error) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go f.serveControlConn(c, unmount)
+	}
+}
+
+func (f *FS) serveControlConn(c net.Conn, unmount func() error) {
+	defer c.Close()
+	enc := json.NewEncoder(c)
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		var req ControlRequest
+		var resp ControlResponse
+		if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+			resp.Error = err.Error()
+		} else if resp, err = f.control(req, unmount); err != nil {
+			resp.Error = err.Error()
+		}
+		value := req.Value
+		if req.Command == CmdToken {
+			value = redactToken(value)
+		}
+		loog.Info(logControl, "command", "command", req.Command, "value", value, "error", resp.Error)
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (f *FS) control(req ControlRequest, unmount func() error) (resp ControlResponse, err error) {
+	switch req.Command {
+	case CmdLatency:
+		err = f.setLatency(req.Value)
+	case CmdFaults:
+		err = f.setFaults(req.Value)
+	case CmdSpace:
+		err = f.setSpace(req.Value)
+	case CmdKill:
+		err = f.setKillPoint(req.Value)
+	case CmdFlakiness:
+		err = f.setFlakiness(req.Value)
+	case CmdFlush:
+		f.flush()
+	case CmdNodes:
+		resp.Nodes = f.nodeInfos()
+	case CmdMetrics:
+		resp.Metrics = f.metrics()
+	case CmdUploads:
+		resp.Uploads = f.uploads.infos()
+	case CmdTrash, CmdRestore:
+		resp.Trash, err = f.controlTrash(req)
+	case CmdToken:
+		err = f.setToken(req.Value)
+	case CmdSnapshot:
+		resp.Snapshots, err = f.controlSnapshot(req.Value)
+	case CmdDedup:
+		if resp.Dedup = f.dedupStats(); resp.Dedup == nil {
+			err = fmt.Errorf("dedup is disabled")
+		}
+	case CmdHealth:
+		ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+		h := f.Health(ctx)
+		cancel()
+		resp.Health = &h
+	case CmdUnmount:
+		err = unmount()
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+	return resp, err
+}
+
+// controlTrash lists the trash of a user or restores an entry of it
+func (f *FS) controlTrash(req ControlRequest) ([]TrashInfo, error) {
+	if !f.trash {
+		return nil, fmt.Errorf("the trash is disabled")
+	}
+	fields := strings.SplitN(req.Value, " ", 2)
+	uid, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %q", fields[0])
+	}
+	if req.Command == CmdTrash {
+		return f.trashInfos(uint32(uid)), nil
+	}
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid restore %q, expected uid name", req.Value)
+	}
+	return nil, f.restoreTrash(uint32(uid), fields[1])
+}
+
+// controlSnapshot creates, deletes or lists snapshots
+func (f *FS) controlSnapshot(value string) ([]SnapshotInfo, error) {
+	fields := strings.Fields(value)
+	switch {
+	case len(fields) == 1 && fields[0] == "list":
+		return f.snapshotInfos(), nil
+	case len(fields) == 2 && fields[0] == "create":
+		return nil, f.createSnapshot(context.Background(), fields[1])
+	case len(fields) == 2 && fields[0] == "delete":
+		return nil, f.deleteSnapshot(fields[1])
+	}
+	return nil, fmt.Errorf("invalid snapshot command %q, expected create NAME, delete NAME or list", value)
+}
+
+func (f *FS) setLatency(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 3 {
+		return fmt.Errorf("invalid latency %q, expected spec [jitter [distribution]]", value)
+	}
+	l, err := ParseLatency(fields[0])
+	if err != nil {
+		return err
+	}
+	f.ctl.Lock()
+	defer f.ctl.Unlock()
+	l.Jitter = f.latency.Jitter
+	l.Distribution = f.latency.Distribution
+	if len(fields) > 1 {
+		if l.Jitter, err = time.ParseDuration(fields[1]); err != nil {
+			return err
+		}
+	}
+	if len(fields) > 2 {
+		if l.Distribution, err = ParseDistribution(fields[2]); err != nil {
+			return err
+		}
+	}
+	f.latency = l
+	return nil
+}
+
+func (f *FS) setFaults(value string) error {
+	f.ctl.Lock()
+	defer f.ctl.Unlock()
+	switch value {
+	case "off":
+		f.faultsEnabled = false
+	case "on":
+		f.faultsEnabled = true
+	default:
+		faults, err := ParseFaults(value)
+		if err != nil {
+			return err
+		}
+		f.faultList = faults
+		f.faultsEnabled = true
+	}
+	if f.faultsEnabled {
+		f.faults = newFaultInjectors(f.faultList)
+	} else {
+		f.faults = nil
+	}
+	return nil
+}
+
+// flush drops the cached attributes and directory listings of all nodes and
+// asks the kernel to drop their cached pages
+func (f *FS) flush() {
+	f.listings.lock.Lock()
+	f.listings.dirs = nil
+	f.listings.lock.Unlock()
+	for _, n := range f.registry.all() {
+		n.invalidateAttr()
+		if !n.isDir {
+			f.invalidateData(n)
+		}
+	}
+	f.blocks.reset()
+	for _, root := range f.remoteRoots() {
+		root.invalidateTree()
+	}
+}
+
+func (f *FS) metrics() *Metrics {
+	m := &Metrics{SweptNodes: atomic.LoadUint64(&f.sweptNodes)}
+	m.Nodes, m.Paths = f.registry.count()
+	m.ChecksumMismatches = f.checksumMismatches()
+	m.Antivirus = f.avStats()
+	if f.offline != nil {
+		m.Offline = f.isOffline()
+		f.offline.lock.Lock()
+		m.Queued = len(f.offline.entries)
+		f.offline.lock.Unlock()
+	}
+	return m
+}
+
+func (f *FS) nodeInfos() []NodeInfo {
+	nodes := f.registry.all()
+	infos := make([]NodeInfo, 0, len(nodes))
+	for _, n := range nodes {
+		infos = append(infos, NodeInfo{
+			Path:       n.getRealPath(),
+			LowerPaths: n.getLowerPaths(),
+			Inode:      n.inode,
+			Dir:        n.isDir,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+	return infos
+}
@@ -8,14 +8,47 @@ package overlay
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"os"
+	"os/exec"
 	"syscall"
 	"time"
 
 	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+	"golang.org/x/sys/unix"
 )
 
+// openDirFlags open a directory only to use it with the *at syscalls
+const openDirFlags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_CLOEXEC
+
+// lstatAt returns the file info of name in the directory dfd. Darwin has no
+// O_PATH to get a descriptor for a symlink itself, so p is stat'ed instead.
+func lstatAt(dfd int, p string, name string) (os.FileInfo, error) {
+	return os.Lstat(p)
+}
+
+// openDirect is O_DIRECT in fuse.OpenFlags, darwin has no O_DIRECT and uses
+// F_NOCACHE on an open fd instead
+const openDirect = fuse.OpenFlags(0)
+
+// openExec is 0, darwin does not tell opens for exec apart
+const openExec = fuse.OpenFlags(0)
+
+// fillStatfs fills resp with the statfs of the backing file system. The
+// block counts are in units of f_bsize, which statvfs reports as f_frsize,
+// f_iosize is the preferred I/O size. Names are limited to MAXNAMLEN.
+func fillStatfs(resp *fuse.StatfsResponse, s *syscall.Statfs_t) {
+	resp.Blocks = s.Blocks
+	resp.Bfree = s.Bfree
+	resp.Bavail = s.Bavail
+	resp.Files = s.Files
+	resp.Ffree = s.Ffree
+	resp.Bsize = uint32(s.Iosize)
+	resp.Namelen = 255
+	resp.Frsize = s.Bsize
+}
+
 func fillAttrWithFileInfo(a *fuse.Attr, fi os.FileInfo) {
 	s := fi.Sys().(*syscall.Stat_t)
 	a.Valid = attrValidDuration
@@ -30,17 +63,95 @@ func fillAttrWithFileInfo(a *fuse.Attr, fi os.FileInfo) {
 	a.Nlink = uint32(s.Nlink)
 	a.Uid = s.Uid
 	a.Gid = s.Gid
+	a.Rdev = uint32(s.Rdev)
 	a.Flags = s.Flags
 	a.BlockSize = uint32(s.Blksize)
 }
 
+// utimens sets the access and modification times of p, nil times are left
+// unchanged. Darwin has no UTIME_OMIT in the syscall package, so missing
+// times are read from the file first.
+func utimens(p string, atime *time.Time, mtime *time.Time) error {
+	if atime == nil || mtime == nil {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		s := fi.Sys().(*syscall.Stat_t)
+		if atime == nil {
+			t := time.Unix(s.Atimespec.Unix())
+			atime = &t
+		}
+		if mtime == nil {
+			t := time.Unix(s.Mtimespec.Unix())
+			mtime = &t
+		}
+	}
+	return os.Chtimes(p, *atime, *mtime)
+}
+
 func (n *Node) setattrPlatformSpecific(ctx context.Context,
 	req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
 	if req.Valid.Flags() {
-		log.Printf("Flags: %x", req.Flags)
+		loog.Debug(logAttr, "Setattr flags", "path", n.realPath, "flags", req.Flags)
 		if err = syscall.Chflags(n.realPath, int(req.Flags)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// watcher is not supported on darwin, it has no inotify
+type watcher struct{}
+
+func newWatcher() (*watcher, error) {
+	return nil, fmt.Errorf("watching the backing store needs inotify, it is only supported on linux")
+}
+
+func (w *watcher) add(p string)                              {}
+func (w *watcher) remove(p string)                           {}
+func (w *watcher) rename(oldPath string, newPath string)     {}
+func (w *watcher) run(changed func(dir string, name string)) {}
+
+// keyringCommand returns the command printing the secret of account in the
+// keyring, the login keychain
+func keyringCommand(account string) *exec.Cmd {
+	return exec.Command("security", "find-generic-password", "-s", keyringService, "-a", account, "-w")
+}
+
+// reflink is not supported, clonefile(2) creates the clone itself and is
+// not available to the overlay
+func reflink(dst *os.File, src *os.File) error {
+	return syscall.ENOTSUP
+}
+
+// dedupe is not supported, the file systems of macOS cannot share the data
+// of existing files
+func dedupe(dst *os.File, src *os.File, size int64) (int64, error) {
+	return 0, syscall.ENOTSUP
+}
+
+// memFile is not supported, darwin has no memfd_create and a shm_open
+// object cannot be opened by path
+func memFile(name string) (*os.File, string, error) {
+	return nil, "", os.NewSyscallError("memfd_create", syscall.ENOTSUP)
+}
+
+// smbMounts returns the mounted SMB shares from the mount table
+func smbMounts() ([]smbMount, error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+	fss := make([]unix.Statfs_t, n)
+	if n, err = unix.Getfsstat(fss, unix.MNT_NOWAIT); err != nil {
+		return nil, err
+	}
+	var mounts []smbMount
+	for _, fs := range fss[:n] {
+		if unix.ByteSliceToString(fs.Fstypename[:]) == "smbfs" {
+			mounts = append(mounts, smbMount{source: unix.ByteSliceToString(fs.Mntfromname[:]), dir: unix.ByteSliceToString(fs.Mntonname[:])})
+		}
+	}
+	return mounts, nil
+}
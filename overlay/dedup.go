@@ -0,0 +1,242 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+const (
+	// dedupIndexFile is the file below the metaDir the content index is
+	// persisted in
+	dedupIndexFile = "dedup.json"
+	// dedupMinSize skips smaller files, they fit into a block or two
+	dedupMinSize = 4096
+	// dedupQueue is how many written files may wait for the deduplicator,
+	// more are not deduplicated
+	dedupQueue = 1024
+	// dedupSaveDelay collects index changes for this long before they are
+	// written
+	dedupSaveDelay = 5 * time.Second
+)
+
+// DedupStats are the counters of the content deduplication
+type DedupStats struct {
+	// Indexed is the number of distinct contents in the index
+	Indexed int `json:"indexed"`
+	// Hashed counts the files hashed after they were written
+	Hashed uint64 `json:"hashed"`
+	// Deduplicated counts the files that share the data of an indexed file
+	// with the same content, BytesSaved the bytes they share
+	Deduplicated uint64 `json:"deduplicated"`
+	BytesSaved   uint64 `json:"bytes_saved"`
+	// Unsupported counts the files whose data the file system could not
+	// share
+	Unsupported uint64 `json:"unsupported"`
+}
+
+// dedupEntry is a file of the upper layer with an indexed content
+type dedupEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// persistedDedup is the dedupIndexFile
+type persistedDedup struct {
+	Index map[string]dedupEntry `json:"index"`
+	Stats DedupStats            `json:"stats"`
+}
+
+// deduper indexes the files written to the upper layer of a local mount by
+// the sha256 of their content. A file with the same content as an indexed
+// one shares its data, see dedupFile.
+type deduper struct {
+	lock  sync.Mutex
+	index map[string]dedupEntry
+	stats DedupStats
+	queue chan string
+	save  *time.Timer
+}
+
+// startDedup loads the index of an earlier mount and starts the deduplicator
+func (f *FS) startDedup() {
+	d := &deduper{index: make(map[string]dedupEntry), queue: make(chan string, dedupQueue)}
+	b, err := ioutil.ReadFile(f.metaPath(dedupIndexFile))
+	if err == nil {
+		var p persistedDedup
+		if err = json.Unmarshal(b, &p); err == nil && p.Index != nil {
+			d.index, d.stats = p.Index, p.Stats
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		loog.Error(logFS, "could not load the dedup index", "path", f.metaPath(dedupIndexFile), "error", err)
+	}
+	f.dedup = d
+	go func() {
+		for p := range d.queue {
+			f.dedupFile(p)
+		}
+	}()
+}
+
+// queueDedup hands the file at the upper path p to the deduplicator once it
+// was written
+func (f *FS) queueDedup(p string) {
+	if f.dedup == nil {
+		return
+	}
+	select {
+	case f.dedup.queue <- p:
+	default:
+		loog.Debug(logFS, "dedup queue full, skipping file", "path", p)
+	}
+}
+
+// dedupFile indexes the content of the file at p or, if a file with the
+// same content is indexed, makes p share its data with the FIDEDUPERANGE
+// ioctl. The kernel compares the data before it shares it, so files that
+// changed since they were hashed keep their content; the index entry is
+// replaced then. Inodes, metadata and xattrs stay as they are, hard links
+// would share those.
+func (f *FS) dedupFile(p string) {
+	d := f.dedup
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() < dedupMinSize {
+		return
+	}
+	sum, err := hashFile(p)
+	if err != nil {
+		loog.Debug(logFS, "could not hash file for dedup", "path", p, "error", err)
+		return
+	}
+	d.lock.Lock()
+	d.stats.Hashed++
+	e, ok := d.index[sum]
+	d.lock.Unlock()
+	if ok && e.Path == p {
+		return
+	}
+	var shared int64
+	if ok && e.Size == fi.Size() {
+		shared, err = dedupPaths(p, e.Path, fi)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	switch {
+	case err == nil && shared == fi.Size():
+		d.stats.Deduplicated++
+		d.stats.BytesSaved += uint64(shared)
+		loog.Debug(logFS, "deduplicated file", "path", p, "source", e.Path, "bytes", shared)
+	case err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP || err == syscall.EINVAL || err == syscall.EXDEV:
+		d.stats.Unsupported++
+	case err != nil && !os.IsNotExist(err):
+		loog.Debug(logFS, "could not deduplicate file", "path", p, "source", e.Path, "error", err)
+		return
+	default:
+		// new content, or the indexed file changed or is gone: p takes its
+		// place
+		d.index[sum] = dedupEntry{Path: p, Size: fi.Size()}
+	}
+	f.dedupChanged()
+}
+
+// dedupPaths makes the file at p share the data of the file at src, fi is
+// the info of p. It returns the bytes shared.
+func dedupPaths(p string, src string, fi os.FileInfo) (int64, error) {
+	sfi, err := os.Lstat(src)
+	if err != nil {
+		return 0, err
+	}
+	if os.SameFile(fi, sfi) || !sfi.Mode().IsRegular() {
+		return 0, nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	// the owner of a file may share its data without opening it for writing
+	out, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	return dedupe(out, in, fi.Size())
+}
+
+// hashFile returns the hex sha256 of the content of the file at p
+func hashFile(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dedupChanged schedules writing the index, f.dedup.lock must be held
+func (f *FS) dedupChanged() {
+	if f.dedup.save == nil {
+		f.dedup.save = time.AfterFunc(dedupSaveDelay, f.saveDedup)
+	}
+}
+
+// saveDedup writes the index and the counters if they changed, through a
+// temporary file like saveXattrs
+func (f *FS) saveDedup() {
+	d := f.dedup
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	if d.save == nil {
+		d.lock.Unlock()
+		return
+	}
+	d.save.Stop()
+	d.save = nil
+	b, err := json.Marshal(persistedDedup{Index: d.index, Stats: d.stats})
+	d.lock.Unlock()
+
+	p := f.metaPath(dedupIndexFile)
+	if err == nil {
+		err = os.MkdirAll(f.metaPath(), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(p+".tmp", b, 0600)
+	}
+	if err == nil {
+		err = os.Rename(p+".tmp", p)
+	}
+	if err != nil {
+		loog.Error(logFS, "could not persist the dedup index", "path", p, "error", err)
+	}
+}
+
+// dedupStats returns the counters of the deduplication, nil if it is
+// disabled
+func (f *FS) dedupStats() *DedupStats {
+	d := f.dedup
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := d.stats
+	s.Indexed = len(d.index)
+	return &s
+}
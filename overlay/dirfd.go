@@ -0,0 +1,140 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// In passthrough mode operations on the entries of a directory go through
+// the directory opened in the store, for osStore a descriptor and the *at
+// syscalls. They keep working on the same directory when it is renamed or
+// replaced in the backing store while the operation runs, building paths
+// from getRealPath would hit whatever is at the path then. The layers of an
+// overlay are resolved by path.
+
+// openDir returns the directory node opened in the store, it is opened on
+// first use and closed when the kernel forgets the node. If ok, it stays
+// open until releaseDir, a forget racing with a lookup that returns the
+// node again must not close it under a request using it.
+func (n *Node) openDir() (d StoreDir, ok bool) {
+	if !n.isDir || n.fs.overlay() {
+		return nil, false
+	}
+	n.dlock.RLock()
+	for n.dir == nil {
+		n.dlock.RUnlock()
+		n.dlock.Lock()
+		if n.dir == nil {
+			d, err := n.fs.store.OpenDir(n.getRealPath())
+			if err != nil {
+				n.dlock.Unlock()
+				return nil, false
+			}
+			n.dir = d
+		}
+		n.dlock.Unlock()
+		n.dlock.RLock()
+	}
+	return n.dir, true
+}
+
+// releaseDir ends the use of the directory returned by openDir
+func (n *Node) releaseDir() {
+	n.dlock.RUnlock()
+}
+
+func (n *Node) closeDir() {
+	n.dlock.Lock()
+	defer n.dlock.Unlock()
+	if n.dir != nil {
+		n.dir.Close()
+		n.dir = nil
+	}
+}
+
+// openChild opens name in the directory node n
+func (n *Node) openChild(name string, flags int, perm os.FileMode) (File, error) {
+	p := filepath.Join(n.getRealPath(), name)
+	d, ok := n.openDir()
+	if !ok {
+		return n.fs.store.OpenFile(p, flags, perm)
+	}
+	defer n.releaseDir()
+	return d.OpenFile(name, p, flags, perm)
+}
+
+// lstatChild returns the file info of name in the directory node n
+func (n *Node) lstatChild(name string) (os.FileInfo, error) {
+	p := filepath.Join(n.getRealPath(), name)
+	d, ok := n.openDir()
+	if !ok {
+		return n.fs.store.Lstat(p)
+	}
+	defer n.releaseDir()
+	return d.Lstat(name, p)
+}
+
+func (n *Node) mkdirChild(name string, mode os.FileMode) error {
+	p := filepath.Join(n.getRealPath(), name)
+	d, ok := n.openDir()
+	if !ok {
+		return n.fs.store.Mkdir(p, mode)
+	}
+	defer n.releaseDir()
+	return d.Mkdir(name, p, mode)
+}
+
+func (n *Node) symlinkChild(target string, name string) error {
+	p := filepath.Join(n.getRealPath(), name)
+	d, ok := n.openDir()
+	if !ok {
+		return n.fs.store.Symlink(target, p)
+	}
+	defer n.releaseDir()
+	return d.Symlink(target, name, p)
+}
+
+// linkChild creates name in the directory node n as a hard link to oldPath
+func (n *Node) linkChild(oldPath string, name string) error {
+	p := filepath.Join(n.getRealPath(), name)
+	d, ok := n.openDir()
+	if !ok {
+		return n.fs.store.Link(oldPath, p)
+	}
+	defer n.releaseDir()
+	return d.Link(oldPath, name, p)
+}
+
+// removeChild removes the empty directory name if dir is set, like rmdir,
+// and the file name otherwise, like unlink
+func (n *Node) removeChild(name string, dir bool) error {
+	p := filepath.Join(n.getRealPath(), name)
+	d, ok := n.openDir()
+	if !ok {
+		return n.fs.store.Remove(p, dir)
+	}
+	defer n.releaseDir()
+	return d.Remove(name, p, dir)
+}
+
+// renameChild renames oldName in n to newName in the directory node newDir
+func (n *Node) renameChild(oldName string, newDir *Node, newName string) error {
+	op := filepath.Join(n.getRealPath(), oldName)
+	np := filepath.Join(newDir.getRealPath(), newName)
+	od, ok := n.openDir()
+	if !ok {
+		return n.fs.store.Rename(op, np)
+	}
+	defer n.releaseDir()
+	nd := od
+	if newDir != n {
+		// read locking the same node twice could deadlock with a forget
+		if nd, ok = newDir.openDir(); !ok {
+			return n.fs.store.Rename(op, np)
+		}
+		defer newDir.releaseDir()
+	}
+	return od.Rename(oldName, op, nd, newName)
+}
@@ -0,0 +1,322 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+const (
+	// keyAttr holds the key of an encrypted file, wrapped by the master key
+	keyAttr = overlayXattrPrefix + "key"
+	// cipherAES256GCM is the codec of encrypted files in their mark
+	cipherAES256GCM = "aes-256-gcm"
+	// sealChunk is the size of the plaintext sealed at a time
+	sealChunk = 64 << 10
+)
+
+// ParseMasterKey parses a master key of 64 hex digits, e.g. from
+// openssl rand -hex 32
+func ParseMasterKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("the encryption key must be 64 hex digits")
+	}
+	return key, nil
+}
+
+// encryption encrypts the content of files with a random key per file that
+// is stored wrapped by the master key, and optionally their names
+type encryption struct {
+	master cipher.AEAD
+	// names encrypts names, nil if they are not encrypted. nameMAC is the
+	// key their nonces are derived with.
+	names   cipher.AEAD
+	nameMAC []byte
+}
+
+// newEncryption returns the encryption with the master key
+func newEncryption(key []byte, names bool) (*encryption, error) {
+	e := &encryption{}
+	var err error
+	if e.master, err = newGCM(subKey(key, "file keys")); err != nil {
+		return nil, err
+	}
+	if names {
+		if e.names, err = newGCM(subKey(key, "names")); err != nil {
+			return nil, err
+		}
+		e.nameMAC = subKey(key, "name nonces")
+	}
+	return e, nil
+}
+
+// subKey derives the key for purpose from the master key
+func subKey(key []byte, purpose string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(purpose))
+	return m.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// sealer returns a writer that encrypts to w with a new file key and the
+// key wrapped by the master key
+func (e *encryption) sealer(w io.Writer) (io.WriteCloser, []byte, error) {
+	key := make([]byte, 32)
+	nonce := make([]byte, e.master.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped := e.master.Seal(nonce, nonce, key, []byte(keyAttr))
+	return &sealWriter{w: w, aead: aead, buf: make([]byte, 0, sealChunk)}, wrapped, nil
+}
+
+// opener returns a reader that decrypts r with the file key wrapped, as
+// stored in keyAttr
+func (e *encryption) opener(r io.Reader, stored []byte) (io.Reader, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(string(stored))
+	if err != nil || len(wrapped) < e.master.NonceSize() {
+		return nil, fmt.Errorf("invalid file key")
+	}
+	n := e.master.NonceSize()
+	key, err := e.master.Open(nil, wrapped[:n], wrapped[n:], []byte(keyAttr))
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap the file key, wrong encryption key?")
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{r: bufio.NewReaderSize(r, sealChunk+aead.Overhead()), aead: aead}, nil
+}
+
+// chunkNonce returns the nonce of chunk i, every file key seals one file
+// only
+func chunkNonce(aead cipher.AEAD, i uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], i)
+	return nonce
+}
+
+// the additional data of a chunk tells whether it is the last one, so
+// truncating a file at a chunk boundary is detected
+var (
+	chunkMore = []byte{0}
+	chunkLast = []byte{1}
+)
+
+// sealWriter encrypts chunks of sealChunk bytes, the last one on Close
+type sealWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64
+}
+
+func (s *sealWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		// a full chunk is only sealed once more data follows, the last
+		// chunk is sealed by Close
+		if len(s.buf) == sealChunk {
+			if err := s.seal(chunkMore); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):sealChunk], b)
+		s.buf = s.buf[:len(s.buf)+n]
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealWriter) seal(ad []byte) error {
+	_, err := s.w.Write(s.aead.Seal(nil, chunkNonce(s.aead, s.chunk), s.buf, ad))
+	s.chunk++
+	s.buf = s.buf[:0]
+	return err
+}
+
+func (s *sealWriter) Close() error {
+	return s.seal(chunkLast)
+}
+
+// openReader decrypts the chunks written by a sealWriter
+type openReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64
+	done  bool
+}
+
+func (o *openReader) Read(b []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *openReader) open() error {
+	sealed := make([]byte, sealChunk+o.aead.Overhead())
+	n, err := io.ReadFull(o.r, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	ad := chunkMore
+	if _, perr := o.r.Peek(1); perr == io.EOF {
+		ad, o.done = chunkLast, true
+	}
+	o.buf, err = o.aead.Open(sealed[:0], chunkNonce(o.aead, o.chunk), sealed[:n], ad)
+	if err != nil {
+		return fmt.Errorf("encrypted file is corrupt or truncated")
+	}
+	o.chunk++
+	return nil
+}
+
+// encryptName returns the name a file named name is stored under. Equal
+// names encrypt to equal names, the nonce is derived from the name.
+func (e *encryption) encryptName(name string) string {
+	m := hmac.New(sha256.New, e.nameMAC)
+	m.Write([]byte(name))
+	nonce := m.Sum(nil)[:e.names.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(e.names.Seal(nonce, nonce, []byte(name), nil))
+}
+
+// decryptName returns the name of the file stored as name, ok is false
+// for names that are not encrypted
+func (e *encryption) decryptName(name string) (string, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(name)
+	n := e.names.NonceSize()
+	if err != nil || len(b) < n {
+		return "", false
+	}
+	plain, err := e.names.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", false
+	}
+	return string(plain), true
+}
+
+// storedName returns the name name is stored under in the directory dir.
+// The names the overlay reserves in the root and the suffix of version
+// directories stay as they are.
+func (f *FS) storedName(dir string, name string) string {
+	e := f.nameEncryption()
+	if e == nil {
+		return name
+	}
+	if f.reservedName(dir, name) {
+		return name
+	}
+	if f.versions && strings.HasSuffix(name, versionsSuffix) {
+		return e.encryptName(strings.TrimSuffix(name, versionsSuffix)) + versionsSuffix
+	}
+	return e.encryptName(name)
+}
+
+// nameMax is NAME_MAX of the backing file systems of Linux and macOS
+const nameMax = 255
+
+// storedNameMax returns the longest name an encrypted name may have to fit
+// into names of namelen bytes, the versions directory of a file appends a
+// suffix to it
+func (f *FS) storedNameMax(namelen int) int {
+	if f.versions {
+		return namelen - len(versionsSuffix)
+	}
+	return namelen
+}
+
+// plainNameMax returns the longest name a new entry may have if the backing
+// file system stores names of namelen bytes. Encrypted names carry a nonce
+// and a tag and are base64 encoded.
+func (f *FS) plainNameMax(namelen uint32) uint32 {
+	e := f.nameEncryption()
+	if e == nil {
+		return namelen
+	}
+	raw := f.storedNameMax(int(namelen))*6/8 - e.names.NonceSize() - e.names.Overhead()
+	if raw < 0 {
+		return 0
+	}
+	return uint32(raw)
+}
+
+// reservedName reports whether the overlay reserves name in the directory
+// dir
+func (f *FS) reservedName(dir string, name string) bool {
+	if dir != f.rootPath {
+		return false
+	}
+	switch name {
+	case metaDir, healthName, trashName, snapshotsName:
+		return true
+	}
+	return false
+}
+
+// nameEncryption returns the encryption of names, nil if they are not
+// encrypted
+func (f *FS) nameEncryption() *encryption {
+	if f.codecs == nil || f.codecs.enc == nil || f.codecs.enc.names == nil {
+		return nil
+	}
+	return f.codecs.enc
+}
+
+// plainNames decrypts the names of a listing of the directory dir. Entries
+// that are not encrypted were put into the backing directory behind the
+// mount and are left out, unless the overlay reserves their names.
+func (f *FS) plainNames(dir string, dirs []fuse.Dirent) []fuse.Dirent {
+	e := f.nameEncryption()
+	if e == nil {
+		return dirs
+	}
+	plain := dirs[:0]
+	for _, d := range dirs {
+		if name, ok := e.decryptName(d.Name); ok {
+			d.Name = name
+			plain = append(plain, d)
+		} else if f.reservedName(dir, d.Name) {
+			plain = append(plain, d)
+		}
+	}
+	return plain
+}
@@ -0,0 +1,172 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// plaintextOnDisk fails t if a file below the working directory contains
+// secret
+func plaintextOnDisk(t *testing.T, when string, secret []byte) {
+	t.Helper()
+	filepath.Walk(".", func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		if data, err := ioutil.ReadFile(p); err == nil && bytes.Contains(data, secret) {
+			t.Errorf("%s: %s contains the plaintext", when, p)
+		}
+		return nil
+	})
+}
+
+// readAll reads size bytes of n through a new handle
+func readAll(t *testing.T, n *Node, size int) []byte {
+	t.Helper()
+	ctx := context.Background()
+	h, err := n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.(*Handle).Release(ctx, &fuse.ReleaseRequest{})
+	var resp fuse.ReadResponse
+	if err = h.(*Handle).Read(ctx, &fuse.ReadRequest{Size: size}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Data
+}
+
+// TestEncryptOnWrite checks that the content written to an encrypted mount
+// never reaches the backing directory in plaintext, not even while it is
+// open, and reads back through the mount.
+func TestEncryptOnWrite(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	f, root := stressFS(t, Options{EncryptionKey: key, Compression: CompressionGzip})
+	if !f.encrypting() {
+		t.Fatal("the mount does not encrypt")
+	}
+	ctx := context.Background()
+	secret := []byte("attack at dawn ")
+	content := bytes.Repeat(secret, 10000)
+
+	created, h, err := root.Create(ctx,
+		&fuse.CreateRequest{Name: "a", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := created.(*Node)
+	if err = h.(*Handle).Write(ctx, &fuse.WriteRequest{Data: content}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	plaintextOnDisk(t, "written", secret)
+	var a fuse.Attr
+	if err = n.Attr(ctx, &a); err != nil || a.Size != uint64(len(content)) {
+		t.Errorf("an open file has size %d, %v, want %d", a.Size, err, len(content))
+	}
+	if err = h.(*Handle).Flush(ctx, &fuse.FlushRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	plaintextOnDisk(t, "flushed", secret)
+	if err = h.(*Handle).Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	plaintextOnDisk(t, "released", secret)
+	fi, err := os.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readCodecMark("a", fi); !ok {
+		t.Error("the file is not marked encoded")
+	}
+	if got := readAll(t, n, len(content)+1); !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes back, want the %d written", len(got), len(content))
+	}
+
+	if err = n.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: uint64(len(secret))}, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	plaintextOnDisk(t, "truncated", secret)
+	if got := readAll(t, n, len(content)); !bytes.Equal(got, secret) {
+		t.Errorf("read %q after the truncate, want %q", got, secret)
+	}
+	if f.codecs.plain != nil && len(f.codecs.plain) != 0 {
+		t.Errorf("%d decrypted copies are left open", len(f.codecs.plain))
+	}
+
+	_, err = root.Link(ctx, &fuse.LinkRequest{NewName: "b"}, n)
+	if err != fuse.Errno(syscall.EPERM) {
+		t.Errorf("linking an encrypted file returned %v, want EPERM", err)
+	}
+}
+
+// TestEncryptedNameMax checks that statfs reports the longest name that
+// can be stored encrypted and that longer names are rejected up front.
+func TestEncryptedNameMax(t *testing.T) {
+	f, root := stressFS(t, Options{EncryptionKey: bytes.Repeat([]byte{7}, 32), EncryptNames: true})
+	ctx := context.Background()
+	var st fuse.StatfsResponse
+	if err := f.Statfs(ctx, &fuse.StatfsRequest{}, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Namelen == 0 || st.Namelen >= nameMax {
+		t.Fatalf("statfs reports names of %d bytes with encrypted names", st.Namelen)
+	}
+	for _, tc := range []struct {
+		len  int
+		want error
+	}{
+		{int(st.Namelen), nil},
+		{int(st.Namelen) + 1, fuse.Errno(syscall.ENAMETOOLONG)},
+	} {
+		_, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: strings.Repeat("a", tc.len), Mode: os.ModeDir | 0755})
+		if err != tc.want {
+			t.Errorf("a name of %d bytes returned %v, want %v", tc.len, err, tc.want)
+		}
+	}
+}
+
+// TestEncryptedChangedBehind checks that an encrypted file changed behind
+// the mount fails to read instead of returning its ciphertext.
+func TestEncryptedChangedBehind(t *testing.T) {
+	_, root := stressFS(t, Options{EncryptionKey: bytes.Repeat([]byte{7}, 32)})
+	ctx := context.Background()
+	content := []byte("attack at dawn")
+	created, h, err := root.Create(ctx,
+		&fuse.CreateRequest{Name: "a", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := created.(*Node)
+	if err = h.(*Handle).Write(ctx, &fuse.WriteRequest{Data: content}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.(*Handle).Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	backing, err := os.OpenFile("a", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing.Write([]byte("appended behind the mount"))
+	backing.Close()
+
+	_, err = n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != fuse.Errno(syscall.EIO) {
+		t.Errorf("opening the changed file returned %v, want EIO", err)
+	}
+	n.invalidateAttr()
+	var a fuse.Attr
+	if err = n.Attr(ctx, &a); err != nil || a.Size != uint64(len(content)) {
+		t.Errorf("the changed file has size %d, %v, want %d", a.Size, err, len(content))
+	}
+}
@@ -0,0 +1,108 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// passedErrnos are the errors of the backing store passed on to the kernel,
+// including the network errors of the remote backends. The fuse library
+// turns everything else into EIO, errnos missing here are logged so they can
+// be added.
+var passedErrnos = map[syscall.Errno]bool{
+	syscall.E2BIG:        true,
+	syscall.EACCES:       true,
+	syscall.EAGAIN:       true,
+	syscall.EBADF:        true,
+	syscall.EBUSY:        true,
+	syscall.ECONNABORTED: true,
+	syscall.ECONNREFUSED: true,
+	syscall.ECONNRESET:   true,
+	syscall.EDQUOT:       true,
+	syscall.EEXIST:       true,
+	syscall.EFBIG:        true,
+	syscall.EHOSTDOWN:    true,
+	syscall.EHOSTUNREACH: true,
+	syscall.EINTR:        true,
+	syscall.EINVAL:       true,
+	syscall.EIO:          true,
+	syscall.EISDIR:       true,
+	syscall.ELOOP:        true,
+	syscall.EMFILE:       true,
+	syscall.EMLINK:       true,
+	syscall.ENAMETOOLONG: true,
+	syscall.ENETDOWN:     true,
+	syscall.ENETRESET:    true,
+	syscall.ENETUNREACH:  true,
+	syscall.ENFILE:       true,
+	syscall.ENODEV:       true,
+	syscall.ENOENT:       true,
+	syscall.ENOLCK:       true,
+	syscall.ENOMEM:       true,
+	syscall.ENOSPC:       true,
+	syscall.ENOSYS:       true,
+	syscall.ENOTCONN:     true,
+	syscall.ENOTDIR:      true,
+	syscall.ENOTEMPTY:    true,
+	syscall.ENOTSUP:      true,
+	syscall.ENXIO:        true,
+	syscall.EOVERFLOW:    true,
+	syscall.EPERM:        true,
+	syscall.ERANGE:       true,
+	syscall.EROFS:        true,
+	syscall.ESTALE:       true,
+	syscall.ETIMEDOUT:    true,
+	syscall.ETXTBSY:      true,
+	syscall.EXDEV:        true,
+	// ENODATA on linux, ENOATTR on darwin
+	syscall.Errno(fuse.ErrNoXattr): true,
+}
+
+// translateError translates errors of the backing store to errnos the
+// kernel understands. EACCES and EPERM are kept apart, the former means
+// missing permissions, the latter an operation that is not permitted at all.
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(fuse.ErrorNumber); ok {
+		// already translated, e.g. fuse.Errno or errInterrupted
+		return err
+	}
+	if errno := errnoOf(err); errno != 0 {
+		if passedErrnos[errno] {
+			return fuse.Errno(errno)
+		}
+		loog.Warn(logFS, "untranslated errno, returning EIO", "error", err, "errno", int(errno))
+		return fuse.EIO
+	}
+	switch {
+	case os.IsNotExist(err):
+		return fuse.ENOENT
+	case os.IsExist(err):
+		return fuse.EEXIST
+	case os.IsPermission(err):
+		return fuse.Errno(syscall.EACCES)
+	}
+	return err
+}
+
+// errnoOf returns the syscall.Errno wrapped in err, or 0
+func errnoOf(err error) syscall.Errno {
+	switch e := err.(type) {
+	case syscall.Errno:
+		return e
+	case *os.PathError:
+		return errnoOf(e.Err)
+	case *os.LinkError:
+		return errnoOf(e.Err)
+	case *os.SyscallError:
+		return errnoOf(e.Err)
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// wrappers wrap an errno the ways the os package returns them
+var wrappers = []struct {
+	name string
+	wrap func(syscall.Errno) error
+}{
+	{"bare", func(e syscall.Errno) error { return e }},
+	{"PathError", func(e syscall.Errno) error { return &os.PathError{Op: "open", Path: "a", Err: e} }},
+	{"LinkError", func(e syscall.Errno) error { return &os.LinkError{Op: "rename", Old: "a", New: "b", Err: e} }},
+	{"SyscallError", func(e syscall.Errno) error { return os.NewSyscallError("getxattr", e) }},
+	{"nested", func(e syscall.Errno) error {
+		return &os.PathError{Op: "open", Path: "a", Err: os.NewSyscallError("openat", e)}
+	}},
+}
+
+func TestTranslatePassedErrnos(t *testing.T) {
+	passed := []syscall.Errno{
+		syscall.E2BIG, syscall.EACCES, syscall.EAGAIN, syscall.EBADF,
+		syscall.EBUSY, syscall.ECONNABORTED, syscall.ECONNREFUSED,
+		syscall.ECONNRESET, syscall.EDQUOT, syscall.EEXIST, syscall.EFBIG,
+		syscall.EHOSTDOWN, syscall.EHOSTUNREACH, syscall.EINTR, syscall.EINVAL,
+		syscall.EIO, syscall.EISDIR, syscall.ELOOP, syscall.EMFILE,
+		syscall.EMLINK, syscall.ENAMETOOLONG, syscall.ENETDOWN,
+		syscall.ENETRESET, syscall.ENETUNREACH, syscall.ENFILE, syscall.ENODEV,
+		syscall.ENOENT, syscall.ENOLCK, syscall.ENOMEM, syscall.ENOSPC,
+		syscall.ENOSYS, syscall.ENOTCONN, syscall.ENOTDIR, syscall.ENOTEMPTY,
+		syscall.ENOTSUP, syscall.ENXIO, syscall.EOVERFLOW, syscall.EPERM,
+		syscall.ERANGE, syscall.EROFS, syscall.ESTALE, syscall.ETIMEDOUT,
+		syscall.ETXTBSY, syscall.EXDEV,
+		syscall.Errno(fuse.ErrNoXattr),
+	}
+	if len(passed) != len(passedErrnos) {
+		t.Errorf("the test covers %d errnos, passedErrnos has %d", len(passed), len(passedErrnos))
+	}
+	for _, errno := range passed {
+		if !passedErrnos[errno] {
+			t.Errorf("%v is not passed on", errno)
+			continue
+		}
+		for _, w := range wrappers {
+			t.Run(fmt.Sprintf("%v/%s", errno, w.name), func(t *testing.T) {
+				got := translateError(w.wrap(errno))
+				if got != fuse.Errno(errno) {
+					t.Errorf("got %#v, want %#v", got, fuse.Errno(errno))
+				}
+			})
+		}
+	}
+}
+
+func TestTranslateUnpassedErrnos(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.EPIPE, syscall.ECHILD, syscall.ESRCH, syscall.EDOM} {
+		if passedErrnos[errno] {
+			t.Fatalf("%v is passed on, pick another errno", errno)
+		}
+		for _, w := range wrappers {
+			t.Run(fmt.Sprintf("%v/%s", errno, w.name), func(t *testing.T) {
+				if got := translateError(w.wrap(errno)); got != fuse.EIO {
+					t.Errorf("got %#v, want EIO", got)
+				}
+			})
+		}
+	}
+}
+
+func TestTranslateOtherErrors(t *testing.T) {
+	other := errors.New("other")
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"nil", nil, nil},
+		{"fuse.Errno", fuse.Errno(syscall.EPERM), fuse.Errno(syscall.EPERM)},
+		{"interrupted", errInterrupted, errInterrupted},
+		{"not exist", os.ErrNotExist, fuse.ENOENT},
+		{"exist", &os.PathError{Op: "mkdir", Path: "a", Err: os.ErrExist}, fuse.EEXIST},
+		{"permission", os.ErrPermission, fuse.Errno(syscall.EACCES)},
+		{"other", other, other},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := translateError(tc.err); got != tc.want {
+				t.Errorf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
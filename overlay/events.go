@@ -0,0 +1,219 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// eventQueueSize is the number of events buffered for the sink, more are
+// dropped while the sink is slow or unreachable
+const eventQueueSize = 1024
+
+// Event types, named after the oCIS events for the same change
+const (
+	EventFileTouched      = "FileTouched"
+	EventFileUploaded     = "FileUploaded"
+	EventContainerCreated = "ContainerCreated"
+	EventItemMoved        = "ItemMoved"
+	EventItemTrashed      = "ItemTrashed"
+	EventItemPurged       = "ItemPurged"
+)
+
+// Event is a CloudEvents 1.0 event in structured JSON mode
+type Event struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            EventData `json:"data"`
+}
+
+// EventData describes the changed node. Paths are relative to the mount.
+type EventData struct {
+	Path    string `json:"path"`
+	OldPath string `json:"old_path,omitempty"`
+	// ID is the decomposedfs node id, if the metadata is maintained
+	ID string `json:"id,omitempty"`
+}
+
+// EventSink publishes events
+type EventSink interface {
+	Publish(e *Event) error
+}
+
+// NewEventSink returns a sink for the endpoint u. nats://host:port/subject
+// publishes to a NATS subject, main-queue if none is given, http:// and
+// https:// URLs receive a POST per event.
+func NewEventSink(u string) (EventSink, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	switch pu.Scheme {
+	case "nats":
+		subject := strings.Trim(pu.Path, "/")
+		if subject == "" {
+			subject = "main-queue"
+		}
+		return &natsSink{addr: pu.Host, subject: subject}, nil
+	case "http", "https":
+		return &httpSink{url: u, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported event endpoint %q, expected nats://, http:// or https://", u)
+	}
+}
+
+// httpSink posts every event to a URL
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) Publish(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/cloudevents+json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("event endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// natsSink publishes events with the NATS core protocol. It connects on
+// the first event and reconnects after errors. Publish is only called by the
+// event queue, wlock serializes its writes with the answers to pings.
+type natsSink struct {
+	addr    string
+	subject string
+
+	conn  net.Conn
+	wlock sync.Mutex
+}
+
+func (s *natsSink) connect() (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(c)
+	// the server greets with INFO
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO") {
+		c.Close()
+		return nil, fmt.Errorf("no NATS server at %s", s.addr)
+	}
+	if _, err := fmt.Fprintf(c, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"ocis-overlay\"}\r\n"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// answer the keep alive pings of the server
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PING"):
+				s.wlock.Lock()
+				_, err = c.Write([]byte("PONG\r\n"))
+				s.wlock.Unlock()
+			case strings.HasPrefix(line, "-ERR"):
+				loog.Warn(logEvents, "NATS error", "addr", s.addr, "error", strings.TrimSpace(line))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (s *natsSink) Publish(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if s.conn == nil {
+		if s.conn, err = s.connect(); err != nil {
+			return err
+		}
+	}
+	msg := append([]byte(fmt.Sprintf("PUB %s %d\r\n", s.subject, len(b))), b...)
+	s.wlock.Lock()
+	_, err = s.conn.Write(append(msg, '\r', '\n'))
+	s.wlock.Unlock()
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// eventQueue decouples fuse handlers from the event sink
+type eventQueue struct {
+	sink   EventSink
+	events chan *Event
+}
+
+func newEventQueue(sink EventSink) *eventQueue {
+	if sink == nil {
+		return nil
+	}
+	q := &eventQueue{sink: sink, events: make(chan *Event, eventQueueSize)}
+	go q.run()
+	return q
+}
+
+func (q *eventQueue) run() {
+	for e := range q.events {
+		if err := q.sink.Publish(e); err != nil {
+			loog.Warn(logEvents, "could not publish event", "type", e.Type, "path", e.Data.Path, "error", err)
+		}
+	}
+}
+
+// emit publishes an event for a completed change of the upper path p
+func (f *FS) emit(typ string, p string, oldPath string) {
+	if f.events == nil {
+		return
+	}
+	e := &Event{
+		SpecVersion:     "1.0",
+		ID:              newUUID(),
+		Source:          "ocis-overlay",
+		Type:            typ,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            EventData{Path: p, OldPath: oldPath},
+	}
+	if f.ocisMetadata {
+		if id, err := f.readXattr(p, ocisIDAttr); err == nil {
+			e.Data.ID = string(id)
+		}
+	}
+	select {
+	case f.events.events <- e:
+	default:
+		loog.Warn(logEvents, "event queue full, dropping event", "type", typ, "path", p)
+	}
+}
@@ -0,0 +1,157 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// Fault makes an operation fail with an errno, either with a probability or
+// deterministically on every nth call
+type Fault struct {
+	Op  Op
+	Err syscall.Errno
+	// Probability in [0,1] that a call fails
+	Probability float64
+	// Every makes every nth call fail, takes precedence over Probability
+	Every uint64
+}
+
+func (f Fault) String() string {
+	if f.Every > 0 {
+		return fmt.Sprintf("%s:%s:every=%d", f.Op, errnoName(f.Err), f.Every)
+	}
+	return fmt.Sprintf("%s:%s:%g%%", f.Op, errnoName(f.Err), f.Probability*100)
+}
+
+// errnos that can be injected by name
+var errnos = map[string]syscall.Errno{
+	"EACCES":       syscall.EACCES,
+	"EAGAIN":       syscall.EAGAIN,
+	"EBUSY":        syscall.EBUSY,
+	"EDQUOT":       syscall.EDQUOT,
+	"EEXIST":       syscall.EEXIST,
+	"EINTR":        syscall.EINTR,
+	"EIO":          syscall.EIO,
+	"ENAMETOOLONG": syscall.ENAMETOOLONG,
+	"ENODATA":      syscall.Errno(fuse.ErrNoXattr),
+	"ENOENT":       syscall.ENOENT,
+	"ENOSPC":       syscall.ENOSPC,
+	"ENOTEMPTY":    syscall.ENOTEMPTY,
+	"ENOTSUP":      syscall.ENOTSUP,
+	"EPERM":        syscall.EPERM,
+	"EROFS":        syscall.EROFS,
+	"ESTALE":       syscall.ESTALE,
+	"ETIMEDOUT":    syscall.ETIMEDOUT,
+	"EXDEV":        syscall.EXDEV,
+}
+
+// ParseErrno parses an errno name like EIO or a number
+func ParseErrno(s string) (syscall.Errno, error) {
+	if e, ok := errnos[strings.ToUpper(s)]; ok {
+		return e, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return syscall.Errno(n), nil
+	}
+	return 0, fmt.Errorf("unknown errno %q", s)
+}
+
+func errnoName(e syscall.Errno) string {
+	for name, errno := range errnos {
+		if errno == e {
+			return name
+		}
+	}
+	return strconv.Itoa(int(e))
+}
+
+// ParseFaults parses a comma separated list of faults. A fault is either
+// op:errno:percent%, e.g. getxattr:ENOTSUP:5%, or op:errno:every=n, e.g.
+// write:EIO:every=100.
+func ParseFaults(spec string) ([]Fault, error) {
+	var faults []Fault
+	if spec == "" {
+		return faults, nil
+	}
+	for _, s := range strings.Split(spec, ",") {
+		parts := strings.SplitN(s, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid fault %q, expected op:errno:rule", s)
+		}
+		op, err := ParseOp(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		errno, err := ParseErrno(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		f := Fault{Op: op, Err: errno}
+		rule := parts[2]
+		switch {
+		case strings.HasPrefix(rule, "every="):
+			if f.Every, err = strconv.ParseUint(strings.TrimPrefix(rule, "every="), 10, 64); err != nil || f.Every == 0 {
+				return nil, fmt.Errorf("invalid fault rule %q", rule)
+			}
+		case strings.HasSuffix(rule, "%"):
+			p, err := strconv.ParseFloat(strings.TrimSuffix(rule, "%"), 64)
+			if err != nil || p < 0 || p > 100 {
+				return nil, fmt.Errorf("invalid fault rule %q", rule)
+			}
+			f.Probability = p / 100
+		default:
+			return nil, fmt.Errorf("invalid fault rule %q, expected percent%% or every=n", rule)
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+// faultInjector counts the calls of a fault's operation
+type faultInjector struct {
+	Fault
+	calls uint64
+}
+
+func (fi *faultInjector) trigger() bool {
+	calls := atomic.AddUint64(&fi.calls, 1)
+	if fi.Every > 0 {
+		return calls%fi.Every == 0
+	}
+	return fi.Probability > 0 && rand.Float64() < fi.Probability
+}
+
+func newFaultInjectors(faults []Fault) map[Op][]*faultInjector {
+	m := make(map[Op][]*faultInjector)
+	for _, f := range faults {
+		m[f.Op] = append(m[f.Op], &faultInjector{Fault: f})
+	}
+	return m
+}
+
+// fault returns the injected error for the current call of op, if any,
+// including the one of an exhausted simulated space
+func (f *FS) fault(op Op) error {
+	if err := f.spaceFault(op); err != nil {
+		return err
+	}
+	f.ctl.RLock()
+	injectors := f.faults[op]
+	f.ctl.RUnlock()
+	for _, fi := range injectors {
+		if fi.trigger() {
+			loog.Debug(logFault, "injecting fault", "op", op, "error", fi.Err)
+			return fuse.Errno(fi.Err)
+		}
+	}
+	return nil
+}
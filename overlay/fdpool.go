@@ -0,0 +1,114 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+)
+
+// Gauges of the handles the kernel holds and of the backing files open for
+// them. Handles of all FS instances in the process are counted.
+var (
+	openHandles = expvar.NewInt("ocis_overlay_open_handles")
+	openFiles   = expvar.NewInt("ocis_overlay_open_files")
+)
+
+// fdPool limits the number of backing files open for handles. When the
+// budget is exceeded the least recently used idle backing files are closed,
+// their handles reopen them on the next use. Handles of files removed in the
+// meantime cannot be reopened and fail with ENOENT.
+type fdPool struct {
+	max int // 0 is unlimited
+	// reuses counts the uses of handles that found their backing file open
+	reuses *cacheCounter
+
+	lock sync.Mutex
+	lru  *list.List // handles with an open backing file, most recent first
+}
+
+func newFDPool(max int) *fdPool {
+	return &fdPool{max: max, lru: list.New()}
+}
+
+// track adds a new handle with an open backing file
+func (p *fdPool) track(h *Handle) {
+	openHandles.Add(1)
+	openFiles.Add(1)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	h.elem = p.lru.PushFront(h)
+	p.evict()
+}
+
+// untrack removes a released handle and returns its backing file, if it is
+// still open
+func (p *fdPool) untrack(h *Handle) File {
+	openHandles.Add(-1)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	f := h.f
+	if f != nil {
+		p.lru.Remove(h.elem)
+		h.f, h.elem = nil, nil
+		openFiles.Add(-1)
+	}
+	return f
+}
+
+// acquire returns the backing file of h and keeps it from being evicted
+// until release is called. Evicted files are reopened.
+func (p *fdPool) acquire(h *Handle) (File, error) {
+	p.lock.Lock()
+	h.users++
+	p.reuses.count(h.f != nil)
+	if h.f != nil {
+		p.lru.MoveToFront(h.elem)
+		p.lock.Unlock()
+		return h.f, nil
+	}
+	p.lock.Unlock()
+
+	f, err := h.reopener()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err != nil {
+		h.users--
+		return nil, err
+	}
+	if h.f != nil {
+		// reopened concurrently
+		f.Close()
+		p.lru.MoveToFront(h.elem)
+		return h.f, nil
+	}
+	h.f = f
+	h.elem = p.lru.PushFront(h)
+	openFiles.Add(1)
+	p.evict()
+	return f, nil
+}
+
+// release marks the backing file of h as idle again
+func (p *fdPool) release(h *Handle) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	h.users--
+}
+
+// evict closes idle backing files until the budget is met
+func (p *fdPool) evict() {
+	for e := p.lru.Back(); e != nil && p.max > 0 && p.lru.Len() > p.max; {
+		prev := e.Prev()
+		h := e.Value.(*Handle)
+		if h.users == 0 {
+			p.lru.Remove(e)
+			h.f.Close()
+			h.f, h.elem = nil, nil
+			openFiles.Add(-1)
+		}
+		e = prev
+	}
+}
@@ -7,87 +7,451 @@
 package overlay
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"golang.org/x/net/context"
+	"github.com/butonic/ocis-overlay/loog"
 )
 
 // FS is the filesystem root
 type FS struct {
+	// sweptNodes counts the paths dropped by sweepNodes, first for the
+	// alignment of atomic operations
+	sweptNodes uint64
+	// closing is set by Shutdown, atomic
+	closing int32
+	// mountpoint is the working directory the filesystem is mounted on
+	mountpoint string
+	// served is closed when Serve returns
+	served chan struct{}
+	// rootOnly only admits root and the user serving the mount, see
+	// MountOptions.AllowRoot
+	rootOnly bool
+
 	rootPath string
+	// store holds the files of the upper and the lower layers, see store.go
+	store Store
+	// lowers are the read-only lower layers, top-down, none in passthrough mode
+	lowers []string
+	// clock serializes copy-ups to the upper layer
+	clock sync.Mutex
+
+	xlock sync.RWMutex
+	// xattrs is the in-memory store, by inode so hard links share them
+	xattrs map[fileID]map[string][]byte
+	// persistXattrs saves xattrs to the metaDir after xattrSave fires
+	persistXattrs bool
+	xattrSave     *time.Timer
+
+	registry *registry
+	// moveLock is held to rename a backing file and update the paths of its
+	// nodes in one step, operations addressing a node by its path hold it
+	// for reading, see pinPaths
+	moveLock sync.RWMutex
+	inodes   *inodeMap
+	// watcher drops cached entries on changes to the backing store, nil
+	// unless Options.Watch is set
+	watcher *watcher
+
+	// ctl guards latency, faults, space and kill, they can be changed at
+	// runtime through the control socket
+	ctl           sync.RWMutex
+	latency       Latency
+	faults        map[Op][]*faultInjector
+	faultList     []Fault
+	faultsEnabled bool
+	// space is the simulated free space, nil if disabled, see space.go
+	space *spaceLimit
+	// kill is the armed kill point, nil if none, see killpoint.go
+	kill *killSwitch
+
+	xattrMode   XattrMode
+	attrTimeout time.Duration
+	mknod       bool
+	// xattrSecurity is the policy for security.* and trusted.* xattrs
+	xattrSecurity XattrPolicy
+	maxXattrSize  int
+	// ocisMetadata maintains the decomposedfs xattrs, see ocis.go
+	ocisMetadata bool
+	// etags are propagated to the root on changes, see propagation.go
+	etags            bool
+	treeSize         bool
+	propagationDelay time.Duration
+	propagator       propagator
+
+	events *eventQueue
+	// auditLog records operations on files, nil if disabled
+	auditLog *auditLog
+	// tracer traces fuse requests, logs slow ones and records them, nil if
+	// disabled
+	tracer *tracer
+
+	trash        bool
+	trashMaxAge  time.Duration
+	trashMaxSize int64
+
+	versions       bool
+	versionsMax    int
+	versionsMaxAge time.Duration
+
+	// hide and show are the name filters, see filter.go
+	hide []string
+	show []string
+	// normalization is the form of new names, see norm.go
+	normalization Normalization
+	uidMap        *IDMap
+	gidMap        *IDMap
+	asCaller      bool
+
+	// defaultPermissions leaves permission checks to the kernel
+	defaultPermissions bool
+
+	// backend replaces the local directory if set, see remote.go. rtree
+	// guards the shape of the remote node tree.
+	backend    Backend
+	rtree      sync.RWMutex
+	remoteRoot *remoteNode
+	// userRoots are the trees of the users of a multi-user mount by uid,
+	// nil otherwise, see users.go
+	userRoots map[uint32]*remoteNode
+	blocks    *blockCache
+	// readAheadMax is the largest read-ahead window, 0 disables it
+	readAheadMax int64
+	// remoteIDs maps kernel node ids to remote nodes, guarded by rtree
+	remoteIDs map[fuse.NodeID]*remoteNode
+	uploads   uploads
+	// flaky simulates an unreliable network to the backend, see flaky.go
+	flaky *flakyTransport
+	// retries are the retry policies of backend calls, see retry.go
+	retries map[RetryClass]RetryPolicy
+	// offline queues the changes made while the backend is unreachable,
+	// nil if disabled, see offline.go
+	offline *offlineJournal
+	// conflictPolicy handles files changed behind the mount while they were
+	// written, see conflict.go
+	conflictPolicy ConflictPolicy
+	// ops is the operation journal, nil if disabled, see opjournal.go
+	ops *opJournal
+	// snaps are the files shared with snapshots, see snapshot.go
+	snaps snapshots
+	// dedup indexes the written files by content, nil if disabled, see
+	// dedup.go
+	dedup *deduper
+	// codecs compress and encrypt released files, nil if neither is
+	// enabled, see codec.go
+	codecs *codecs
+	// integrity verifies files against their checksums, nil if disabled,
+	// see integrity.go
+	integrity *integrity
+	// antivirus scans written files, nil if disabled, see antivirus.go
+	antivirus *antivirus
+	// interceptors see every request, inflight are the requests not
+	// answered yet, see interceptor.go
+	interceptors []Interceptor
+	inflight     inflight
+
+	// server is used to notify the kernel about changes, nil until Serve
+	server         *fs.Server
+	writebackCache bool
+	keepCache      bool
+	directIOAll    bool
+	executables    bool
+
+	listings listings
+	fds      *fdPool
+	// readAllMax is the size up to which handles read files whole
+	readAllMax int64
+	// serial is the turn of the one request answered at a time, nil unless
+	// Options.Serialize is set, see serialInterceptor
+	serial chan struct{}
+	// writeCoalesce is the chunk size of buffered writes, flushPool runs
+	// their flushes, see coalesce.go
+	writeCoalesce int64
+	flushPool     chan *writeCoalescer
+
+	// stats counts requests, I/O and cache hits, see stats.go
+	stats *stats
+}
+
+// NewFS returns the overlay of the current directory with the options o. It
+// fails if the files cannot be encrypted as o asks, a mount must not store
+// them in plaintext instead.
+func NewFS(o Options) (*FS, error) {
+	f := &FS{
+		rootPath:    ".",
+		store:       osStore{},
+		lowers:      o.Lowers,
+		xattrs:      make(map[fileID]map[string][]byte),
+		registry:    newRegistry(),
+		inodes:      newInodeMap("."),
+		latency:     o.Latency,
+		faults:      newFaultInjectors(o.Faults),
+		faultList:   o.Faults,
+		xattrMode:   o.XattrMode,
+		attrTimeout: o.AttrTimeout,
+		mknod:       o.Mknod,
+
+		xattrSecurity:  o.XattrSecurity,
+		conflictPolicy: o.ConflictPolicy,
+		maxXattrSize:   o.MaxXattrSize,
+		persistXattrs:  o.PersistXattrs,
+
+		ocisMetadata: o.OcisMetadata,
+		etags:        o.Etags,
+		treeSize:     o.TreeSize,
+
+		propagationDelay: o.PropagationDelay,
+		events:           newEventQueue(o.Events),
 
-	xlock  sync.RWMutex
-	xattrs map[string]map[string][]byte
+		trash:        o.Trash,
+		trashMaxAge:  o.TrashMaxAge,
+		trashMaxSize: o.TrashMaxSize,
 
-	nlock sync.Mutex
-	nodes map[string][]*Node // realPath -> nodes
+		versions:       o.Versions,
+		versionsMax:    o.VersionsMax,
+		versionsMaxAge: o.VersionsMaxAge,
 
-	latency time.Duration
+		hide: o.Hide,
+		show: o.Show,
+
+		normalization: o.Normalization,
+		uidMap:        o.UIDMap,
+		gidMap:        o.GIDMap,
+		asCaller:      o.AsCaller,
+
+		defaultPermissions: o.DefaultPermissions,
+
+		backend: o.Backend,
+		blocks:  newBlockCache(o.BlockCacheSize),
+
+		readAheadMax: o.ReadAhead,
+
+		writebackCache: o.WritebackCache,
+		keepCache:      o.KeepCache,
+		directIOAll:    o.DirectIO,
+		executables:    o.Executables,
+		fds:            newFDPool(o.MaxOpenFiles),
+		writeCoalesce:  o.WriteCoalesce,
+		readAllMax:     o.ReadAllMax,
+		faultsEnabled:  true,
+		served:         make(chan struct{}),
+		stats:          newStats(),
+	}
+	f.fds.reuses = &f.stats.fds
+	if f.writeCoalesce > 0 {
+		f.startFlushers(o.WriteFlushers)
+	}
+	if o.Space.Limit > 0 {
+		f.space = &spaceLimit{Space: o.Space}
+	}
+	f.mountpoint, _ = os.Getwd()
+	if f.backend != nil {
+		f.remoteRoot = newRemoteRoot(f, f.backend, uint32(os.Getuid()))
+		f.userRoots = f.newUserRoots(o.UserBackends)
+		if o.BlockCacheDir != "" && o.BlockCacheDiskSize > 0 {
+			if d, err := newDiskTier(o.BlockCacheDir, o.BlockCacheDiskSize); err != nil {
+				loog.Error(logFS, "cannot use the block cache directory", "path", o.BlockCacheDir, "error", err)
+			} else {
+				f.blocks.disk = d
+				f.blocks.diskHits = &f.stats.blockDisk
+			}
+		}
+		f.flaky = simulateFlakiness(f.backend, o.BackendFlakiness)
+		if f.retries = o.BackendRetry; f.retries == nil {
+			f.retries = DefaultRetry()
+		}
+		if o.OfflineDir != "" {
+			if j, err := newOfflineJournal(o.OfflineDir); err != nil {
+				loog.Error(logFS, "cannot use the offline directory", "path", o.OfflineDir, "error", err)
+			} else {
+				f.offline = j
+				// changes queued before a restart are pushed right away
+				j.wake <- struct{}{}
+				go f.reconcile()
+			}
+		}
+	}
+	if f.trash && f.trashMaxAge > 0 {
+		go f.purgeTrashPeriodically()
+	}
+	if f.persistXattrs {
+		f.loadXattrs()
+	}
+	if o.OpJournal && f.backend == nil {
+		f.startOpJournal()
+	}
+	if f.backend == nil {
+		f.loadSnapshots()
+	}
+	if o.Dedup && f.backend == nil {
+		f.startDedup()
+	}
+	f.interceptors = append([]Interceptor{statsInterceptor{f}, auditInterceptor{f}, latencyInterceptor{f}, faultInterceptor{f}}, o.Interceptors...)
+	if o.Serialize {
+		// the turn is taken first so the other interceptors run in it
+		f.serial = make(chan struct{}, 1)
+		f.interceptors = append([]Interceptor{serialInterceptor{f}}, f.interceptors...)
+	}
+	if o.VerifyChecksums && f.backend == nil {
+		f.integrity = newIntegrity()
+	}
+	if o.Scanner != nil && f.backend == nil {
+		f.antivirus = &antivirus{scanner: o.Scanner, policy: o.AVPolicy}
+	}
+	if f.backend == nil {
+		var enc *encryption
+		if o.EncryptionKey != nil {
+			var err error
+			if enc, err = newEncryption(o.EncryptionKey, o.EncryptNames); err != nil {
+				return nil, fmt.Errorf("cannot set up encryption: %v", err)
+			}
+		}
+		if enc != nil || o.Compression != "" && o.Compression != CompressionOff {
+			if err := f.startCodecs(o.Compression, o.CompressionExclude, enc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if o.AuditLog != "" {
+		if l, err := newAuditLog(o.AuditLog, o.AuditMaxSize, o.AuditMaxFiles, o.AuditMutationsOnly); err != nil {
+			loog.Error(logFS, "cannot open the audit log", "path", o.AuditLog, "error", err)
+		} else {
+			f.auditLog = l
+		}
+	}
+	if o.OTLPEndpoint != "" || o.SlowOpThreshold > 0 || o.Record != "" {
+		if t, err := newTracer(o.OTLPEndpoint, o.SlowOpThreshold, o.Record); err != nil {
+			loog.Error(logFS, "cannot trace requests", "endpoint", o.OTLPEndpoint, "error", err)
+		} else {
+			f.tracer = t
+		}
+	}
+	if o.Watch {
+		if w, err := newWatcher(); err != nil {
+			loog.Error(logFS, "cannot watch the backing store", "error", err)
+		} else {
+			f.watcher = w
+			go w.run(f.backingChanged)
+		}
+	}
+	if o.NodeSweepInterval > 0 {
+		go f.sweepNodesPeriodically(o.NodeSweepInterval)
+	}
+	return f, nil
 }
 
-func NewFS(latency time.Duration) *FS {
-	return &FS{
-		rootPath: ".",
-		xattrs:   make(map[string]map[string][]byte),
-		nodes:    make(map[string][]*Node),
-		latency:  latency,
+// newNode registers n and returns it. If a node for the same file is already
+// known at the path, that node is returned instead, so the kernel sees the
+// same node id for it.
+func (f *FS) newNode(n *Node) *Node {
+	if f.watcher != nil && n.isDir {
+		f.watcher.add(n.getRealPath())
 	}
+	return f.registry.add(n)
 }
 
-func (f *FS) newNode(n *Node) {
-	rp := n.getRealPath()
+// pinPaths keeps renames from moving backing files until the returned func
+// is called, so the paths of the nodes stay valid meanwhile. It must not be
+// taken twice by the same operation, a waiting rename would deadlock it.
+func (f *FS) pinPaths() func() {
+	f.moveLock.RLock()
+	return f.moveLock.RUnlock
+}
 
-	f.nlock.Lock()
-	defer f.nlock.Unlock()
-	f.nodes[rp] = append(f.nodes[rp], n)
+// renameBacking moves the backing file oldPath to newPath with rename and
+// updates the nodes of oldPath in the same step
+func (f *FS) renameBacking(oldPath string, newPath string, rename func() error) error {
+	f.moveLock.Lock()
+	defer f.moveLock.Unlock()
+	if err := rename(); err != nil {
+		return err
+	}
+	f.invalidateNodes(oldPath)
+	f.nodeRenamed(oldPath, newPath)
+	return nil
 }
 
 func (f *FS) nodeRenamed(oldPath string, newPath string) {
-	f.nlock.Lock()
-	defer f.nlock.Unlock()
-	f.nodes[newPath] = append(f.nodes[newPath], f.nodes[oldPath]...)
-	delete(f.nodes, oldPath)
-	for _, n := range f.nodes[newPath] {
-		n.updateRealPath(newPath)
+	f.registry.rename(oldPath, newPath)
+	if f.watcher != nil {
+		f.watcher.rename(oldPath, newPath)
 	}
 }
 
-func (f *FS) forgetNode(n *Node) {
-	f.nlock.Lock()
-	defer f.nlock.Unlock()
-	nodes, ok := f.nodes[n.realPath]
-	if !ok {
+// backingChanged drops what is cached about name in the directory dir after
+// it changed on the backing store. Changes made through the mount are seen
+// as well, the kernel then looks them up again.
+func (f *FS) backingChanged(dir string, name string) {
+	if dir == "" {
+		f.flush()
 		return
 	}
-
-	found := -1
-	for i, node := range nodes {
-		if node == n {
-			found = i
-			break
+	p := filepath.Join(dir, name)
+	f.invalidateNodes(p)
+	// mappings of the file must not keep the old content, changes made
+	// through the mount are in the page cache already
+	for _, n := range f.registry.get(p) {
+		if n.isDir {
+			continue
+		}
+		if fi, err := os.Stat(n.resolvedPath()); err == nil {
+			n.checkData(fi)
 		}
 	}
+	f.invalidateNodes(dir)
+	f.invalidateEntry(dir, name)
+}
 
-	if found > -1 {
-		nodes = append(nodes[:found], nodes[found+1:]...)
+// invalidateNodes drops the cached attributes of all nodes for realPath
+func (f *FS) invalidateNodes(realPath string) {
+	f.forgetListings(realPath)
+	for _, n := range f.registry.get(realPath) {
+		n.invalidateAttr()
 	}
-	if len(nodes) == 0 {
-		delete(f.nodes, n.realPath)
-	} else {
-		f.nodes[n.realPath] = nodes
+}
+
+// invalidateLinks drops the cached attributes of all nodes sharing the inode,
+// e.g. because the link count changed
+func (f *FS) invalidateLinks(inode uint64) {
+	for _, p := range f.registry.linkPaths(inode) {
+		f.invalidateNodes(p)
+	}
+}
+
+// nodeRemoved drops the bookkeeping for a removed path. If the inode is still
+// reachable through another hard link, one of the remaining paths is returned.
+func (f *FS) nodeRemoved(p string) (remaining string) {
+	return f.registry.remove(p)
+}
+
+func (f *FS) forgetNode(n *Node) {
+	f.registry.forget(n)
+	if f.watcher != nil && n.isDir && len(f.registry.get(n.getRealPath())) == 0 {
+		f.watcher.remove(n.getRealPath())
 	}
 }
 
 // Root implements fs.FS interface for *FS
 func (f *FS) Root() (n fs.Node, err error) {
-	time.Sleep(f.latency)
-	defer func() { log.Printf("FS.Root(): %#+v error=%v", n, err) }()
-	nn := &Node{realPath: f.rootPath, isDir: true, fs: f}
+	if err = f.enter(context.Background(), OpRoot, f); err != nil {
+		return nil, err
+	}
+	defer func() { loog.Debug(logFS, "Root", "error", err) }()
+	if f.remoteRoot != nil {
+		return f.remoteRoot, nil
+	}
+	fi, err := os.Lstat(f.rootPath)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	nn := &Node{realPath: f.rootPath, lowerPaths: f.lowers, isDir: true, inode: f.inodeOf(fi), fs: f}
 	f.newNode(nn)
 	return nn, nil
 }
@@ -97,32 +461,20 @@ var _ fs.FSStatfser = (*FS)(nil)
 // Statfs implements fs.FSStatfser interface for *FS
 func (f *FS) Statfs(ctx context.Context,
 	req *fuse.StatfsRequest, resp *fuse.StatfsResponse) (err error) {
-	time.Sleep(f.latency)
-	defer func() { log.Printf("FS.Statfs(): error=%v", err) }()
+	if err = f.enter(ctx, OpStatfs, f); err != nil {
+		return err
+	}
+	defer func() { loog.Debug(logFS, "Statfs", "error", err) }()
+	defer f.limitStatfs(resp)
+	if f.backend != nil {
+		return f.remoteStatfs(ctx, req, resp)
+	}
 	var stat syscall.Statfs_t
 	if err := syscall.Statfs(f.rootPath, &stat); err != nil {
 		return translateError(err)
 	}
-	resp.Blocks = stat.Blocks
-	resp.Bfree = stat.Bfree
-	resp.Bavail = stat.Bavail
-	resp.Files = 0 // TODO
-	resp.Ffree = stat.Ffree
-	resp.Bsize = uint32(stat.Bsize)
-	resp.Namelen = 255 // TODO
-	resp.Frsize = 8    // TODO
-
+	fillStatfs(resp, &stat)
+	resp.Namelen = f.plainNameMax(resp.Namelen)
+	f.quotaStatfs(resp)
 	return nil
 }
-
-// if to is empty, all xattrs on the node is removed
-func (f *FS) moveAllxattrs(ctx context.Context, from string, to string) {
-	f.xlock.Lock()
-	defer f.xlock.Unlock()
-	if f.xattrs[from] != nil {
-		if to != "" {
-			f.xattrs[to] = f.xattrs[from]
-		}
-		f.xattrs[from] = nil
-	}
-}
@@ -0,0 +1,50 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"bazil.org/fuse"
+)
+
+// CheckPatterns returns an error for the first malformed glob pattern
+func CheckPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// matchAny reports whether name matches one of the glob patterns
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hidden reports whether name matches a hide pattern and no show pattern.
+// Hidden names are not listed, cannot be looked up and cannot be created.
+func (f *FS) hidden(name string) bool {
+	return matchAny(f.hide, name) && !matchAny(f.show, name)
+}
+
+// withoutHidden removes the hidden names from dirs
+func (f *FS) withoutHidden(dirs []fuse.Dirent) []fuse.Dirent {
+	if len(f.hide) == 0 {
+		return dirs
+	}
+	kept := dirs[:0]
+	for _, d := range dirs {
+		if !f.hidden(d.Name) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,283 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// Flakiness simulates an unreliable network between the overlay and a
+// remote backend. The requests never reach the server when they fail.
+type Flakiness struct {
+	// Drop is the probability in [0,1] that the connection is reset before
+	// a request is sent
+	Drop float64
+	// Timeout is the probability that a request hangs for TimeoutAfter
+	// and then fails with a timeout
+	Timeout      float64
+	TimeoutAfter time.Duration
+	// Burst is the probability that a request starts a burst of
+	// BurstLength responses with BurstStatus, e.g. 503
+	Burst       float64
+	BurstLength int
+	BurstStatus int
+	// SlowStart throttles the response bodies after the start and after
+	// every dropped connection, the bandwidth grows from 64KiB/s to
+	// unlimited over SlowStart
+	SlowStart time.Duration
+}
+
+const (
+	defaultFlakyTimeout = 30 * time.Second
+	defaultBurstLength  = 5
+	// slowStartRate is the bandwidth in bytes per second right after a
+	// connection was dropped
+	slowStartRate = 64 << 10
+)
+
+func (f Flakiness) String() string {
+	var parts []string
+	if f.Drop > 0 {
+		parts = append(parts, fmt.Sprintf("drop=%g%%", f.Drop*100))
+	}
+	if f.Timeout > 0 {
+		parts = append(parts, fmt.Sprintf("timeout=%g%%:%s", f.Timeout*100, f.TimeoutAfter))
+	}
+	if f.Burst > 0 {
+		parts = append(parts, fmt.Sprintf("5xx=%g%%:%d:%d", f.Burst*100, f.BurstLength, f.BurstStatus))
+	}
+	if f.SlowStart > 0 {
+		parts = append(parts, "slowstart="+f.SlowStart.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// parsePercent parses a probability given as percent%
+func parsePercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || !strings.HasSuffix(s, "%") || p < 0 || p > 100 {
+		return 0, fmt.Errorf("invalid probability %q, expected percent%%", s)
+	}
+	return p / 100, nil
+}
+
+// ParseFlakiness parses a comma separated list of drop=percent%,
+// timeout=percent%[:duration], 5xx=percent%[:length[:status]] and
+// slowstart=duration, e.g. drop=1%,5xx=2%:10:502. The timeout defaults to
+// 30s, a burst to 5 responses with 503.
+func ParseFlakiness(spec string) (Flakiness, error) {
+	f := Flakiness{TimeoutAfter: defaultFlakyTimeout, BurstLength: defaultBurstLength, BurstStatus: http.StatusServiceUnavailable}
+	if spec == "" {
+		return f, nil
+	}
+	for _, s := range strings.Split(spec, ",") {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return f, fmt.Errorf("invalid flakiness %q, expected kind=value", s)
+		}
+		args := strings.Split(kv[1], ":")
+		var err error
+		switch kv[0] {
+		case "drop":
+			if len(args) != 1 {
+				return f, fmt.Errorf("invalid flakiness %q, expected drop=percent%%", s)
+			}
+			f.Drop, err = parsePercent(args[0])
+		case "timeout":
+			if len(args) > 2 {
+				return f, fmt.Errorf("invalid flakiness %q, expected timeout=percent%%[:duration]", s)
+			}
+			if f.Timeout, err = parsePercent(args[0]); err == nil && len(args) == 2 {
+				if f.TimeoutAfter, err = time.ParseDuration(args[1]); err == nil && f.TimeoutAfter <= 0 {
+					err = fmt.Errorf("invalid timeout %q", args[1])
+				}
+			}
+		case "5xx":
+			if len(args) > 3 {
+				return f, fmt.Errorf("invalid flakiness %q, expected 5xx=percent%%[:length[:status]]", s)
+			}
+			if f.Burst, err = parsePercent(args[0]); err == nil && len(args) > 1 {
+				if f.BurstLength, err = strconv.Atoi(args[1]); err == nil && f.BurstLength < 1 {
+					err = fmt.Errorf("invalid burst length %q", args[1])
+				}
+			}
+			if err == nil && len(args) > 2 {
+				if f.BurstStatus, err = strconv.Atoi(args[2]); err == nil && (f.BurstStatus < 500 || f.BurstStatus > 599) {
+					err = fmt.Errorf("invalid burst status %q, expected 5xx", args[2])
+				}
+			}
+		case "slowstart":
+			if f.SlowStart, err = time.ParseDuration(kv[1]); err == nil && f.SlowStart <= 0 {
+				err = fmt.Errorf("invalid slow start %q", kv[1])
+			}
+		default:
+			return f, fmt.Errorf("unknown flakiness %q, expected drop, timeout, 5xx or slowstart", kv[0])
+		}
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// flakyTimeout is the error of a simulated timeout, like the one of an
+// http.Client with a timeout
+type flakyTimeout struct{}
+
+func (flakyTimeout) Error() string   { return "simulated network timeout" }
+func (flakyTimeout) Timeout() bool   { return true }
+func (flakyTimeout) Temporary() bool { return true }
+
+var _ net.Error = flakyTimeout{}
+
+// flakyTransport injects the Flakiness into the requests of a backend
+type flakyTransport struct {
+	next http.RoundTripper
+
+	lock sync.Mutex
+	Flakiness
+	// burst is the number of 5xx responses left in the current burst
+	burst int
+	// restart is when the connection was last dropped, for the slow start
+	restart time.Time
+}
+
+// newFlakyTransport wraps next, nil for the default transport
+func newFlakyTransport(next http.RoundTripper, f Flakiness) *flakyTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &flakyTransport{next: next, Flakiness: f, restart: time.Now()}
+}
+
+// set replaces the simulated flakiness and restarts the slow start
+func (t *flakyTransport) set(f Flakiness) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Flakiness, t.burst, t.restart = f, 0, time.Now()
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	f, now := t.Flakiness, time.Now()
+	var fault string
+	switch {
+	case t.burst > 0:
+		t.burst--
+		fault = "5xx"
+	case f.Drop > 0 && rand.Float64() < f.Drop:
+		t.restart = now
+		fault = "drop"
+	case f.Timeout > 0 && rand.Float64() < f.Timeout:
+		fault = "timeout"
+	case f.Burst > 0 && rand.Float64() < f.Burst:
+		t.burst = f.BurstLength - 1
+		fault = "5xx"
+	}
+	restart := t.restart
+	t.lock.Unlock()
+
+	if fault != "" {
+		loog.Debug(logFault, "simulating network fault", "fault", fault, "method", req.Method, "url", req.URL.String())
+		if req.Body != nil {
+			req.Body.Close()
+		}
+	}
+	switch fault {
+	case "drop":
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	case "timeout":
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(f.TimeoutAfter):
+			return nil, flakyTimeout{}
+		}
+	case "5xx":
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", f.BurstStatus, http.StatusText(f.BurstStatus)),
+			StatusCode: f.BurstStatus,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(&bytes.Buffer{}),
+			Request:    req,
+		}, nil
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && now.Sub(restart) < f.SlowStart {
+		resp.Body = &slowBody{ReadCloser: resp.Body, start: restart, slowStart: f.SlowStart}
+	}
+	return resp, err
+}
+
+// slowBody throttles a response body during a slow start
+type slowBody struct {
+	io.ReadCloser
+	start     time.Time
+	slowStart time.Duration
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if elapsed := time.Since(b.start); n > 0 && elapsed < b.slowStart {
+		// the rate grows to infinity at the end of the slow start
+		rate := slowStartRate / (1 - float64(elapsed)/float64(b.slowStart))
+		time.Sleep(time.Duration(float64(n) / rate * float64(time.Second)))
+	}
+	return n, err
+}
+
+// simulateFlakiness installs the flaky transport in the http clients of
+// backend, it returns nil for other backends
+func simulateFlakiness(backend Backend, f Flakiness) *flakyTransport {
+	var c *http.Client
+	switch b := backend.(type) {
+	case *WebDAV:
+		c = b.client
+	case *Spaces:
+		c = b.graph.client
+	case *S3:
+		c = b.client
+	case *Manifest:
+		c = b.client
+	default:
+		return nil
+	}
+	t := newFlakyTransport(c.Transport, f)
+	c.Transport = t
+	return t
+}
+
+// setFlakiness replaces the simulated flakiness with a ParseFlakiness spec,
+// "off" disables it
+func (f *FS) setFlakiness(value string) error {
+	if f.flaky == nil {
+		return fmt.Errorf("no remote backend")
+	}
+	if value == "off" {
+		value = ""
+	}
+	fl, err := ParseFlakiness(value)
+	if err != nil {
+		return err
+	}
+	f.flaky.set(fl)
+	return nil
+}
@@ -7,23 +7,92 @@
 package overlay
 
 import (
+	"container/list"
+	"context"
+	"io"
 	"io/ioutil"
-	"log"
-	"os"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"golang.org/x/net/context"
+	"github.com/butonic/ocis-overlay/loog"
 )
 
+// readdirBatchSize is the number of directory entries read per Readdir call
+const readdirBatchSize = 1024
+
 // Handle represent an open file or directory
 type Handle struct {
+	// bytesRead and bytesWritten count the I/O for the audit log, first for
+	// the alignment of atomic operations
+	bytesRead    int64
+	bytesWritten int64
+
 	fs        *FS
-	reopener  func() (*os.File, error)
+	node      *Node
+	name      string
+	reopener  func() (File, error)
 	forgetter func()
 
-	f *os.File
+	// f is nil while the backing file is closed to stay within the fd
+	// budget, users and elem are guarded by the fdPool
+	f     File
+	users int
+	elem  *list.Element
+
+	// written is set to 1 by the first write
+	written int32
+	// writeOp is the journaled write of the handle, from the first write
+	// to the release
+	writeOp uint64
+	// seen is the count of foreign changes of the node when the handle was
+	// opened or last flushed, guarded by the alock of the node
+	seen uint64
+	// writes buffers small writes, nil unless they are coalesced
+	writes *writeCoalescer
+	// directIO is set if the kernel bypasses its page cache for the handle
+	directIO bool
+	// plain is the decrypted copy of an encrypted file the handle reads and
+	// writes instead of the backing file, nil otherwise
+	plain *plainCopy
+	// whole is the content of a small file read by wholeFile, large is set
+	// if the file is too big for it
+	wlock sync.Mutex
+	whole []byte
+	large bool
+	// dirLock serializes the listings of a directory handle, they move the
+	// position of the shared directory stream
+	dirLock sync.Mutex
+	// caller opened the file
+	caller fuse.Header
+}
+
+// newHandle returns a handle for n with the open backing file f, opened by
+// the caller of the request of ctx. reopener must open the file again without
+// truncating or creating it.
+func (f *FS) newHandle(ctx context.Context, n *Node, file File, reopener func() (File, error)) *Handle {
+	h := &Handle{fs: f, node: n, name: file.Name(), f: file, reopener: reopener, caller: callerOf(ctx)}
+	if n != nil {
+		n.alock.Lock()
+		h.seen = n.foreign
+		n.alock.Unlock()
+	}
+	n.rememberHandle(h)
+	h.forgetter = func() {
+		n.forgetHandle(h)
+	}
+	f.fds.track(h)
+	return h
+}
+
+// file returns the backing file, it has to be released after use
+func (h *Handle) file() (File, error) {
+	return h.fs.fds.acquire(h)
+}
+
+func (h *Handle) release() {
+	h.fs.fds.release(h)
 }
 
 var _ fs.HandleFlusher = (*Handle)(nil)
@@ -31,21 +100,82 @@ var _ fs.HandleFlusher = (*Handle)(nil)
 // Flush implements fs.HandleFlusher interface for *Handle
 func (h *Handle) Flush(ctx context.Context,
 	req *fuse.FlushRequest) (err error) {
-	time.Sleep(h.fs.latency)
-	defer func() { log.Printf("Handle(%s).Flush(): error=%v", h.f.Name(), err) }()
-	return h.f.Sync()
+	if err = h.fs.enter(ctx, OpFlush, h); err != nil {
+		return err
+	}
+	defer func() { loog.Debug(logIO, "Flush", "path", h.name, "error", err) }()
+	if err = h.sync(); err != nil {
+		return translateError(err)
+	}
+	f, err := h.file()
+	if err != nil {
+		return translateError(err)
+	}
+	defer h.release()
+	if err = interruptible(ctx, f.Sync); err != nil {
+		return translateError(err)
+	}
+	if err = h.savePlain(ctx); err != nil {
+		return translateError(err)
+	}
+	if h.conflicted(f) {
+		return h.resolveConflict()
+	}
+	return nil
 }
 
-var _ fs.HandleReadAller = (*Handle)(nil)
+// Handle does not implement fs.HandleReadAller: bazil.org/fuse would answer
+// every read of a handle from the one ReadAll, loading files of any size
+// into memory and never seeing later changes. Small files are read whole by
+// Read instead, see wholeFile.
 
-// ReadAll implements fs.HandleReadAller interface for *Handle
-func (h *Handle) ReadAll(ctx context.Context) (d []byte, err error) {
-	time.Sleep(h.fs.latency)
-	defer func() {
-		log.Printf("Handle(%s).ReadAll(): error=%v",
-			h.f.Name(), err)
-	}()
-	return ioutil.ReadAll(h.f)
+// wholeFile returns the content of the backing file f, read once per handle
+// if it is at most readAllMax bytes. ok is false for bigger files and if
+// whole-file reads are disabled.
+func (h *Handle) wholeFile(ctx context.Context, f File) (data []byte, ok bool, err error) {
+	if h.fs.readAllMax <= 0 {
+		return nil, false, nil
+	}
+	h.wlock.Lock()
+	defer h.wlock.Unlock()
+	if h.whole != nil || h.large {
+		return h.whole, h.whole != nil, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() > h.fs.readAllMax {
+		h.large = true
+		return nil, false, nil
+	}
+	if err = h.fs.delay(ctx, OpReadAll); err != nil {
+		return nil, false, err
+	}
+	if err = h.fs.fault(OpReadAll); err != nil {
+		return nil, false, err
+	}
+	// the file may have grown since the stat
+	data, err = ioutil.ReadAll(io.NewSectionReader(f, 0, h.fs.readAllMax+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) > h.fs.readAllMax {
+		h.large = true
+		return nil, false, nil
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	h.whole = data
+	return data, true, nil
+}
+
+// forgetWhole drops the content read by wholeFile after the file changed
+func (h *Handle) forgetWhole() {
+	h.wlock.Lock()
+	defer h.wlock.Unlock()
+	h.whole, h.large = nil, false
 }
 
 var _ fs.HandleReadDirAller = (*Handle)(nil)
@@ -53,28 +183,67 @@ var _ fs.HandleReadDirAller = (*Handle)(nil)
 // ReadDirAll implements fs.HandleReadDirAller interface for *Handle
 func (h *Handle) ReadDirAll(ctx context.Context) (
 	dirs []fuse.Dirent, err error) {
-	time.Sleep(h.fs.latency)
+	if err = h.fs.enter(ctx, OpReadDir, h); err != nil {
+		return nil, err
+	}
 	defer func() {
-		log.Printf("Handle(%s).ReadDirAll(): %#+v error=%v",
-			h.f.Name(), dirs, err)
+		loog.Debug(logDir, "ReadDirAll", "path", h.name, "entries", len(dirs), "error", err)
 	}()
-	fis, err := h.f.Readdir(0)
-	if err != nil {
-		return nil, translateError(err)
+
+	defer func() {
+		if err == nil {
+			dirs = h.fs.withoutHidden(dirs)
+			if h.node != nil {
+				dirs = h.fs.plainNames(h.node.getRealPath(), dirs)
+			}
+		}
+	}()
+	if h.node != nil && h.node.getRealPath() == h.fs.rootPath {
+		defer func() {
+			if err == nil {
+				dirs = h.fs.withVirtualDirs(withoutMetaDir(dirs))
+			}
+		}()
 	}
 
-	// Readdir() reads up the entire dir stream but never resets the pointer.
-	// Consequently, when Readdir is called again on the same *File, it gets
-	// nothing. As a result, we need to close the file descriptor and re-open it
-	// so next call would work.
-	if err = h.f.Close(); err != nil {
+	if h.fs.overlay() && h.node != nil {
+		dirs, err = h.fs.readMergedDir(h.node.getRealPath(), h.node.getLowerPaths())
+		return dirs, translateError(err)
+	}
+
+	h.dirLock.Lock()
+	defer h.dirLock.Unlock()
+	f, err := h.file()
+	if err != nil {
 		return nil, translateError(err)
 	}
-	if h.f, err = h.reopener(); err != nil {
+	defer h.release()
+
+	// A previous ReadDirAll left the position at the end of the dir stream.
+	// Seeking back to the start also drops the dir buffer of the *os.File so
+	// the next Readdir starts over.
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
 		return nil, translateError(err)
 	}
 
-	return getDirentsWithFileInfos(fis), nil
+	// read in batches so huge directories never need all os.FileInfos in
+	// memory at once
+	for {
+		if err := interrupted(ctx); err != nil {
+			return nil, err
+		}
+		fis, err := f.Readdir(readdirBatchSize)
+		dirs = append(dirs, h.fs.getDirentsWithFileInfos(fis)...)
+		if h.node != nil {
+			h.fs.rememberListing(h.node.getRealPath(), fis)
+		}
+		if err == io.EOF {
+			return dirs, nil
+		}
+		if err != nil {
+			return nil, translateError(err)
+		}
+	}
 }
 
 var _ fs.HandleReader = (*Handle)(nil)
@@ -82,18 +251,48 @@ var _ fs.HandleReader = (*Handle)(nil)
 // Read implements fs.HandleReader interface for *Handle
 func (h *Handle) Read(ctx context.Context,
 	req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
-	time.Sleep(h.fs.latency)
+	if err = h.fs.enter(ctx, OpRead, h); err != nil {
+		return err
+	}
 	defer func() {
-		log.Printf("Handle(%s).Read(): error=%v",
-			h.f.Name(), err)
+		loog.Debug(logIO, "Read", "path", h.name,
+			"offset", req.Offset, "size", req.Size, "error", err)
 	}()
 
-	if _, err = h.f.Seek(req.Offset, 0); err != nil {
+	if h.node != nil {
+		h.node.drainWrites()
+	}
+	// ReadAt does not use the file offset, concurrent reads on the same
+	// handle are safe
+	f, err := h.file()
+	if err != nil {
 		return translateError(err)
 	}
-	resp.Data = make([]byte, req.Size)
-	n, err := h.f.Read(resp.Data)
-	resp.Data = resp.Data[:n]
+	defer h.release()
+	whole, ok, err := h.wholeFile(ctx, f)
+	if err != nil {
+		return translateError(err)
+	}
+	var n int
+	if ok {
+		if req.Offset < int64(len(whole)) {
+			end := req.Offset + int64(req.Size)
+			if end > int64(len(whole)) {
+				end = int64(len(whole))
+			}
+			resp.Data = append([]byte(nil), whole[req.Offset:end]...)
+		}
+		n = len(resp.Data)
+	} else {
+		resp.Data = make([]byte, req.Size)
+		n, err = f.ReadAt(resp.Data, req.Offset)
+		resp.Data = resp.Data[:n]
+	}
+	atomic.AddInt64(&h.bytesRead, int64(n))
+	atomic.AddInt64(&h.fs.stats.bytesRead, int64(n))
+	if err == io.EOF {
+		err = nil
+	}
 	return translateError(err)
 }
 
@@ -102,15 +301,56 @@ var _ fs.HandleReleaser = (*Handle)(nil)
 // Release implements fs.HandleReleaser interface for *Handle
 func (h *Handle) Release(ctx context.Context,
 	req *fuse.ReleaseRequest) (err error) {
-	time.Sleep(h.fs.latency)
+	// releasing is never interrupted or failed, the backing file has to be
+	// closed
+	h.fs.before(context.Background(), h.fs.entered(ctx, OpRelease, h))
 	defer func() {
-		log.Printf("Handle(%s).Release(): error=%v",
-			h.f.Name(), err)
+		loog.Debug(logIO, "Release", "path", h.name, "error", err)
 	}()
+	// buffered writes need the backing file and the node
+	syncErr := h.sync()
+	if syncErr == nil {
+		syncErr = h.savePlain(context.Background())
+	}
 	if h.forgetter != nil {
 		h.forgetter()
 	}
-	return h.f.Close()
+	if f := h.fs.fds.untrack(h); f != nil {
+		err = f.Close()
+	}
+	if h.plain != nil {
+		h.fs.closePlain(h.plain)
+	}
+	if err == nil {
+		err = syncErr
+	}
+	if atomic.LoadInt32(&h.written) != 0 && h.node != nil && h.fs.scanWritten(h.node.getRealPath()) {
+		h.fs.invalidateWritten(h.node)
+		h.fs.ocisWritten(h.node.getRealPath())
+		h.fs.propagate(h.node.getRealPath())
+		h.fs.emit(EventFileUploaded, h.node.getRealPath(), "")
+		h.fs.queueDedup(h.node.getRealPath())
+	}
+	h.fs.doneOp(h.writeOp)
+	if h.node != nil && !h.node.isDir {
+		h.fs.queueEncode(h.node.getRealPath())
+	}
+	if h.node != nil {
+		h.fs.auditRelease(h.caller, h.node.getRealPath(), atomic.LoadInt64(&h.bytesRead), atomic.LoadInt64(&h.bytesWritten))
+	}
+	return err
+}
+
+// savePlain encrypts the decrypted copy the handle writes to the backing
+// file, see plainCopy
+func (h *Handle) savePlain(ctx context.Context) error {
+	if h.plain == nil {
+		return nil
+	}
+	defer h.fs.pinPaths()()
+	p := h.node.getRealPath()
+	defer h.fs.lockPath(p)()
+	return h.fs.savePlain(ctx, h.plain, p)
 }
 
 var _ fs.HandleWriter = (*Handle)(nil)
@@ -118,16 +358,55 @@ var _ fs.HandleWriter = (*Handle)(nil)
 // Write implements fs.HandleWriter interface for *Handle
 func (h *Handle) Write(ctx context.Context,
 	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
-	time.Sleep(h.fs.latency)
+	if err = h.fs.enter(ctx, OpWrite, h); err != nil {
+		return err
+	}
 	defer func() {
-		log.Printf("Handle(%s).Write(): error=%v",
-			h.f.Name(), err)
+		loog.Debug(logIO, "Write", "path", h.name,
+			"offset", req.Offset, "size", len(req.Data), "error", err)
 	}()
+	if err = h.fs.reserveSpace(int64(len(req.Data))); err != nil {
+		return err
+	}
 
-	if _, err = h.f.Seek(req.Offset, 0); err != nil {
-		return translateError(err)
+	if h.node != nil {
+		defer h.node.invalidateAttr()
+		if h.directIO {
+			defer h.node.wroteDirect()
+		} else {
+			defer h.node.wroteData()
+		}
+	}
+	if atomic.SwapInt32(&h.written, 1) == 0 && h.node != nil {
+		h.writeOp = h.fs.beginOp(&opRecord{Op: opWrite, Path: h.node.getRealPath()})
+		h.fs.snapshot(ctx, h.node.getRealPath())
 	}
-	n, err := h.f.Write(req.Data)
+	if h.writes != nil {
+		if err = h.writes.write(req.Offset, req.Data); err != nil {
+			return translateError(err)
+		}
+		resp.Size = len(req.Data)
+		atomic.AddInt64(&h.bytesWritten, int64(resp.Size))
+		atomic.AddInt64(&h.fs.stats.bytesWritten, int64(resp.Size))
+		return nil
+	}
+	n, err := h.writeAt(req.Data, req.Offset)
 	resp.Size = n
+	atomic.AddInt64(&h.bytesWritten, int64(n))
+	atomic.AddInt64(&h.fs.stats.bytesWritten, int64(n))
 	return translateError(err)
 }
+
+// writeAt writes data at off to the backing file
+func (h *Handle) writeAt(data []byte, off int64) (int, error) {
+	f, err := h.file()
+	if err != nil {
+		return 0, err
+	}
+	defer h.release()
+	n, err := f.WriteAt(data, off)
+	if err == nil {
+		h.fs.killPoint(KillAfterWrite)
+	}
+	return n, err
+}
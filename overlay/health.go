@@ -0,0 +1,203 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// healthName in the root is a scratch file for health checks. It is not
+// listed and never reaches the backing store, every open gets its own empty
+// buffer, so a check can write through the kernel and read its data back.
+const healthName = ".ocis-overlay-health"
+
+// Health is the result of a health check
+type Health struct {
+	Healthy bool `json:"healthy"`
+	// Mount is ok or the error of the stat, write and read round trip
+	// through the kernel mount
+	Mount string `json:"mount"`
+	// Backend is ok or the error of a stat of the remote root, empty without
+	// a remote backend
+	Backend string `json:"backend,omitempty"`
+}
+
+// Health checks the mount and the remote backend
+func (f *FS) Health(ctx context.Context) Health {
+	h := Health{Healthy: true, Mount: "ok"}
+	if err := CheckMount(ctx, f.mountpoint); err != nil {
+		h.Healthy = false
+		h.Mount = err.Error()
+	}
+	if f.backend != nil {
+		h.Backend = "ok"
+		if _, err := f.backend.Stat(ctx, ""); err != nil {
+			h.Healthy = false
+			h.Backend = err.Error()
+		}
+	}
+	return h
+}
+
+// CheckMount verifies that the overlay mounted on mountpoint answers: it
+// stats the root, writes a random token to the health file and reads it
+// back. A hung mount makes it return with the error of ctx, the system calls
+// keep hanging in the background.
+func CheckMount(ctx context.Context, mountpoint string) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- checkMount(mountpoint)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func checkMount(mountpoint string) error {
+	if _, err := os.Stat(mountpoint); err != nil {
+		return err
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	token = []byte(hex.EncodeToString(token))
+	file, err := os.OpenFile(filepath.Join(mountpoint, healthName), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.WriteAt(token, 0); err != nil {
+		return err
+	}
+	got := make([]byte, len(token))
+	if _, err = file.ReadAt(got, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, token) {
+		return errors.New("read back different data than written")
+	}
+	return nil
+}
+
+// healthFile is the node of the health file
+type healthFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*healthFile)(nil)
+
+// Attr implements fs.Node interface for *healthFile
+func (n *healthFile) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	if err = n.fs.enter(ctx, OpAttr, n); err != nil {
+		return err
+	}
+	healthAttr(a)
+	return nil
+}
+
+func healthAttr(a *fuse.Attr) {
+	a.Mode = 0666
+	a.Mtime = time.Now()
+	a.Valid = 0
+}
+
+var _ fs.NodeOpener = (*healthFile)(nil)
+
+// Open implements fs.NodeOpener interface for *healthFile. Direct I/O keeps
+// the page cache from answering reads.
+func (n *healthFile) Open(ctx context.Context,
+	req *fuse.OpenRequest, resp *fuse.OpenResponse) (h fs.Handle, err error) {
+	if err = n.fs.enter(ctx, OpOpen, n); err != nil {
+		return nil, err
+	}
+	defer func() { loog.Debug(logFS, "Open", "path", healthName, "error", err) }()
+	resp.Flags |= fuse.OpenDirectIO
+	return &healthHandle{fs: n.fs}, nil
+}
+
+var _ fs.NodeSetattrer = (*healthFile)(nil)
+
+// Setattr implements fs.NodeSetattrer interface for *healthFile. Truncating
+// is accepted, the buffers are per handle.
+func (n *healthFile) Setattr(ctx context.Context,
+	req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	if err = n.fs.enter(ctx, OpSetattr, n); err != nil {
+		return err
+	}
+	healthAttr(&resp.Attr)
+	return nil
+}
+
+// healthHandle is an open health file
+type healthHandle struct {
+	fs *FS
+
+	lock sync.Mutex
+	data []byte
+}
+
+var _ fs.HandleReader = (*healthHandle)(nil)
+
+// Read implements fs.HandleReader interface for *healthHandle
+func (h *healthHandle) Read(ctx context.Context,
+	req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	if err = h.fs.enter(ctx, OpRead, h); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if req.Offset < int64(len(h.data)) {
+		end := req.Offset + int64(req.Size)
+		if end > int64(len(h.data)) {
+			end = int64(len(h.data))
+		}
+		resp.Data = append(resp.Data[:0], h.data[req.Offset:end]...)
+	}
+	return nil
+}
+
+var _ fs.HandleWriter = (*healthHandle)(nil)
+
+// Write implements fs.HandleWriter interface for *healthHandle. Checks write
+// a few bytes, bigger writes are refused.
+func (h *healthHandle) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	if err = h.fs.enter(ctx, OpWrite, h); err != nil {
+		return err
+	}
+	end := req.Offset + int64(len(req.Data))
+	if end > 4096 {
+		return fuse.Errno(syscall.EFBIG)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if end > int64(len(h.data)) {
+		h.data = append(h.data, make([]byte, end-int64(len(h.data)))...)
+	}
+	resp.Size = copy(h.data[req.Offset:], req.Data)
+	return nil
+}
+
+// healthProbe returns the node of the health file
+func (f *FS) healthProbe(resp *fuse.LookupResponse) fs.Node {
+	healthAttr(&resp.Attr)
+	resp.EntryValid = 0
+	return &healthFile{fs: f}
+}
@@ -0,0 +1,71 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IDMap maps user or group ids of the backing store to the ids shown in the
+// mount and back, like an idmapped mount. Unmapped ids are passed through.
+// A nil *IDMap maps nothing.
+type IDMap struct {
+	toMount   map[uint32]uint32
+	toBacking map[uint32]uint32
+}
+
+// ParseIDMap parses comma separated mount:backing id pairs, e.g. 1000:33
+// shows files owned by 33 on the backing store as owned by 1000
+func ParseIDMap(s string) (*IDMap, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := &IDMap{toMount: make(map[uint32]uint32), toBacking: make(map[uint32]uint32)}
+	for _, pair := range strings.Split(s, ",") {
+		ids := strings.Split(pair, ":")
+		if len(ids) != 2 {
+			return nil, fmt.Errorf("invalid id mapping %q, expected mount:backing", pair)
+		}
+		mount, err := strconv.ParseUint(ids[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id mapping %q: %v", pair, err)
+		}
+		backing, err := strconv.ParseUint(ids[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id mapping %q: %v", pair, err)
+		}
+		if _, ok := m.toBacking[uint32(mount)]; ok {
+			return nil, fmt.Errorf("id %d is mapped twice", mount)
+		}
+		if _, ok := m.toMount[uint32(backing)]; ok {
+			return nil, fmt.Errorf("id %d is mapped twice", backing)
+		}
+		m.toBacking[uint32(mount)] = uint32(backing)
+		m.toMount[uint32(backing)] = uint32(mount)
+	}
+	return m, nil
+}
+
+// mount returns the id shown in the mount for the backing id
+func (m *IDMap) mount(id uint32) uint32 {
+	if m == nil {
+		return id
+	}
+	if mapped, ok := m.toMount[id]; ok {
+		return mapped
+	}
+	return id
+}
+
+// backing returns the backing id for an id of the mount
+func (m *IDMap) backing(id uint32) uint32 {
+	if m == nil {
+		return id
+	}
+	if mapped, ok := m.toBacking[id]; ok {
+		return mapped
+	}
+	return id
+}
@@ -0,0 +1,65 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// foreignInodeBit marks inode numbers allocated for files that do not live
+// on the device of the root, e.g. lower layers or nested mounts. Their own
+// inode numbers could collide with the ones of the root device.
+const foreignInodeBit = 1 << 63
+
+// fileID identifies a file on the backing filesystems
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// inodeMap hands out inode numbers that are stable for the lifetime of the
+// mount. Files on the root device keep their own inode number, files of
+// other devices get a number allocated on first sight.
+type inodeMap struct {
+	rootDev uint64
+
+	lock    sync.Mutex
+	foreign map[fileID]uint64
+	next    uint64
+}
+
+func newInodeMap(root string) *inodeMap {
+	m := &inodeMap{foreign: make(map[fileID]uint64)}
+	if fi, err := os.Lstat(root); err == nil {
+		if s, ok := fi.Sys().(*syscall.Stat_t); ok {
+			m.rootDev = uint64(s.Dev)
+		}
+	}
+	return m
+}
+
+func (m *inodeMap) inode(id fileID) uint64 {
+	if id.dev == m.rootDev {
+		return id.ino
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ino, ok := m.foreign[id]
+	if !ok {
+		m.next++
+		ino = foreignInodeBit | m.next
+		m.foreign[id] = ino
+	}
+	return ino
+}
+
+// inodeOf returns the stable inode number of the file described by fi
+func (f *FS) inodeOf(fi os.FileInfo) uint64 {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return f.inodes.inode(fileID{dev: uint64(s.Dev), ino: uint64(s.Ino)})
+}
@@ -0,0 +1,170 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"hash"
+	"hash/adler32"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// EventChecksumMismatch reports a file whose content does not match its
+// checksums. oCIS has no event for it.
+const EventChecksumMismatch = "ChecksumMismatch"
+
+// integrityCacheSize is how many verified files are remembered, the cache
+// starts over when it is full
+const integrityCacheSize = 1 << 16
+
+// checksumHashes are the decomposedfs checksums by the name of their xattr
+// below ocisChecksumPrefix
+var checksumHashes = map[string]func() hash.Hash{
+	"sha1":    sha1.New,
+	"md5":     md5.New,
+	"adler32": func() hash.Hash { return adler32.New() },
+}
+
+// verifiedFile is a version of a backing file whose content was checked
+type verifiedFile struct {
+	id    fileID
+	size  int64
+	mtime time.Time
+	ok    bool
+}
+
+// integrity verifies the content of files against their checksum xattrs
+// when they are opened for reading. Every version of a file is verified
+// once, until it changes again.
+type integrity struct {
+	// mismatches counts the files that did not match, first for the
+	// alignment of atomic operations
+	mismatches uint64
+
+	lock     sync.Mutex
+	verified map[string]verifiedFile
+}
+
+func newIntegrity() *integrity {
+	return &integrity{verified: make(map[string]verifiedFile)}
+}
+
+// verifyContent checks the content of file, opened from the backing path
+// p, against the checksums recorded in the xattrs of p. Files without
+// checksums, files whose size differs from the recorded blob size because
+// they were replaced behind the mount and files written through the mount
+// right now are not checked. A mismatch is logged, counted and published
+// as an event and fails with EIO.
+func (f *FS) verifyContent(ctx context.Context, p string, file File) error {
+	in := f.integrity
+	if in == nil {
+		return nil
+	}
+	// file is a decoded copy of encoded backing files, the version is the
+	// one of the backing file
+	bfi, err := os.Stat(p)
+	if err != nil {
+		return nil
+	}
+	fi, err := file.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	id, _, _ := statID(bfi)
+	in.lock.Lock()
+	v, ok := in.verified[p]
+	in.lock.Unlock()
+	if ok && v.id == id && v.size == bfi.Size() && v.mtime.Equal(bfi.ModTime()) {
+		if !v.ok {
+			return fuse.EIO
+		}
+		return nil
+	}
+
+	want := make(map[string][]byte)
+	for name := range checksumHashes {
+		if sum, err := f.readXattr(p, ocisChecksumPrefix+name); err == nil && len(sum) > 0 {
+			want[name] = sum
+		}
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	if b, err := f.readXattr(p, ocisBlobSizeAttr); err == nil {
+		if size, err := strconv.ParseInt(string(b), 10, 64); err == nil && size != fi.Size() {
+			loog.Debug(logFS, "not verifying file replaced behind the mount", "path", p, "size", fi.Size(), "blobsize", size)
+			return nil
+		}
+	}
+	if f.beingWritten(p) {
+		return nil
+	}
+
+	hashes := make(map[string]hash.Hash, len(want))
+	writers := make([]io.Writer, 0, len(want))
+	for name := range want {
+		hashes[name] = checksumHashes[name]()
+		writers = append(writers, hashes[name])
+	}
+	r := &ctxReader{ctx: ctx, r: io.NewSectionReader(file, 0, fi.Size())}
+	if _, err = io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return err
+	}
+	v = verifiedFile{id: id, size: bfi.Size(), mtime: bfi.ModTime(), ok: true}
+	var mismatched string
+	for name, h := range hashes {
+		if !bytes.Equal(h.Sum(nil), want[name]) {
+			v.ok, mismatched = false, name
+			break
+		}
+	}
+
+	in.lock.Lock()
+	if len(in.verified) >= integrityCacheSize {
+		in.verified = make(map[string]verifiedFile)
+	}
+	in.verified[p] = v
+	in.lock.Unlock()
+	if v.ok {
+		return nil
+	}
+	atomic.AddUint64(&in.mismatches, 1)
+	loog.Error(logFS, "file content does not match its checksum", "path", p, "checksum", mismatched, "size", fi.Size())
+	f.emit(EventChecksumMismatch, p, "")
+	return fuse.EIO
+}
+
+// beingWritten reports whether a handle wrote to the file at the upper path
+// p and was not released yet, its checksums are updated on release
+func (f *FS) beingWritten(p string) bool {
+	for _, n := range f.registry.get(p) {
+		n.lock.RLock()
+		for h := range n.flushers {
+			if atomic.LoadInt32(&h.written) != 0 {
+				n.lock.RUnlock()
+				return true
+			}
+		}
+		n.lock.RUnlock()
+	}
+	return false
+}
+
+// checksumMismatches returns how many files did not match their checksums
+func (f *FS) checksumMismatches() uint64 {
+	if f.integrity == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&f.integrity.mismatches)
+}
@@ -0,0 +1,221 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Request describes a fuse request to the interceptors
+type Request struct {
+	// ID and Name identify the fuse request, Name is its type without the
+	// Request suffix, e.g. Lookup. Caller has the uid, gid and pid of the
+	// process that made it, Start is when it was received.
+	ID     fuse.RequestID
+	Name   string
+	Caller fuse.Header
+	Start  time.Time
+	// Op is the operation of the overlay handling the request and Path the
+	// backing path of the node it is handled by, both are empty if the
+	// request was answered before a handler was entered. Handlers that
+	// audit their changes set Path to the path they changed and Target to
+	// the new path of a rename or link, the target of a symlink or the name
+	// of an xattr.
+	Op     Op
+	Path   string
+	Target string
+
+	// audited and auditErr are set by FS.audit
+	audited  bool
+	auditErr error
+	// serial is set while the request has the turn of serialInterceptor
+	serial bool
+}
+
+// Interceptor sees every request the overlay handles, to add policy,
+// logging or metrics without changing the handlers. The built-in
+// interceptors add the -latency, inject the -faults, count the Stats and
+// write the audit log, Options.Interceptors follow them.
+type Interceptor interface {
+	// Before is called when a handler is entered, in the order of the
+	// chain. An error fails the request with it, the handler and the
+	// following interceptors are skipped. It is not called for requests the
+	// fuse server answers itself, like Forget, and it is called again if a
+	// handler enters another one. Handlers of Release ignore the error,
+	// their backing file has to be closed.
+	Before(ctx context.Context, r *Request) error
+	// After is called once the request was answered, in the reverse order
+	// of the chain, with the name of the errno it failed with, empty if it
+	// succeeded. It is called for every request, also if Before failed or
+	// never ran.
+	After(ctx context.Context, r *Request, errno string)
+}
+
+// requestKey is the context key of the *Request of a request
+type requestKey struct{}
+
+// requestOf returns the request ctx belongs to, nil outside of handlers
+func requestOf(ctx context.Context) *Request {
+	r, _ := ctx.Value(requestKey{}).(*Request)
+	return r
+}
+
+// inflight are the requests not answered yet
+type inflight struct {
+	lock     sync.Mutex
+	requests map[fuse.RequestID]inflightRequest
+}
+
+type inflightRequest struct {
+	ctx context.Context
+	r   *Request
+}
+
+// withRequest wraps withContext to describe every request for the
+// interceptors, the result is the WithContext function of the fuse server
+func (f *FS) withRequest(withContext func(context.Context, fuse.Request) context.Context) func(context.Context, fuse.Request) context.Context {
+	return func(ctx context.Context, req fuse.Request) context.Context {
+		ctx = withContext(ctx, req)
+		h := req.Hdr()
+		r := &Request{
+			ID:     h.ID,
+			Name:   requestName(req),
+			Caller: callerOf(ctx),
+			Start:  time.Now(),
+		}
+		ctx = context.WithValue(ctx, requestKey{}, r)
+		f.inflight.lock.Lock()
+		if f.inflight.requests == nil {
+			f.inflight.requests = make(map[fuse.RequestID]inflightRequest)
+		}
+		f.inflight.requests[h.ID] = inflightRequest{ctx: ctx, r: r}
+		f.inflight.lock.Unlock()
+		return ctx
+	}
+}
+
+// requestName returns the name of the type of req without the Request
+// suffix, like the fuse server names requests in its debug messages
+func requestName(req fuse.Request) string {
+	return strings.TrimSuffix(reflect.Indirect(reflect.ValueOf(req)).Type().Name(), "Request")
+}
+
+// entered records the operation and the node of the handler of the request
+// of ctx. It returns the request, a new one outside of handlers.
+func (f *FS) entered(ctx context.Context, op Op, node traced) *Request {
+	r := requestOf(ctx)
+	if r == nil {
+		r = &Request{Caller: callerOf(ctx), Start: time.Now()}
+	}
+	r.Op, r.Path = op, node.tracePath()
+	return r
+}
+
+// before runs Before of the interceptors until one fails
+func (f *FS) before(ctx context.Context, r *Request) error {
+	for _, i := range f.interceptors {
+		if err := i.Before(ctx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// answered runs After of the interceptors for the request id, name is the
+// name of the request in case it is not known
+func (f *FS) answered(id fuse.RequestID, name string, errno string) {
+	f.inflight.lock.Lock()
+	ir, ok := f.inflight.requests[id]
+	delete(f.inflight.requests, id)
+	f.inflight.lock.Unlock()
+	if !ok {
+		ir = inflightRequest{ctx: context.Background(), r: &Request{ID: id, Name: name, Start: time.Now()}}
+	}
+	for i := len(f.interceptors) - 1; i >= 0; i-- {
+		f.interceptors[i].After(ir.ctx, ir.r, errno)
+	}
+}
+
+// latencyInterceptor adds the configured latency before every operation
+type latencyInterceptor struct {
+	fs *FS
+}
+
+func (i latencyInterceptor) Before(ctx context.Context, r *Request) error {
+	return i.fs.delay(ctx, r.Op)
+}
+
+func (latencyInterceptor) After(context.Context, *Request, string) {}
+
+// faultInterceptor injects the configured faults and the errors of a
+// full -space-limit
+type faultInterceptor struct {
+	fs *FS
+}
+
+func (i faultInterceptor) Before(ctx context.Context, r *Request) error {
+	return i.fs.fault(r.Op)
+}
+
+func (faultInterceptor) After(context.Context, *Request, string) {}
+
+// serialInterceptor answers one request at a time for -serialize. The turn
+// is taken once a handler is entered, when the fuse server already
+// registered the request for interrupts, so a request waiting for it can be
+// interrupted. It is given up once the request was answered. Requests the
+// fuse server answers itself, like Forget, do not wait for it.
+type serialInterceptor struct {
+	fs *FS
+}
+
+func (i serialInterceptor) Before(ctx context.Context, r *Request) error {
+	if r.serial || requestOf(ctx) != r {
+		// a handler entered by another one, or no fuse request at all
+		return nil
+	}
+	select {
+	case i.fs.serial <- struct{}{}:
+		r.serial = true
+		return nil
+	case <-ctx.Done():
+		return errInterrupted
+	}
+}
+
+func (i serialInterceptor) After(ctx context.Context, r *Request, errno string) {
+	if r.serial {
+		r.serial = false
+		<-i.fs.serial
+	}
+}
+
+// statsInterceptor counts the answered requests for Stats
+type statsInterceptor struct {
+	fs *FS
+}
+
+func (statsInterceptor) Before(context.Context, *Request) error { return nil }
+
+func (i statsInterceptor) After(ctx context.Context, r *Request, errno string) {
+	i.fs.stats.answered(r.Name, errno)
+}
+
+// auditInterceptor writes the changes the handlers audited to the audit log
+// once they are answered
+type auditInterceptor struct {
+	fs *FS
+}
+
+func (auditInterceptor) Before(context.Context, *Request) error { return nil }
+
+func (i auditInterceptor) After(ctx context.Context, r *Request, errno string) {
+	if r.audited {
+		i.fs.auditAnswered(r)
+	}
+}
@@ -0,0 +1,41 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// errInterrupted is returned for requests the kernel interrupted, e.g.
+// because the calling process got a signal. The request context is canceled
+// by the fuse server when an interrupt request arrives.
+var errInterrupted = fuse.Errno(syscall.EINTR)
+
+// interrupted returns errInterrupted if ctx is done
+func interrupted(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return errInterrupted
+	default:
+		return nil
+	}
+}
+
+// interruptible runs fn, which may block on a hung backing store, and
+// returns errInterrupted if ctx is done first. fn keeps running in the
+// background then, so it must only use state that stays valid on its own.
+func interruptible(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errInterrupted
+	}
+}
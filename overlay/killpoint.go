@@ -0,0 +1,102 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// KillPoint is a point in a handler where an armed overlay kills itself
+// with SIGKILL, leaving the backing store in the state of a crash right
+// there: nothing is flushed, the mount is left disconnected. Applications
+// and checkers can then verify how they cope with the torn operation.
+type KillPoint string
+
+// Kill points that can be armed with CmdKill
+const (
+	// KillAfterWrite is after the data of a write reached the backing file,
+	// before the write is answered and before any fsync
+	KillAfterWrite KillPoint = "after-write-before-fsync"
+	// KillBeforeFsync is when an fsync came in, before the backing file is
+	// synced
+	KillBeforeFsync KillPoint = "before-fsync"
+	// KillAfterFsync is after the backing file was synced, before the fsync
+	// is answered
+	KillAfterFsync KillPoint = "after-fsync"
+	// KillMidCreate is after a file was created in the backing store,
+	// before its metadata is initialized and the etags are propagated
+	KillMidCreate KillPoint = "mid-create"
+	// KillMidRename is after a file was renamed in the backing store,
+	// before its versions and metadata are moved and the etags are
+	// propagated
+	KillMidRename KillPoint = "mid-rename"
+)
+
+// KillPoints are all kill points
+var KillPoints = []KillPoint{KillAfterWrite, KillBeforeFsync, KillAfterFsync, KillMidCreate, KillMidRename}
+
+// killSwitch is an armed kill point, it fires on the nth time the point is
+// passed
+type killSwitch struct {
+	// hits is first for the alignment of atomic operations
+	hits  uint64
+	point KillPoint
+	nth   uint64
+}
+
+// parseKillPoint parses point[:n], n defaults to 1
+func parseKillPoint(value string) (*killSwitch, error) {
+	parts := strings.SplitN(value, ":", 2)
+	k := &killSwitch{point: KillPoint(parts[0]), nth: 1}
+	known := false
+	for _, p := range KillPoints {
+		known = known || p == k.point
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown kill point %q", parts[0])
+	}
+	if len(parts) == 2 {
+		n, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid kill point %q, expected point[:n]", value)
+		}
+		k.nth = n
+	}
+	return k, nil
+}
+
+// setKillPoint arms a kill point given as point[:n], "off" disarms it
+func (f *FS) setKillPoint(value string) error {
+	var k *killSwitch
+	if value != "off" {
+		var err error
+		if k, err = parseKillPoint(value); err != nil {
+			return err
+		}
+	}
+	f.ctl.Lock()
+	defer f.ctl.Unlock()
+	f.kill = k
+	return nil
+}
+
+// killPoint kills the process if p is armed and passed for the nth time
+func (f *FS) killPoint(p KillPoint) {
+	f.ctl.RLock()
+	k := f.kill
+	f.ctl.RUnlock()
+	if k == nil || k.point != p || atomic.AddUint64(&k.hits, 1) != k.nth {
+		return
+	}
+	loog.Error(logFault, "kill point reached, killing the process", "point", p, "hits", k.nth)
+	syscall.Kill(os.Getpid(), syscall.SIGKILL)
+	// SIGKILL cannot be handled, but is delivered asynchronously
+	select {}
+}
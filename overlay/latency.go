@@ -0,0 +1,195 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Op names a fuse operation handled by the overlay
+type Op string
+
+// Operations handled by the overlay
+const (
+	OpRoot        Op = "root"
+	OpStatfs      Op = "statfs"
+	OpAccess      Op = "access"
+	OpAttr        Op = "attr"
+	OpLookup      Op = "lookup"
+	OpOpen        Op = "open"
+	OpCreate      Op = "create"
+	OpMkdir       Op = "mkdir"
+	OpMknod       Op = "mknod"
+	OpSymlink     Op = "symlink"
+	OpLink        Op = "link"
+	OpReadlink    Op = "readlink"
+	OpRemove      Op = "remove"
+	OpFsync       Op = "fsync"
+	OpSetattr     Op = "setattr"
+	OpRename      Op = "rename"
+	OpGetxattr    Op = "getxattr"
+	OpListxattr   Op = "listxattr"
+	OpSetxattr    Op = "setxattr"
+	OpRemovexattr Op = "removexattr"
+	OpFlush       Op = "flush"
+	OpReadAll     Op = "readall"
+	OpReadDir     Op = "readdir"
+	OpRead        Op = "read"
+	OpRelease     Op = "release"
+	OpWrite       Op = "write"
+)
+
+// Ops lists all operations handled by the overlay
+var Ops = []Op{
+	OpRoot, OpStatfs, OpAccess, OpAttr, OpLookup, OpOpen, OpCreate, OpMkdir,
+	OpMknod, OpSymlink, OpLink, OpReadlink, OpRemove, OpFsync, OpSetattr, OpRename,
+	OpGetxattr, OpListxattr, OpSetxattr, OpRemovexattr, OpFlush, OpReadAll,
+	OpReadDir, OpRead, OpRelease, OpWrite,
+}
+
+// ParseOp parses the name of an operation
+func ParseOp(s string) (Op, error) {
+	for _, op := range Ops {
+		if string(op) == s {
+			return op, nil
+		}
+	}
+	return "", fmt.Errorf("unknown operation %q", s)
+}
+
+// Distribution describes how the jitter of a latency is distributed
+type Distribution string
+
+// Supported latency distributions
+const (
+	// Fixed always waits exactly the configured latency
+	Fixed Distribution = "fixed"
+	// Uniform adds a uniformly distributed jitter in [-Jitter, Jitter]
+	Uniform Distribution = "uniform"
+	// Normal adds a normally distributed jitter with Jitter as the standard
+	// deviation
+	Normal Distribution = "normal"
+)
+
+// Latency is an artificial delay added to fuse handlers
+type Latency struct {
+	// Default applies to all operations without an explicit latency
+	Default time.Duration
+	// PerOp overrides the latency of individual operations
+	PerOp map[Op]time.Duration
+	// Distribution of the jitter, defaults to Fixed
+	Distribution Distribution
+	// Jitter is the spread around the latency
+	Jitter time.Duration
+}
+
+// ParseLatency parses either a single duration that applies to every
+// operation, e.g. "10ms", or a comma separated list of op=duration pairs, e.g.
+// "read=20ms,write=50ms,lookup=5ms". The op default sets the latency of all
+// other operations.
+func ParseLatency(spec string) (Latency, error) {
+	var l Latency
+	if spec == "" {
+		return l, nil
+	}
+	if !strings.Contains(spec, "=") {
+		d, err := time.ParseDuration(spec)
+		l.Default = d
+		return l, err
+	}
+	l.PerOp = make(map[Op]time.Duration)
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return l, fmt.Errorf("invalid latency %q, expected op=duration", pair)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return l, err
+		}
+		if kv[0] == "default" {
+			l.Default = d
+			continue
+		}
+		op, err := ParseOp(kv[0])
+		if err != nil {
+			return l, err
+		}
+		l.PerOp[op] = d
+	}
+	return l, nil
+}
+
+// ParseDistribution parses fixed, uniform or normal
+func ParseDistribution(s string) (Distribution, error) {
+	switch d := Distribution(s); d {
+	case Fixed, Uniform, Normal:
+		return d, nil
+	case "":
+		return Fixed, nil
+	default:
+		return "", fmt.Errorf("unknown distribution %q", s)
+	}
+}
+
+// sample returns the delay for the next call of op
+func (l Latency) sample(op Op) time.Duration {
+	d, ok := l.PerOp[op]
+	if !ok {
+		d = l.Default
+	}
+	if d <= 0 && l.Jitter <= 0 {
+		return 0
+	}
+	switch l.Distribution {
+	case Uniform:
+		d += time.Duration((rand.Float64()*2 - 1) * float64(l.Jitter))
+	case Normal:
+		d += time.Duration(rand.NormFloat64() * float64(l.Jitter))
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// delay blocks for the configured latency of op, or until ctx is done
+func (f *FS) delay(ctx context.Context, op Op) error {
+	f.ctl.RLock()
+	l := f.latency
+	f.ctl.RUnlock()
+	d := l.sample(op)
+	if d <= 0 {
+		return interrupted(ctx)
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return errInterrupted
+	}
+}
+
+// enter is called at the start of every fuse handler of node. It returns
+// ESHUTDOWN once Shutdown started and runs the interceptors, which add the
+// configured latency and return injected faults or EINTR if the request was
+// interrupted in the meantime.
+func (f *FS) enter(ctx context.Context, op Op, node traced) error {
+	if s := spanOf(ctx); s != nil {
+		s.setOp(op, node.tracePath())
+	}
+	r := f.entered(ctx, op, node)
+	if f.shuttingDown() {
+		return errShutdown
+	}
+	if err := f.checkCaller(ctx); err != nil {
+		return err
+	}
+	return f.before(ctx, r)
+}
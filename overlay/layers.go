@@ -0,0 +1,465 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/pkg/xattr"
+)
+
+// Whiteouts and opaque directories use the same markers as OCI image layers:
+// an empty file named .wh.<name> in the upper layer hides <name> of the lower
+// layer, a .wh..wh..opq file hides all lower entries of its directory.
+const (
+	whiteoutPrefix = ".wh."
+	opaqueMarker   = ".wh..wh..opq"
+)
+
+func isWhiteoutName(name string) bool {
+	return strings.HasPrefix(name, whiteoutPrefix)
+}
+
+func whiteoutPath(dir string, name string) string {
+	return filepath.Join(dir, whiteoutPrefix+name)
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+// overlay reports whether the FS merges read-only lower layers with the
+// writable upper layer
+func (f *FS) overlay() bool {
+	return len(f.lowers) > 0
+}
+
+// lowerChildren returns the paths of name in the lower layers of the
+// directory with the upper path upperDir and the lower paths lowerDirs. The
+// paths of hidden or missing entries are empty. Layers are searched top-down
+// and only directories are merged, so the first entry that is not a
+// directory shadows everything below it. fi describes the topmost entry.
+func (f *FS) lowerChildren(upperDir string, lowerDirs []string, name string) (paths []string, fi os.FileInfo) {
+	if isWhiteoutName(name) {
+		return nil, nil
+	}
+	if exists(whiteoutPath(upperDir, name)) || exists(filepath.Join(upperDir, opaqueMarker)) {
+		return nil, nil
+	}
+	paths = make([]string, len(lowerDirs))
+	for i, ld := range lowerDirs {
+		if ld == "" {
+			continue
+		}
+		lp := filepath.Join(ld, name)
+		if lfi, err := os.Lstat(lp); err == nil {
+			if fi == nil {
+				fi = lfi
+			}
+			if !fi.IsDir() || !lfi.IsDir() {
+				if fi == lfi {
+					paths[i] = lp
+				}
+				break
+			}
+			paths[i] = lp
+		}
+		// whiteouts and opaque markers of a lower layer hide the layers below
+		if exists(whiteoutPath(ld, name)) || exists(filepath.Join(ld, opaqueMarker)) {
+			break
+		}
+	}
+	if fi == nil {
+		return nil, nil
+	}
+	return paths, fi
+}
+
+// firstPath returns the topmost non empty layer path
+func firstPath(paths []string) string {
+	for _, p := range paths {
+		if p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+func (n *Node) getLowerPaths() []string {
+	n.rpLock.RLock()
+	defer n.rpLock.RUnlock()
+	return n.lowerPaths
+}
+
+func (n *Node) updateLowerPaths(lowerPaths []string) {
+	n.rpLock.Lock()
+	defer n.rpLock.Unlock()
+	n.lowerPaths = lowerPaths
+}
+
+// resolvedPath returns the path of the topmost layer that contains the node
+func (n *Node) resolvedPath() string {
+	rp := n.getRealPath()
+	if !n.fs.overlay() || exists(rp) {
+		return rp
+	}
+	if lp := firstPath(n.getLowerPaths()); lp != "" {
+		return lp
+	}
+	return rp
+}
+
+// copyUp makes sure the node exists in the upper layer so it can be
+// modified, without changing a snapshot
+func (n *Node) copyUp(ctx context.Context) error {
+	if !n.fs.overlay() && !n.fs.snaps.any() {
+		return nil
+	}
+	n.fs.clock.Lock()
+	defer n.fs.clock.Unlock()
+	if err := n.fs.copyUpPath(ctx, n.getRealPath(), firstPath(n.getLowerPaths())); err != nil {
+		return err
+	}
+	return n.fs.unshareSnapshot(ctx, n.getRealPath())
+}
+
+func (f *FS) copyUpPath(ctx context.Context, upper string, lower string) error {
+	if exists(upper) || lower == "" {
+		return nil
+	}
+	if err := f.copyUpPath(ctx, filepath.Dir(upper), filepath.Dir(lower)); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(lower)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.IsDir():
+		err = os.Mkdir(upper, fi.Mode().Perm())
+	case fi.Mode()&os.ModeSymlink != 0:
+		var target string
+		if target, err = os.Readlink(lower); err == nil {
+			err = os.Symlink(target, upper)
+		}
+	case fi.Mode().IsRegular() && f.encrypting():
+		err = f.encryptCopy(ctx, upper, lower, fi)
+	case fi.Mode().IsRegular() && f.ops != nil:
+		err = f.copyUpAtomic(ctx, upper, lower, fi)
+	case fi.Mode().IsRegular():
+		err = copyFile(ctx, upper, lower, fi.Mode().Perm())
+	default:
+		// special files only carry their type and device number
+		s, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fuse.Errno(syscall.EXDEV)
+		}
+		err = syscall.Mknod(upper, modeToSyscall(fi.Mode()), int(s.Rdev))
+	}
+	if err != nil {
+		return err
+	}
+	copyMetadata(upper, lower, fi)
+	f.copyxattrs(upper, lower)
+	return nil
+}
+
+func copyFile(ctx context.Context, dst string, src string, perm os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err = copySparse(ctx, out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// sparseBlockSize is the granularity copySparse detects holes with
+const sparseBlockSize = 64 * 1024
+
+// copySparse copies in to out and seeks over blocks of zeros instead of
+// writing them, so copied up sparse files keep their holes. Copying large
+// files can be interrupted.
+func copySparse(ctx context.Context, out *os.File, in io.Reader) error {
+	buf := make([]byte, sparseBlockSize)
+	var size int64
+	for {
+		if err := interrupted(ctx); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				_, err = out.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = out.Write(buf[:n])
+			}
+			if err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a trailing hole is only allocated by setting the size
+			return out.Truncate(size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// copyMetadata copies ownership, times and xattrs on a best effort basis
+func copyMetadata(dst string, src string, fi os.FileInfo) {
+	if s, ok := fi.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(dst, int(s.Uid), int(s.Gid))
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+		if names, err := xattr.List(src); err == nil {
+			for _, name := range names {
+				if v, err := xattr.Get(src, name); err == nil {
+					xattr.Set(dst, name, v)
+				}
+			}
+		}
+	}
+}
+
+// prepareCreate is called before name is created in the upper layer of the
+// directory. It copies up the directory and removes a whiteout for name. It
+// reports whether a whiteout was removed, in which case a new directory must
+// be made opaque. Hidden names cannot be created.
+func (n *Node) prepareCreate(ctx context.Context, name string) (whiteout bool, err error) {
+	if n.fs.hidden(name) {
+		return false, fuse.EPERM
+	}
+	if !n.fs.overlay() {
+		return false, nil
+	}
+	if err = n.copyUp(ctx); err != nil {
+		return false, err
+	}
+	wh := whiteoutPath(n.getRealPath(), name)
+	if exists(wh) {
+		if err = os.Remove(wh); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// makeOpaque hides the lower layer entries of the upper directory dir
+func makeOpaque(dir string) error {
+	f, err := os.OpenFile(filepath.Join(dir, opaqueMarker), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// createWhiteout hides name of the lower layer
+func createWhiteout(dir string, name string) error {
+	f, err := os.OpenFile(whiteoutPath(dir, name), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readMergedDir lists the directory with the upper path upperDir and the
+// lower paths lowerDirs. Entries of upper layers shadow the ones below,
+// whiteouts and opaque markers hide entries of the layers below and are never
+// listed themselves.
+func (f *FS) readMergedDir(upperDir string, lowerDirs []string) ([]fuse.Dirent, error) {
+	var dirs []fuse.Dirent
+	seen := make(map[string]bool)
+	for i, d := range append([]string{upperDir}, lowerDirs...) {
+		if d == "" {
+			continue
+		}
+		fis, err := readDirPath(d)
+		if err != nil {
+			if i == 0 && os.IsNotExist(err) && len(lowerDirs) > 0 {
+				// not copied up yet
+				continue
+			}
+			return nil, err
+		}
+		if i == 0 {
+			f.rememberListing(upperDir, fis)
+		}
+		opaque := false
+		var whiteouts []string
+		for _, fi := range fis {
+			name := fi.Name()
+			switch {
+			case name == opaqueMarker:
+				opaque = true
+			case isWhiteoutName(name):
+				whiteouts = append(whiteouts, strings.TrimPrefix(name, whiteoutPrefix))
+			case !seen[name]:
+				seen[name] = true
+				dirs = append(dirs, f.getDirentsWithFileInfos([]os.FileInfo{fi})...)
+			}
+		}
+		if opaque {
+			break
+		}
+		for _, name := range whiteouts {
+			seen[name] = true
+		}
+	}
+	return dirs, nil
+}
+
+func readDirPath(p string) ([]os.FileInfo, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(0)
+}
+
+// isEmptyMergedDir reports whether the merged view of a directory is empty
+func (f *FS) isEmptyMergedDir(upperDir string, lowerDirs []string) (bool, error) {
+	dirs, err := f.readMergedDir(upperDir, lowerDirs)
+	return len(dirs) == 0, err
+}
+
+// removeLayered removes name from the directory, dir tells rmdir from unlink.
+// Upper entries are deleted, a whiteout hides the entry of the lower layer.
+func (n *Node) removeLayered(ctx context.Context, name string, dir bool) error {
+	rp := n.getRealPath()
+	upper := filepath.Join(rp, name)
+	lps, lfi := n.fs.lowerChildren(rp, n.getLowerPaths(), name)
+	ufi, err := os.Lstat(upper)
+	if err != nil && lfi == nil {
+		return err
+	}
+	fi := ufi
+	if fi == nil {
+		fi = lfi
+	}
+	switch {
+	case dir && !fi.IsDir():
+		return fuse.Errno(syscall.ENOTDIR)
+	case !dir && fi.IsDir():
+		return fuse.Errno(syscall.EISDIR)
+	}
+	if fi.IsDir() {
+		var lowerDirs []string
+		if lfi != nil && lfi.IsDir() && (ufi == nil || ufi.IsDir()) {
+			lowerDirs = lps
+		}
+		empty, err := n.fs.isEmptyMergedDir(upper, lowerDirs)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		if ufi != nil {
+			// only whiteouts and the opaque marker are left
+			if err = os.RemoveAll(upper); err != nil {
+				return err
+			}
+		}
+	} else if ufi != nil {
+		if err = os.Remove(upper); err != nil {
+			return err
+		}
+	}
+	if lfi == nil {
+		return nil
+	}
+	if err = n.copyUp(ctx); err != nil {
+		return err
+	}
+	return createWhiteout(rp, name)
+}
+
+// renameLayered renames oldName to newName in newDir. The source is copied up
+// first and hidden by a whiteout if it also exists in a lower layer.
+// Directories that exist in a lower layer cannot be renamed, like with
+// overlayfs callers get EXDEV and fall back to copy and delete.
+func (n *Node) renameLayered(ctx context.Context, oldName string, newDir *Node, newName string) error {
+	rp := n.getRealPath()
+	op := filepath.Join(rp, oldName)
+	np := filepath.Join(newDir.getRealPath(), newName)
+
+	lps, lfi := n.fs.lowerChildren(rp, n.getLowerPaths(), oldName)
+	ufi, err := os.Lstat(op)
+	if err != nil && lfi == nil {
+		return err
+	}
+	isDir := (ufi != nil && ufi.IsDir()) || (ufi == nil && lfi.IsDir())
+	if isDir && lfi != nil {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	if err = n.copyUp(ctx); err != nil {
+		return err
+	}
+	if ufi == nil {
+		n.fs.clock.Lock()
+		err = n.fs.copyUpPath(ctx, op, firstPath(lps))
+		n.fs.clock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	tls, tlfi := n.fs.lowerChildren(newDir.getRealPath(), newDir.getLowerPaths(), newName)
+	if isDir && tlfi != nil && tlfi.IsDir() {
+		empty, err := n.fs.isEmptyMergedDir(np, tls)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if !empty {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+	whiteout, err := newDir.prepareCreate(ctx, newName)
+	if err != nil {
+		return err
+	}
+	if err = n.fs.renameBacking(op, np, func() error { return os.Rename(op, np) }); err != nil {
+		return err
+	}
+	if isDir && (whiteout || tlfi != nil && tlfi.IsDir()) {
+		if err = makeOpaque(np); err != nil {
+			return err
+		}
+	}
+	if lfi != nil {
+		return createWhiteout(rp, oldName)
+	}
+	return nil
+}
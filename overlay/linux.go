@@ -8,13 +8,54 @@ package overlay
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"bazil.org/fuse"
+	"golang.org/x/sys/unix"
 )
 
+// openDirFlags open a directory only to use it with the *at syscalls
+const openDirFlags = unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC
+
+// lstatAt returns the file info of name in the directory dfd without
+// following symlinks. An O_PATH descriptor of the entry is stat'ed so the
+// result carries a *syscall.Stat_t like os.Lstat. p is used for errors.
+func lstatAt(dfd int, p string, name string) (os.FileInfo, error) {
+	fd, err := unix.Openat(dfd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, atError("lstatat", p, err)
+	}
+	f := os.NewFile(uintptr(fd), p)
+	defer f.Close()
+	return f.Stat()
+}
+
+// openDirect is O_DIRECT in fuse.OpenFlags
+const openDirect = fuse.OpenFlags(syscall.O_DIRECT)
+
+// openExec is __FMODE_EXEC in fuse.OpenFlags, the kernel opens binaries and
+// shared libraries it executes with it
+const openExec = fuse.OpenFlags(0x20)
+
+// fillStatfs fills resp with the statfs of the backing file system
+func fillStatfs(resp *fuse.StatfsResponse, s *syscall.Statfs_t) {
+	resp.Blocks = s.Blocks
+	resp.Bfree = s.Bfree
+	resp.Bavail = s.Bavail
+	resp.Files = s.Files
+	resp.Ffree = s.Ffree
+	resp.Bsize = uint32(s.Bsize)
+	resp.Namelen = uint32(s.Namelen)
+	resp.Frsize = uint32(s.Frsize)
+}
+
 func fillAttrWithFileInfo(a *fuse.Attr, fi os.FileInfo) {
 	s := fi.Sys().(*syscall.Stat_t)
 	a.Valid = attrValidDuration
@@ -28,10 +69,137 @@ func fillAttrWithFileInfo(a *fuse.Attr, fi os.FileInfo) {
 	a.Nlink = uint32(s.Nlink)
 	a.Uid = s.Uid
 	a.Gid = s.Gid
+	a.Rdev = uint32(s.Rdev)
 	a.BlockSize = uint32(s.Blksize)
 }
 
+// utimens sets the access and modification times of p with nanosecond
+// precision, nil times are left unchanged. Symlinks are not followed.
+func utimens(p string, atime *time.Time, mtime *time.Time) error {
+	ts := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, {Nsec: unix.UTIME_OMIT}}
+	if atime != nil {
+		ts[0] = unix.NsecToTimespec(atime.UnixNano())
+	}
+	if mtime != nil {
+		ts[1] = unix.NsecToTimespec(mtime.UnixNano())
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
 func (n *Node) setattrPlatformSpecific(ctx context.Context,
 	req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
 	return nil
 }
+
+// keyringCommand returns the command printing the secret of account in the
+// keyring, the Secret Service of the desktop session
+func keyringCommand(account string) *exec.Cmd {
+	return exec.Command("secret-tool", "lookup", "service", keyringService, "account", account)
+}
+
+// ficlone is the FICLONE ioctl
+const ficlone = 0x40049409
+
+// reflink makes dst share the data of src copy-on-write, on file systems
+// like btrfs and XFS
+func reflink(dst *os.File, src *os.File) error {
+	return unix.IoctlSetInt(int(dst.Fd()), ficlone, int(src.Fd()))
+}
+
+// memFile creates a file in memory named name, for content that must not be
+// written to disk. It returns the path that opens it again while it is
+// open.
+func memFile(name string) (*os.File, string, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, "", os.NewSyscallError("memfd_create", err)
+	}
+	return os.NewFile(uintptr(fd), name), "/proc/self/fd/" + strconv.Itoa(fd), nil
+}
+
+const (
+	// fideduperange is the FIDEDUPERANGE ioctl
+	fideduperange = 0xc0189436
+	// dedupeChunk is the range shared per ioctl, btrfs caps it at 16MiB
+	dedupeChunk = 16 << 20
+)
+
+// fileDedupeRange is struct file_dedupe_range with one destination
+type fileDedupeRange struct {
+	srcOffset    uint64
+	srcLength    uint64
+	destCount    uint16
+	reserved1    uint16
+	reserved2    uint32
+	destFd       int64
+	destOffset   uint64
+	bytesDeduped uint64
+	status       int32
+	reserved     uint32
+}
+
+// dedupe makes dst share the data of the first size bytes of src as far as
+// their content is the same, the kernel compares them while both are
+// locked. It returns the bytes shared.
+func dedupe(dst *os.File, src *os.File, size int64) (int64, error) {
+	var done int64
+	for done < size {
+		r := fileDedupeRange{
+			srcOffset:  uint64(done),
+			srcLength:  uint64(size - done),
+			destCount:  1,
+			destFd:     int64(dst.Fd()),
+			destOffset: uint64(done),
+		}
+		if r.srcLength > dedupeChunk {
+			r.srcLength = dedupeChunk
+		}
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, src.Fd(), fideduperange, uintptr(unsafe.Pointer(&r)))
+		if errno != 0 {
+			return done, errno
+		}
+		if r.status < 0 {
+			return done, syscall.Errno(-r.status)
+		}
+		// FILE_DEDUPE_RANGE_DIFFERS
+		if r.status != 0 || r.bytesDeduped == 0 {
+			return done, nil
+		}
+		done += int64(r.bytesDeduped)
+	}
+	return done, nil
+}
+
+// smbMounts returns the mounted SMB shares from the mount table
+func smbMounts() ([]smbMount, error) {
+	b, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	var mounts []smbMount
+	for _, line := range strings.Split(string(b), "\n") {
+		// source dir type options, spaces are escaped as \040
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[2] != "cifs" && fields[2] != "smb3" {
+			continue
+		}
+		mounts = append(mounts, smbMount{source: unescapeMount(fields[0]), dir: unescapeMount(fields[1])})
+	}
+	return mounts, nil
+}
+
+// unescapeMount replaces the octal escapes of a field of the mount table
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxListings limits the number of directories whose entries are kept after
+// a directory read
+const maxListings = 64
+
+// listing holds the file infos of a directory read, so the lookups the
+// kernel sends for every entry afterwards, e.g. for ls -l, do not need to
+// stat the backing files again. This is what READDIRPLUS would return in one
+// go, but the fuse library does not support it.
+type listing struct {
+	expiry time.Time
+	fis    map[string]os.FileInfo
+}
+
+type listings struct {
+	lock sync.Mutex
+	dirs map[string]*listing
+}
+
+// rememberListing keeps the file infos of the upper directory dir for one
+// attribute timeout. Directories read in batches add to the same listing.
+func (f *FS) rememberListing(dir string, fis []os.FileInfo) {
+	if f.attrTimeout <= 0 || len(fis) == 0 {
+		return
+	}
+	f.listings.lock.Lock()
+	defer f.listings.lock.Unlock()
+	if f.listings.dirs == nil {
+		f.listings.dirs = make(map[string]*listing)
+	}
+	now := time.Now()
+	l := f.listings.dirs[dir]
+	if l == nil || now.After(l.expiry) {
+		if len(f.listings.dirs) >= maxListings {
+			for d, old := range f.listings.dirs {
+				if now.After(old.expiry) || len(f.listings.dirs) >= maxListings {
+					delete(f.listings.dirs, d)
+				}
+			}
+		}
+		l = &listing{
+			expiry: now.Add(f.attrTimeout),
+			fis:    make(map[string]os.FileInfo, len(fis)),
+		}
+		f.listings.dirs[dir] = l
+	}
+	for _, fi := range fis {
+		l.fis[fi.Name()] = fi
+	}
+}
+
+// listedFileInfo returns and forgets the file info of name in the upper
+// directory dir if it was read recently
+func (f *FS) listedFileInfo(dir string, name string) os.FileInfo {
+	f.listings.lock.Lock()
+	defer f.listings.lock.Unlock()
+	l := f.listings.dirs[dir]
+	if l == nil {
+		f.stats.listings.count(false)
+		return nil
+	}
+	if time.Now().After(l.expiry) {
+		delete(f.listings.dirs, dir)
+		f.stats.listings.count(false)
+		return nil
+	}
+	fi := l.fis[name]
+	f.stats.listings.count(fi != nil)
+	delete(l.fis, name)
+	if len(l.fis) == 0 {
+		delete(f.listings.dirs, dir)
+	}
+	return fi
+}
+
+// forgetListings drops what is known about the directory p and about p as
+// an entry of its parent, because either changed
+func (f *FS) forgetListings(p string) {
+	f.listings.lock.Lock()
+	defer f.listings.lock.Unlock()
+	delete(f.listings.dirs, p)
+	delete(f.listings.dirs, filepath.Dir(p))
+}
@@ -0,0 +1,435 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// manifestRefresh is how long the manifest is cached
+	manifestRefresh = time.Minute
+	// manifestHeads limits the HEAD requests for the sizes of the files of a
+	// directory that are sent at a time
+	manifestHeads = 8
+)
+
+func init() {
+	newManifest := func(u *url.URL, creds *Credentials) (Backend, error) {
+		return NewManifest(u, creds)
+	}
+	RegisterBackend("manifest+https", newManifest)
+	RegisterBackend("manifest+http", newManifest)
+}
+
+// Manifest is a read-only Backend for files served over HTTP, e.g. release
+// artifacts or public datasets. A manifest lists them with one line per
+// file:
+//
+//	# comment
+//	URL
+//	PATH URL [SIZE]
+//
+// URLs are relative to the manifest. Without a PATH, files below the
+// directory of the manifest keep their path relative to it, other files are
+// put into the root by their name. PATH is escaped like a URL path, e.g.
+// spaces as %20, and its parents are the directories of the tree. Files are
+// read with ranged GETs, the SIZE saves a HEAD request for their size.
+type Manifest struct {
+	url    *url.URL
+	creds  *Credentials
+	client *http.Client
+
+	lock    sync.Mutex
+	entries map[string]*manifestEntry
+	etag    string
+	mtime   time.Time
+	expiry  time.Time
+}
+
+// manifestEntry is a file or a directory of the manifest
+type manifestEntry struct {
+	name  string
+	isDir bool
+	// url of a file, children of a directory
+	url      string
+	children map[string]*manifestEntry
+
+	// lock guards the info of a file, filled from the manifest or by a HEAD
+	// request
+	lock  sync.Mutex
+	size  int64
+	mtime time.Time
+	etag  string
+	known bool
+}
+
+// manifestInfo is the os.FileInfo of a manifest entry
+type manifestInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	isDir bool
+	etag  string
+}
+
+func (i *manifestInfo) Name() string       { return i.name }
+func (i *manifestInfo) Size() int64        { return i.size }
+func (i *manifestInfo) ModTime() time.Time { return i.mtime }
+func (i *manifestInfo) IsDir() bool        { return i.isDir }
+func (i *manifestInfo) Sys() interface{}   { return nil }
+func (i *manifestInfo) ETag() string       { return i.etag }
+
+func (i *manifestInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// NewManifest returns a Backend for the files listed by the manifest at u,
+// manifest+https:// uses https and manifest+http:// plain http. creds
+// authenticate the requests to the host of the manifest, other hosts get
+// none.
+func NewManifest(u *url.URL, creds *Credentials) (*Manifest, error) {
+	mu := *u
+	mu.Scheme = strings.TrimPrefix(u.Scheme, "manifest+")
+	if mu.Host == "" || mu.Path == "" || strings.HasSuffix(mu.Path, "/") {
+		return nil, fmt.Errorf("invalid manifest backend %q, expected manifest+https://host/path/to/manifest", u.String())
+	}
+	return &Manifest{url: &mu, creds: creds, client: &http.Client{}}, nil
+}
+
+// send sends req for name. Responses with status codes of 300 and above
+// are returned as errors, unless they are in ok.
+func (m *Manifest) send(req *http.Request, name string, ok ...int) (resp *http.Response, err error) {
+	if s := startCall(req.Context(), "manifest."+req.Method); s != nil {
+		req.Header.Set("traceparent", s.traceparent())
+		defer func() { s.endCall(name, err) }()
+	}
+	if req.URL.Host == m.url.Host {
+		m.creds.authorize(req)
+	}
+	resp, err = m.client.Do(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return nil, errInterrupted
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = syscall.ETIMEDOUT
+		}
+		return nil, &os.PathError{Op: req.Method, Path: name, Err: err}
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil, &os.PathError{Op: req.Method, Path: name, Err: statusErrno(resp.StatusCode)}
+}
+
+// do sends a request to u for name, see send
+func (m *Manifest) do(ctx context.Context, method string, name string, u string,
+	header http.Header, ok ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return m.send(req, name, ok...)
+}
+
+// load returns the entries of the manifest by path, the root is "". The
+// manifest is fetched again once manifestRefresh passed, if it changed.
+func (m *Manifest) load(ctx context.Context) (map[string]*manifestEntry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.entries != nil && time.Now().Before(m.expiry) {
+		return m.entries, nil
+	}
+	header := make(http.Header)
+	if m.etag != "" && m.entries != nil {
+		header.Set("If-None-Match", m.etag)
+	}
+	resp, err := m.do(ctx, "GET", "", m.url.String(), header, http.StatusNotModified)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		m.expiry = time.Now().Add(manifestRefresh)
+		return m.entries, nil
+	}
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	entries, err := m.parse(resp.Body, mtime)
+	if err != nil {
+		return nil, err
+	}
+	// files that did not move keep what HEAD told about them
+	for p, e := range entries {
+		if old := m.entries[p]; old != nil && !e.isDir && !e.known && old.url == e.url {
+			old.lock.Lock()
+			e.size, e.mtime, e.etag, e.known = old.size, old.mtime, old.etag, old.known
+			old.lock.Unlock()
+		}
+	}
+	m.entries, m.etag, m.mtime = entries, resp.Header.Get("ETag"), mtime
+	m.expiry = time.Now().Add(manifestRefresh)
+	return entries, nil
+}
+
+// parse parses a manifest, mtime is the mtime of the directories and of the
+// files with a SIZE
+func (m *Manifest) parse(r io.Reader, mtime time.Time) (map[string]*manifestEntry, error) {
+	root := &manifestEntry{isDir: true, children: make(map[string]*manifestEntry)}
+	entries := map[string]*manifestEntry{"": root}
+	dir := strings.TrimSuffix(path.Dir(m.url.Path), "/") + "/"
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		invalid := func(reason string) error {
+			return fmt.Errorf("manifest %s line %d: %s", m.url.Path, line, reason)
+		}
+		if len(fields) > 3 {
+			return nil, invalid("expected URL or PATH URL [SIZE]")
+		}
+		raw := fields[len(fields)-1]
+		if len(fields) > 1 {
+			raw = fields[1]
+		}
+		u, err := m.url.Parse(raw)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			return nil, invalid("invalid URL " + raw)
+		}
+		var p string
+		switch {
+		case len(fields) > 1:
+			if p, err = url.PathUnescape(fields[0]); err != nil {
+				return nil, invalid("invalid path " + fields[0])
+			}
+		case u.Host == m.url.Host && strings.HasPrefix(u.Path, dir):
+			p = strings.TrimPrefix(u.Path, dir)
+		default:
+			p = path.Base(u.Path)
+		}
+		p = strings.TrimPrefix(path.Clean("/"+p), "/")
+		if p == "" {
+			return nil, invalid("no file name for " + raw)
+		}
+		e := &manifestEntry{name: path.Base(p), url: u.String(), size: -1}
+		if len(fields) == 3 {
+			if e.size, err = strconv.ParseInt(fields[2], 10, 64); err != nil || e.size < 0 {
+				return nil, invalid("invalid size " + fields[2])
+			}
+			e.mtime, e.known = mtime, true
+		}
+		if old := entries[p]; old != nil {
+			return nil, invalid(p + " is listed twice or is a directory")
+		}
+		// add the parents
+		parent, dp := root, ""
+		for _, elem := range strings.Split(p, "/")[:strings.Count(p, "/")] {
+			dp = path.Join(dp, elem)
+			d := entries[dp]
+			if d == nil {
+				d = &manifestEntry{name: elem, isDir: true, children: make(map[string]*manifestEntry)}
+				entries[dp] = d
+				parent.children[elem] = d
+			} else if !d.isDir {
+				return nil, invalid(dp + " is a file and a directory")
+			}
+			parent = d
+		}
+		entries[p] = e
+		parent.children[e.name] = e
+	}
+	if err := s.Err(); err != nil {
+		return nil, &os.PathError{Op: "GET", Path: m.url.Path, Err: err}
+	}
+	return entries, nil
+}
+
+// entry returns the entry of name
+func (m *Manifest) entry(ctx context.Context, name string) (*manifestEntry, error) {
+	entries, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e := entries[name]
+	if e == nil {
+		return nil, &os.PathError{Op: "GET", Path: name, Err: syscall.ENOENT}
+	}
+	return e, nil
+}
+
+// info returns the info of e, a file without a SIZE is asked for it with a
+// HEAD request
+func (m *Manifest) info(ctx context.Context, p string, e *manifestEntry) (os.FileInfo, error) {
+	if e.isDir {
+		m.lock.Lock()
+		mtime := m.mtime
+		m.lock.Unlock()
+		name := e.name
+		if p == "" {
+			name = "/"
+		}
+		return &manifestInfo{name: name, isDir: true, mtime: mtime}, nil
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.known {
+		resp, err := m.do(ctx, "HEAD", p, e.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		e.size = resp.ContentLength
+		if e.size < 0 {
+			return nil, &os.PathError{Op: "HEAD", Path: p, Err: fmt.Errorf("the server did not send the size, add it to the manifest")}
+		}
+		e.mtime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+		e.etag = resp.Header.Get("ETag")
+		e.known = true
+	}
+	return &manifestInfo{name: e.name, size: e.size, mtime: e.mtime, etag: e.etag}, nil
+}
+
+// Stat implements Backend for *Manifest
+func (m *Manifest) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	e, err := m.entry(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return m.info(ctx, name, e)
+}
+
+// ReadDir implements Backend for *Manifest
+func (m *Manifest) ReadDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	e, err := m.entry(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.isDir {
+		return nil, &os.PathError{Op: "GET", Path: name, Err: syscall.ENOTDIR}
+	}
+	children := make([]*manifestEntry, 0, len(e.children))
+	for _, c := range e.children {
+		children = append(children, c)
+	}
+	// files without a SIZE are asked for it by manifestHeads workers at a
+	// time, the first error stops them
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fis := make([]os.FileInfo, len(children))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failed error
+	for w := 0; w < manifestHeads && w < len(children); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fi, err := m.info(ctx, path.Join(name, children[i].name), children[i])
+				if err != nil {
+					once.Do(func() { failed = err; cancel() })
+					continue
+				}
+				fis[i] = fi
+			}
+		}()
+	}
+	for i := range children {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(next)
+	wg.Wait()
+	if failed != nil {
+		return nil, failed
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, errInterrupted
+	}
+	return fis, nil
+}
+
+// ReadAt implements Backend for *Manifest with a ranged GET
+func (m *Manifest) ReadAt(ctx context.Context, name string, p []byte, off int64) (int, error) {
+	e, err := m.entry(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if e.isDir {
+		return 0, &os.PathError{Op: "GET", Path: name, Err: syscall.EISDIR}
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)}}
+	resp, err := m.do(ctx, "GET", name, e.url, header, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return 0, io.EOF
+	}
+	return readRange(resp, name, p, off)
+}
+
+// readOnly is the error of the changes to a manifest
+func readOnly(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+// Upload implements Backend for *Manifest, it fails with EROFS
+func (m *Manifest) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	return readOnly("upload", name)
+}
+
+// Mkdir implements Backend for *Manifest, it fails with EROFS
+func (m *Manifest) Mkdir(ctx context.Context, name string) error {
+	return readOnly("mkdir", name)
+}
+
+// Remove implements Backend for *Manifest, it fails with EROFS
+func (m *Manifest) Remove(ctx context.Context, name string) error {
+	return readOnly("remove", name)
+}
+
+// Rename implements Backend for *Manifest, it fails with EROFS
+func (m *Manifest) Rename(ctx context.Context, oldName string, newName string) error {
+	return readOnly("rename", oldName)
+}
+
+// ReadOnly implements ReadOnlyBackend for *Manifest
+func (m *Manifest) ReadOnly() bool {
+	return true
+}
@@ -0,0 +1,96 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManifestReadDir(t *testing.T) {
+	const files = 40
+	var lock sync.Mutex
+	inflight, peak := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/files.txt" {
+			for i := 0; i < files; i++ {
+				fmt.Fprintf(w, "dir/f%d\n", i)
+			}
+			fmt.Fprintln(w, "dir/known /elsewhere 7")
+			return
+		}
+		lock.Lock()
+		inflight++
+		if inflight > peak {
+			peak = inflight
+		}
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		inflight--
+		lock.Unlock()
+		w.Header().Set("Content-Length", fmt.Sprint(len(r.URL.Path)))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse("manifest+http://" + strings.TrimPrefix(srv.URL, "http://") + "/files.txt")
+	m, err := NewManifest(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fis, err := m.ReadDir(context.Background(), "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != files+1 {
+		t.Fatalf("listed %d files, want %d", len(fis), files+1)
+	}
+	for _, fi := range fis {
+		want := int64(len("/dir/" + fi.Name()))
+		if fi.Name() == "known" {
+			want = 7
+		}
+		if fi.Size() != want {
+			t.Errorf("%s has size %d, want %d", fi.Name(), fi.Size(), want)
+		}
+	}
+	if peak > manifestHeads || peak < 2 {
+		t.Errorf("sent %d HEAD requests at a time, want 2 to %d", peak, manifestHeads)
+	}
+
+	// sizes are asked for once
+	peak = 0
+	if _, err = m.ReadDir(context.Background(), "dir"); err != nil || peak != 0 {
+		t.Errorf("listing again sent %d HEAD requests, error %v", peak, err)
+	}
+}
+
+func TestManifestReadDirError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files.txt":
+			for i := 0; i < 20; i++ {
+				fmt.Fprintf(w, "f%d\n", i)
+			}
+		case "/f13":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Length", "1")
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse("manifest+http://" + strings.TrimPrefix(srv.URL, "http://") + "/files.txt")
+	m, err := NewManifest(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.ReadDir(context.Background(), ""); err == nil {
+		t.Fatal("listing with a missing file succeeded")
+	}
+}
@@ -0,0 +1,33 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"path/filepath"
+
+	"bazil.org/fuse"
+)
+
+// metaDir is the directory in the root of the backing store the overlay
+// keeps its own data in, e.g. the trash. It is hidden from the mount.
+const metaDir = ".ocis-overlay"
+
+// isMetaDir reports whether name in the directory dir is the hidden metaDir
+func (f *FS) isMetaDir(dir string, name string) bool {
+	return dir == f.rootPath && name == metaDir
+}
+
+// metaPath returns the path of elem below the metaDir
+func (f *FS) metaPath(elem ...string) string {
+	return filepath.Join(append([]string{f.rootPath, metaDir}, elem...)...)
+}
+
+// withoutMetaDir removes the metaDir from the entries of the root directory
+func withoutMetaDir(dirs []fuse.Dirent) []fuse.Dirent {
+	for i, d := range dirs {
+		if d.Name == metaDir {
+			return append(dirs[:i:i], dirs[i+1:]...)
+		}
+	}
+	return dirs
+}
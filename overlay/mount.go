@@ -0,0 +1,168 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// MountOptions configure Mount
+type MountOptions struct {
+	Options
+	// Mountpoint is the directory mounted over itself
+	Mountpoint string
+	// FSName, Subtype and VolumeName are shown in the mount table, they
+	// default to ocis-overlay, ocis-overlay-fs and OCISOverlay
+	FSName     string
+	Subtype    string
+	VolumeName string
+	// AllowOther lets users other than the one mounting access the mount
+	AllowOther bool
+	// AllowRoot only lets root access the mount besides the user mounting
+	// it. bazil.org/fuse has no allow_root option, the mount uses allow_other
+	// and the overlay rejects requests of other users with EACCES.
+	AllowRoot bool
+	// MaxReadahead limits the bytes the kernel prefetches for sequential
+	// reads, 0 leaves the kernel default
+	MaxReadahead uint32
+	// SyncRead sends at most one read per handle at a time
+	SyncRead bool
+	// RequireEmpty refuses to mount over a non-empty directory, which the
+	// overlay usually does on purpose
+	RequireEmpty bool
+}
+
+// Mounted is a mounted overlay
+type Mounted struct {
+	// FS is the mounted filesystem, e.g. to call ServeControl or Shutdown
+	FS         *FS
+	Mountpoint string
+
+	done chan struct{}
+	err  error
+}
+
+// Mount mounts an overlay and serves it in the background until it is
+// unmounted, e.g. with m.FS.Shutdown. The overlay reaches the directory it
+// covers through the working directory of the process, so Mount changes
+// into the mountpoint and a process can only serve one overlay. ctx limits
+// the wait for the kernel to complete the mount.
+func Mount(ctx context.Context, o MountOptions) (*Mounted, error) {
+	mountpoint, err := filepath.Abs(o.Mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chdir(mountpoint); err != nil {
+		return nil, err
+	}
+	loog.Info(logFS, "changed into dir", "mountpoint", mountpoint)
+
+	c, err := fuse.Mount(".", o.mountOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	// check if the mount process has an error to report
+	select {
+	case <-c.Ready:
+	case <-ctx.Done():
+		fuse.Unmount(mountpoint)
+		c.Close()
+		return nil, ctx.Err()
+	}
+	if err = c.MountError; err != nil {
+		c.Close()
+		return nil, err
+	}
+	loog.Info(logFS, "mounted", "mountpoint", mountpoint)
+
+	fsys, err := NewFS(o.Options)
+	if err != nil {
+		fuse.Unmount(mountpoint)
+		c.Close()
+		return nil, err
+	}
+	m := &Mounted{FS: fsys, Mountpoint: mountpoint, done: make(chan struct{})}
+	m.FS.rootOnly = o.AllowRoot && !o.AllowOther
+	go func() {
+		defer close(m.done)
+		defer c.Close()
+		m.err = m.FS.Serve(c)
+		loog.Info(logFS, "unmounted", "mountpoint", mountpoint, "error", m.err)
+	}()
+	return m, nil
+}
+
+// Wait blocks until the overlay is unmounted and returns the error of
+// serving it
+func (m *Mounted) Wait() error {
+	<-m.done
+	return m.err
+}
+
+func (o MountOptions) mountOptions() []fuse.MountOption {
+	opts := []fuse.MountOption{
+		fuse.FSName(orDefault(o.FSName, "ocis-overlay")),
+		fuse.Subtype(orDefault(o.Subtype, "ocis-overlay-fs")),
+		fuse.VolumeName(orDefault(o.VolumeName, "OCISOverlay")),
+	}
+	if !o.RequireEmpty {
+		opts = append(opts, fuse.AllowNonEmptyMount())
+	}
+	if !o.SyncRead {
+		// reads and writes use pread and pwrite and may run in parallel
+		opts = append(opts, fuse.AsyncRead())
+	}
+	if o.MaxReadahead > 0 {
+		opts = append(opts, fuse.MaxReadahead(o.MaxReadahead))
+	}
+	if o.AllowOther || o.AllowRoot {
+		opts = append(opts, fuse.AllowOther())
+	}
+	if o.WritebackCache {
+		opts = append(opts, fuse.WritebackCache())
+	}
+	if o.DefaultPermissions {
+		opts = append(opts, fuse.DefaultPermissions())
+	}
+	if rb, ok := o.Backend.(ReadOnlyBackend); ok && rb.ReadOnly() {
+		opts = append(opts, fuse.ReadOnly())
+	}
+	return opts
+}
+
+// callerKey is the context key of a header with the uid, gid and pid of the
+// caller of a request
+type callerKey struct{}
+
+// withCaller remembers the caller of req in its context. The header is
+// copied without the message it belongs to, which must not be retained.
+func withCaller(ctx context.Context, req fuse.Request) context.Context {
+	h := req.Hdr()
+	return context.WithValue(ctx, callerKey{}, fuse.Header{Uid: h.Uid, Gid: h.Gid, Pid: h.Pid})
+}
+
+// checkCaller rejects requests of users other than root and the one serving
+// the mount if only they may access it
+func (f *FS) checkCaller(ctx context.Context) error {
+	if !f.rootOnly {
+		return nil
+	}
+	h, ok := ctx.Value(callerKey{}).(fuse.Header)
+	if !ok || h.Uid == 0 || h.Uid == uint32(os.Getuid()) {
+		return nil
+	}
+	return fuse.Errno(syscall.EACCES)
+}
+
+func orDefault(s string, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
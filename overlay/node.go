@@ -7,7 +7,8 @@
 package overlay
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
@@ -16,8 +17,7 @@ import (
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/pkg/xattr"
-	"golang.org/x/net/context"
+	"github.com/butonic/ocis-overlay/loog"
 )
 
 // Node is the node for both directories and files
@@ -26,11 +26,87 @@ type Node struct {
 
 	rpLock   sync.RWMutex
 	realPath string
+	// lowerPaths are the paths of the node in the lower layers, top-down. A
+	// path is empty if the node does not exist in or is hidden for that layer.
+	lowerPaths []string
 
 	isDir bool
+	inode uint64
+	// readOnly nodes are entries of virtual directories, e.g. versions
+	readOnly bool
 
 	lock     sync.RWMutex
 	flushers map[*Handle]bool
+
+	// dir is the directory node opened in the store, nil until openDir. It
+	// is read locked while in use.
+	dlock sync.RWMutex
+	dir   StoreDir
+
+	alock      sync.Mutex
+	attr       fuse.Attr
+	attrExpiry time.Time
+	// data is the last seen version of the backing file, localWrite is set
+	// when it was changed through the mount
+	data       dataVersion
+	localWrite bool
+	// foreign counts the changes of the backing file made behind the mount
+	foreign uint64
+	// directWrite is set when the file was written bypassing the page cache
+	// since the last invalidateWritten
+	directWrite bool
+}
+
+// cachedAttr fills a with the cached attributes if they are still valid
+func (n *Node) cachedAttr(a *fuse.Attr) bool {
+	n.alock.Lock()
+	defer n.alock.Unlock()
+	if time.Now().After(n.attrExpiry) {
+		return false
+	}
+	*a = n.attr
+	return true
+}
+
+func (n *Node) cacheAttr(a *fuse.Attr) {
+	if n.fs.attrTimeout <= 0 {
+		return
+	}
+	n.alock.Lock()
+	defer n.alock.Unlock()
+	n.attr = *a
+	n.attrExpiry = time.Now().Add(n.fs.attrTimeout)
+}
+
+func (n *Node) invalidateAttr() {
+	n.fs.forgetListings(n.getRealPath())
+	n.alock.Lock()
+	defer n.alock.Unlock()
+	n.attrExpiry = time.Time{}
+}
+
+// fillAttr fills a from fi and caches the result
+func (n *Node) fillAttr(a *fuse.Attr, fi os.FileInfo) {
+	fillAttrWithFileInfo(a, fi)
+	if n.fs.codecs != nil && a.Mode.IsRegular() {
+		a.Size = uint64(n.fs.contentSize(n.resolvedPath(), fi))
+		if v, ok := n.fs.codecs.plainVersion(fi); ok {
+			a.Mtime = v.mtime
+		}
+	}
+	a.Uid = n.fs.uidMap.mount(a.Uid)
+	a.Gid = n.fs.gidMap.mount(a.Gid)
+	if n.inode != 0 {
+		a.Inode = n.inode
+	}
+	if n.readOnly {
+		a.Mode &^= 0222
+	}
+	if n.fs.executables && a.Mode.IsRegular() && a.BlockSize < execBlockSize {
+		a.BlockSize = execBlockSize
+	}
+	a.Valid = n.fs.attrTimeout
+	n.cacheAttr(a)
 }
 
 func (n *Node) getRealPath() string {
@@ -49,69 +125,134 @@ var _ fs.NodeAccesser = (*Node)(nil)
 
 // Access implements fs.NodeAccesser interface for *Node
 func (n *Node) Access(ctx context.Context, a *fuse.AccessRequest) (err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpAccess, n); err != nil {
+		return err
+	}
 	defer func() {
-		log.Printf("%s.Access(%o): error=%v", n.getRealPath(), a.Mask, err)
+		loog.Debug(logAttr, "Access", "path", n.getRealPath(), "mask", fmt.Sprintf("%o", a.Mask), "error", err)
 	}()
-	fi, err := os.Stat(n.getRealPath())
+	if n.fs.defaultPermissions {
+		return nil
+	}
+	rp := n.resolvedPath()
+	fi, err := n.fs.store.Stat(rp)
 	if err != nil {
 		return translateError(err)
 	}
-	if a.Mask&uint32(fi.Mode()>>6) != a.Mask {
-		return fuse.EPERM
+	var attr fuse.Attr
+	n.fillAttr(&attr, fi)
+	groups := callerGroups(a.Header)
+	ok := permitted(fi.Mode(), attr.Uid, attr.Gid, a.Header, groups, a.Mask)
+	if value, err := n.fs.readXattr(rp, PosixACLAccessAttr); err == nil {
+		if entries, err := parseACL(n.fs.mapACL(value, true)); err == nil {
+			ok = entries.permitted(fi.Mode(), attr.Uid, attr.Gid, a.Header, groups, a.Mask)
+		}
+	}
+	if !ok {
+		return fuse.Errno(syscall.EACCES)
 	}
 	return nil
 }
 
 // Attr implements fs.Node interface for *Dir
 func (n *Node) Attr(ctx context.Context, a *fuse.Attr) (err error) {
-	time.Sleep(n.fs.latency)
-	defer func() { log.Printf("%s.Attr(): %#+v error=%v", n.getRealPath(), a, err) }()
-	fi, err := os.Stat(n.getRealPath())
+	if err = n.fs.enter(ctx, OpAttr, n); err != nil {
+		return err
+	}
+	defer func() { loog.Debug(logAttr, "Attr", "path", n.getRealPath(), "attr", a, "error", err) }()
+	if n.cachedAttr(a) {
+		return nil
+	}
+	defer n.fs.pinPaths()()
+	n.drainWrites()
+	fi, err := n.fs.store.Lstat(n.resolvedPath())
 	if err != nil {
 		return translateError(err)
 	}
 
-	fillAttrWithFileInfo(a, fi)
+	n.checkData(fi)
+	n.fillAttr(a, fi)
 
 	return nil
 }
 
+var _ fs.NodeRequestLookuper = (*Node)(nil)
+
 // Lookup implements fs.NodeRequestLookuper interface for *Node
 func (n *Node) Lookup(ctx context.Context,
-	name string) (ret fs.Node, err error) {
-	time.Sleep(n.fs.latency)
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (ret fs.Node, err error) {
+	if err = n.fs.enter(ctx, OpLookup, n); err != nil {
+		return nil, err
+	}
+	if n.isDir {
+		req.Name = n.childName(req.Name)
+	}
+	name := req.Name
 	defer func() {
-		log.Printf("%s.Lookup(%s): %#+v error=%v",
-			n.getRealPath(), name, ret, err)
+		loog.Debug(logLookup, "Lookup", "path", n.getRealPath(), "name", name, "error", err)
 	}()
 
 	if !n.isDir {
 		return nil, fuse.ENOTSUP
 	}
 
+	if n.fs.isMetaDir(n.getRealPath(), name) {
+		return n.fs.metaLookup(resp), nil
+	}
+	if n.fs.overlay() && isWhiteoutName(name) || n.fs.hidden(name) {
+		return nil, fuse.ENOENT
+	}
+	if n.getRealPath() == n.fs.rootPath && name == healthName {
+		return n.fs.healthProbe(resp), nil
+	}
+
 	p := filepath.Join(n.getRealPath(), name)
-	fi, err := os.Stat(p)
+	var fi os.FileInfo
+	if fi = n.fs.listedFileInfo(n.getRealPath(), name); fi == nil {
+		fi, err = n.lstatChild(name)
+	}
+	upper := err == nil
+
+	var lps []string
+	if n.fs.overlay() {
+		var lfi os.FileInfo
+		lps, lfi = n.fs.lowerChildren(n.getRealPath(), n.getLowerPaths(), name)
+		switch {
+		case err != nil && lfi != nil:
+			fi, err = lfi, nil
+		case err == nil && !(fi.IsDir() && lfi != nil && lfi.IsDir()):
+			// the upper entry shadows the lower ones completely
+			lps = nil
+		}
+	}
 
 	err = translateError(err)
+	if err == fuse.ENOENT {
+		if v := n.virtualChild(req); v != nil {
+			return v, nil
+		}
+	}
 	if err != nil {
 		return nil, translateError(err)
 	}
 
 	var nn *Node
 	if fi.IsDir() {
-		nn = &Node{realPath: p, isDir: true, fs: n.fs}
+		nn = &Node{realPath: p, lowerPaths: lps, isDir: true, inode: n.fs.inodeOf(fi), fs: n.fs}
 	} else {
-		nn = &Node{realPath: p, isDir: false, fs: n.fs}
+		nn = &Node{realPath: p, lowerPaths: lps, isDir: false, inode: n.fs.inodeOf(fi), fs: n.fs}
 	}
-
-	n.fs.newNode(nn)
+	nn = n.fs.newNode(nn)
+	if upper {
+		n.fs.ocisInit(n.getRealPath(), name, fi)
+	}
+	nn.fillAttr(&resp.Attr, fi)
+	resp.EntryValid = n.fs.attrTimeout
 	return nn, nil
 }
 
-func getDirentsWithFileInfos(fis []os.FileInfo) (dirs []fuse.Dirent) {
+func (f *FS) getDirentsWithFileInfos(fis []os.FileInfo) (dirs []fuse.Dirent) {
 	for _, fi := range fis {
-		stat := fi.Sys().(*syscall.Stat_t)
 		var tp fuse.DirentType
 
 		switch {
@@ -119,12 +260,22 @@ func getDirentsWithFileInfos(fis []os.FileInfo) (dirs []fuse.Dirent) {
 			tp = fuse.DT_Dir
 		case fi.Mode().IsRegular():
 			tp = fuse.DT_File
+		case fi.Mode()&os.ModeSymlink != 0:
+			tp = fuse.DT_Link
+		case fi.Mode()&os.ModeNamedPipe != 0:
+			tp = fuse.DT_FIFO
+		case fi.Mode()&os.ModeSocket != 0:
+			tp = fuse.DT_Socket
+		case fi.Mode()&os.ModeCharDevice != 0:
+			tp = fuse.DT_Char
+		case fi.Mode()&os.ModeDevice != 0:
+			tp = fuse.DT_Block
 		default:
-			panic("unsupported dirent type")
+			tp = fuse.DT_Unknown
 		}
 
 		dirs = append(dirs, fuse.Dirent{
-			Inode: stat.Ino,
+			Inode: f.inodeOf(fi),
 			Name:  fi.Name(),
 			Type:  tp,
 		})
@@ -149,7 +300,7 @@ func fuseOpenFlagsToOSFlagsAndPerms(
 		perm |= os.ModeExclusive
 	}
 	if f&fuse.OpenNonblock != 0 {
-		log.Printf("fuse.OpenNonblock is set in OpenFlags but ignored")
+		loog.Debug(logIO, "fuse.OpenNonblock is set in OpenFlags but ignored")
 	}
 	if f&fuse.OpenSync != 0 {
 		flag |= os.O_SYNC
@@ -179,33 +330,108 @@ func (n *Node) forgetHandle(h *Handle) {
 	delete(n.flushers, h)
 }
 
+// reopenMask are the open flags that must not be repeated when a handle
+// reopens its backing file
+const reopenMask = os.O_CREATE | os.O_EXCL | os.O_TRUNC
+
 var _ fs.NodeOpener = (*Node)(nil)
 
 // Open implements fs.NodeOpener interface for *Node
 func (n *Node) Open(ctx context.Context,
 	req *fuse.OpenRequest, resp *fuse.OpenResponse) (h fs.Handle, err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpOpen, n); err != nil {
+		return nil, err
+	}
+	defer func() { n.fs.audit(ctx, OpOpen, n.getRealPath(), "", err) }()
 	flags, perm := fuseOpenFlagsToOSFlagsAndPerms(req.Flags)
 	defer func() {
-		log.Printf("%s.Open(): %o %o error=%v",
-			n.getRealPath(), flags, perm, err)
+		loog.Debug(logIO, "Open", "path", n.getRealPath(),
+			"flags", fmt.Sprintf("%o", flags), "perm", perm, "error", err)
 	}()
 
-	opener := func() (*os.File, error) {
-		return os.OpenFile(n.getRealPath(), flags, perm)
+	writing := flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0
+	if writing {
+		if n.readOnly {
+			return nil, fuse.Errno(syscall.EROFS)
+		}
+		if err = n.copyUp(ctx); err != nil {
+			return nil, translateError(err)
+		}
+	}
+	if flags&os.O_TRUNC != 0 {
+		n.fs.snapshot(ctx, n.getRealPath())
 	}
 
-	f, err := opener()
+	// encrypted files are decrypted to a copy in memory, compressed files
+	// are decompressed in place for writers and to a copy for readers
+	defer n.fs.lockPath(n.getRealPath())()
+	var pc *plainCopy
+	var plain string
+	switch {
+	case n.isDir:
+	case n.fs.encrypting() && n.resolvedPath() == n.getRealPath():
+		if pc, err = n.fs.openPlain(ctx, n.getRealPath()); pc != nil {
+			plain = pc.path
+		}
+	case writing:
+		err = n.fs.decodeInPlace(ctx, n.getRealPath())
+	default:
+		plain, err = n.fs.decodedCopy(ctx, n.resolvedPath())
+	}
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if plain != "" {
+		defer func() {
+			if err == nil {
+				return
+			}
+			if pc != nil {
+				n.fs.closePlain(pc)
+			} else {
+				n.fs.store.Remove(plain, false)
+			}
+		}()
+	}
+	open := func(flags int) (File, error) {
+		switch {
+		case pc != nil:
+			return pc.open(flags)
+		case plain != "":
+			return n.fs.store.OpenFile(plain, flags, perm)
+		}
+		return n.fs.store.OpenFile(n.resolvedPath(), flags, perm)
+	}
+	f, err := n.fs.openWriteback(open, flags)
 	if err != nil {
 		return nil, translateError(err)
 	}
+	if !writing && !n.isDir {
+		if err = n.fs.verifyContent(ctx, n.resolvedPath(), f); err != nil {
+			f.Close()
+			return nil, translateError(err)
+		}
+	}
+	if n.fs.directIO(req.Flags) {
+		resp.Flags |= fuse.OpenDirectIO
+	} else if fi, err := f.Stat(); err == nil && n.checkData(fi) && (n.fs.keepCache || n.fs.keepExecutable(req.Flags, flags, fi)) {
+		resp.Flags |= fuse.OpenKeepCache
+	}
 
-	handle := &Handle{fs: n.fs, f: f, reopener: opener}
-	n.rememberHandle(handle)
-	handle.forgetter = func() {
-		n.forgetHandle(handle)
+	fh := n.fs.newHandle(ctx, n, f, func() (File, error) {
+		return n.fs.openWriteback(open, flags&^reopenMask)
+	})
+	fh.plain = pc
+	if plain != "" && pc == nil {
+		forget := fh.forgetter
+		fh.forgetter = func() {
+			forget()
+			n.fs.store.Remove(plain, false)
+		}
 	}
-	return handle, nil
+	fh.directIO = resp.Flags&fuse.OpenDirectIO != 0
+	n.fs.coalesceWrites(fh, flags)
+	return fh, nil
 }
 
 var _ fs.NodeCreater = (*Node)(nil)
@@ -214,35 +440,103 @@ var _ fs.NodeCreater = (*Node)(nil)
 func (n *Node) Create(
 	ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (
 	fsn fs.Node, fsh fs.Handle, err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpCreate, n); err != nil {
+		return nil, nil, err
+	}
+	if req.Name, err = n.newChildName(req.Name); err != nil {
+		return nil, nil, err
+	}
 	flags, _ := fuseOpenFlagsToOSFlagsAndPerms(req.Flags)
 	name := filepath.Join(n.getRealPath(), req.Name)
+	defer func() { n.fs.audit(ctx, OpCreate, name, "", err) }()
 	defer func() {
-		log.Printf("%s.Create(%s): %o %o error=%v",
-			n.getRealPath(), name, flags, req.Mode, err)
+		loog.Debug(logCreate, "Create", "path", n.getRealPath(), "name", name,
+			"flags", fmt.Sprintf("%o", flags), "mode", req.Mode, "error", err)
 	}()
 
-	opener := func() (f *os.File, err error) {
-		return os.OpenFile(name, flags, req.Mode)
+	seq := n.fs.beginOp(n.creating(opCreate, req.Name))
+	defer n.fs.doneOp(seq)
+	if _, err = n.prepareCreate(ctx, req.Name); err != nil {
+		return nil, nil, translateError(err)
+	}
+	// without O_EXCL a compressed file may be opened
+	defer n.fs.lockPath(name)()
+	if !n.fs.encrypting() {
+		if err = n.fs.decodeInPlace(ctx, name); err != nil {
+			return nil, nil, translateError(err)
+		}
 	}
 
-	f, err := opener()
+	open := func(flags int) (File, error) {
+		return n.openChild(req.Name, flags, req.Mode)
+	}
+	// without O_EXCL an existing file is opened, it keeps its owner
+	created := n.fs.asCaller
+	if created {
+		_, statErr := n.lstatChild(req.Name)
+		created = os.IsNotExist(statErr)
+	}
+	f, err := n.fs.openWriteback(open, flags)
 	if err != nil {
 		return nil, nil, translateError(err)
 	}
-
-	h := &Handle{fs: n.fs, f: f, reopener: opener}
+	if created {
+		n.fs.ownByCaller(name, req.Header)
+	}
+	n.fs.appliedOp(seq)
+	n.fs.killPoint(KillMidCreate)
 
 	node := &Node{
 		realPath: filepath.Join(n.getRealPath(), req.Name),
 		isDir:    req.Mode.IsDir(),
 		fs:       n.fs,
 	}
-	node.rememberHandle(h)
-	h.forgetter = func() {
-		node.forgetHandle(h)
+	fi, err := f.Stat()
+	if err == nil {
+		node.inode = n.fs.inodeOf(fi)
+	}
+	// without O_EXCL the file may already be known
+	node = n.fs.newNode(node)
+	if fi != nil {
+		n.fs.ocisInit(n.getRealPath(), req.Name, fi)
+		n.fs.propagate(node.getRealPath())
+		n.fs.emit(EventFileTouched, node.getRealPath(), "")
+		node.checkData(fi)
+		node.fillAttr(&resp.Attr, fi)
 	}
-	n.fs.newNode(node)
+	resp.EntryValid = n.fs.attrTimeout
+	if n.fs.directIO(req.Flags) {
+		resp.Flags |= fuse.OpenDirectIO
+	}
+	n.invalidateAttr()
+
+	reopen := func(flags int) (File, error) {
+		return n.fs.store.OpenFile(node.getRealPath(), flags, req.Mode)
+	}
+	// the content of an encrypted file is written to a copy in memory
+	var pc *plainCopy
+	if n.fs.encrypting() {
+		f.Close()
+		if pc, err = n.fs.openPlain(ctx, name); err != nil {
+			return nil, nil, translateError(err)
+		}
+		if pc != nil {
+			reopen = pc.open
+		}
+		// another handle may have the copy open, it is truncated as well
+		if f, err = n.fs.openWriteback(reopen, flags&^(os.O_CREATE|os.O_EXCL)); err != nil {
+			if pc != nil {
+				n.fs.closePlain(pc)
+			}
+			return nil, nil, translateError(err)
+		}
+	}
+	h := n.fs.newHandle(ctx, node, f, func() (File, error) {
+		return n.fs.openWriteback(reopen, flags&^reopenMask)
+	})
+	h.plain = pc
+	h.directIO = resp.Flags&fuse.OpenDirectIO != 0
+	n.fs.coalesceWrites(h, flags)
 	return node, h, nil
 }
 
@@ -251,44 +545,298 @@ var _ fs.NodeMkdirer = (*Node)(nil)
 // Mkdir implements fs.NodeMkdirer interface for *Node
 func (n *Node) Mkdir(ctx context.Context,
 	req *fuse.MkdirRequest) (created fs.Node, err error) {
-	time.Sleep(n.fs.latency)
-	defer func() { log.Printf("%s.Mkdir(%s): error=%v", n.getRealPath(), req.Name, err) }()
+	if err = n.fs.enter(ctx, OpMkdir, n); err != nil {
+		return nil, err
+	}
+	if req.Name, err = n.newChildName(req.Name); err != nil {
+		return nil, err
+	}
+	defer func() { loog.Debug(logCreate, "Mkdir", "path", n.getRealPath(), "name", req.Name, "error", err) }()
 	name := filepath.Join(n.getRealPath(), req.Name)
-	if err = os.Mkdir(name, req.Mode); err != nil {
+	defer func() { n.fs.audit(ctx, OpMkdir, name, "", err) }()
+	seq := n.fs.beginOp(n.creating(opMkdir, req.Name))
+	defer n.fs.doneOp(seq)
+	whiteout, err := n.prepareCreate(ctx, req.Name)
+	if err != nil {
 		return nil, translateError(err)
 	}
+	if err = n.mkdirChild(req.Name, req.Mode); err != nil {
+		return nil, translateError(err)
+	}
+	n.fs.appliedOp(seq)
+	n.fs.ownByCaller(name, req.Header)
+	if whiteout {
+		// the lower directory was removed before, do not merge it back in
+		if err = makeOpaque(name); err != nil {
+			return nil, translateError(err)
+		}
+	}
+	n.invalidateAttr()
 	nn := &Node{realPath: name, isDir: true, fs: n.fs}
-	n.fs.newNode(nn)
+	if fi, err := n.lstatChild(req.Name); err == nil {
+		nn.inode = n.fs.inodeOf(fi)
+		n.fs.ocisInit(n.getRealPath(), req.Name, fi)
+	}
+	// a racing lookup may have registered the node already
+	nn = n.fs.newNode(nn)
+	n.fs.propagate(name)
+	n.fs.emit(EventContainerCreated, name, "")
+	return nn, nil
+}
+
+var _ fs.NodeMknoder = (*Node)(nil)
+
+// Mknod implements fs.NodeMknoder interface for *Node
+func (n *Node) Mknod(ctx context.Context,
+	req *fuse.MknodRequest) (created fs.Node, err error) {
+	if err = n.fs.enter(ctx, OpMknod, n); err != nil {
+		return nil, err
+	}
+	if req.Name, err = n.newChildName(req.Name); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(n.getRealPath(), req.Name)
+	defer func() { n.fs.audit(ctx, OpMknod, name, "", err) }()
+	defer func() {
+		loog.Debug(logCreate, "Mknod", "path", n.getRealPath(), "name", req.Name,
+			"mode", req.Mode, "rdev", req.Rdev, "error", err)
+	}()
+	if !n.fs.mknod {
+		return nil, fuse.EPERM
+	}
+	if _, err = n.prepareCreate(ctx, req.Name); err != nil {
+		return nil, translateError(err)
+	}
+	if err = n.fs.store.Mknod(name, req.Mode, int(req.Rdev)); err != nil {
+		return nil, translateError(err)
+	}
+	n.fs.ownByCaller(name, req.Header)
+	n.invalidateAttr()
+	nn := &Node{realPath: name, isDir: false, fs: n.fs}
+	if fi, err := n.lstatChild(req.Name); err == nil {
+		nn.inode = n.fs.inodeOf(fi)
+	}
+	nn = n.fs.newNode(nn)
+	n.fs.propagate(name)
+	n.fs.emit(EventFileTouched, name, "")
+	return nn, nil
+}
+
+// modeToSyscall converts the file type and permissions of mode to st_mode bits
+func modeToSyscall(mode os.FileMode) uint32 {
+	m := permToSyscall(mode)
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		m |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		m |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		m |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= syscall.S_IFBLK
+	default:
+		m |= syscall.S_IFREG
+	}
+	return m
+}
+
+// permToSyscall converts the permissions of mode to st_mode bits
+func permToSyscall(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
+
+var _ fs.NodeSymlinker = (*Node)(nil)
+
+// Symlink implements fs.NodeSymlinker interface for *Node
+func (n *Node) Symlink(ctx context.Context,
+	req *fuse.SymlinkRequest) (created fs.Node, err error) {
+	if err = n.fs.enter(ctx, OpSymlink, n); err != nil {
+		return nil, err
+	}
+	if req.NewName, err = n.newChildName(req.NewName); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(n.getRealPath(), req.NewName)
+	defer func() {
+		loog.Debug(logLink, "Symlink", "path", n.getRealPath(), "name", name,
+			"target", req.Target, "error", err)
+	}()
+	defer func() { n.fs.audit(ctx, OpSymlink, name, req.Target, err) }()
+	if _, err = n.prepareCreate(ctx, req.NewName); err != nil {
+		return nil, translateError(err)
+	}
+	if err = n.symlinkChild(req.Target, req.NewName); err != nil {
+		return nil, translateError(err)
+	}
+	n.fs.ownByCaller(name, req.Header)
+	n.invalidateAttr()
+	nn := &Node{realPath: name, isDir: false, fs: n.fs}
+	if fi, err := n.lstatChild(req.NewName); err == nil {
+		nn.inode = n.fs.inodeOf(fi)
+	}
+	nn = n.fs.newNode(nn)
+	n.fs.propagate(name)
+	n.fs.emit(EventFileTouched, name, "")
 	return nn, nil
 }
 
+var _ fs.NodeLinker = (*Node)(nil)
+
+// Link implements fs.NodeLinker interface for *Node
+func (n *Node) Link(ctx context.Context,
+	req *fuse.LinkRequest, old fs.Node) (created fs.Node, err error) {
+	if err = n.fs.enter(ctx, OpLink, n); err != nil {
+		return nil, err
+	}
+	if req.NewName, err = n.newChildName(req.NewName); err != nil {
+		return nil, err
+	}
+	op := old.(*Node).getRealPath()
+	name := filepath.Join(n.getRealPath(), req.NewName)
+	defer func() {
+		loog.Debug(logLink, "Link", "path", n.getRealPath(), "name", name, "old", op, "error", err)
+	}()
+	defer func() { n.fs.audit(ctx, OpLink, op, name, err) }()
+	if n.fs.encrypting() {
+		// encrypting a file replaces it, other links would keep the old
+		// content
+		return nil, fuse.EPERM
+	}
+	if err = old.(*Node).copyUp(ctx); err != nil {
+		return nil, translateError(err)
+	}
+	if _, err = n.prepareCreate(ctx, req.NewName); err != nil {
+		return nil, translateError(err)
+	}
+	if err = n.linkChild(op, req.NewName); err != nil {
+		return nil, translateError(err)
+	}
+	n.invalidateAttr()
+	n.fs.invalidateLinks(old.(*Node).inode)
+	nn := &Node{realPath: name, isDir: false, inode: old.(*Node).inode, fs: n.fs}
+	nn = n.fs.newNode(nn)
+	n.fs.propagate(name)
+	n.fs.emit(EventFileTouched, name, "")
+	return nn, nil
+}
+
+var _ fs.NodeReadlinker = (*Node)(nil)
+
+// Readlink implements fs.NodeReadlinker interface for *Node
+func (n *Node) Readlink(ctx context.Context,
+	req *fuse.ReadlinkRequest) (target string, err error) {
+	if err = n.fs.enter(ctx, OpReadlink, n); err != nil {
+		return "", err
+	}
+	defer func() {
+		loog.Debug(logLink, "Readlink", "path", n.getRealPath(), "target", target, "error", err)
+	}()
+	if target, err = n.fs.store.Readlink(n.resolvedPath()); err != nil {
+		return "", translateError(err)
+	}
+	return target, nil
+}
+
 var _ fs.NodeRemover = (*Node)(nil)
 
 // Remove implements fs.NodeRemover interface for *Node
 func (n *Node) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpRemove, n); err != nil {
+		return err
+	}
+	req.Name = n.childName(req.Name)
 	name := filepath.Join(n.getRealPath(), req.Name)
-	defer func() { log.Printf("%s.Remove(%s): error=%v", n.getRealPath(), name, err) }()
+	defer func() { loog.Debug(logRemove, "Remove", "path", n.getRealPath(), "name", name, "error", err) }()
+	defer func() { n.fs.audit(ctx, OpRemove, name, "", err) }()
+	event := EventItemPurged
+	fi, statErr := n.lstatChild(req.Name)
+	seq := n.fs.beginOp(n.removing(req.Name, nil, ""))
+	defer n.fs.doneOp(seq)
 	defer func() {
 		if err == nil {
-			n.fs.moveAllxattrs(ctx, name, "")
+			n.invalidateAttr()
+			// trashed files keep their inode and xattrs
+			if statErr == nil && event == EventItemPurged {
+				n.fs.unlinkedXattrs(fi)
+			}
+			remaining := n.fs.nodeRemoved(name)
+			if remaining != "" {
+				n.fs.invalidateNodes(remaining)
+			}
+			n.fs.propagate(n.getRealPath())
+			n.fs.emit(event, name, "")
 		}
 	}()
-	return os.Remove(name)
+	if n.fs.trash && !req.Dir {
+		trashed, err := n.trashChild(ctx, req.Name, req.Header.Uid)
+		if trashed || err != nil {
+			event = EventItemTrashed
+			return translateError(err)
+		}
+	}
+	if n.fs.overlay() {
+		return translateError(n.removeLayered(ctx, req.Name, req.Dir))
+	}
+	return translateError(n.removeChild(req.Name, req.Dir))
 }
 
 var _ fs.NodeFsyncer = (*Node)(nil)
 
 // Fsync implements fs.NodeFsyncer interface for *Node
 func (n *Node) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
-	time.Sleep(n.fs.latency)
-	defer func() { log.Printf("%s.Fsync(): error=%v", n.getRealPath(), err) }()
-	n.lock.RLock()
-	defer n.lock.RUnlock()
-	for h := range n.flushers {
-		return h.f.Sync()
+	if err = n.fs.enter(ctx, OpFsync, n); err != nil {
+		return err
+	}
+	defer func() {
+		loog.Debug(logIO, "Fsync", "path", n.getRealPath(), "dir", req.Dir, "error", err)
+	}()
+	n.fs.killPoint(KillBeforeFsync)
+	defer func() {
+		if err == nil {
+			n.fs.killPoint(KillAfterFsync)
+		}
+	}()
+	if !req.Dir && !n.isDir {
+		if err = n.syncWrites(); err != nil {
+			return translateError(err)
+		}
+		defer n.fs.invalidateWritten(n)
+		n.lock.RLock()
+		for h := range n.flushers {
+			n.lock.RUnlock()
+			f, err := h.file()
+			if err != nil {
+				return translateError(err)
+			}
+			defer h.release()
+			return translateError(interruptible(ctx, f.Sync))
+		}
+		n.lock.RUnlock()
 	}
-	return fuse.EIO
+	// directories rarely have an open handle, and fsync flushes the inode
+	// no matter which descriptor it is called on. Lower layers are read-only,
+	// only the upper layer needs to be synced.
+	f, err := n.fs.store.OpenFile(n.getRealPath(), os.O_RDONLY, 0)
+	if err != nil {
+		if n.fs.overlay() && os.IsNotExist(err) {
+			return nil
+		}
+		return translateError(err)
+	}
+	return translateError(interruptible(ctx, func() error {
+		defer f.Close()
+		return f.Sync()
+	}))
 }
 
 var _ fs.NodeSetattrer = (*Node)(nil)
@@ -296,54 +844,96 @@ var _ fs.NodeSetattrer = (*Node)(nil)
 // Setattr implements fs.NodeSetattrer interface for *Node
 func (n *Node) Setattr(ctx context.Context,
 	req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpSetattr, n); err != nil {
+		return err
+	}
+	defer func() { n.fs.audit(ctx, OpSetattr, n.getRealPath(), "", err) }()
+	if n.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	defer n.fs.pinPaths()()
 	defer func() {
-		log.Printf("%s.Setattr(valid=%x): error=%v", n.getRealPath(), req.Valid, err)
+		loog.Debug(logAttr, "Setattr", "path", n.getRealPath(), "valid", req.Valid, "error", err)
 	}()
+	n.invalidateAttr()
+	if err = n.copyUp(ctx); err != nil {
+		return translateError(err)
+	}
+	if req.Valid.Size() || req.Valid.Mtime() {
+		// the kernel already knows about the new size and mtime
+		defer n.wroteData()
+	}
 	if req.Valid.Size() {
-		if err = syscall.Truncate(n.getRealPath(), int64(req.Size)); err != nil {
+		// buffered writes must not extend the file again
+		n.drainWrites()
+		n.fs.snapshot(ctx, n.getRealPath())
+		defer n.fs.lockPath(n.getRealPath())()
+		if n.fs.encrypting() {
+			err = n.fs.truncatePlain(ctx, n.getRealPath(), int64(req.Size))
+		} else if err = n.fs.decodeInPlace(ctx, n.getRealPath()); err == nil {
+			defer n.fs.queueEncode(n.getRealPath())
+			err = n.fs.store.Truncate(n.getRealPath(), int64(req.Size))
+		}
+		if err != nil {
 			return translateError(err)
 		}
+		n.fs.ocisWritten(n.getRealPath())
+		defer n.fs.propagate(n.getRealPath())
+		defer n.fs.emit(EventFileUploaded, n.getRealPath(), "")
 	}
 
-	if req.Valid.Mtime() {
-		var tvs [2]syscall.Timeval
-		if !req.Valid.Atime() {
-			tvs[0] = tToTv(time.Now())
-		} else {
-			tvs[0] = tToTv(req.Atime)
+	if req.Valid.Atime() || req.Valid.Mtime() {
+		var atime, mtime *time.Time
+		now := time.Now()
+		switch {
+		case req.Valid.AtimeNow():
+			atime = &now
+		case req.Valid.Atime():
+			atime = &req.Atime
+		}
+		switch {
+		case req.Valid.MtimeNow():
+			mtime = &now
+		case req.Valid.Mtime():
+			mtime = &req.Mtime
+		}
+		if err = n.fs.store.Utimens(n.getRealPath(), atime, mtime); err != nil {
+			return translateError(err)
+		}
+		if mtime != nil && n.fs.encrypting() {
+			n.fs.touchPlain(n.getRealPath(), *mtime)
 		}
-		tvs[1] = tToTv(req.Mtime)
 	}
 
 	if req.Valid.Handle() {
-		log.Printf("%s.Setattr(): unhandled request: req.Valid.Handle() == true",
-			n.getRealPath())
+		loog.Debug(logAttr, "Setattr: unhandled request: req.Valid.Handle() == true",
+			"path", n.getRealPath())
 	}
 
 	if req.Valid.Mode() {
-		if err = os.Chmod(n.getRealPath(), req.Mode); err != nil {
+		if err = n.fs.store.Chmod(n.getRealPath(), req.Mode); err != nil {
 			return translateError(err)
 		}
 	}
 
 	if req.Valid.Uid() || req.Valid.Gid() {
+		uid, gid := n.fs.uidMap.backing(req.Uid), n.fs.gidMap.backing(req.Gid)
 		if req.Valid.Uid() && req.Valid.Gid() {
-			if err = os.Chown(n.getRealPath(), int(req.Uid), int(req.Gid)); err != nil {
+			if err = n.fs.store.Chown(n.getRealPath(), int(uid), int(gid)); err != nil {
 				return translateError(err)
 			}
 		}
-		fi, err := os.Stat(n.getRealPath())
+		fi, err := n.fs.store.Stat(n.getRealPath())
 		if err != nil {
 			return translateError(err)
 		}
 		s := fi.Sys().(*syscall.Stat_t)
 		if req.Valid.Uid() {
-			if err = os.Chown(n.getRealPath(), int(req.Uid), int(s.Gid)); err != nil {
+			if err = n.fs.store.Chown(n.getRealPath(), int(uid), int(s.Gid)); err != nil {
 				return translateError(err)
 			}
 		} else {
-			if err = os.Chown(n.getRealPath(), int(s.Uid), int(req.Gid)); err != nil {
+			if err = n.fs.store.Chown(n.getRealPath(), int(s.Uid), int(gid)); err != nil {
 				return translateError(err)
 			}
 		}
@@ -353,12 +943,12 @@ func (n *Node) Setattr(ctx context.Context,
 		return translateError(err)
 	}
 
-	fi, err := os.Stat(n.getRealPath())
+	fi, err := n.fs.store.Lstat(n.getRealPath())
 	if err != nil {
 		return translateError(err)
 	}
 
-	fillAttrWithFileInfo(&resp.Attr, fi)
+	n.fillAttr(&resp.Attr, fi)
 
 	return nil
 }
@@ -368,20 +958,49 @@ var _ fs.NodeRenamer = (*Node)(nil)
 // Rename implements fs.NodeRenamer interface for *Node
 func (n *Node) Rename(ctx context.Context,
 	req *fuse.RenameRequest, newDir fs.Node) (err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpRename, n); err != nil {
+		return err
+	}
+	req.OldName = n.childName(req.OldName)
+	if req.NewName, err = newDir.(*Node).newChildName(req.NewName); err != nil {
+		return err
+	}
 	np := filepath.Join(newDir.(*Node).getRealPath(), req.NewName)
 	op := filepath.Join(n.getRealPath(), req.OldName)
 	defer func() {
-		log.Printf("%s.Rename(%s->%s): error=%v",
-			n.getRealPath(), op, np, err)
+		loog.Debug(logRename, "Rename", "path", n.getRealPath(), "old", op, "new", np, "error", err)
 	}()
+	defer func() { n.fs.audit(ctx, OpRename, op, np, err) }()
+	// a replaced file loses a link, unless it is a hard link of the moved one
+	moved, _ := n.lstatChild(req.OldName)
+	replaced, statErr := newDir.(*Node).lstatChild(req.NewName)
+	seq := n.fs.beginOp(n.removing(req.OldName, newDir.(*Node), req.NewName))
+	defer n.fs.doneOp(seq)
 	defer func() {
 		if err == nil {
-			n.fs.moveAllxattrs(ctx, op, np)
-			n.fs.nodeRenamed(op, np)
+			n.fs.appliedOp(seq)
+			n.fs.killPoint(KillMidRename)
+			if statErr == nil && !os.SameFile(moved, replaced) {
+				n.fs.unlinkedXattrs(replaced)
+			}
+			n.fs.moveVersions(op, np)
+			n.fs.ocisMoved(newDir.(*Node).getRealPath(), req.NewName)
+			n.fs.propagate(np)
+			n.fs.propagate(n.getRealPath())
+			n.fs.emit(EventItemMoved, np, op)
+			n.invalidateAttr()
+			newDir.(*Node).invalidateAttr()
 		}
 	}()
-	return os.Rename(op, np)
+	if n.fs.hidden(req.NewName) {
+		return fuse.EPERM
+	}
+	if n.fs.overlay() {
+		return translateError(n.renameLayered(ctx, req.OldName, newDir.(*Node), req.NewName))
+	}
+	return n.fs.renameBacking(op, np, func() error {
+		return n.renameChild(req.OldName, newDir.(*Node), req.NewName)
+	})
 }
 
 var _ fs.NodeGetxattrer = (*Node)(nil)
@@ -389,17 +1008,38 @@ var _ fs.NodeGetxattrer = (*Node)(nil)
 // Getxattr implements fs.Getxattrer interface for *Node
 func (n *Node) Getxattr(ctx context.Context,
 	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpGetxattr, n); err != nil {
+		return err
+	}
+
+	defer func() {
+		loog.Debug(logXattr, "Getxattr", "path", n.getRealPath(), "name", req.Name, "error", err)
+	}()
 
 	defer func() {
-		log.Printf("%s.Getxattr(%s): error=%#v", n.getRealPath(), req.Name, err)
+		if err == nil && isACLAttr(req.Name) {
+			resp.Xattr = n.fs.mapACL(resp.Xattr, true)
+		}
+		// values set before the limit was lowered cannot be returned in
+		// one reply, the size probing of the kernel is done by fs.Serve
+		if err == nil && len(resp.Xattr) > xattrSizeMax {
+			resp.Xattr, err = nil, fuse.Errno(syscall.E2BIG)
+		}
 	}()
 
-	if resp.Xattr, err = xattr.Get(n.getRealPath(), req.Name); err != nil {
-		return translateError(unpackSysErr(err))
+	rp := n.resolvedPath()
+	backing, memory := n.fs.xattrStores(req.Name)
+	if backing {
+		if resp.Xattr, err = n.fs.store.GetXattr(rp, req.Name); !memory || !xattrUnsupported(err) {
+			return translateXattrError(err)
+		}
+		n.fs.xattrFallback(rp)
 	}
-	// TODO if no data is available / attr not set return fuse.ENODATA
-	return nil
+	if !memory {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr, err = n.fs.getxattr(rp, req.Name)
+	return err
 }
 
 var _ fs.NodeListxattrer = (*Node)(nil)
@@ -407,19 +1047,53 @@ var _ fs.NodeListxattrer = (*Node)(nil)
 // Listxattr implements fs.Listxattrer interface for *Node
 func (n *Node) Listxattr(ctx context.Context,
 	req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpListxattr, n); err != nil {
+		return err
+	}
 
 	defer func() {
-		log.Printf("%s.Listxattr(%d,%d): error=%v",
-			n.getRealPath(), req.Position, req.Size, err)
+		loog.Debug(logXattr, "Listxattr", "path", n.getRealPath(),
+			"position", req.Position, "size", req.Size, "error", err)
 	}()
 
+	rp := n.resolvedPath()
 	var names []string
-	if names, err = xattr.List(n.getRealPath()); err != nil {
-		return translateError(unpackSysErr(err))
+	fromBacking := false
+	if n.fs.passthroughXattrs() {
+		if names, err = n.fs.store.ListXattr(rp); !xattrUnsupported(err) {
+			if err != nil {
+				return translateXattrError(err)
+			}
+			fromBacking = true
+		} else {
+			n.fs.xattrFallback(rp)
+		}
+	}
+	if !fromBacking {
+		names = n.fs.listxattr(rp)
+	}
+	for _, name := range names {
+		if backing, memory := n.fs.xattrStores(name); fromBacking && backing || !fromBacking && memory {
+			resp.Append(name)
+		}
 	}
-	resp.Append(names...)
 
+	// security.* and trusted.* may only be kept in the other store
+	var others []string
+	if fromBacking {
+		others = n.fs.listxattr(rp)
+	} else {
+		others, _ = n.fs.store.ListXattr(rp)
+	}
+	for _, name := range others {
+		if backing, memory := n.fs.xattrStores(name); fromBacking && memory && !backing || !fromBacking && backing && !memory {
+			resp.Append(name)
+		}
+	}
+	if len(resp.Xattr) > xattrListMax {
+		resp.Xattr = nil
+		return fuse.Errno(syscall.E2BIG)
+	}
 	return nil
 }
 
@@ -428,16 +1102,41 @@ var _ fs.NodeSetxattrer = (*Node)(nil)
 // Setxattr implements fs.Setxattrer interface for *Node
 func (n *Node) Setxattr(ctx context.Context,
 	req *fuse.SetxattrRequest) (err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpSetxattr, n); err != nil {
+		return err
+	}
+	defer func() { n.fs.audit(ctx, OpSetxattr, n.getRealPath(), req.Name, err) }()
+	if n.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
 
 	defer func() {
-		log.Printf("%s.Setxattr(%s): error=%v", n.getRealPath(), req.Name, err)
+		loog.Debug(logXattr, "Setxattr", "path", n.getRealPath(), "name", req.Name,
+			"size", len(req.Xattr), "error", err)
 	}()
 
-	if err = xattr.SetWithFlags(n.getRealPath(), req.Name, req.Xattr, int(req.Flags)); err != nil {
-		return translateError(unpackSysErr(err))
+	if n.fs.xattrTooBig(len(req.Xattr)) {
+		return fuse.Errno(syscall.E2BIG)
 	}
-	return nil
+
+	if err = n.copyUp(ctx); err != nil {
+		return translateError(err)
+	}
+	if isACLAttr(req.Name) {
+		req.Xattr = n.fs.mapACL(req.Xattr, false)
+	}
+	rp := n.getRealPath()
+	backing, memory := n.fs.xattrStores(req.Name)
+	if backing {
+		if err = n.fs.store.SetXattr(rp, req.Name, req.Xattr, int(req.Flags)); !memory || !xattrUnsupported(err) {
+			return translateXattrError(err)
+		}
+		n.fs.xattrFallback(rp)
+	}
+	if !memory {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	return n.fs.setxattr(rp, req.Name, req.Xattr, req.Flags)
 }
 
 var _ fs.NodeRemovexattrer = (*Node)(nil)
@@ -445,17 +1144,33 @@ var _ fs.NodeRemovexattrer = (*Node)(nil)
 // Removexattr implements fs.Removexattrer interface for *Node
 func (n *Node) Removexattr(ctx context.Context,
 	req *fuse.RemovexattrRequest) (err error) {
-	time.Sleep(n.fs.latency)
+	if err = n.fs.enter(ctx, OpRemovexattr, n); err != nil {
+		return err
+	}
+	defer func() { n.fs.audit(ctx, OpRemovexattr, n.getRealPath(), req.Name, err) }()
+	if n.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
 
 	defer func() {
-		log.Printf("%s.Removexattr(%s): error=%v", n.getRealPath(), req.Name, err)
+		loog.Debug(logXattr, "Removexattr", "path", n.getRealPath(), "name", req.Name, "error", err)
 	}()
 
-	if err = xattr.Remove(n.getRealPath(), req.Name); err != nil {
-		return translateError(unpackSysErr(err))
+	if err = n.copyUp(ctx); err != nil {
+		return translateError(err)
 	}
-
-	return nil
+	rp := n.getRealPath()
+	backing, memory := n.fs.xattrStores(req.Name)
+	if backing {
+		if err = n.fs.store.RemoveXattr(rp, req.Name); !memory || !xattrUnsupported(err) {
+			return translateXattrError(err)
+		}
+		n.fs.xattrFallback(rp)
+	}
+	if !memory {
+		return fuse.ErrNoXattr
+	}
+	return n.fs.removexattr(rp, req.Name)
 }
 
 var _ fs.NodeForgetter = (*Node)(nil)
@@ -463,4 +1178,5 @@ var _ fs.NodeForgetter = (*Node)(nil)
 // Forget implements fs.NodeForgetter interface for *Node
 func (n *Node) Forget() {
 	n.fs.forgetNode(n)
+	n.closeDir()
 }
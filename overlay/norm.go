@@ -0,0 +1,94 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"fmt"
+	"syscall"
+	"unicode/utf8"
+
+	"bazil.org/fuse"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization is the Unicode normalization form of new names
+type Normalization string
+
+const (
+	// NormalizeNone keeps names as they are
+	NormalizeNone Normalization = ""
+	// NormalizeNFC composes names, like Linux and Windows clients create them
+	NormalizeNFC Normalization = "nfc"
+	// NormalizeNFD decomposes names, like macOS clients create them
+	NormalizeNFD Normalization = "nfd"
+)
+
+// ParseNormalization parses a -normalize value
+func ParseNormalization(s string) (Normalization, error) {
+	switch n := Normalization(s); n {
+	case NormalizeNone, NormalizeNFC, NormalizeNFD:
+		return n, nil
+	}
+	return "", fmt.Errorf("unknown normalization %q, expected nfc or nfd", s)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// normalize returns name in the form new entries are created with
+func (f *FS) normalize(name string) string {
+	switch f.normalization {
+	case NormalizeNFC:
+		return norm.NFC.String(name)
+	case NormalizeNFD:
+		return norm.NFD.String(name)
+	}
+	return name
+}
+
+// childName returns the name of the entry in the directory n that name
+// refers to: name itself if it exists, otherwise an existing entry with the
+// NFC or NFD form of name, otherwise the normalized name for a new entry.
+// So both forms find a file no matter which form it was created with.
+func (n *Node) childName(name string) string {
+	if n.fs.nameEncryption() != nil {
+		return n.fs.storedName(n.getRealPath(), n.fs.normalize(name))
+	}
+	if n.fs.normalization == NormalizeNone || isASCII(name) {
+		return name
+	}
+	for _, c := range []string{name, norm.NFC.String(name), norm.NFD.String(name)} {
+		if n.childExists(c) {
+			return c
+		}
+	}
+	return n.fs.normalize(name)
+}
+
+// newChildName is childName for the name of a new entry, it fails with
+// ENAMETOOLONG if the name is too long to be stored encrypted
+func (n *Node) newChildName(name string) (string, error) {
+	stored := n.childName(name)
+	if n.fs.nameEncryption() != nil && len(stored) > n.fs.storedNameMax(nameMax) {
+		return "", fuse.Errno(syscall.ENAMETOOLONG)
+	}
+	return stored, nil
+}
+
+// childExists reports whether name exists in any layer of the directory n
+func (n *Node) childExists(name string) bool {
+	if _, err := n.lstatChild(name); err == nil {
+		return true
+	}
+	if n.fs.overlay() {
+		_, fi := n.fs.lowerChildren(n.getRealPath(), n.getLowerPaths(), name)
+		return fi != nil
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/butonic/ocis-overlay/loog"
+	"github.com/pkg/xattr"
+)
+
+// xattrs maintained like the oCIS decomposedfs storage driver does
+const (
+	ocisIDAttr         = "user.ocis.id"
+	ocisParentIDAttr   = "user.ocis.parentid"
+	ocisNameAttr       = "user.ocis.name"
+	ocisBlobIDAttr     = "user.ocis.blobid"
+	ocisBlobSizeAttr   = "user.ocis.blobsize"
+	ocisChecksumPrefix = "user.ocis.cs."
+)
+
+// newUUID returns a random version 4 UUID, decomposedfs uses them as node
+// and blob ids
+func newUUID() string {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// readXattr reads an xattr of p from where the xattr mode stores it
+func (f *FS) readXattr(p string, name string) ([]byte, error) {
+	if f.passthroughXattrs() {
+		v, err := xattr.Get(p, name)
+		if !xattrUnsupported(err) {
+			return v, err
+		}
+	}
+	return f.getxattr(p, name)
+}
+
+// writeXattr sets an xattr of p where the xattr mode stores it
+func (f *FS) writeXattr(p string, name string, value []byte) error {
+	if f.passthroughXattrs() {
+		err := xattr.Set(p, name, value)
+		if !xattrUnsupported(err) {
+			return err
+		}
+	}
+	return f.setxattr(p, name, value, 0)
+}
+
+// ocisManaged reports whether the decomposedfs metadata is maintained for
+// fi. User xattrs are only allowed on regular files and directories.
+func (f *FS) ocisManaged(fi os.FileInfo) bool {
+	return f.ocisMetadata && (fi.Mode().IsRegular() || fi.IsDir())
+}
+
+// ocisNodeID returns the node id of p, a new one is assigned if p has none
+func (f *FS) ocisNodeID(p string) (string, error) {
+	if id, err := f.readXattr(p, ocisIDAttr); err == nil && len(id) > 0 {
+		return string(id), nil
+	}
+	id := newUUID()
+	return id, f.writeXattr(p, ocisIDAttr, []byte(id))
+}
+
+// ocisInit makes sure the upper file name in dir carries the decomposedfs
+// metadata. Files created outside the mount get it on their first lookup.
+func (f *FS) ocisInit(dir string, name string, fi os.FileInfo) {
+	if !f.ocisManaged(fi) {
+		return
+	}
+	p := filepath.Join(dir, name)
+	if id, err := f.readXattr(p, ocisIDAttr); err == nil && len(id) > 0 {
+		return
+	}
+	err := f.ocisSetParent(dir, name)
+	if err == nil && fi.Mode().IsRegular() {
+		err = f.ocisContentChanged(p)
+	}
+	if err != nil {
+		loog.Warn(logOcis, "could not initialize metadata", "path", p, "error", err)
+	}
+}
+
+// ocisSetParent records the parent id and the name of dir/name, e.g. after it
+// was created or moved
+func (f *FS) ocisSetParent(dir string, name string) error {
+	p := filepath.Join(dir, name)
+	parentID, err := f.ocisNodeID(dir)
+	if err != nil {
+		return err
+	}
+	if _, err = f.ocisNodeID(p); err != nil {
+		return err
+	}
+	if err = f.writeXattr(p, ocisParentIDAttr, []byte(parentID)); err != nil {
+		return err
+	}
+	return f.writeXattr(p, ocisNameAttr, []byte(name))
+}
+
+// ocisContentChanged assigns a new blob id to the regular file p and records
+// its size and checksums, like decomposedfs does for every upload
+func (f *FS) ocisContentChanged(p string) error {
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sums := map[string]hash.Hash{
+		"sha1":    sha1.New(),
+		"md5":     md5.New(),
+		"adler32": adler32.New(),
+	}
+	w := io.MultiWriter(sums["sha1"], sums["md5"], sums["adler32"])
+	size, err := io.Copy(w, file)
+	if err != nil {
+		return err
+	}
+	if err = f.writeXattr(p, ocisBlobIDAttr, []byte(newUUID())); err != nil {
+		return err
+	}
+	if err = f.writeXattr(p, ocisBlobSizeAttr, []byte(strconv.FormatInt(size, 10))); err != nil {
+		return err
+	}
+	for name, h := range sums {
+		if err = f.writeXattr(p, ocisChecksumPrefix+name, h.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ocisMoved updates the parent id and name of a renamed node
+func (f *FS) ocisMoved(newDir string, newName string) {
+	p := filepath.Join(newDir, newName)
+	fi, err := os.Lstat(p)
+	if err != nil || !f.ocisManaged(fi) {
+		return
+	}
+	if err = f.ocisSetParent(newDir, newName); err != nil {
+		loog.Warn(logOcis, "could not update metadata", "path", p, "error", err)
+	}
+}
+
+// ocisWritten updates the blob metadata of the regular file p after its
+// content changed through the mount
+func (f *FS) ocisWritten(p string) {
+	if !f.ocisMetadata {
+		return
+	}
+	if err := f.ocisContentChanged(p); err != nil {
+		loog.Warn(logOcis, "could not update blob metadata", "path", p, "error", err)
+	}
+}
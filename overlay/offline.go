@@ -0,0 +1,564 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// offlineProbe is how often an offline mount checks if the backend is back
+const offlineProbe = 30 * time.Second
+
+// journal operations
+const (
+	journalUpload = "upload"
+	journalMkdir  = "mkdir"
+	journalRemove = "remove"
+)
+
+// journalEntry is a change made while the backend was unreachable
+type journalEntry struct {
+	Seq  int64  `json:"seq"`
+	Op   string `json:"op"`
+	UID  uint32 `json:"uid,omitempty"`
+	Path string `json:"path"`
+	// Base is the version of the remote file the change was made to, empty
+	// for new files. It is a conflict if the version changed meanwhile.
+	Base  string    `json:"base,omitempty"`
+	Size  int64     `json:"size,omitempty"`
+	Mtime time.Time `json:"mtime"`
+}
+
+// offlineJournal queues the changes to a remote backend made while it is
+// unreachable, in a directory that survives restarts: the entries in
+// journal.json and the content of uploads in files named after their
+// sequence number.
+type offlineJournal struct {
+	dir string
+	// offline is set while the backend is unreachable
+	offline int32
+	wake    chan struct{}
+
+	lock    sync.Mutex
+	entries []*journalEntry
+	seq     int64
+}
+
+// errOffline is returned for backend calls while the backend is unreachable
+func errOffline(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.ENETDOWN}
+}
+
+// unreachableErrnos are the errors of a backend call that mean the backend
+// cannot be reached at all
+var unreachableErrnos = []syscall.Errno{
+	syscall.ENETDOWN,
+	syscall.ENETUNREACH,
+	syscall.EHOSTUNREACH,
+	syscall.ECONNREFUSED,
+	syscall.ECONNRESET,
+	syscall.ETIMEDOUT,
+}
+
+// unreachable reports whether err of a backend call means that the backend
+// cannot be reached
+func unreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	if errno := errnoOf(err); errno != 0 {
+		err = errno
+	}
+	for _, errno := range unreachableErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+func newOfflineJournal(dir string) (*offlineJournal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	j := &offlineJournal{dir: dir, wake: make(chan struct{}, 1)}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "journal.json"))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(data, &j.entries); err != nil {
+			return nil, fmt.Errorf("invalid offline journal: %v", err)
+		}
+		for _, e := range j.entries {
+			if e.Seq > j.seq {
+				j.seq = e.Seq
+			}
+		}
+	}
+	return j, nil
+}
+
+// save writes the entries, j.lock must be held
+func (j *offlineJournal) save() error {
+	data, err := json.Marshal(j.entries)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(j.dir, "journal.json.tmp")
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(j.dir, "journal.json"))
+}
+
+// data returns the path of the content of an upload
+func (j *offlineJournal) data(e *journalEntry) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%d.data", e.Seq))
+}
+
+// latest returns the last entry for p in the tree of uid, nil if there is
+// none
+func (j *offlineJournal) latest(uid uint32, p string) *journalEntry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		if e := j.entries[i]; e.UID == uid && e.Path == p {
+			return e
+		}
+	}
+	return nil
+}
+
+// drop removes the entries for p of uid matching op, j.lock must be held.
+// It returns the first one dropped.
+func (j *offlineJournal) drop(uid uint32, p string, op string) *journalEntry {
+	var first *journalEntry
+	kept := j.entries[:0]
+	for _, e := range j.entries {
+		if e.UID == uid && e.Path == p && e.Op == op {
+			if first == nil {
+				first = e
+			}
+			if op == journalUpload {
+				os.Remove(j.data(e))
+			}
+			continue
+		}
+		kept = append(kept, e)
+	}
+	j.entries = kept
+	return first
+}
+
+// add appends e and saves the journal, j.lock must be held
+func (j *offlineJournal) add(e *journalEntry) error {
+	j.entries = append(j.entries, e)
+	if err := j.save(); err != nil {
+		j.entries = j.entries[:len(j.entries)-1]
+		return err
+	}
+	return nil
+}
+
+// isOffline reports whether the backend is unreachable
+func (f *FS) isOffline() bool {
+	return f.offline != nil && atomic.LoadInt32(&f.offline.offline) == 1
+}
+
+// observe takes the mount offline when a backend call failed because the
+// backend is unreachable
+func (f *FS) observe(err error) {
+	if f.offline == nil || !unreachable(err) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&f.offline.offline, 0, 1) {
+		loog.Warn(logRemote, "backend unreachable, working offline", "error", err)
+	}
+}
+
+// queueing reports whether a change that failed with err is queued in the
+// journal instead
+func (f *FS) queueing(err error) bool {
+	return f.offline != nil && (f.isOffline() || unreachable(err))
+}
+
+// journalInfo returns the file info of the queued change e, nil for removes
+func journalInfo(e *journalEntry) os.FileInfo {
+	switch e.Op {
+	case journalUpload:
+		return &davInfo{name: path.Base(e.Path), size: e.Size, mtime: e.Mtime, etag: fmt.Sprintf("offline-%d", e.Seq)}
+	case journalMkdir:
+		return &davInfo{name: path.Base(e.Path), mtime: e.Mtime, isDir: true}
+	default:
+		return nil
+	}
+}
+
+// queuedInfo returns the info of the queued change to p in the tree of uid,
+// nil if there is none. ok is false if p was removed.
+func (f *FS) queuedInfo(uid uint32, p string) (fi os.FileInfo, ok bool) {
+	if f.offline == nil {
+		return nil, true
+	}
+	e := f.offline.latest(uid, p)
+	if e == nil {
+		return nil, true
+	}
+	fi = journalInfo(e)
+	return fi, fi != nil
+}
+
+// queuedUpload returns the queued upload of n, nil if there is none
+func (f *FS) queuedUpload(n *remoteNode) *journalEntry {
+	if f.offline == nil {
+		return nil
+	}
+	if e := f.offline.latest(n.uid, n.path()); e != nil && e.Op == journalUpload {
+		return e
+	}
+	return nil
+}
+
+// below reports whether there are queued changes below the directory p of
+// uid
+func (j *offlineJournal) below(uid uint32, p string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, e := range j.entries {
+		if e.UID == uid && strings.HasPrefix(e.Path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedInfo returns the last known file info of n, expired or not
+func (n *remoteNode) cachedInfo() os.FileInfo {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.fi
+}
+
+// kidInfo returns the last known file info of the child name of n. listed
+// is set if n was read before, so a missing child is known not to exist.
+func (n *remoteNode) kidInfo(name string) (fi os.FileInfo, listed bool) {
+	n.fs.rtree.RLock()
+	c := n.kids[name]
+	n.fs.rtree.RUnlock()
+	if c != nil {
+		fi = c.cachedInfo()
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if fi == nil {
+		fi = n.listing[name]
+	}
+	return fi, n.listing != nil
+}
+
+// cachedListing returns the infos of the last directory read of n, expired
+// or not, nil if it was never read
+func (n *remoteNode) cachedListing() []os.FileInfo {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.listing == nil {
+		return nil
+	}
+	fis := make([]os.FileInfo, 0, len(n.listing))
+	for _, fi := range n.listing {
+		fis = append(fis, fi)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis
+}
+
+// copyRemote copies the file of n to w through the block cache, so files
+// can be changed while offline as far as they are cached
+func (f *FS) copyRemote(ctx context.Context, n *remoteNode, w io.WriterAt) error {
+	buf := make([]byte, remoteBlockSize)
+	for off := int64(0); ; off += remoteBlockSize {
+		k, err := f.readRemote(ctx, n, buf, off)
+		if _, werr := w.WriteAt(buf[:k], off); werr != nil {
+			return werr
+		}
+		if err == io.EOF || k < len(buf) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// withQueued applies the queued changes below the directory n to the
+// infos of its entries
+func (n *remoteNode) withQueued(fis []os.FileInfo) []os.FileInfo {
+	if n.fs.offline == nil {
+		return fis
+	}
+	dir := n.path()
+	j := n.fs.offline
+	j.lock.Lock()
+	var changed []*journalEntry
+	for _, e := range j.entries {
+		if e.UID == n.uid && path.Dir("/"+e.Path) == path.Clean("/"+dir) {
+			changed = append(changed, e)
+		}
+	}
+	j.lock.Unlock()
+	if len(changed) == 0 {
+		return fis
+	}
+	byName := make(map[string]os.FileInfo, len(fis))
+	var names []string
+	for _, fi := range fis {
+		if _, ok := byName[fi.Name()]; !ok {
+			names = append(names, fi.Name())
+		}
+		byName[fi.Name()] = fi
+	}
+	for _, e := range changed {
+		name := path.Base(e.Path)
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = journalInfo(e)
+	}
+	out := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		if fi := byName[name]; fi != nil {
+			out = append(out, fi)
+		}
+	}
+	return out
+}
+
+// queueUpload journals the content of r as the new content of n. base is
+// the version of the file r was made from, an earlier queued upload keeps
+// its base.
+func (f *FS) queueUpload(n *remoteNode, r io.ReaderAt, size int64, base string) error {
+	j := f.offline
+	p := n.path()
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.seq++
+	e := &journalEntry{Seq: j.seq, Op: journalUpload, UID: n.uid, Path: p, Base: base, Size: size, Mtime: time.Now()}
+	data, err := os.OpenFile(j.data(e), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(data, io.NewSectionReader(r, 0, size))
+	if cerr := data.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(j.data(e))
+		return err
+	}
+	if prev := j.drop(n.uid, p, journalUpload); prev != nil {
+		e.Base = prev.Base
+	}
+	if err = j.add(e); err != nil {
+		os.Remove(j.data(e))
+		return err
+	}
+	loog.Info(logRemote, "queued upload", "path", p, "size", size)
+	return nil
+}
+
+// queueMkdir journals the creation of the directory p in the tree of uid
+func (f *FS) queueMkdir(uid uint32, p string) error {
+	j := f.offline
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.seq++
+	loog.Info(logRemote, "queued mkdir", "path", p)
+	return j.add(&journalEntry{Seq: j.seq, Op: journalMkdir, UID: uid, Path: p, Mtime: time.Now()})
+}
+
+// queueRemove journals the removal of p in the tree of uid, base is the
+// version of the file that was removed. Files and directories created
+// while offline just disappear from the journal.
+func (f *FS) queueRemove(uid uint32, p string, base string) error {
+	j := f.offline
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if prev := j.drop(uid, p, journalUpload); prev != nil {
+		if prev.Base == "" {
+			return j.save()
+		}
+		base = prev.Base
+	}
+	if prev := j.drop(uid, p, journalMkdir); prev != nil {
+		return j.save()
+	}
+	j.seq++
+	loog.Info(logRemote, "queued remove", "path", p)
+	return j.add(&journalEntry{Seq: j.seq, Op: journalRemove, UID: uid, Path: p, Base: base, Mtime: time.Now()})
+}
+
+// readQueued reads the content of the queued upload e at off
+func (f *FS) readQueued(e *journalEntry, p []byte, off int64) (int, error) {
+	data, err := os.Open(f.offline.data(e))
+	if err != nil {
+		return 0, err
+	}
+	defer data.Close()
+	return data.ReadAt(p, off)
+}
+
+// backendOf returns the backend of the tree of uid
+func (f *FS) backendOf(uid uint32) Backend {
+	if root := f.userRoots[uid]; root != nil {
+		return root.backend
+	}
+	return f.backend
+}
+
+// reconcile checks every offlineProbe whether the backend is back while it
+// is offline or changes are queued, and replays the journal
+func (f *FS) reconcile() {
+	t := time.NewTicker(offlineProbe)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-f.offline.wake:
+		}
+		f.offline.lock.Lock()
+		pending := len(f.offline.entries)
+		f.offline.lock.Unlock()
+		if pending == 0 && !f.isOffline() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), offlineProbe)
+		_, err := f.backend.Stat(ctx, "")
+		cancel()
+		if err != nil {
+			loog.Debug(logRemote, "backend still unreachable", "error", err)
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&f.offline.offline, 1, 0) {
+			loog.Info(logRemote, "backend reachable again", "queued", pending)
+		}
+		f.replay()
+	}
+}
+
+// replay pushes the queued changes in order until the backend becomes
+// unreachable again
+func (f *FS) replay() {
+	j := f.offline
+	replayed := 0
+	for !f.isOffline() {
+		j.lock.Lock()
+		if len(j.entries) == 0 {
+			j.lock.Unlock()
+			break
+		}
+		e := j.entries[0]
+		j.lock.Unlock()
+		err := f.replayEntry(e)
+		if err != nil && unreachable(err) {
+			f.observe(err)
+			break
+		}
+		if err != nil {
+			loog.Error(logRemote, "could not replay queued change, dropping it", "op", e.Op, "path", e.Path, "error", err)
+		}
+		j.lock.Lock()
+		if len(j.entries) > 0 && j.entries[0] == e {
+			j.entries = j.entries[1:]
+			if e.Op == journalUpload {
+				os.Remove(j.data(e))
+			}
+			if err := j.save(); err != nil {
+				loog.Error(logRemote, "could not save the offline journal", "error", err)
+			}
+		}
+		j.lock.Unlock()
+		f.blocks.dropFile(e.Path)
+		replayed++
+	}
+	if replayed > 0 {
+		for _, root := range f.remoteRoots() {
+			root.invalidateTree()
+		}
+		loog.Info(logRemote, "replayed queued changes", "count", replayed)
+	}
+}
+
+// replayEntry pushes the queued change e. Uploads to a file that changed in
+// the backend meanwhile go to a conflict file next to it, removes of such
+// a file are skipped.
+func (f *FS) replayEntry(e *journalEntry) error {
+	ctx := context.Background()
+	b := f.backendOf(e.UID)
+	var remote os.FileInfo
+	err := f.retry(ctx, RetryRead, "stat", e.Path, func() (err error) {
+		remote, err = b.Stat(ctx, e.Path)
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) && errnoOf(err) != syscall.ENOENT {
+		return err
+	}
+	conflict := remote != nil && !remote.IsDir() && version(remote) != e.Base &&
+		// a new file that was created empty before going offline
+		!(e.Base == "" && remote.Size() == 0)
+	switch e.Op {
+	case journalMkdir:
+		if remote != nil {
+			return nil
+		}
+		return f.retry(ctx, RetryNamespace, "mkdir", e.Path, func() error {
+			return b.Mkdir(ctx, e.Path)
+		})
+	case journalRemove:
+		if remote == nil {
+			return nil
+		}
+		if conflict {
+			loog.Warn(logRemote, "not removing file changed in the backend", "path", e.Path)
+			return nil
+		}
+		return f.retry(ctx, RetryNamespace, "remove", e.Path, func() error {
+			return b.Remove(ctx, e.Path)
+		})
+	}
+	target := e.Path
+	if conflict {
+		target = conflictName(e.Path, e.Mtime)
+		loog.Warn(logRemote, "file changed in the backend, uploading to a conflicted copy", "path", e.Path, "conflict", target)
+	}
+	data, err := os.Open(f.offline.data(e))
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	return f.retry(ctx, RetryWrite, "upload", target, func() error {
+		return b.Upload(ctx, target, io.NewSectionReader(data, 0, e.Size), e.Size)
+	})
+}
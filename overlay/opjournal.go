@@ -0,0 +1,329 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+const (
+	// opJournalFile is the file below the metaDir the operation journal is
+	// kept in
+	opJournalFile = "journal"
+	// opJournalCompact empties the journal once it grew this big and no
+	// operation is running
+	opJournalCompact = 1 << 20
+	// copyUpTmp is the directory below the metaDir files are copied up in
+	// before they are moved to the upper layer
+	copyUpTmp = "copyup"
+)
+
+// journaled operations
+const (
+	opCreate = "create"
+	opMkdir  = "mkdir"
+	opWrite  = "write"
+	opRename = "rename"
+	opRemove = "remove"
+)
+
+// opRecord is a line of the operation journal. The intent of an operation is
+// synced to disk before the backing store is changed, Applied is recorded
+// once the change is made and Done once the metadata, versions and etags
+// are updated as well.
+type opRecord struct {
+	Seq     uint64 `json:"seq"`
+	Op      string `json:"op,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Applied bool   `json:"applied,omitempty"`
+	Done    bool   `json:"done,omitempty"`
+	// Hidden is set if a whiteout hid the name that is created, Path or the
+	// Target of a rename. It is removed before the name is created.
+	Hidden bool `json:"hidden,omitempty"`
+	// Whiteout is set if Path exists in a lower layer, a whiteout hides it
+	// once it is removed or renamed
+	Whiteout bool `json:"whiteout,omitempty"`
+	// Existed is set if Path existed in the upper layer before a rename
+	Existed bool `json:"existed,omitempty"`
+}
+
+// opJournal is the write-ahead journal of the mutating operations of a
+// local mount. After a crash the operations that did not complete are
+// finished or rolled back on the next start, see recoverOp.
+type opJournal struct {
+	lock    sync.Mutex
+	file    *os.File
+	seq     uint64
+	size    int64
+	running map[uint64]bool
+}
+
+// openOpJournal opens the journal at p and returns the records of the
+// operations that did not complete, with the ones recorded later merged in
+func openOpJournal(p string) (*opJournal, []*opRecord, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pending []*opRecord
+	bySeq := make(map[uint64]*opRecord)
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		var r opRecord
+		// a torn last line is from a crash while it was written
+		if json.Unmarshal(s.Bytes(), &r) != nil {
+			continue
+		}
+		switch b := bySeq[r.Seq]; {
+		case b == nil && r.Op != "":
+			bySeq[r.Seq] = &r
+			pending = append(pending, &r)
+		case b != nil:
+			b.Applied = b.Applied || r.Applied
+			b.Done = b.Done || r.Done
+		}
+	}
+	if err = s.Err(); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	incomplete := pending[:0]
+	for _, r := range pending {
+		if !r.Done {
+			incomplete = append(incomplete, r)
+		}
+	}
+	return &opJournal{file: file, running: make(map[uint64]bool)}, incomplete, nil
+}
+
+// write appends r to the journal, synced if sync is set, j.lock must be held
+func (j *opJournal) write(r *opRecord, sync bool) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	n, err := j.file.Write(append(b, '\n'))
+	j.size += int64(n)
+	if err == nil && sync {
+		err = j.file.Sync()
+	}
+	return err
+}
+
+// reset empties the journal, j.lock must be held
+func (j *opJournal) reset() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	return j.file.Sync()
+}
+
+// beginOp records the intent of an operation, nothing is recorded without
+// a journal. It returns the sequence number the operation is recorded
+// under, 0 if it is not.
+func (f *FS) beginOp(r *opRecord) uint64 {
+	j := f.ops
+	if j == nil {
+		return 0
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.seq++
+	r.Seq = j.seq
+	if err := j.write(r, true); err != nil {
+		loog.Error(logFS, "could not journal operation", "op", r.Op, "path", r.Path, "error", err)
+		return 0
+	}
+	j.running[r.Seq] = true
+	return r.Seq
+}
+
+// appliedOp records that the backing store was changed by operation seq.
+// Like doneOp it is not synced, the intent already is.
+func (f *FS) appliedOp(seq uint64) {
+	if seq == 0 {
+		return
+	}
+	f.ops.lock.Lock()
+	defer f.ops.lock.Unlock()
+	if err := f.ops.write(&opRecord{Seq: seq, Applied: true}, false); err != nil {
+		loog.Warn(logFS, "could not journal operation", "seq", seq, "error", err)
+	}
+}
+
+// doneOp records that operation seq completed or failed without changing
+// anything
+func (f *FS) doneOp(seq uint64) {
+	if seq == 0 {
+		return
+	}
+	j := f.ops
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.running, seq)
+	err := j.write(&opRecord{Seq: seq, Done: true}, false)
+	if err == nil && len(j.running) == 0 && j.size > opJournalCompact {
+		err = j.reset()
+	}
+	if err != nil {
+		loog.Warn(logFS, "could not journal operation", "seq", seq, "error", err)
+	}
+}
+
+// creating returns the intent to create name in the directory n, op is
+// opCreate or opMkdir
+func (n *Node) creating(op string, name string) *opRecord {
+	r := &opRecord{Op: op, Path: filepath.Join(n.getRealPath(), name)}
+	if n.fs.ops != nil && n.fs.overlay() {
+		r.Hidden = exists(whiteoutPath(n.getRealPath(), name))
+	}
+	return r
+}
+
+// removing returns the intent to remove name from the directory n, or to
+// rename it to newName in newDir if that is not nil
+func (n *Node) removing(name string, newDir *Node, newName string) *opRecord {
+	r := &opRecord{Op: opRemove, Path: filepath.Join(n.getRealPath(), name)}
+	if newDir != nil {
+		r.Op, r.Target = opRename, filepath.Join(newDir.getRealPath(), newName)
+	}
+	if n.fs.ops == nil {
+		return r
+	}
+	r.Existed = exists(r.Path)
+	if !n.fs.overlay() {
+		return r
+	}
+	_, lfi := n.fs.lowerChildren(n.getRealPath(), n.getLowerPaths(), name)
+	r.Whiteout = lfi != nil
+	if newDir != nil {
+		r.Hidden = exists(whiteoutPath(newDir.getRealPath(), newName))
+	}
+	return r
+}
+
+// startOpJournal opens the journal of a local mount and recovers the
+// operations a crash interrupted
+func (f *FS) startOpJournal() {
+	p := f.metaPath(opJournalFile)
+	j, pending, err := openOpJournal(p)
+	if err != nil {
+		loog.Error(logFS, "cannot open the operation journal", "path", p, "error", err)
+		return
+	}
+	// files copied up halfway are not in the upper layer yet
+	os.RemoveAll(f.metaPath(copyUpTmp))
+	for _, r := range pending {
+		f.recoverOp(r)
+	}
+	if len(pending) > 0 {
+		f.flushPropagation()
+	}
+	// the journal is only emptied once everything is recovered, a crash
+	// meanwhile recovers it all again
+	j.lock.Lock()
+	if err = j.reset(); err != nil {
+		loog.Error(logFS, "cannot empty the operation journal", "path", p, "error", err)
+	}
+	j.lock.Unlock()
+	f.ops = j
+}
+
+// recoverOp finishes or rolls back an operation that was interrupted by a
+// crash. The caller never got an answer, so either outcome is valid, but
+// not the half of it: a created file without its metadata, a removed or
+// renamed file of the upper layer whose lower one shows through again or a
+// new directory that is not opaque. Every step can be repeated.
+func (f *FS) recoverOp(r *opRecord) {
+	dir, name := filepath.Split(r.Path)
+	dir = filepath.Clean(dir)
+	fi, err := os.Lstat(r.Path)
+	switch r.Op {
+	case opCreate, opMkdir:
+		if err != nil {
+			if r.Hidden {
+				createWhiteout(dir, name)
+			}
+			break
+		}
+		if r.Hidden && fi.IsDir() {
+			makeOpaque(r.Path)
+		}
+		f.ocisInit(dir, name, fi)
+		f.propagate(r.Path)
+	case opWrite:
+		if err == nil && fi.Mode().IsRegular() {
+			f.ocisWritten(r.Path)
+			f.propagate(r.Path)
+		}
+	case opRemove:
+		if err == nil {
+			break
+		}
+		if r.Whiteout {
+			createWhiteout(dir, name)
+		}
+		f.propagate(dir)
+	case opRename:
+		tfi, terr := os.Lstat(r.Target)
+		// a source only in a lower layer is copied up first, only Applied
+		// tells its rename happened
+		if !r.Applied && (err == nil || terr != nil || !r.Existed) {
+			if r.Hidden && terr != nil {
+				createWhiteout(filepath.Dir(r.Target), filepath.Base(r.Target))
+			}
+			break
+		}
+		if r.Hidden && terr == nil && tfi.IsDir() {
+			makeOpaque(r.Target)
+		}
+		if r.Whiteout {
+			createWhiteout(dir, name)
+		}
+		f.moveVersions(r.Path, r.Target)
+		f.ocisMoved(filepath.Dir(r.Target), filepath.Base(r.Target))
+		f.propagate(r.Target)
+		f.propagate(dir)
+	}
+	loog.Info(logFS, "recovered interrupted operation", "op", r.Op, "path", r.Path, "target", r.Target, "applied", r.Applied)
+}
+
+// copyUpAtomic copies the regular file lower to upper through a file in the
+// metaDir, so a crash never leaves a partial copy in the upper layer. Files
+// are copied in place if the metaDir is on another file system.
+func (f *FS) copyUpAtomic(ctx context.Context, upper string, lower string, fi os.FileInfo) error {
+	tmpDir := f.metaPath(copyUpTmp)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(tmpDir, "")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name())
+	if err = copyFile(ctx, tmp.Name(), lower, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	copyMetadata(tmp.Name(), lower, fi)
+	err = os.Rename(tmp.Name(), upper)
+	if errnoOf(err) == syscall.EXDEV {
+		return copyFile(ctx, upper, lower, fi.Mode().Perm())
+	}
+	return err
+}
@@ -8,29 +8,252 @@ package overlay
 
 import (
 	"log"
-	"os"
 	"syscall"
 	"time"
 
-	"bazil.org/fuse"
 	"github.com/pkg/xattr"
 )
 
 const (
 	attrValidDuration = time.Second
+
+	// flags of setxattr(2)
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+	// xattrSizeMax and xattrListMax are the limits of the kernel for a value
+	// and for the list of names, bigger replies are refused
+	xattrSizeMax = 64 << 10
+	xattrListMax = 64 << 10
 )
 
-func translateError(err error) error {
-	switch {
-	case os.IsNotExist(err):
-		return fuse.ENOENT
-	case os.IsExist(err):
-		return fuse.EEXIST
-	case os.IsPermission(err):
-		return fuse.EPERM
-	default:
-		return err
-	}
+// subsystems used for logging
+const (
+	logFS      = "fs"
+	logAttr    = "attr"
+	logLookup  = "lookup"
+	logDir     = "dir"
+	logIO      = "io"
+	logCreate  = "create"
+	logRemove  = "remove"
+	logRename  = "rename"
+	logLink    = "link"
+	logXattr   = "xattr"
+	logFault   = "fault"
+	logControl = "control"
+	logOcis    = "ocis"
+	logEvents  = "events"
+	logRemote  = "remote"
+	logTrace   = "trace"
+)
+
+// LogSubsystems lists the subsystems the overlay logs for
+var LogSubsystems = []string{
+	logFS, logAttr, logLookup, logDir, logIO, logCreate, logRemove, logRename, logLink, logXattr, logFault, logControl, logOcis, logEvents, logRemote, logTrace,
+}
+
+// Options configure the overlay filesystem
+type Options struct {
+	// Latency is added to fuse handlers on every call
+	Latency Latency
+	// Faults make operations fail with injected errors
+	Faults []Fault
+	// Space simulates a nearly full disk, a zero Limit disables it
+	Space Space
+	// XattrMode selects where extended attributes are stored, defaults to
+	// XattrPassthrough
+	XattrMode XattrMode
+	// XattrSecurity selects how security.* and trusted.* xattrs are handled,
+	// defaults to XattrPolicyPassthrough
+	XattrSecurity XattrPolicy
+	// MaxXattrSize limits the size of xattr values, setting bigger ones fails
+	// with E2BIG. 0 uses the limit of the kernel, 64KiB.
+	MaxXattrSize int
+	// PersistXattrs saves the xattrs of the in-memory store below the
+	// metaDir and loads them on the next mount
+	PersistXattrs bool
+	// OpJournal journals creates, writes, renames and removes below the
+	// metaDir, so operations a crash interrupted are finished or rolled back
+	// on the next mount. Remote mounts do not journal.
+	OpJournal bool
+	// Dedup makes files written to the upper layer of a local mount share
+	// their data with files of the same content, on file systems that
+	// support it
+	Dedup bool
+	// Compression is the codec files released in the upper layer of a local
+	// mount are compressed with, files with the CompressionExclude
+	// extensions are not
+	Compression        Compression
+	CompressionExclude map[string]bool
+	// EncryptionKey is the master key files written to the upper layer of
+	// a local mount are encrypted with, nil if they are not. EncryptNames
+	// encrypts their names as well.
+	EncryptionKey []byte
+	EncryptNames  bool
+	// AttrTimeout is how long the kernel and the overlay may cache attributes
+	// and directory entries, 0 disables caching
+	AttrTimeout time.Duration
+	// Lowers are read-only directories merged below the mounted directory,
+	// top-down. If set, the mounted directory becomes the writable upper layer
+	// and changes to lower files are copied up on write.
+	Lowers []string
+	// Watch watches the backing directories with inotify, so changes made
+	// by others show up in the mount right away instead of after AttrTimeout
+	Watch bool
+	// NodeSweepInterval is how often nodes of files that vanished from the
+	// backing store are dropped, 0 disables the sweeper
+	NodeSweepInterval time.Duration
+	// Mknod allows creating FIFOs, sockets and device nodes, special files
+	// are always listed
+	Mknod bool
+	// WritebackCache must be set if the filesystem is mounted with
+	// fuse.WritebackCache, files are then opened for reading as well
+	WritebackCache bool
+	// KeepCache keeps the kernel page cache of files across opens as long as
+	// the backing file does not change
+	KeepCache bool
+	// DirectIO bypasses the kernel page cache for all files, otherwise only
+	// files opened with O_DIRECT do
+	DirectIO bool
+	// Executables tunes the overlay for running programs from it, e.g. a
+	// container rootfs: the page cache of binaries and libraries is kept
+	// across opens like with KeepCache and regular files report a larger
+	// st_blksize
+	Executables bool
+	// MaxOpenFiles limits the backing files kept open for handles, idle ones
+	// are closed and reopened on demand. 0 is unlimited.
+	MaxOpenFiles int
+	// Serialize answers one request at a time instead of serving them in
+	// parallel, to tell races in the overlay from bugs elsewhere
+	Serialize bool
+	// ReadAllMax is the size up to which files are read whole by the first
+	// read of a handle and the following reads are answered from memory,
+	// bigger files are read in the chunks the kernel asks for. 0 disables
+	// whole-file reads. The -latency and -faults of OpReadAll apply to
+	// the whole-file read.
+	ReadAllMax int64
+	// WriteCoalesce buffers writes smaller than this many bytes per handle
+	// and writes them to the backing file in chunks aligned to it, in the
+	// background. 0 writes through.
+	WriteCoalesce int64
+	// WriteFlushers is the number of goroutines writing buffered chunks
+	WriteFlushers int
+	// OcisMetadata maintains the user.ocis.* xattrs of the oCIS decomposedfs
+	// storage driver on all regular files and directories: node id, parent
+	// id, name, blob id, blob size and checksums
+	OcisMetadata bool
+	// VerifyChecksums checks the content of files of a local mount against
+	// the checksums of the OcisMetadata when they are opened for reading,
+	// files that do not match fail with EIO
+	VerifyChecksums bool
+	// Etags maintains an etag in the EtagAttr xattr of every changed file and
+	// of all of its parent directories
+	Etags bool
+	// TreeSize maintains the total size and the latest mtime below every
+	// directory in the TreeSizeAttr and TreeMtimeAttr xattrs
+	TreeSize bool
+	// PropagationDelay collects changes for this long before etags and tree
+	// sizes are propagated in one batch, 0 propagates every change right away
+	PropagationDelay time.Duration
+	// Events receives an event for every completed change, nil disables
+	// events
+	Events EventSink
+	// Interceptors see every request after the built-in ones, see
+	// Interceptor
+	Interceptors []Interceptor
+	// Scanner scans the files written to a local mount for viruses when
+	// they are closed, nil disables scanning. AVPolicy selects what happens
+	// to infected files.
+	Scanner  Scanner
+	AVPolicy AVPolicy
+	// AuditLog is the file every operation on files is appended to as a JSON
+	// line, empty disables the audit log
+	AuditLog string
+	// AuditMutationsOnly leaves opens and handles that wrote nothing out of
+	// the audit log
+	AuditMutationsOnly bool
+	// AuditMaxSize rotates the audit log when it grows bigger, AuditMaxFiles
+	// rotated logs are kept. 0 disables the rotation.
+	AuditMaxSize  int64
+	AuditMaxFiles int
+	// OTLPEndpoint is the OTLP/HTTP endpoint of an OpenTelemetry collector
+	// a span of every fuse request is exported to, empty disables tracing
+	OTLPEndpoint string
+	// SlowOpThreshold logs fuse requests taking this long or longer with
+	// their duration, operation, path and the number of requests in flight
+	// when they came in, 0 disables it
+	SlowOpThreshold time.Duration
+	// Record writes every fuse request with its arguments, the hashes of the
+	// data read and written, the timing and the result as a JSON line to
+	// this file, to be replayed with Replay. Empty disables the recording.
+	Record string
+	// Trash moves removed files into a per-user trash directory instead of
+	// deleting them
+	Trash bool
+	// TrashMaxAge purges trash entries older than this, 0 keeps them
+	TrashMaxAge time.Duration
+	// TrashMaxSize purges the oldest trash entries of a user while the trash
+	// holds more bytes than this, 0 is unlimited
+	TrashMaxSize int64
+	// Versions keeps the previous content of a file when it is truncated or
+	// written to for the first time after it was opened
+	Versions bool
+	// VersionsMax limits the versions kept per file, 0 is unlimited
+	VersionsMax int
+	// VersionsMaxAge prunes versions older than this, 0 keeps them
+	VersionsMaxAge time.Duration
+	// Hide lists glob patterns of names that are not listed, cannot be
+	// looked up and cannot be created, e.g. the temporary files of sync
+	// clients. Patterns match the name only, not the path.
+	Hide []string
+	// Show lists glob patterns of names that are never hidden
+	Show []string
+	// Normalization is the Unicode form names of new entries are created
+	// with. Lookups find entries in both forms, so names created by macOS
+	// (NFD) and Linux (NFC) clients do not show up twice.
+	Normalization Normalization
+	// UIDMap and GIDMap map the owners of backing files to the owners shown
+	// in the mount, in Attr and chown
+	UIDMap *IDMap
+	GIDMap *IDMap
+	// DefaultPermissions must be set if the filesystem is mounted with
+	// fuse.DefaultPermissions, the kernel then checks permissions and Access
+	// allows everything
+	DefaultPermissions bool
+	// AsCaller hands new files to the calling user, which needs the daemon
+	// to run as root or with CAP_CHOWN
+	AsCaller bool
+	// Backend is mounted instead of the local directory if set, Lowers and
+	// the local-only features like Trash and OcisMetadata do not apply
+	Backend Backend
+	// OfflineDir keeps working with a remote Backend while it is
+	// unreachable: cached data is served and changes are queued in this
+	// directory until the backend is back, see offline.go
+	OfflineDir string
+	// ConflictPolicy selects what flushing a file does when it was changed
+	// behind the mount while it was written, in the backing directory or
+	// the remote Backend. Defaults to ConflictOverwrite.
+	ConflictPolicy ConflictPolicy
+	// UserBackends serve the users with these uids on a multi-user mount,
+	// each sees their own tree of the store. Backend serves the user
+	// running the overlay unless it is in UserBackends, other users are
+	// denied.
+	UserBackends map[uint32]Backend
+	// BackendFlakiness simulates an unreliable network to a remote Backend
+	BackendFlakiness Flakiness
+	// BackendRetry are the retry policies of the calls to a remote Backend
+	// by class, nil uses DefaultRetry
+	BackendRetry map[RetryClass]RetryPolicy
+	// BlockCacheSize limits the bytes of remote files cached in memory, 0
+	// disables the cache
+	BlockCacheSize int64
+	// BlockCacheDir is a directory for blocks pushed out of memory, empty
+	// for none. It is emptied on start.
+	BlockCacheDir string
+	// BlockCacheDiskSize limits the bytes of blocks kept in BlockCacheDir
+	BlockCacheDiskSize int64
+	// ReadAhead is the maximum number of bytes fetched ahead into the block
+	// cache when a remote file is read sequentially, 0 disables it
+	ReadAhead int64
 }
 
 // unpackSysErr unpacks the underlying syscall.Errno from an error value
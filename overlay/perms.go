@@ -0,0 +1,122 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// access(2) mask bits
+const (
+	accessRead  = 4
+	accessWrite = 2
+	accessExec  = 1
+)
+
+// permitted reports whether a caller in the supplementary groups may access
+// a file with the given mode and owner, all ids as seen in the mount. Like
+// the kernel only the first matching class of owner, group and other is
+// checked. Root may read and write anything and execute files with at least
+// one execute bit.
+func permitted(mode os.FileMode, uid uint32, gid uint32,
+	caller fuse.Header, groups []uint32, mask uint32) bool {
+	if caller.Uid == 0 {
+		return mask&accessExec == 0 || mode.IsDir() || mode&0111 != 0
+	}
+	perm := uint32(mode.Perm())
+	switch {
+	case caller.Uid == uid:
+		perm >>= 6
+	case caller.Gid == gid || inGroups(gid, groups):
+		perm >>= 3
+	}
+	return mask&perm&7 == mask
+}
+
+func inGroups(gid uint32, groups []uint32) bool {
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// callerGroups returns the supplementary groups of the calling process. They
+// are read from /proc, on systems without it or if the process is gone the
+// groups of the user in the group database are used.
+func callerGroups(caller fuse.Header) []uint32 {
+	if groups, err := procGroups(caller.Pid); err == nil {
+		return groups
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(caller.Uid), 10))
+	if err != nil {
+		return nil
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+	groups := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+			groups = append(groups, uint32(g))
+		}
+	}
+	return groups
+}
+
+// procGroups parses the Groups line of /proc/<pid>/status
+func procGroups(pid uint32) ([]uint32, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Groups:"))
+		groups := make([]uint32, 0, len(fields))
+		for _, field := range fields {
+			g, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, uint32(g))
+		}
+		return groups, nil
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no groups in /proc/%d/status", pid)
+}
+
+// ownByCaller hands the new file p over to the calling user, if -as-caller
+// is set. In a setgid directory the file keeps the group of the directory.
+func (f *FS) ownByCaller(p string, caller fuse.Header) {
+	if !f.asCaller {
+		return
+	}
+	uid, gid := int(f.uidMap.backing(caller.Uid)), int(f.gidMap.backing(caller.Gid))
+	if fi, err := os.Stat(filepath.Dir(p)); err == nil && fi.Mode()&os.ModeSetgid != 0 {
+		gid = -1
+	}
+	if err := os.Lchown(p, uid, gid); err != nil {
+		loog.Warn(logCreate, "could not hand new file to the caller", "path", p,
+			"uid", caller.Uid, "gid", caller.Gid, "error", err)
+	}
+}
@@ -0,0 +1,291 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/xattr"
+)
+
+// plainCopy is the decrypted content of an encrypted file while handles of
+// it are open. It is kept in memory, see memFile, so the plaintext never
+// reaches the backing file system: the handles read and write the copy and
+// it is encrypted to the backing file when a handle is flushed or released.
+// Failing to encrypt it fails the flush.
+type plainCopy struct {
+	file *os.File
+	// path opens file again for a handle
+	path string
+	// id is the backing file, refs counts the handles and opens of the
+	// copy, both are guarded by codecs.plainLock
+	id   fileID
+	refs int
+	// saved is the version of the copy when it was read or last saved,
+	// guarded by the lock of the path
+	saved dataVersion
+}
+
+// version returns the size and mtime of the copy
+func (pc *plainCopy) version() (dataVersion, error) {
+	fi, err := pc.file.Stat()
+	if err != nil {
+		return dataVersion{}, err
+	}
+	return dataVersion{mtime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// open opens the copy again for a handle
+func (pc *plainCopy) open(flags int) (File, error) {
+	f, err := os.OpenFile(pc.path, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// encrypting reports whether the files of the upper layer are encrypted
+func (f *FS) encrypting() bool {
+	return f.codecs != nil && f.codecs.enc != nil
+}
+
+// checkEncryption fails if the files of the upper layer cannot be encrypted:
+// open files are decrypted to memory files and the backing file system must
+// store the xattrs of encrypted files
+func (f *FS) checkEncryption() error {
+	m, _, err := memFile("ocis-overlay")
+	if err != nil {
+		return fmt.Errorf("cannot keep decrypted files in memory: %v", err)
+	}
+	m.Close()
+	dir := f.metaPath(copyUpTmp)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err = xattr.Set(tmp.Name(), codecAttr, []byte("none 0 0")); err != nil {
+		return fmt.Errorf("cannot mark encrypted files, the backing file system needs xattr support: %v", err)
+	}
+	return nil
+}
+
+// openPlain returns the decrypted copy of the file at the upper path p, nil
+// if it is no regular file. Files that are not encrypted yet are copied as
+// they are. The path must be locked, the copy must be closed with
+// closePlain.
+func (f *FS) openPlain(ctx context.Context, p string) (*plainCopy, error) {
+	c := f.codecs
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	id, _, ok := statID(fi)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.ENOTSUP}
+	}
+	c.plainLock.Lock()
+	pc := c.plain[id]
+	if pc != nil {
+		pc.refs++
+	}
+	c.plainLock.Unlock()
+	if pc != nil {
+		return pc, nil
+	}
+	if pc, err = f.decrypt(ctx, p, fi); err != nil {
+		return nil, err
+	}
+	pc.id, pc.refs = id, 1
+	c.plainLock.Lock()
+	if c.plain == nil {
+		c.plain = make(map[fileID]*plainCopy)
+	}
+	c.plain[id] = pc
+	c.plainLock.Unlock()
+	return pc, nil
+}
+
+// decrypt reads the backing file p with info fi into a new copy
+func (f *FS) decrypt(ctx context.Context, p string, fi os.FileInfo) (*plainCopy, error) {
+	in, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	var r io.Reader = &ctxReader{ctx: ctx, r: in}
+	if m, ok := readCodecMark(p, fi); ok {
+		if r, err = f.codecs.decoder(r, p, m); err != nil {
+			return nil, err
+		}
+	} else if err = f.staleMark(p, m); err != nil {
+		return nil, err
+	}
+	file, path, err := memFile("ocis-overlay")
+	if err != nil {
+		return nil, err
+	}
+	pc := &plainCopy{file: file, path: path}
+	if _, err = io.Copy(file, r); err == nil {
+		err = os.Chtimes(path, fi.ModTime(), fi.ModTime())
+	}
+	if err == nil {
+		pc.saved, err = pc.version()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// savePlain encrypts the copy pc to the backing file at the upper path p if
+// it changed since it was read or last saved. A copy of a file that was
+// removed or replaced meanwhile is not saved. The path must be locked.
+func (f *FS) savePlain(ctx context.Context, pc *plainCopy, p string) error {
+	c := f.codecs
+	v, err := pc.version()
+	if err != nil || v == pc.saved {
+		return err
+	}
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.plainLock.Lock()
+	id := pc.id
+	c.plainLock.Unlock()
+	if now, nlink, ok := statID(fi); !ok || now != id {
+		return nil
+	} else if nlink > 1 && !f.snaps.isLinked(id) {
+		// replacing the file would leave the other links with the old
+		// content
+		return &os.PathError{Op: "encrypt", Path: p, Err: syscall.EMLINK}
+	}
+	tmp, _, err := f.encoded(ctx, io.NewSectionReader(pc.file, 0, v.size), p, fi, c.compressible(p, v.size))
+	if err != nil {
+		return err
+	}
+	os.Chtimes(tmp, v.mtime, v.mtime)
+	tfi, err := os.Lstat(tmp)
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f.unlinkedXattrs(fi)
+	c.plainLock.Lock()
+	if c.plain[id] == pc {
+		delete(c.plain, id)
+	}
+	pc.id, _, _ = statID(tfi)
+	c.plain[pc.id] = pc
+	c.plainLock.Unlock()
+	pc.saved = v
+	return nil
+}
+
+// closePlain releases a copy returned by openPlain, the last release
+// drops it
+func (f *FS) closePlain(pc *plainCopy) {
+	c := f.codecs
+	c.plainLock.Lock()
+	defer c.plainLock.Unlock()
+	if pc.refs--; pc.refs > 0 {
+		return
+	}
+	if c.plain[pc.id] == pc {
+		delete(c.plain, pc.id)
+	}
+	pc.file.Close()
+}
+
+// truncatePlain truncates the encrypted file at the upper path p to size,
+// the path must be locked
+func (f *FS) truncatePlain(ctx context.Context, p string, size int64) error {
+	pc, err := f.openPlain(ctx, p)
+	if err != nil {
+		return err
+	}
+	if pc == nil {
+		return syscall.Truncate(p, size)
+	}
+	defer f.closePlain(pc)
+	if err = pc.file.Truncate(size); err != nil {
+		return err
+	}
+	return f.savePlain(ctx, pc, p)
+}
+
+// touchPlain sets the mtime of the open copy of the file at the upper path
+// p, so saving the copy keeps it
+func (f *FS) touchPlain(p string, mtime time.Time) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return
+	}
+	id, _, ok := statID(fi)
+	if !ok {
+		return
+	}
+	c := f.codecs
+	c.plainLock.Lock()
+	defer c.plainLock.Unlock()
+	if pc := c.plain[id]; pc != nil {
+		os.Chtimes(pc.path, mtime, mtime)
+	}
+}
+
+// plainVersion returns the size and mtime of the open copy of the backing
+// file with info fi, ok is false if it is not open
+func (c *codecs) plainVersion(fi os.FileInfo) (v dataVersion, ok bool) {
+	id, _, ok := statID(fi)
+	if !ok {
+		return v, false
+	}
+	c.plainLock.Lock()
+	defer c.plainLock.Unlock()
+	pc := c.plain[id]
+	if pc == nil {
+		return v, false
+	}
+	v, err := pc.version()
+	return v, err == nil
+}
+
+// encryptCopy copies the lower file src with info fi encrypted to the
+// upper path dst
+func (f *FS) encryptCopy(ctx context.Context, dst string, src string, fi os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, _, err := f.encoded(ctx, in, src, fi, f.codecs.compressible(src, fi.Size()))
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// xattrs propagated up the tree on changes
+const (
+	// EtagAttr holds the etag of a file or directory. The etag of a
+	// directory changes whenever anything below it changes.
+	EtagAttr = "user.ocis.etag"
+	// TreeSizeAttr holds the total size of the regular files below a
+	// directory, in bytes
+	TreeSizeAttr = "user.ocis.treesize"
+	// TreeMtimeAttr holds the latest mtime below a directory, RFC 3339 with
+	// nanoseconds
+	TreeMtimeAttr = "user.ocis.tmtime"
+	// QuotaAttr holds the quota of the space below a directory in bytes,
+	// oCIS keeps it on the root of a space
+	QuotaAttr = "user.ocis.quota"
+)
+
+// propagator collects changed paths until they are propagated in one batch,
+// so a burst of writes to a deep tree updates every parent only once
+type propagator struct {
+	lock    sync.Mutex
+	changed map[string]bool
+	timer   *time.Timer
+}
+
+// newEtag returns a random quoted etag
+func newEtag() []byte {
+	var b [8]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		panic(err)
+	}
+	return []byte(`"` + hex.EncodeToString(b[:]) + `"`)
+}
+
+// propagate records a change of the upper path p. p gets a new etag, and so
+// does every parent directory up to the root, like ownCloud sync clients
+// expect it. The tree size and mtime of the parents are updated as well. p
+// may have been removed already.
+func (f *FS) propagate(p string) {
+	if !f.etags && !f.treeSize {
+		return
+	}
+	if f.propagationDelay <= 0 {
+		f.propagateBatch(map[string]bool{p: true})
+		return
+	}
+	f.propagator.lock.Lock()
+	defer f.propagator.lock.Unlock()
+	if f.propagator.changed == nil {
+		f.propagator.changed = make(map[string]bool)
+	}
+	f.propagator.changed[p] = true
+	if f.propagator.timer == nil {
+		f.propagator.timer = time.AfterFunc(f.propagationDelay, f.flushPropagation)
+	}
+}
+
+// flushPropagation propagates all changes collected so far
+func (f *FS) flushPropagation() {
+	f.propagator.lock.Lock()
+	changed := f.propagator.changed
+	f.propagator.changed = nil
+	if f.propagator.timer != nil {
+		f.propagator.timer.Stop()
+		f.propagator.timer = nil
+	}
+	f.propagator.lock.Unlock()
+	if len(changed) > 0 {
+		f.propagateBatch(changed)
+	}
+}
+
+// depth returns the number of path elements of p below the root
+func depth(p string) int {
+	if p == "." {
+		return 0
+	}
+	return strings.Count(p, string(filepath.Separator)) + 1
+}
+
+// propagateBatch updates the changed paths and all of their parents,
+// deepest first, so every directory sees the updated values of its children
+func (f *FS) propagateBatch(changed map[string]bool) {
+	affected := make(map[string]bool)
+	for p := range changed {
+		for {
+			affected[p] = true
+			if p == f.rootPath {
+				break
+			}
+			p = filepath.Dir(p)
+		}
+	}
+	paths := make([]string, 0, len(affected))
+	for p := range affected {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool { return depth(paths[i]) > depth(paths[j]) })
+	for _, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil || !(fi.Mode().IsRegular() || fi.IsDir()) {
+			continue
+		}
+		if f.etags {
+			if err = f.writeXattr(p, EtagAttr, newEtag()); err != nil {
+				loog.Warn(logOcis, "could not update etag", "path", p, "error", err)
+			}
+		}
+		if f.treeSize && fi.IsDir() {
+			if _, _, err = f.updateTree(p, fi); err != nil {
+				loog.Warn(logOcis, "could not update tree size", "path", p, "error", err)
+			}
+		}
+	}
+}
+
+// updateTree sums up the sizes of the regular files below the upper
+// directory d and finds the latest mtime. Subdirectories contribute their
+// recorded values, they are computed once if missing. Lower layers are not
+// accounted for, the upper layer is what a storage driver consumes.
+func (f *FS) updateTree(d string, fi os.FileInfo) (size int64, tmtime time.Time, err error) {
+	fis, err := readDirPath(d)
+	if err != nil {
+		return 0, tmtime, err
+	}
+	tmtime = fi.ModTime()
+	for _, child := range fis {
+		name := child.Name()
+		if f.overlay() && (name == opaqueMarker || isWhiteoutName(name)) || f.isMetaDir(d, name) {
+			continue
+		}
+		var s int64
+		t := child.ModTime()
+		switch {
+		case child.IsDir():
+			if s, t, err = f.treeOf(filepath.Join(d, name), child); err != nil {
+				return 0, tmtime, err
+			}
+		case child.Mode().IsRegular():
+			s = child.Size()
+		}
+		size += s
+		if t.After(tmtime) {
+			tmtime = t
+		}
+	}
+	if err = f.writeXattr(d, TreeSizeAttr, []byte(strconv.FormatInt(size, 10))); err != nil {
+		return 0, tmtime, err
+	}
+	err = f.writeXattr(d, TreeMtimeAttr, []byte(tmtime.UTC().Format(time.RFC3339Nano)))
+	return size, tmtime, err
+}
+
+// treeOf returns the recorded tree size and mtime of the directory d
+func (f *FS) treeOf(d string, fi os.FileInfo) (size int64, tmtime time.Time, err error) {
+	s, serr := f.readXattr(d, TreeSizeAttr)
+	t, terr := f.readXattr(d, TreeMtimeAttr)
+	if serr == nil && terr == nil {
+		size, serr = strconv.ParseInt(string(s), 10, 64)
+		tmtime, terr = time.Parse(time.RFC3339Nano, string(t))
+		if serr == nil && terr == nil {
+			return size, tmtime, nil
+		}
+	}
+	return f.updateTree(d, fi)
+}
+
+// quotaStatfs reports the quota in the QuotaAttr of the root as the size of
+// the file system and its tree size as used, the way oCIS reports a space.
+// Without a quota, or without -treesize to account for the usage, the backing
+// file system is reported as is.
+func (f *FS) quotaStatfs(resp *fuse.StatfsResponse) {
+	if !f.treeSize {
+		return
+	}
+	q, err := f.readXattr(f.rootPath, QuotaAttr)
+	if err != nil {
+		return
+	}
+	quota, err := strconv.ParseInt(strings.TrimSpace(string(q)), 10, 64)
+	if err != nil || quota <= 0 {
+		return
+	}
+	fi, err := os.Lstat(f.rootPath)
+	if err != nil {
+		return
+	}
+	used, _, err := f.treeOf(f.rootPath, fi)
+	if err != nil {
+		loog.Warn(logFS, "could not get tree size", "error", err)
+		return
+	}
+	unit := int64(resp.Frsize)
+	if unit == 0 {
+		unit = int64(resp.Bsize)
+	}
+	if unit == 0 {
+		return
+	}
+	free := quota - used
+	if free < 0 {
+		free = 0
+	}
+	// the space can't hold more than the backing file system
+	if avail := int64(resp.Bavail) * unit; free > avail {
+		free = avail
+	}
+	resp.Blocks = uint64(quota / unit)
+	resp.Bfree = uint64(free / unit)
+	resp.Bavail = resp.Bfree
+}
@@ -0,0 +1,122 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// readAhead detects sequential reads through a handle. The window of
+// blocks fetched ahead starts at two blocks and doubles with every
+// sequential read up to the maximum, a read elsewhere resets it.
+type readAhead struct {
+	lock sync.Mutex
+	// next is the offset following the last read
+	next int64
+	// window is the number of bytes fetched ahead of next
+	window int64
+	// fetched is the offset up to which blocks were fetched
+	fetched int64
+}
+
+// advance records a read of n bytes at off and returns the range to fetch
+// ahead, which is empty if the reads are not sequential or the range was
+// fetched already
+func (r *readAhead) advance(off int64, n int, max int64) (from int64, to int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off != r.next {
+		r.window, r.fetched = 0, 0
+	} else if r.window < max {
+		if r.window *= 2; r.window < 2*remoteBlockSize {
+			r.window = 2 * remoteBlockSize
+		}
+		if r.window > max {
+			r.window = max
+		}
+	}
+	r.next = off + int64(n)
+	if r.window == 0 {
+		return 0, 0
+	}
+	from, to = r.next, r.next+r.window
+	if from < r.fetched {
+		from = r.fetched
+	}
+	if from < to {
+		r.fetched = to
+	}
+	return from, to
+}
+
+// loadBlock returns the block idx of the remote file name from the block
+// cache or reads it from backend. A block being read already, e.g. by
+// the read-ahead, is waited for instead of read twice.
+func (f *FS) loadBlock(ctx context.Context, backend Backend, id blockID) ([]byte, error) {
+	for {
+		block, ok, loading := f.blocks.load(id)
+		if ok {
+			return block, nil
+		}
+		if loading == nil {
+			break
+		}
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return nil, errInterrupted
+		}
+	}
+	defer f.blocks.loaded(id)
+	buf := make([]byte, remoteBlockSize)
+	var n int
+	err := f.retry(ctx, RetryRead, "read", id.name, func() (err error) {
+		n, err = backend.ReadAt(ctx, id.name, buf, id.idx*remoteBlockSize)
+		return err
+	})
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	block := buf[:n]
+	f.blocks.put(id, block)
+	return block, nil
+}
+
+// readAhead fetches the blocks following a read of n bytes at off through
+// the handle with the read-ahead state ra into the block cache, in the
+// background
+func (f *FS) readAhead(ctx context.Context, node *remoteNode, ra *readAhead, off int64, n int) {
+	if f.readAheadMax <= 0 || f.blocks.max <= 0 {
+		return
+	}
+	from, to := ra.advance(off, n, f.readAheadMax)
+	if from >= to {
+		return
+	}
+	fi, err := node.info(ctx)
+	if err != nil {
+		return
+	}
+	if to > fi.Size() {
+		to = fi.Size()
+	}
+	if from >= to {
+		return
+	}
+	name, v := node.path(), version(fi)
+	first, last := from/remoteBlockSize, (to-1)/remoteBlockSize
+	go func() {
+		for idx := first; idx <= last; idx++ {
+			// the read that triggered it may be interrupted, the next ones
+			// still need the blocks
+			if _, err := f.loadBlock(context.Background(), node.backend, blockID{node.uid, name, v, idx}); err != nil {
+				loog.Debug(logRemote, "read-ahead failed", "path", name, "block", idx, "error", err)
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,305 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+	"github.com/pkg/xattr"
+)
+
+// Record is a line of a recording of the fuse requests. Paths are relative
+// to the mount. Data is not recorded, only its size and SHA-256 hash.
+type Record struct {
+	// Time is when the request came in, since the start of the recording
+	Time     time.Duration `json:"time"`
+	Duration time.Duration `json:"duration"`
+	// Request is the fuse request, e.g. Lookup, Op the operation of the
+	// overlay that answered it, empty if it was answered by the library
+	Request string `json:"request"`
+	Op      Op     `json:"op,omitempty"`
+	UID     uint32 `json:"uid"`
+	GID     uint32 `json:"gid"`
+	PID     uint32 `json:"pid"`
+	// Path is the node the request was for, or the path it changed. Name is
+	// the looked up name or the xattr read, Target the new path of a rename
+	// or link, the target of a symlink or the name of a changed xattr.
+	Path   string `json:"path"`
+	Name   string `json:"name,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Flags of an open or create, Mode of a create, mkdir or chmod
+	Flags uint32  `json:"flags,omitempty"`
+	Mode  *uint32 `json:"mode,omitempty"`
+	Dir   bool    `json:"dir,omitempty"`
+	// Offset and Size of a read or write, Size is also the size of an xattr
+	// value. Returned is the number of bytes read, Hash the SHA-256 of the
+	// data written or read.
+	Offset   int64  `json:"offset,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Returned int64  `json:"returned,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+	// Truncate and Mtime are set by a setattr
+	Truncate *int64     `json:"truncate,omitempty"`
+	Mtime    *time.Time `json:"mtime,omitempty"`
+	// Errno is the error returned to the caller, empty for success
+	Errno string `json:"errno,omitempty"`
+}
+
+// recorder appends a Record per answered request to a file
+type recorder struct {
+	start time.Time
+
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{start: time.Now(), path: path, file: f}, nil
+}
+
+func dataHash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// record writes the request of s, answered with errno and out
+func (r *recorder) record(s *span, errno string, out interface{}) {
+	now := time.Now()
+	h := s.req.Hdr()
+	rec := &Record{
+		Time:     s.start.Sub(r.start),
+		Duration: now.Sub(s.start),
+		Request:  s.name[len("fuse."):],
+		UID:      h.Uid,
+		GID:      h.Gid,
+		PID:      h.Pid,
+		Errno:    errno,
+	}
+	s.lock.Lock()
+	rec.Op, rec.Path, rec.Target = s.op, s.path, s.target
+	s.lock.Unlock()
+	mode := func(m os.FileMode) *uint32 {
+		u := uint32(m)
+		return &u
+	}
+	switch req := s.req.(type) {
+	case *fuse.LookupRequest:
+		rec.Name = req.Name
+	case *fuse.OpenRequest:
+		rec.Flags, rec.Dir = uint32(req.Flags), req.Dir
+	case *fuse.CreateRequest:
+		rec.Flags, rec.Mode = uint32(req.Flags), mode(req.Mode)
+	case *fuse.MkdirRequest:
+		rec.Mode, rec.Dir = mode(req.Mode), true
+	case *fuse.MknodRequest:
+		rec.Mode = mode(req.Mode)
+	case *fuse.RemoveRequest:
+		rec.Dir = req.Dir
+	case *fuse.ReadRequest:
+		rec.Offset, rec.Size, rec.Dir = req.Offset, int64(req.Size), req.Dir
+		if resp, ok := out.(*fuse.ReadResponse); ok && !req.Dir {
+			rec.Returned, rec.Hash = int64(len(resp.Data)), dataHash(resp.Data)
+		}
+	case *fuse.WriteRequest:
+		rec.Offset, rec.Size, rec.Hash = req.Offset, int64(len(req.Data)), dataHash(req.Data)
+	case *fuse.SetattrRequest:
+		if req.Valid.Size() {
+			size := int64(req.Size)
+			rec.Truncate = &size
+		}
+		if req.Valid.Mode() {
+			rec.Mode = mode(req.Mode)
+		}
+		if req.Valid.Mtime() {
+			mtime := req.Mtime
+			rec.Mtime = &mtime
+		}
+	case *fuse.GetxattrRequest:
+		rec.Name = req.Name
+	case *fuse.SetxattrRequest:
+		rec.Size, rec.Hash = int64(len(req.Xattr)), dataHash(req.Xattr)
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	if _, err = r.file.Write(append(b, '\n')); err != nil {
+		loog.Error(logFS, "could not write the recording, recording stopped", "path", r.path, "error", err)
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// close closes the recording, later requests are not recorded
+func (r *recorder) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// ReplayResult is the outcome of a replayed record
+type ReplayResult struct {
+	Record *Record
+	// Errno is what the replay returned, empty for success. Skipped is set
+	// for records that are not replayed, e.g. releases.
+	Errno   string
+	Skipped bool
+}
+
+// Mismatch reports whether the replay answered differently than the
+// recording
+func (r *ReplayResult) Mismatch() bool {
+	return !r.Skipped && r.Errno != r.Record.Errno
+}
+
+// Replay executes the recording read from r against the directory dir and
+// calls result for every record. Written data is replaced by zeros of the
+// same size. With timing the requests are started at their recorded times,
+// otherwise one after the other as fast as possible.
+func Replay(r io.Reader, dir string, timing bool, result func(*ReplayResult)) error {
+	start := time.Now()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if timing {
+			if d := rec.Time - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		res := &ReplayResult{Record: rec}
+		err, ok := replay(dir, rec)
+		if !ok {
+			res.Skipped = true
+		} else if err != nil {
+			res.Errno = fuse.ToErrno(translateError(err)).ErrnoName()
+		}
+		result(res)
+	}
+	return scanner.Err()
+}
+
+// replay executes rec on dir, ok is false if rec is not replayed
+func replay(dir string, rec *Record) (err error, ok bool) {
+	p := filepath.Join(dir, rec.Path)
+	perm := func() os.FileMode {
+		if rec.Mode == nil {
+			return 0644
+		}
+		return os.FileMode(*rec.Mode).Perm()
+	}
+	switch rec.Op {
+	case OpLookup:
+		_, err = os.Lstat(filepath.Join(p, rec.Name))
+	case OpAttr:
+		_, err = os.Lstat(p)
+	case OpReadlink:
+		_, err = os.Readlink(p)
+	case OpReadDir:
+		_, err = ioutil.ReadDir(p)
+	case OpOpen:
+		var f *os.File
+		if f, err = os.OpenFile(p, openFlags(rec.Flags), 0); err == nil {
+			f.Close()
+		}
+	case OpCreate:
+		var f *os.File
+		if f, err = os.OpenFile(p, openFlags(rec.Flags)|os.O_CREATE, perm()); err == nil {
+			f.Close()
+		}
+	case OpMkdir:
+		err = os.Mkdir(p, perm())
+	case OpSymlink:
+		err = os.Symlink(rec.Target, p)
+	case OpLink:
+		err = os.Link(p, filepath.Join(dir, rec.Target))
+	case OpRename:
+		err = os.Rename(p, filepath.Join(dir, rec.Target))
+	case OpRemove:
+		err = os.Remove(p)
+	case OpRead, OpReadAll:
+		var f *os.File
+		if f, err = os.Open(p); err == nil {
+			_, err = f.ReadAt(make([]byte, rec.Size), rec.Offset)
+			if err == io.EOF {
+				err = nil
+			}
+			f.Close()
+		}
+	case OpWrite:
+		var f *os.File
+		if f, err = os.OpenFile(p, os.O_WRONLY, 0); err == nil {
+			_, err = f.WriteAt(make([]byte, rec.Size), rec.Offset)
+			f.Close()
+		}
+	case OpSetattr:
+		if rec.Truncate != nil {
+			err = os.Truncate(p, *rec.Truncate)
+		}
+		if err == nil && rec.Mode != nil {
+			err = os.Chmod(p, perm())
+		}
+		if err == nil && rec.Mtime != nil {
+			err = os.Chtimes(p, *rec.Mtime, *rec.Mtime)
+		}
+	case OpGetxattr:
+		_, err = xattr.Get(p, rec.Name)
+	case OpSetxattr:
+		err = xattr.Set(p, rec.Target, make([]byte, rec.Size))
+	case OpRemovexattr:
+		err = xattr.Remove(p, rec.Target)
+	default:
+		return nil, false
+	}
+	return err, true
+}
+
+// openFlags returns the flags to open a file with like the recorded open
+func openFlags(flags uint32) int {
+	f := fuse.OpenFlags(flags)
+	o := 0
+	switch {
+	case f.IsWriteOnly():
+		o = os.O_WRONLY
+	case f.IsReadWrite():
+		o = os.O_RDWR
+	}
+	if f&fuse.OpenAppend != 0 {
+		o |= os.O_APPEND
+	}
+	if f&fuse.OpenTruncate != 0 {
+		o |= os.O_TRUNC
+	}
+	if f&fuse.OpenExclusive != 0 {
+		o |= os.O_EXCL
+	}
+	return o
+}
@@ -0,0 +1,240 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// registryShards is the number of independently locked parts of the node
+// registry
+const registryShards = 64
+
+type nodeShard struct {
+	sync.Mutex
+	nodes map[string][]*Node // realPath -> nodes
+}
+
+type linkShard struct {
+	sync.Mutex
+	links map[uint64]map[string]bool // inode -> realPaths
+}
+
+// registry keeps track of the nodes known to the kernel and the paths of
+// hard linked inodes. Nodes are sharded by the hash of their path and links
+// by inode, so lookups of unrelated paths do not contend for the same lock.
+// Node shards are always locked before link shards.
+type registry struct {
+	nodes [registryShards]nodeShard
+	links [registryShards]linkShard
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.nodes {
+		r.nodes[i].nodes = make(map[string][]*Node)
+		r.links[i].links = make(map[uint64]map[string]bool)
+	}
+	return r
+}
+
+func (r *registry) nodeShard(realPath string) *nodeShard {
+	h := fnv.New32a()
+	h.Write([]byte(realPath))
+	return &r.nodes[h.Sum32()%registryShards]
+}
+
+func (r *registry) linkShard(inode uint64) *linkShard {
+	return &r.links[inode%registryShards]
+}
+
+func (r *registry) addLink(inode uint64, realPath string) {
+	if inode == 0 {
+		return
+	}
+	ls := r.linkShard(inode)
+	ls.Lock()
+	defer ls.Unlock()
+	if ls.links[inode] == nil {
+		ls.links[inode] = make(map[string]bool)
+	}
+	ls.links[inode][realPath] = true
+}
+
+// removeLink removes realPath from the paths of inode and returns one of the
+// remaining paths
+func (r *registry) removeLink(inode uint64, realPath string) (remaining string) {
+	ls := r.linkShard(inode)
+	ls.Lock()
+	defer ls.Unlock()
+	paths := ls.links[inode]
+	if paths == nil {
+		return ""
+	}
+	delete(paths, realPath)
+	if len(paths) == 0 {
+		delete(ls.links, inode)
+		return ""
+	}
+	for p := range paths {
+		return p
+	}
+	return ""
+}
+
+func (r *registry) renameLink(inode uint64, oldPath string, newPath string) {
+	ls := r.linkShard(inode)
+	ls.Lock()
+	defer ls.Unlock()
+	if paths := ls.links[inode]; paths != nil && paths[oldPath] {
+		delete(paths, oldPath)
+		paths[newPath] = true
+	}
+}
+
+// linkPaths returns the known paths of inode
+func (r *registry) linkPaths(inode uint64) []string {
+	ls := r.linkShard(inode)
+	ls.Lock()
+	defer ls.Unlock()
+	paths := make([]string, 0, len(ls.links[inode]))
+	for p := range ls.links[inode] {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// add registers n unless a node with the same inode is already known for
+// the path, in which case the known node is returned with updated lower paths
+func (r *registry) add(n *Node) *Node {
+	rp := n.getRealPath()
+	ns := r.nodeShard(rp)
+	ns.Lock()
+	defer ns.Unlock()
+	if n.inode != 0 {
+		for _, known := range ns.nodes[rp] {
+			if known.inode == n.inode && known.isDir == n.isDir {
+				known.updateLowerPaths(n.getLowerPaths())
+				return known
+			}
+		}
+	}
+	ns.nodes[rp] = append(ns.nodes[rp], n)
+	r.addLink(n.inode, rp)
+	return n
+}
+
+// get returns a copy of the nodes for realPath
+func (r *registry) get(realPath string) []*Node {
+	ns := r.nodeShard(realPath)
+	ns.Lock()
+	defer ns.Unlock()
+	return append([]*Node(nil), ns.nodes[realPath]...)
+}
+
+// rename moves the nodes of oldPath and of its children to newPath. Children
+// can live in any shard, so all shards are locked.
+func (r *registry) rename(oldPath string, newPath string) {
+	for i := range r.nodes {
+		r.nodes[i].Lock()
+		defer r.nodes[i].Unlock()
+	}
+	moved := make(map[string][]*Node)
+	for i := range r.nodes {
+		ns := &r.nodes[i]
+		for p, nodes := range ns.nodes {
+			np := newPath
+			if p != oldPath {
+				if !strings.HasPrefix(p, oldPath+string(filepath.Separator)) {
+					continue
+				}
+				// children of a renamed directory move along with it
+				np = newPath + p[len(oldPath):]
+			}
+			delete(ns.nodes, p)
+			moved[np] = append(moved[np], nodes...)
+			for _, n := range nodes {
+				r.renameLink(n.inode, p, np)
+				n.updateRealPath(np)
+				// renamed nodes always live in the upper layer only
+				n.updateLowerPaths(nil)
+			}
+		}
+	}
+	for np, nodes := range moved {
+		ns := r.nodeShard(np)
+		ns.nodes[np] = append(ns.nodes[np], nodes...)
+	}
+}
+
+// remove drops all nodes of a removed path. If their inode is still
+// reachable through another hard link, one of the remaining paths is
+// returned.
+func (r *registry) remove(p string) (remaining string) {
+	ns := r.nodeShard(p)
+	ns.Lock()
+	defer ns.Unlock()
+	nodes := ns.nodes[p]
+	delete(ns.nodes, p)
+	for _, n := range nodes {
+		if rp := r.removeLink(n.inode, p); rp != "" {
+			remaining = rp
+		}
+	}
+	return remaining
+}
+
+// forget drops n, the link is kept as long as other nodes use the path
+func (r *registry) forget(n *Node) {
+	rp := n.getRealPath()
+	ns := r.nodeShard(rp)
+	ns.Lock()
+	defer ns.Unlock()
+	nodes, ok := ns.nodes[rp]
+	if !ok {
+		return
+	}
+	for i, node := range nodes {
+		if node == n {
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			break
+		}
+	}
+	if len(nodes) == 0 {
+		delete(ns.nodes, rp)
+		r.removeLink(n.inode, rp)
+	} else {
+		ns.nodes[rp] = nodes
+	}
+}
+
+// count returns the number of known nodes and of the paths they have
+func (r *registry) count() (nodes int, paths int) {
+	for i := range r.nodes {
+		ns := &r.nodes[i]
+		ns.Lock()
+		paths += len(ns.nodes)
+		for _, n := range ns.nodes {
+			nodes += len(n)
+		}
+		ns.Unlock()
+	}
+	return nodes, paths
+}
+
+// all returns a copy of all known nodes
+func (r *registry) all() []*Node {
+	var nodes []*Node
+	for i := range r.nodes {
+		ns := &r.nodes[i]
+		ns.Lock()
+		for _, n := range ns.nodes {
+			nodes = append(nodes, n...)
+		}
+		ns.Unlock()
+	}
+	return nodes
+}
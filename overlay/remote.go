@@ -0,0 +1,1084 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// Backend is a remote store mounted instead of a local directory. Names are
+// slash separated paths relative to the root of the store, the root itself
+// is "". Errors should be *os.PathError values carrying a syscall.Errno, so
+// the kernel gets the right errno.
+type Backend interface {
+	Stat(ctx context.Context, name string) (os.FileInfo, error)
+	ReadDir(ctx context.Context, name string) ([]os.FileInfo, error)
+	// ReadAt reads len(p) bytes at off, at the end of the file it returns
+	// fewer bytes and io.EOF
+	ReadAt(ctx context.Context, name string, p []byte, off int64) (int, error)
+	// Upload replaces the content of the file name with size bytes from r,
+	// the file is created if it does not exist
+	Upload(ctx context.Context, name string, r io.Reader, size int64) error
+	Mkdir(ctx context.Context, name string) error
+	// Remove removes a file or an empty directory
+	Remove(ctx context.Context, name string) error
+	Rename(ctx context.Context, oldName string, newName string) error
+}
+
+// QuotaBackend is implemented by backends that know the quota of the store.
+// A negative available size means unlimited or unknown.
+type QuotaBackend interface {
+	Quota(ctx context.Context) (used int64, available int64, err error)
+}
+
+// PathQuotaBackend is implemented by backends made of several stores with
+// their own quota, e.g. oCIS spaces. name is any path within the store.
+type PathQuotaBackend interface {
+	QuotaOf(ctx context.Context, name string) (used int64, available int64, err error)
+}
+
+// ResumableBackend is implemented by backends that resume interrupted
+// uploads. progress is called with the number of bytes stored remotely so far.
+type ResumableBackend interface {
+	UploadResumable(ctx context.Context, name string, r io.ReaderAt, size int64, progress func(int64)) error
+}
+
+// etagger is implemented by file infos of backends that know the etag of a
+// file
+type etagger interface {
+	ETag() string
+}
+
+const (
+	// remoteBlockSize is the unit remote files are read and cached in
+	remoteBlockSize = 256 * 1024
+	// unknownSpace is reported as size and free space of stores without a
+	// quota, so applications do not refuse to write
+	unknownSpace = 1 << 50
+)
+
+// remoteNode is a file or directory of a Backend. Nodes form a tree, so
+// renaming a directory moves its known children along.
+type remoteNode struct {
+	fs    *FS
+	isDir bool
+	// backend stores the node, uid is the user whose tree it is in on a
+	// multi-user mount, see users.go
+	backend Backend
+	uid     uint32
+
+	// parent, base, kids and id are guarded by FS.rtree. id is the kernel's
+	// node id of n, its key in FS.remoteIDs.
+	parent *remoteNode
+	base   string
+	kids   map[string]*remoteNode
+	id     fuse.NodeID
+
+	lock   sync.Mutex
+	fi     os.FileInfo
+	expiry time.Time
+	// listing holds the file infos of the last directory read
+	listing       map[string]os.FileInfo
+	listingExpiry time.Time
+	writers       map[*remoteHandle]bool
+}
+
+func newRemoteRoot(f *FS, backend Backend, uid uint32) *remoteNode {
+	return &remoteNode{fs: f, isDir: true, backend: backend, uid: uid}
+}
+
+// path returns the backend name of n
+func (n *remoteNode) path() string {
+	n.fs.rtree.RLock()
+	defer n.fs.rtree.RUnlock()
+	var elems []string
+	for m := n; m.parent != nil; m = m.parent {
+		elems = append(elems, m.base)
+	}
+	for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+		elems[i], elems[j] = elems[j], elems[i]
+	}
+	return strings.Join(elems, "/")
+}
+
+// childPath returns the backend name of the child name of n
+func (n *remoteNode) childPath(name string) string {
+	if p := n.path(); p != "" {
+		return p + "/" + name
+	}
+	return name
+}
+
+// child returns the known node for name or a new one
+func (n *remoteNode) child(name string, isDir bool) *remoteNode {
+	n.fs.rtree.Lock()
+	defer n.fs.rtree.Unlock()
+	if c, ok := n.kids[name]; ok && c.isDir == isDir {
+		return c
+	}
+	c := &remoteNode{fs: n.fs, isDir: isDir, backend: n.backend, uid: n.uid, parent: n, base: name}
+	if n.kids == nil {
+		n.kids = make(map[string]*remoteNode)
+	}
+	n.kids[name] = c
+	return c
+}
+
+// info returns the cached file info of n, or stats it
+func (n *remoteNode) info(ctx context.Context) (os.FileInfo, error) {
+	if fi, ok := n.fs.queuedInfo(n.uid, n.path()); fi != nil {
+		return fi, nil
+	} else if !ok {
+		return nil, &os.PathError{Op: "stat", Path: n.path(), Err: syscall.ENOENT}
+	}
+	n.lock.Lock()
+	if n.fi != nil && time.Now().Before(n.expiry) {
+		fi := n.fi
+		n.lock.Unlock()
+		return fi, nil
+	}
+	n.lock.Unlock()
+	var fi os.FileInfo
+	err := n.fs.retry(ctx, RetryRead, "stat", n.path(), func() (err error) {
+		fi, err = n.backend.Stat(ctx, n.path())
+		return err
+	})
+	if err != nil {
+		if fi = n.cachedInfo(); fi != nil && n.fs.isOffline() {
+			// the last known state while the backend is unreachable
+			return fi, nil
+		}
+		return nil, err
+	}
+	n.setInfo(fi)
+	return fi, nil
+}
+
+// setInfo caches fi, the cached blocks of an older version of the file are
+// dropped when it changed in the backend
+func (n *remoteNode) setInfo(fi os.FileInfo) {
+	n.lock.Lock()
+	changed := n.fi != nil && !fi.IsDir() && version(n.fi) != version(fi)
+	n.fi = fi
+	n.expiry = time.Now().Add(n.fs.attrTimeout)
+	n.lock.Unlock()
+	if changed {
+		n.fs.blocks.dropFile(n.path())
+	}
+}
+
+// invalidate expires the cached file info and directory listing, they are
+// only used further while the backend is unreachable
+func (n *remoteNode) invalidate() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.expiry = time.Time{}
+	n.listingExpiry = time.Time{}
+}
+
+// invalidateTree invalidates n and all known nodes below it
+func (n *remoteNode) invalidateTree() {
+	n.invalidate()
+	n.fs.rtree.RLock()
+	kids := make([]*remoteNode, 0, len(n.kids))
+	for _, c := range n.kids {
+		kids = append(kids, c)
+	}
+	n.fs.rtree.RUnlock()
+	for _, c := range kids {
+		c.invalidateTree()
+	}
+}
+
+// listedInfo returns the file info of name from the last directory read
+func (n *remoteNode) listedInfo(name string) os.FileInfo {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if time.Now().After(n.listingExpiry) && !n.fs.isOffline() {
+		return nil
+	}
+	return n.listing[name]
+}
+
+// version identifies the content of a remote file for the block cache
+func version(fi os.FileInfo) string {
+	if e, ok := fi.(etagger); ok && e.ETag() != "" {
+		return e.ETag()
+	}
+	return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+func (n *remoteNode) fillAttr(a *fuse.Attr, fi os.FileInfo) {
+	a.Size = uint64(fi.Size())
+	n.lock.Lock()
+	for h := range n.writers {
+		if size, err := h.size(); err == nil {
+			a.Size = uint64(size)
+		}
+	}
+	n.lock.Unlock()
+	a.Blocks = (a.Size + 511) / 512
+	a.Mode = fi.Mode()
+	a.Mtime = fi.ModTime()
+	a.Ctime = fi.ModTime()
+	a.Atime = fi.ModTime()
+	a.Nlink = 1
+	a.Uid = n.fs.uidMap.mount(uint32(os.Getuid()))
+	if n.fs.userRoots != nil {
+		a.Uid = n.uid
+	}
+	a.Gid = n.fs.gidMap.mount(uint32(os.Getgid()))
+	a.BlockSize = remoteBlockSize
+	a.Valid = n.fs.attrTimeout
+}
+
+var _ fs.Node = (*remoteNode)(nil)
+
+// Attr implements fs.Node interface for *remoteNode
+func (n *remoteNode) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	if err = n.fs.enter(ctx, OpAttr, n); err != nil {
+		return err
+	}
+	if n = n.route(ctx); n == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logAttr, "Attr", "path", n.path(), "attr", a, "error", err) }()
+	fi, err := n.info(ctx)
+	if err != nil {
+		return translateError(err)
+	}
+	n.fillAttr(a, fi)
+	return nil
+}
+
+var _ fs.NodeGetattrer = (*remoteNode)(nil)
+
+// Getattr implements fs.NodeGetattrer interface for *remoteNode, it
+// remembers the node id for Statfs
+func (n *remoteNode) Getattr(ctx context.Context,
+	req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	n.fs.rememberNodeID(req.Header.Node, n)
+	return n.Attr(ctx, &resp.Attr)
+}
+
+var _ fs.NodeRequestLookuper = (*remoteNode)(nil)
+
+// Lookup implements fs.NodeRequestLookuper interface for *remoteNode
+func (n *remoteNode) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (ret fs.Node, err error) {
+	if err = n.fs.enter(ctx, OpLookup, n); err != nil {
+		return nil, err
+	}
+	n.fs.rememberNodeID(req.Header.Node, n)
+	if n = n.route(ctx); n == nil {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logLookup, "Lookup", "path", n.path(), "name", req.Name, "error", err) }()
+	if n.fs.hidden(req.Name) {
+		return nil, fuse.ENOENT
+	}
+	if n.parent == nil && req.Name == healthName {
+		return n.fs.healthProbe(resp), nil
+	}
+	if n.parent == nil && req.Name == metaDir {
+		return n.fs.metaLookup(resp), nil
+	}
+	p := n.childPath(req.Name)
+	fi, ok := n.fs.queuedInfo(n.uid, p)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if fi == nil {
+		fi = n.listedInfo(req.Name)
+	}
+	if fi == nil && n.fs.isOffline() {
+		var listed bool
+		if fi, listed = n.kidInfo(req.Name); fi == nil && listed {
+			return nil, fuse.ENOENT
+		}
+	}
+	if fi == nil {
+		if err = n.fs.retry(ctx, RetryRead, "stat", p, func() (err error) {
+			fi, err = n.backend.Stat(ctx, p)
+			return err
+		}); err != nil {
+			return nil, translateError(err)
+		}
+	}
+	c := n.child(req.Name, fi.IsDir())
+	c.setInfo(fi)
+	resp.EntryValid = n.fs.attrTimeout
+	if n.parent == nil && n.fs.userRoots != nil {
+		// the entries of the shared root differ by caller, the kernel must
+		// look them up again for every path walk
+		resp.EntryValid = 0
+	}
+	return c, nil
+}
+
+var _ fs.NodeOpener = (*remoteNode)(nil)
+
+// Open implements fs.NodeOpener interface for *remoteNode
+func (n *remoteNode) Open(ctx context.Context,
+	req *fuse.OpenRequest, resp *fuse.OpenResponse) (h fs.Handle, err error) {
+	if err = n.fs.enter(ctx, OpOpen, n); err != nil {
+		return nil, err
+	}
+	if n = n.route(ctx); n == nil {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logIO, "Open", "path", n.path(), "flags", req.Flags, "error", err) }()
+	defer func() { n.fs.audit(ctx, OpOpen, n.path(), "", err) }()
+	if n.isDir {
+		return n, nil
+	}
+	if req.Flags.IsReadOnly() && req.Flags&fuse.OpenTruncate == 0 {
+		return &remoteHandle{node: n, caller: callerOf(ctx)}, nil
+	}
+	rh, err := n.openWriter(ctx, req.Flags&fuse.OpenTruncate != 0)
+	return rh, translateError(err)
+}
+
+// openWriter returns a handle with a local copy of the file, it is uploaded
+// on flush
+func (n *remoteNode) openWriter(ctx context.Context, truncate bool) (*remoteHandle, error) {
+	tmp, err := ioutil.TempFile("", "ocis-overlay-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	rh := &remoteHandle{node: n, tmp: tmp, caller: callerOf(ctx), base: n.baseVersion(ctx)}
+	switch {
+	case truncate:
+		rh.dirty = true
+	case n.fs.offline != nil:
+		// queued content and cached blocks are used while offline
+		err = n.fs.copyRemote(ctx, n, tmp)
+	default:
+		err = n.fs.download(ctx, n.backend, n.path(), tmp)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	n.lock.Lock()
+	if n.writers == nil {
+		n.writers = make(map[*remoteHandle]bool)
+	}
+	n.writers[rh] = true
+	n.lock.Unlock()
+	return rh, nil
+}
+
+var _ fs.HandleReadDirAller = (*remoteNode)(nil)
+
+// ReadDirAll implements fs.HandleReadDirAller interface for *remoteNode
+func (n *remoteNode) ReadDirAll(ctx context.Context) (dirs []fuse.Dirent, err error) {
+	if err = n.fs.enter(ctx, OpReadDir, n); err != nil {
+		return nil, err
+	}
+	if n = n.route(ctx); n == nil {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logDir, "ReadDirAll", "path", n.path(), "entries", len(dirs), "error", err) }()
+	var fis []os.FileInfo
+	err = n.fs.retry(ctx, RetryRead, "readdir", n.path(), func() (err error) {
+		fis, err = n.backend.ReadDir(ctx, n.path())
+		return err
+	})
+	if err != nil {
+		if fis = n.cachedListing(); fis == nil || !n.fs.isOffline() {
+			return nil, translateError(err)
+		}
+	}
+	fis = n.withQueued(fis)
+	listing := make(map[string]os.FileInfo, len(fis))
+	for _, fi := range fis {
+		listing[fi.Name()] = fi
+		tp := fuse.DT_File
+		if fi.IsDir() {
+			tp = fuse.DT_Dir
+		}
+		dirs = append(dirs, fuse.Dirent{Name: fi.Name(), Type: tp})
+	}
+	n.lock.Lock()
+	n.listing = listing
+	n.listingExpiry = time.Now().Add(n.fs.attrTimeout)
+	n.lock.Unlock()
+	return n.fs.withoutHidden(dirs), nil
+}
+
+var _ fs.NodeCreater = (*remoteNode)(nil)
+
+// Create implements fs.NodeCreater interface for *remoteNode
+func (n *remoteNode) Create(ctx context.Context,
+	req *fuse.CreateRequest, resp *fuse.CreateResponse) (fsn fs.Node, fsh fs.Handle, err error) {
+	if err = n.fs.enter(ctx, OpCreate, n); err != nil {
+		return nil, nil, err
+	}
+	if n = n.route(ctx); n == nil {
+		return nil, nil, fuse.Errno(syscall.EACCES)
+	}
+	p := n.childPath(req.Name)
+	defer func() { loog.Debug(logCreate, "Create", "path", p, "flags", req.Flags, "error", err) }()
+	defer func() { n.fs.audit(ctx, OpCreate, p, "", err) }()
+	if n.fs.hidden(req.Name) {
+		return nil, nil, fuse.EPERM
+	}
+	if req.Flags&fuse.OpenExclusive != 0 {
+		if err = n.fs.retry(ctx, RetryRead, "stat", p, func() (err error) {
+			_, err = n.backend.Stat(ctx, p)
+			return err
+		}); err == nil {
+			return nil, nil, fuse.EEXIST
+		}
+	}
+	queued := false
+	if err = n.fs.retry(ctx, RetryWrite, "upload", p, func() error {
+		return n.backend.Upload(ctx, p, strings.NewReader(""), 0)
+	}); err != nil {
+		if !n.fs.queueing(err) {
+			return nil, nil, translateError(err)
+		}
+		queued = true
+	}
+	n.invalidate()
+	c := n.child(req.Name, false)
+	c.invalidate()
+	if queued {
+		c.setInfo(&davInfo{name: req.Name, mtime: time.Now()})
+	}
+	rh, err := c.openWriter(ctx, true)
+	if err != nil {
+		return nil, nil, translateError(err)
+	}
+	// the empty file is already there, unless it is queued on release
+	rh.dirty = queued
+	n.fs.emit(EventFileTouched, p, "")
+	return c, rh, nil
+}
+
+var _ fs.NodeMkdirer = (*remoteNode)(nil)
+
+// Mkdir implements fs.NodeMkdirer interface for *remoteNode
+func (n *remoteNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (created fs.Node, err error) {
+	if err = n.fs.enter(ctx, OpMkdir, n); err != nil {
+		return nil, err
+	}
+	if n = n.route(ctx); n == nil {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	p := n.childPath(req.Name)
+	defer func() { loog.Debug(logCreate, "Mkdir", "path", p, "error", err) }()
+	defer func() { n.fs.audit(ctx, OpMkdir, p, "", err) }()
+	if n.fs.hidden(req.Name) {
+		return nil, fuse.EPERM
+	}
+	if err = n.fs.retry(ctx, RetryNamespace, "mkdir", p, func() error {
+		return n.backend.Mkdir(ctx, p)
+	}); err != nil {
+		if !n.fs.queueing(err) {
+			return nil, translateError(err)
+		}
+		if err = n.fs.queueMkdir(n.uid, p); err != nil {
+			return nil, translateError(err)
+		}
+	}
+	n.invalidate()
+	c := n.child(req.Name, true)
+	c.invalidate()
+	n.fs.emit(EventContainerCreated, p, "")
+	return c, nil
+}
+
+var _ fs.NodeRemover = (*remoteNode)(nil)
+
+// Remove implements fs.NodeRemover interface for *remoteNode
+func (n *remoteNode) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	if err = n.fs.enter(ctx, OpRemove, n); err != nil {
+		return err
+	}
+	if n = n.route(ctx); n == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	p := n.childPath(req.Name)
+	defer func() { loog.Debug(logRemove, "Remove", "path", p, "error", err) }()
+	defer func() { n.fs.audit(ctx, OpRemove, p, "", err) }()
+	// files with queued changes and files removed while offline are removed
+	// through the journal
+	fi, ok := n.fs.queuedInfo(n.uid, p)
+	if !ok {
+		return fuse.ENOENT
+	}
+	queued := fi != nil
+	if !queued {
+		if err = n.fs.retry(ctx, RetryRead, "stat", p, func() (err error) {
+			fi, err = n.backend.Stat(ctx, p)
+			return err
+		}); err != nil {
+			if fi, _ = n.kidInfo(req.Name); fi == nil || !n.fs.isOffline() {
+				return translateError(err)
+			}
+			queued = true
+		}
+	}
+	switch {
+	case req.Dir && !fi.IsDir():
+		return fuse.Errno(syscall.ENOTDIR)
+	case !req.Dir && fi.IsDir():
+		return fuse.Errno(syscall.EISDIR)
+	case req.Dir && queued:
+		// only directories created offline are known to be empty
+		if e := n.fs.offline.latest(n.uid, p); e == nil || e.Op != journalMkdir {
+			return translateError(errOffline("rmdir", p))
+		}
+		if n.fs.offline.below(n.uid, p) {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	case req.Dir:
+		// remote stores delete collections recursively, rmdir must not
+		var fis []os.FileInfo
+		if err = n.fs.retry(ctx, RetryRead, "readdir", p, func() (err error) {
+			fis, err = n.backend.ReadDir(ctx, p)
+			return err
+		}); err != nil {
+			return translateError(err)
+		}
+		if len(fis) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+	if queued {
+		err = n.fs.queueRemove(n.uid, p, version(fi))
+	} else if err = n.fs.retry(ctx, RetryNamespace, "remove", p, func() error {
+		return n.backend.Remove(ctx, p)
+	}); err != nil && n.fs.queueing(err) {
+		err = n.fs.queueRemove(n.uid, p, version(fi))
+	}
+	if err != nil {
+		return translateError(err)
+	}
+	n.invalidate()
+	n.fs.blocks.dropFile(p)
+	n.fs.rtree.Lock()
+	delete(n.kids, req.Name)
+	n.fs.rtree.Unlock()
+	n.fs.emit(EventItemPurged, p, "")
+	return nil
+}
+
+var _ fs.NodeRenamer = (*remoteNode)(nil)
+
+// Rename implements fs.NodeRenamer interface for *remoteNode
+func (n *remoteNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	if err = n.fs.enter(ctx, OpRename, n); err != nil {
+		return err
+	}
+	if n = n.route(ctx); n == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	nd := newDir.(*remoteNode).route(ctx)
+	if nd == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	op, np := n.childPath(req.OldName), nd.childPath(req.NewName)
+	defer func() { loog.Debug(logRename, "Rename", "old", op, "new", np, "error", err) }()
+	defer func() { n.fs.audit(ctx, OpRename, op, np, err) }()
+	if n.fs.hidden(req.NewName) {
+		return fuse.EPERM
+	}
+	if err = n.fs.retry(ctx, RetryNamespace, "rename", op, func() error {
+		return n.backend.Rename(ctx, op, np)
+	}); err != nil {
+		return translateError(err)
+	}
+	n.invalidate()
+	nd.invalidate()
+	n.fs.blocks.dropFile(op)
+	n.fs.blocks.dropFile(np)
+	n.fs.rtree.Lock()
+	if c, ok := n.kids[req.OldName]; ok {
+		delete(n.kids, req.OldName)
+		c.parent, c.base = nd, req.NewName
+		if nd.kids == nil {
+			nd.kids = make(map[string]*remoteNode)
+		}
+		nd.kids[req.NewName] = c
+	}
+	n.fs.rtree.Unlock()
+	n.fs.emit(EventItemMoved, np, op)
+	return nil
+}
+
+var _ fs.NodeSetattrer = (*remoteNode)(nil)
+
+// Setattr implements fs.NodeSetattrer interface for *remoteNode. Only the
+// size can be changed, remote stores manage times and permissions
+// themselves.
+func (n *remoteNode) Setattr(ctx context.Context,
+	req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	if err = n.fs.enter(ctx, OpSetattr, n); err != nil {
+		return err
+	}
+	if n = n.route(ctx); n == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logAttr, "Setattr", "path", n.path(), "valid", req.Valid, "error", err) }()
+	defer func() { n.fs.audit(ctx, OpSetattr, n.path(), "", err) }()
+	if req.Valid.Size() && !n.isDir {
+		if err = n.truncate(ctx, int64(req.Size)); err != nil {
+			return translateError(err)
+		}
+	}
+	fi, err := n.info(ctx)
+	if err != nil {
+		return translateError(err)
+	}
+	n.fillAttr(&resp.Attr, fi)
+	return nil
+}
+
+// truncate changes the size of the file. Open writers truncate their local
+// copy, otherwise the truncated file is uploaded right away.
+func (n *remoteNode) truncate(ctx context.Context, size int64) error {
+	n.lock.Lock()
+	var writers []*remoteHandle
+	for h := range n.writers {
+		writers = append(writers, h)
+	}
+	n.lock.Unlock()
+	if len(writers) > 0 {
+		for _, h := range writers {
+			if err := h.truncate(size); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	h, err := n.openWriter(ctx, size == 0)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+	if err = h.truncate(size); err != nil {
+		return err
+	}
+	return h.upload(ctx, false)
+}
+
+var _ fs.NodeFsyncer = (*remoteNode)(nil)
+
+// Fsync implements fs.NodeFsyncer interface for *remoteNode
+func (n *remoteNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	if err = n.fs.enter(ctx, OpFsync, n); err != nil {
+		return err
+	}
+	if n = n.route(ctx); n == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logIO, "Fsync", "path", n.path(), "error", err) }()
+	n.fs.killPoint(KillBeforeFsync)
+	defer func() {
+		if err == nil {
+			n.fs.killPoint(KillAfterFsync)
+		}
+	}()
+	n.lock.Lock()
+	var writers []*remoteHandle
+	for h := range n.writers {
+		writers = append(writers, h)
+	}
+	n.lock.Unlock()
+	for _, h := range writers {
+		if err = h.upload(ctx, false); err != nil {
+			return translateError(err)
+		}
+	}
+	return nil
+}
+
+var _ fs.NodeForgetter = (*remoteNode)(nil)
+
+// Forget implements fs.NodeForgetter interface for *remoteNode
+func (n *remoteNode) Forget() {
+	n.fs.rtree.Lock()
+	defer n.fs.rtree.Unlock()
+	if n.parent != nil && n.parent.kids[n.base] == n {
+		delete(n.parent.kids, n.base)
+	}
+	if n.fs.remoteIDs[n.id] == n {
+		delete(n.fs.remoteIDs, n.id)
+	}
+}
+
+// rememberNodeID records the kernel's node id of n. Statfs requests only
+// carry the node id, they report the quota of the store the node is in.
+func (f *FS) rememberNodeID(id fuse.NodeID, n *remoteNode) {
+	f.rtree.Lock()
+	defer f.rtree.Unlock()
+	if f.remoteIDs == nil {
+		f.remoteIDs = make(map[fuse.NodeID]*remoteNode)
+	}
+	if n.id != id && f.remoteIDs[n.id] == n {
+		delete(f.remoteIDs, n.id)
+	}
+	f.remoteIDs[id], n.id = n, id
+}
+
+// remoteHandle is an open remote file. Handles opened for writing keep a
+// local copy that is uploaded on flush.
+type remoteHandle struct {
+	// bytesRead and bytesWritten count the I/O for the audit log, first for
+	// the alignment of atomic operations
+	bytesRead    int64
+	bytesWritten int64
+
+	node *remoteNode
+	// caller opened the file
+	caller fuse.Header
+
+	lock  sync.Mutex
+	tmp   *os.File
+	dirty bool
+	// base is the version of the file the local copy was made from
+	base string
+	// conflict is the conflicted copy the local copy goes to once the file
+	// changed in the backend, see target
+	conflict string
+	// ahead detects sequential reads, see readahead.go
+	ahead readAhead
+}
+
+func (h *remoteHandle) size() (int64, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fi, err := h.tmp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (h *remoteHandle) truncate(size int64) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.dirty = true
+	return h.tmp.Truncate(size)
+}
+
+// upload pushes the local copy if it changed, final is set for the last
+// upload before the handle is closed
+func (h *remoteHandle) upload(ctx context.Context, final bool) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.tmp == nil || !h.dirty {
+		return nil
+	}
+	fi, err := h.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	p, target := h.node.path(), ""
+	if h.node.fs.queuedUpload(h.node) != nil {
+		// later changes queue up behind the queued ones
+		err = errOffline("upload", p)
+	} else if target, err = h.target(ctx, final); err == nil {
+		err = h.push(ctx, target, fi.Size())
+	}
+	if err != nil && h.node.fs.queueing(err) {
+		if err = h.node.fs.queueUpload(h.node, h.tmp, fi.Size(), h.base); err == nil {
+			h.dirty = false
+			h.node.invalidate()
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	h.dirty = false
+	h.uploaded(ctx, target)
+	h.node.fs.blocks.dropFile(target)
+	loog.Debug(logRemote, "uploaded", "path", target, "size", fi.Size())
+	h.node.fs.emit(EventFileUploaded, target, "")
+	return nil
+}
+
+// push uploads size bytes of the local copy to p, h.lock must be held
+func (h *remoteHandle) push(ctx context.Context, p string, size int64) error {
+	if rb, ok := h.node.backend.(ResumableBackend); ok {
+		u := h.node.fs.uploads.start(p, size)
+		defer h.node.fs.uploads.done(u)
+		return h.node.fs.retry(ctx, RetryWrite, "upload", p, func() error {
+			return rb.UploadResumable(ctx, p, h.tmp, size, u.progress)
+		})
+	}
+	return h.node.fs.retry(ctx, RetryWrite, "upload", p, func() error {
+		return h.node.backend.Upload(ctx, p, io.NewSectionReader(h.tmp, 0, size), size)
+	})
+}
+
+// close drops the local copy
+func (h *remoteHandle) close() {
+	h.node.lock.Lock()
+	delete(h.node.writers, h)
+	h.node.lock.Unlock()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.tmp != nil {
+		h.tmp.Close()
+		h.tmp = nil
+	}
+}
+
+var _ fs.HandleReader = (*remoteHandle)(nil)
+
+// Read implements fs.HandleReader interface for *remoteHandle
+func (h *remoteHandle) Read(ctx context.Context,
+	req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	if err = h.node.fs.enter(ctx, OpRead, h); err != nil {
+		return err
+	}
+	defer func() {
+		loog.Debug(logIO, "Read", "path", h.node.path(), "offset", req.Offset, "size", req.Size, "error", err)
+	}()
+	buf := make([]byte, req.Size)
+	var n int
+	h.lock.Lock()
+	if h.tmp != nil {
+		n, err = h.tmp.ReadAt(buf, req.Offset)
+		h.lock.Unlock()
+	} else {
+		h.lock.Unlock()
+		n, err = h.node.fs.readRemote(ctx, h.node, buf, req.Offset)
+		h.node.fs.readAhead(ctx, h.node, &h.ahead, req.Offset, n)
+	}
+	if err != nil && err != io.EOF {
+		return translateError(err)
+	}
+	resp.Data = buf[:n]
+	atomic.AddInt64(&h.bytesRead, int64(n))
+	atomic.AddInt64(&h.node.fs.stats.bytesRead, int64(n))
+	return nil
+}
+
+var _ fs.HandleWriter = (*remoteHandle)(nil)
+
+// Write implements fs.HandleWriter interface for *remoteHandle
+func (h *remoteHandle) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	if err = h.node.fs.enter(ctx, OpWrite, h); err != nil {
+		return err
+	}
+	defer func() {
+		loog.Debug(logIO, "Write", "path", h.node.path(), "offset", req.Offset, "size", len(req.Data), "error", err)
+	}()
+	if err = h.node.fs.reserveSpace(int64(len(req.Data))); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.tmp == nil {
+		return fuse.Errno(syscall.EBADF)
+	}
+	h.dirty = true
+	resp.Size, err = h.tmp.WriteAt(req.Data, req.Offset)
+	atomic.AddInt64(&h.bytesWritten, int64(resp.Size))
+	atomic.AddInt64(&h.node.fs.stats.bytesWritten, int64(resp.Size))
+	if err == nil {
+		h.node.fs.killPoint(KillAfterWrite)
+	}
+	return translateError(err)
+}
+
+var _ fs.HandleFlusher = (*remoteHandle)(nil)
+
+// Flush implements fs.HandleFlusher interface for *remoteHandle
+func (h *remoteHandle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	if err = h.node.fs.enter(ctx, OpFlush, h); err != nil {
+		return err
+	}
+	defer func() { loog.Debug(logIO, "Flush", "path", h.node.path(), "error", err) }()
+	return translateError(h.upload(ctx, false))
+}
+
+var _ fs.HandleReleaser = (*remoteHandle)(nil)
+
+// Release implements fs.HandleReleaser interface for *remoteHandle
+func (h *remoteHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	// releasing is never interrupted, pending changes have to be uploaded
+	h.node.fs.delay(context.Background(), OpRelease)
+	defer func() { loog.Debug(logIO, "Release", "path", h.node.path(), "error", err) }()
+	defer func() {
+		h.node.fs.auditRelease(h.caller, h.node.path(), atomic.LoadInt64(&h.bytesRead), atomic.LoadInt64(&h.bytesWritten))
+	}()
+	defer h.close()
+	return translateError(h.upload(context.Background(), true))
+}
+
+// uploads tracks the running uploads for the control socket
+type uploads struct {
+	lock    sync.Mutex
+	running map[*upload]bool
+}
+
+type upload struct {
+	uploads *uploads
+	info    UploadInfo
+}
+
+func (u *uploads) start(p string, size int64) *upload {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	up := &upload{uploads: u, info: UploadInfo{Path: p, Size: size, Started: time.Now()}}
+	if u.running == nil {
+		u.running = make(map[*upload]bool)
+	}
+	u.running[up] = true
+	return up
+}
+
+func (u *uploads) done(up *upload) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.running, up)
+}
+
+func (up *upload) progress(uploaded int64) {
+	up.uploads.lock.Lock()
+	defer up.uploads.lock.Unlock()
+	up.info.Uploaded = uploaded
+}
+
+func (u *uploads) infos() []UploadInfo {
+	u.lock.Lock()
+	infos := make([]UploadInfo, 0, len(u.running))
+	for up := range u.running {
+		infos = append(infos, up.info)
+	}
+	u.lock.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+// download copies the remote file name of backend to w
+func (f *FS) download(ctx context.Context, backend Backend, name string, w io.WriterAt) error {
+	buf := make([]byte, remoteBlockSize)
+	for off := int64(0); ; off += remoteBlockSize {
+		var n int
+		err := f.retry(ctx, RetryRead, "read", name, func() (err error) {
+			n, err = backend.ReadAt(ctx, name, buf, off)
+			return err
+		})
+		// a read that failed within the file must not leave a shorter copy
+		// that looks complete, it would be uploaded over the file
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if _, werr := w.WriteAt(buf[:n], off); werr != nil {
+			return werr
+		}
+		if err == io.EOF || n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// readRemote reads the file of n at off through the block cache
+func (f *FS) readRemote(ctx context.Context, n *remoteNode, p []byte, off int64) (int, error) {
+	if e := f.queuedUpload(n); e != nil {
+		return f.readQueued(e, p, off)
+	}
+	fi, err := n.info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	name, v := n.path(), version(fi)
+	read := 0
+	for read < len(p) {
+		idx := (off + int64(read)) / remoteBlockSize
+		id := blockID{n.uid, name, v, idx}
+		block, ok := f.blocks.get(id)
+		f.stats.blocks.count(ok)
+		if !ok {
+			if block, err = f.loadBlock(ctx, n.backend, id); err != nil {
+				return read, err
+			}
+		}
+		start := int(off + int64(read) - idx*remoteBlockSize)
+		if start >= len(block) {
+			return read, io.EOF
+		}
+		read += copy(p[read:], block[start:])
+		if len(block) < remoteBlockSize {
+			if read < len(p) {
+				return read, io.EOF
+			}
+			break
+		}
+	}
+	return read, nil
+}
+
+// Statfs of a remote store reports its quota
+func (f *FS) remoteStatfs(ctx context.Context,
+	req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	const bsize = 4096
+	used, available := int64(0), int64(-1)
+	var err error
+	f.rtree.RLock()
+	n := f.remoteIDs[req.Header.Node]
+	f.rtree.RUnlock()
+	backend := f.backend
+	if f.userRoots != nil {
+		// the quota of the caller's store, none for the trees of others
+		if n == nil {
+			n = f.remoteRoot
+		}
+		if n = n.route(ctx); n != nil {
+			backend = n.backend
+		} else {
+			backend = nil
+		}
+	}
+	if pq, ok := backend.(PathQuotaBackend); ok && n != nil {
+		err = f.retry(ctx, RetryRead, "quota", n.path(), func() (err error) {
+			used, available, err = pq.QuotaOf(ctx, n.path())
+			return err
+		})
+	} else if q, ok := backend.(QuotaBackend); ok {
+		err = f.retry(ctx, RetryRead, "quota", "", func() (err error) {
+			used, available, err = q.Quota(ctx)
+			return err
+		})
+	}
+	if err != nil {
+		loog.Warn(logRemote, "could not get quota", "error", err)
+		available = -1
+	}
+	if available < 0 {
+		available = unknownSpace
+	}
+	resp.Bsize = bsize
+	resp.Frsize = bsize
+	resp.Blocks = uint64(used+available) / bsize
+	resp.Bfree = uint64(available) / bsize
+	resp.Bavail = resp.Bfree
+	resp.Files = unknownSpace
+	resp.Ffree = unknownSpace
+	resp.Namelen = 255
+	return nil
+}
@@ -0,0 +1,79 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// failingBackend serves a file of size bytes and fails reads at failAt
+type failingBackend struct {
+	Backend
+	size   int64
+	failAt int64
+}
+
+func (b *failingBackend) ReadAt(ctx context.Context, name string, p []byte, off int64) (int, error) {
+	n := 0
+	for ; n < len(p) && off+int64(n) < b.size; n++ {
+		if off+int64(n) == b.failAt {
+			return n, &os.PathError{Op: "GET", Path: name, Err: syscall.ECONNRESET}
+		}
+		p[n] = 'x'
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// buffer is an io.WriterAt in memory
+type buffer struct {
+	bytes.Buffer
+}
+
+func (b *buffer) WriteAt(p []byte, off int64) (int, error) {
+	if int64(b.Len()) != off {
+		return 0, io.ErrShortWrite
+	}
+	return b.Write(p)
+}
+
+func TestDownload(t *testing.T) {
+	f := &FS{}
+	for _, tc := range []struct {
+		name    string
+		size    int64
+		failAt  int64
+		wantErr bool
+	}{
+		{"empty", 0, -1, false},
+		{"one block", remoteBlockSize, -1, false},
+		{"blocks and a half", 2*remoteBlockSize + remoteBlockSize/2, -1, false},
+		{"fails in the first block", 2 * remoteBlockSize, 100, true},
+		{"fails in a later block", 3 * remoteBlockSize, 2*remoteBlockSize + 7, true},
+		{"fails in the last short block", 2*remoteBlockSize + 100, 2*remoteBlockSize + 50, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var w buffer
+			err := f.download(context.Background(), &failingBackend{size: tc.size, failAt: tc.failAt}, "file", &w)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("download returned no error, wrote %d of %d bytes", w.Len(), tc.size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(w.Len()) != tc.size {
+				t.Fatalf("downloaded %d bytes, want %d", w.Len(), tc.size)
+			}
+		})
+	}
+}
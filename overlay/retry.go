@@ -0,0 +1,162 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// RetryClass groups the calls to a remote backend that share a RetryPolicy
+type RetryClass string
+
+// Retry classes
+const (
+	// RetryRead are stats, listings, reads and quota lookups
+	RetryRead RetryClass = "read"
+	// RetryWrite are uploads, they replace the whole file and can be
+	// repeated
+	RetryWrite RetryClass = "write"
+	// RetryNamespace are mkdir, remove and rename. They are not idempotent,
+	// a retry after a lost response fails with EEXIST or ENOENT, so they are
+	// not retried by default.
+	RetryNamespace RetryClass = "namespace"
+)
+
+// RetryPolicy retries calls to a remote backend that failed with a
+// transient error: EINTR, EAGAIN (429, 502 and 503 responses), ETIMEDOUT
+// (504 responses and timeouts) and reset or refused connections.
+type RetryPolicy struct {
+	// Attempts is the maximum number of calls, 1 disables retries
+	Attempts int
+	// Backoff is the delay before the first retry, it doubles for every
+	// further one up to MaxBackoff. Delays are randomized between half and
+	// the full value.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func (p RetryPolicy) String() string {
+	return fmt.Sprintf("%d:%s:%s", p.Attempts, p.Backoff, p.MaxBackoff)
+}
+
+// DefaultRetry returns the default policies of the retry classes
+func DefaultRetry() map[RetryClass]RetryPolicy {
+	return map[RetryClass]RetryPolicy{
+		RetryRead:      {Attempts: 4, Backoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second},
+		RetryWrite:     {Attempts: 3, Backoff: 500 * time.Millisecond, MaxBackoff: 5 * time.Second},
+		RetryNamespace: {Attempts: 1, Backoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second},
+	}
+}
+
+// ParseRetry parses a comma separated list of class=attempts[:backoff[:max]],
+// e.g. read=5:50ms:1s,namespace=3, into the DefaultRetry policies
+func ParseRetry(spec string) (map[RetryClass]RetryPolicy, error) {
+	policies := DefaultRetry()
+	if spec == "" {
+		return policies, nil
+	}
+	for _, s := range strings.Split(spec, ",") {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid retry policy %q, expected class=attempts[:backoff[:max]]", s)
+		}
+		class := RetryClass(kv[0])
+		p, ok := policies[class]
+		if !ok {
+			return nil, fmt.Errorf("unknown retry class %q, expected read, write or namespace", kv[0])
+		}
+		args := strings.Split(kv[1], ":")
+		if len(args) > 3 {
+			return nil, fmt.Errorf("invalid retry policy %q, expected class=attempts[:backoff[:max]]", s)
+		}
+		var err error
+		if p.Attempts, err = strconv.Atoi(args[0]); err != nil || p.Attempts < 1 {
+			return nil, fmt.Errorf("invalid retry attempts %q", args[0])
+		}
+		if len(args) > 1 {
+			if p.Backoff, err = time.ParseDuration(args[1]); err != nil || p.Backoff < 0 {
+				return nil, fmt.Errorf("invalid retry backoff %q", args[1])
+			}
+			if p.MaxBackoff < p.Backoff {
+				p.MaxBackoff = p.Backoff
+			}
+		}
+		if len(args) > 2 {
+			if p.MaxBackoff, err = time.ParseDuration(args[2]); err != nil || p.MaxBackoff < p.Backoff {
+				return nil, fmt.Errorf("invalid maximum retry backoff %q", args[2])
+			}
+		}
+		policies[class] = p
+	}
+	return policies, nil
+}
+
+// transientErrnos are the errors of a backend call worth retrying
+var transientErrnos = []syscall.Errno{
+	syscall.EINTR,
+	syscall.EAGAIN,
+	syscall.ETIMEDOUT,
+	syscall.ECONNRESET,
+	syscall.ECONNREFUSED,
+	syscall.ECONNABORTED,
+	syscall.EPIPE,
+}
+
+// retryable reports whether err of a backend call may go away on a retry,
+// responses cut off by a dropped connection are
+func retryable(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if errno := errnoOf(err); errno != 0 {
+		err = errno
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// retry calls the backend with call until it succeeds, fails with an error
+// that is not transient or the attempts of the policy of class are used up.
+// op and name are logged with the retries.
+func (f *FS) retry(ctx context.Context, class RetryClass, op string, name string, call func() error) error {
+	if f.isOffline() {
+		// fail fast instead of waiting for timeouts, see offline.go
+		return errOffline(op, name)
+	}
+	p := f.retries[class]
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= p.Attempts || !retryable(err) || ctx.Err() != nil {
+			f.observe(err)
+			return err
+		}
+		// random delays keep clients that failed together from retrying
+		// together
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		loog.Warn(logRemote, "retrying backend call", "op", op, "path", name,
+			"attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
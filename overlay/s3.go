@@ -0,0 +1,736 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+const (
+	// s3PartSize is the size of the parts of multipart uploads, files up to
+	// it are uploaded with a single PUT
+	s3PartSize = 16 << 20
+	// s3MaxCopySize is the largest object CopyObject copies, larger files
+	// cannot be renamed
+	s3MaxCopySize = 5 << 30
+	// s3XattrMeta prefixes the user metadata holding xattrs, followed by the
+	// hex encoded name of the xattr, the value is base64 encoded
+	s3XattrMeta = "x-amz-meta-xattr-"
+	// s3UnsignedPayload is sent instead of the hash of request bodies
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// s3XattrTimeout limits fetching the xattrs of a listed object
+	s3XattrTimeout = 30 * time.Second
+)
+
+func init() {
+	newS3 := func(u *url.URL, creds *Credentials) (Backend, error) {
+		return NewS3(u, creds)
+	}
+	RegisterBackend("s3", newS3)
+	RegisterBackend("s3+http", newS3)
+}
+
+// S3 is a Backend for a bucket of an S3 compatible store like AWS S3 or
+// MinIO. Directories are key prefixes ending in a slash, empty directories
+// are kept as empty marker objects named like the prefix. Requests address
+// the bucket in the path and are signed with AWS signature version 4.
+type S3 struct {
+	endpoint *url.URL
+	bucket   string
+	// prefix is the key prefix of the mounted tree, without a slash at the
+	// end, empty for the whole bucket
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// NewS3 returns a Backend for the bucket at u, s3://host/bucket/prefix
+// uses https and s3+http://host/bucket/prefix plain http. The region is
+// given as ?region=, us-east-1 by default. The user of creds is the access
+// key and its password the secret key, without them requests are anonymous.
+func NewS3(u *url.URL, creds *Credentials) (*S3, error) {
+	elems := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || elems[0] == "" {
+		return nil, fmt.Errorf("invalid S3 backend %q, expected s3://host/bucket/prefix", u.String())
+	}
+	s := &S3{
+		endpoint: &url.URL{Scheme: "https", Host: u.Host},
+		bucket:   elems[0],
+		region:   u.Query().Get("region"),
+		client:   &http.Client{},
+	}
+	if u.Scheme == "s3+http" {
+		s.endpoint.Scheme = "http"
+	}
+	if len(elems) > 1 {
+		s.prefix = strings.Trim(elems[1], "/")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if creds != nil {
+		if creds.token != "" || creds.refreshToken != "" {
+			return nil, fmt.Errorf("S3 needs the access key and the secret key as user and password, not a token")
+		}
+		s.accessKey, s.secretKey = creds.User, creds.Password
+	}
+	return s, nil
+}
+
+// key returns the key of the object name
+func (s *S3) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, name), "/")
+}
+
+// dirKey returns the key prefix of the entries of the directory name, also
+// the key of its marker object
+func (s *S3) dirKey(name string) string {
+	if k := s.key(name); k != "" && k != "." {
+		return k + "/"
+	}
+	return ""
+}
+
+// s3Escape percent-encodes s like signature version 4 expects, every byte
+// but the unreserved ones and, for paths, the slash
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || keepSlash && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// request returns a request for the object key, or the bucket if key is
+// empty, with query
+func (s *S3) request(ctx context.Context, method string, key string, query url.Values,
+	body io.Reader, header http.Header) (*http.Request, error) {
+	u := s.endpoint.String() + "/" + s3Escape(s.bucket, false) + "/" + s3Escape(key, true)
+	if len(query) > 0 {
+		u += "?" + s3Query(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+// s3Query encodes query sorted by key, as signature version 4 expects
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// sign signs req with signature version 4, the body is not hashed
+func (s *S3) sign(req *http.Request) {
+	if s.accessKey == "" {
+		return
+	}
+	now := time.Now().UTC()
+	date := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	// the host and the x-amz-* headers are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	request := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonical.String(), signed, s3UnsignedPayload}, "\n")
+
+	scope := date[:8] + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// send signs and sends req for name. Responses with status codes of 300 and
+// above are returned as errors, unless they are in ok.
+func (s *S3) send(req *http.Request, name string, ok ...int) (resp *http.Response, err error) {
+	if sp := startCall(req.Context(), "s3."+req.Method); sp != nil {
+		req.Header.Set("traceparent", sp.traceparent())
+		defer func() { sp.endCall(name, err) }()
+	}
+	s.sign(req)
+	resp, err = s.client.Do(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return nil, errInterrupted
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = syscall.ETIMEDOUT
+		}
+		return nil, &os.PathError{Op: req.Method, Path: name, Err: err}
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil, &os.PathError{Op: req.Method, Path: name, Err: statusErrno(resp.StatusCode)}
+}
+
+// do sends a request for the object key, see send
+func (s *S3) do(ctx context.Context, method string, name string, key string, query url.Values,
+	body io.Reader, header http.Header, ok ...int) (*http.Response, error) {
+	req, err := s.request(ctx, method, key, query, body, header)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil && (method == "PUT" || method == "POST") {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+	return s.send(req, name, ok...)
+}
+
+// s3Error is the body of a failed request. CompleteMultipartUpload and
+// CopyObject may answer 200 with an error.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// checkBody returns the error in the body of a successful response
+func checkBody(resp *http.Response, name string, v interface{}) error {
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &os.PathError{Op: resp.Request.Method, Path: name, Err: err}
+	}
+	var e s3Error
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return &os.PathError{Op: resp.Request.Method, Path: name, Err: fmt.Errorf("%s: %s", e.Code, e.Message)}
+	}
+	if v != nil {
+		if err = xml.Unmarshal(b, v); err != nil {
+			return &os.PathError{Op: resp.Request.Method, Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// s3Info is the os.FileInfo of an object or a directory
+type s3Info struct {
+	name  string
+	size  int64
+	mtime time.Time
+	isDir bool
+	etag  string
+
+	// xattrs are the xattrs stored in the user metadata. Listings do not
+	// have them, they are fetched from s3 on first use then.
+	xattrs map[string][]byte
+	s3     *S3
+	once   sync.Once
+	key    string
+}
+
+func (i *s3Info) Name() string       { return i.name }
+func (i *s3Info) Size() int64        { return i.size }
+func (i *s3Info) ModTime() time.Time { return i.mtime }
+func (i *s3Info) IsDir() bool        { return i.isDir }
+func (i *s3Info) Sys() interface{}   { return nil }
+func (i *s3Info) ETag() string       { return i.etag }
+
+func (i *s3Info) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// Xattrs implements xattrInfo for *s3Info
+func (i *s3Info) Xattrs() map[string][]byte {
+	i.once.Do(func() {
+		if i.xattrs != nil || i.s3 == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s3XattrTimeout)
+		defer cancel()
+		if h, err := i.s3.head(ctx, i.name, i.key); err == nil && h != nil {
+			i.xattrs = s3Xattrs(h)
+		}
+	})
+	return i.xattrs
+}
+
+// s3Xattrs returns the xattrs in the user metadata of header
+func s3Xattrs(header http.Header) map[string][]byte {
+	x := make(map[string][]byte)
+	for k, v := range header {
+		lk := strings.ToLower(k)
+		if !strings.HasPrefix(lk, s3XattrMeta) || len(v) == 0 {
+			continue
+		}
+		name, err := hex.DecodeString(strings.TrimPrefix(lk, s3XattrMeta))
+		if err != nil {
+			continue
+		}
+		if value, err := base64.StdEncoding.DecodeString(v[0]); err == nil {
+			x[string(name)] = value
+		}
+	}
+	return x
+}
+
+// head returns the headers of the object key, nil if it does not exist
+func (s *S3) head(ctx context.Context, name string, key string) (http.Header, error) {
+	resp, err := s.do(ctx, "HEAD", name, key, nil, nil, nil, http.StatusNotFound)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return resp.Header, nil
+}
+
+// listResult is the answer of ListObjectsV2
+type listResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// list lists the keys below prefix, grouped by the next slash, calling fn
+// for every page. max limits the keys of a page, 0 is the maximum of the
+// store, and stops after the first page.
+func (s *S3) list(ctx context.Context, name string, prefix string, max int, fn func(*listResult)) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		if max > 0 {
+			query.Set("max-keys", strconv.Itoa(max))
+		}
+		resp, err := s.do(ctx, "GET", name, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var r listResult
+		if err = checkBody(resp, name, &r); err != nil {
+			return err
+		}
+		fn(&r)
+		if !r.IsTruncated || r.NextContinuationToken == "" || max > 0 {
+			return nil
+		}
+		token = r.NextContinuationToken
+	}
+}
+
+// dirExists reports whether the directory name has a marker or entries
+func (s *S3) dirExists(ctx context.Context, name string) (exists bool, empty bool, err error) {
+	marker := s.dirKey(name)
+	entries := 0
+	err = s.list(ctx, name, marker, 2, func(r *listResult) {
+		for _, c := range r.Contents {
+			exists = true
+			if c.Key != marker {
+				entries++
+			}
+		}
+		if len(r.CommonPrefixes) > 0 {
+			exists = true
+			entries += len(r.CommonPrefixes)
+		}
+	})
+	return exists, entries == 0, err
+}
+
+// Stat implements Backend for *S3
+func (s *S3) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if name == "" {
+		return &s3Info{name: "/", isDir: true}, nil
+	}
+	h, err := s.head(ctx, name, s.key(name))
+	if err != nil {
+		return nil, err
+	}
+	if h != nil {
+		i := &s3Info{name: path.Base(name), etag: h.Get("ETag"), xattrs: s3Xattrs(h)}
+		i.size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		i.mtime, _ = http.ParseTime(h.Get("Last-Modified"))
+		return i, nil
+	}
+	exists, _, err := s.dirExists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &os.PathError{Op: "HEAD", Path: name, Err: syscall.ENOENT}
+	}
+	i := &s3Info{name: path.Base(name), isDir: true, s3: s, key: s.dirKey(name)}
+	return i, nil
+}
+
+// ReadDir implements Backend for *S3 with ListObjectsV2. An object and a
+// directory of the same name are listed as the directory.
+func (s *S3) ReadDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	prefix := s.dirKey(name)
+	dirs := make(map[string]bool)
+	var files []*s3Info
+	err := s.list(ctx, name, prefix, 0, func(r *listResult) {
+		for _, p := range r.CommonPrefixes {
+			if base := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); base != "" {
+				dirs[base] = true
+			}
+		}
+		for _, c := range r.Contents {
+			base := strings.TrimPrefix(c.Key, prefix)
+			if base == "" || strings.Contains(base, "/") {
+				// the marker of the directory itself
+				continue
+			}
+			i := &s3Info{name: base, size: c.Size, etag: c.ETag, s3: s, key: c.Key}
+			i.mtime, _ = time.Parse(time.RFC3339, c.LastModified)
+			files = append(files, i)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 && len(files) == 0 && name != "" {
+		if exists, _, err := s.dirExists(ctx, name); err != nil || !exists {
+			return nil, &os.PathError{Op: "GET", Path: name, Err: syscall.ENOENT}
+		}
+	}
+	fis := make([]os.FileInfo, 0, len(dirs)+len(files))
+	for d := range dirs {
+		fis = append(fis, &s3Info{name: d, isDir: true, s3: s, key: prefix + d + "/"})
+	}
+	for _, i := range files {
+		if !dirs[i.name] {
+			fis = append(fis, i)
+		}
+	}
+	return fis, nil
+}
+
+// ReadAt implements Backend for *S3 with a ranged GET
+func (s *S3) ReadAt(ctx context.Context, name string, p []byte, off int64) (int, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)}}
+	resp, err := s.do(ctx, "GET", name, s.key(name), nil, nil, header, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return 0, io.EOF
+	}
+	return readRange(resp, name, p, off)
+}
+
+// Upload implements Backend for *S3, files larger than s3PartSize are
+// uploaded in parts
+func (s *S3) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	return s.put(ctx, name, s.key(name), r, size, nil)
+}
+
+// put stores size bytes from r as the object key with the user metadata in
+// header
+func (s *S3) put(ctx context.Context, name string, key string, r io.Reader, size int64, header http.Header) error {
+	if size > s3PartSize {
+		return s.putMultipart(ctx, name, key, r, header)
+	}
+	req, err := s.request(ctx, "PUT", key, nil, r, header)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := s.send(req, name)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type completeUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads r in parts of s3PartSize, the upload is aborted if a
+// part fails
+func (s *S3) putMultipart(ctx context.Context, name string, key string, r io.Reader, header http.Header) (err error) {
+	resp, err := s.do(ctx, "POST", name, key, url.Values{"uploads": {""}}, nil, header)
+	if err != nil {
+		return err
+	}
+	var started struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = checkBody(resp, name, &started); err != nil {
+		return err
+	}
+	id := started.UploadID
+	defer func() {
+		if err != nil {
+			// the parts are kept and billed until the upload is aborted
+			if resp, aerr := s.do(context.Background(), "DELETE", name, key, url.Values{"uploadId": {id}}, nil, nil); aerr == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	var done completeUpload
+	buf := make([]byte, s3PartSize)
+	for number := 1; ; number++ {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 || number == 1 {
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {id}}
+			req, err := s.request(ctx, "PUT", key, query, bytes.NewReader(buf[:n]), nil)
+			if err != nil {
+				return err
+			}
+			resp, err := s.send(req, name)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			done.Parts = append(done.Parts, completePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	body, err := xml.Marshal(done)
+	if err != nil {
+		return err
+	}
+	resp, err = s.do(ctx, "POST", name, key, url.Values{"uploadId": {id}}, bytes.NewReader(body), nil)
+	if err != nil {
+		return err
+	}
+	return checkBody(resp, name, nil)
+}
+
+// Mkdir implements Backend for *S3 with a marker object
+func (s *S3) Mkdir(ctx context.Context, name string) error {
+	if _, err := s.Stat(ctx, name); err == nil {
+		return &os.PathError{Op: "PUT", Path: name, Err: syscall.EEXIST}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return s.put(ctx, name, s.dirKey(name), nil, 0, nil)
+}
+
+// Remove implements Backend for *S3
+func (s *S3) Remove(ctx context.Context, name string) error {
+	h, err := s.head(ctx, name, s.key(name))
+	if err != nil {
+		return err
+	}
+	key := s.key(name)
+	if h == nil {
+		exists, empty, err := s.dirExists(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &os.PathError{Op: "DELETE", Path: name, Err: syscall.ENOENT}
+		}
+		if !empty {
+			return &os.PathError{Op: "DELETE", Path: name, Err: syscall.ENOTEMPTY}
+		}
+		key = s.dirKey(name)
+	}
+	resp, err := s.do(ctx, "DELETE", name, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename implements Backend for *S3 by copying the object and deleting the
+// original. Directories and objects larger than s3MaxCopySize fail with
+// EXDEV, so mv copies them.
+func (s *S3) Rename(ctx context.Context, oldName string, newName string) error {
+	fi, err := s.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Size() > s3MaxCopySize {
+		return &os.PathError{Op: "COPY", Path: oldName, Err: syscall.EXDEV}
+	}
+	if err = s.copyObject(ctx, newName, s.key(oldName), s.key(newName), nil); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, "DELETE", oldName, s.key(oldName), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// copyObject copies the object src to dst. With meta the user metadata is
+// replaced by it, otherwise it is copied.
+func (s *S3) copyObject(ctx context.Context, name string, src string, dst string, meta http.Header) error {
+	header := http.Header{"X-Amz-Copy-Source": {"/" + s3Escape(s.bucket, false) + "/" + s3Escape(src, true)}}
+	if meta != nil {
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+		for k, v := range meta {
+			header[k] = v
+		}
+	}
+	resp, err := s.do(ctx, "PUT", name, dst, nil, nil, header)
+	if err != nil {
+		return err
+	}
+	return checkBody(resp, name, nil)
+}
+
+// SetXattr implements XattrBackend for *S3, xattrs are kept in the user
+// metadata of the object or the marker of a directory
+func (s *S3) SetXattr(ctx context.Context, name string, attr string, value []byte) error {
+	return s.changeMeta(ctx, name, func(meta http.Header) error {
+		meta.Set(s3XattrMeta+hex.EncodeToString([]byte(attr)), base64.StdEncoding.EncodeToString(value))
+		return nil
+	})
+}
+
+// RemoveXattr implements XattrBackend for *S3
+func (s *S3) RemoveXattr(ctx context.Context, name string, attr string) error {
+	return s.changeMeta(ctx, name, func(meta http.Header) error {
+		k := http.CanonicalHeaderKey(s3XattrMeta + hex.EncodeToString([]byte(attr)))
+		if _, ok := meta[k]; !ok {
+			return fuse.ErrNoXattr
+		}
+		delete(meta, k)
+		return nil
+	})
+}
+
+// changeMeta replaces the user metadata of name with the one change makes
+// of it, by copying the object onto itself. Directories without a marker
+// get one.
+func (s *S3) changeMeta(ctx context.Context, name string, change func(meta http.Header) error) error {
+	key := s.key(name)
+	h, err := s.head(ctx, name, key)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		if fi, err := s.Stat(ctx, name); err != nil {
+			return err
+		} else if fi.IsDir() {
+			key = s.dirKey(name)
+			if h, err = s.head(ctx, name, key); err != nil {
+				return err
+			}
+		}
+	}
+	meta := make(http.Header)
+	if h != nil {
+		for k, v := range h {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") || k == "Content-Type" {
+				meta[k] = v
+			}
+		}
+	}
+	if err = change(meta); err != nil {
+		return err
+	}
+	if h == nil {
+		return s.put(ctx, name, key, nil, 0, meta)
+	}
+	return s.copyObject(ctx, name, key, key, meta)
+}
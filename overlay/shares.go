@@ -0,0 +1,169 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"strconv"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// read-only xattrs of remote files, so file managers can show share badges
+// without asking the server
+const (
+	// PermissionsAttr holds the permissions of the user on a remote file in
+	// the ownCloud notation, e.g. RDNVW: R shareable, D deletable, N
+	// renameable, V moveable, W writable, C/K creating files/dirs allowed, S
+	// shared with the user, M mounted
+	PermissionsAttr = "user.ocis.permissions"
+	// ShareTypesAttr lists the kinds of shares of a remote file, comma
+	// separated: user, group, link, email or federated
+	ShareTypesAttr = "user.ocis.share.types"
+)
+
+// shareTypeName returns the name of an OCS share type
+func shareTypeName(t int) string {
+	switch t {
+	case 0:
+		return "user"
+	case 1:
+		return "group"
+	case 3:
+		return "link"
+	case 4:
+		return "email"
+	case 6:
+		return "federated"
+	default:
+		return strconv.Itoa(t)
+	}
+}
+
+// xattrInfo is implemented by file infos of backends that provide virtual
+// xattrs
+type xattrInfo interface {
+	Xattrs() map[string][]byte
+}
+
+// xattrs returns the virtual xattrs of n
+func (n *remoteNode) xattrs(ctx context.Context) (map[string][]byte, error) {
+	fi, err := n.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if xi, ok := fi.(xattrInfo); ok {
+		return xi.Xattrs(), nil
+	}
+	return nil, nil
+}
+
+var _ fs.NodeGetxattrer = (*remoteNode)(nil)
+
+// Getxattr implements fs.NodeGetxattrer interface for *remoteNode
+func (n *remoteNode) Getxattr(ctx context.Context,
+	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	if err = n.fs.enter(ctx, OpGetxattr, n); err != nil {
+		return err
+	}
+	if n = n.route(ctx); n == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logXattr, "Getxattr", "path", n.path(), "name", req.Name, "error", err) }()
+	x, err := n.xattrs(ctx)
+	if err != nil {
+		return translateError(err)
+	}
+	v, ok := x[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = v
+	return nil
+}
+
+var _ fs.NodeListxattrer = (*remoteNode)(nil)
+
+// Listxattr implements fs.NodeListxattrer interface for *remoteNode
+func (n *remoteNode) Listxattr(ctx context.Context,
+	req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	if err = n.fs.enter(ctx, OpListxattr, n); err != nil {
+		return err
+	}
+	if n = n.route(ctx); n == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logXattr, "Listxattr", "path", n.path(), "error", err) }()
+	x, err := n.xattrs(ctx)
+	if err != nil {
+		return translateError(err)
+	}
+	for name := range x {
+		resp.Append(name)
+	}
+	return nil
+}
+
+var _ fs.NodeSetxattrer = (*remoteNode)(nil)
+
+// Setxattr implements fs.NodeSetxattrer interface for *remoteNode. The
+// virtual xattrs are read-only, others are only stored by an XattrBackend.
+func (n *remoteNode) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	if err = n.fs.enter(ctx, OpSetxattr, n); err != nil {
+		return err
+	}
+	if n = n.route(ctx); n == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logXattr, "Setxattr", "path", n.path(), "name", req.Name, "error", err) }()
+	return n.changeXattr(ctx, req.Name, "setxattr", func(xb XattrBackend) error {
+		return xb.SetXattr(ctx, n.path(), req.Name, req.Xattr)
+	})
+}
+
+var _ fs.NodeRemovexattrer = (*remoteNode)(nil)
+
+// Removexattr implements fs.NodeRemovexattrer interface for *remoteNode
+func (n *remoteNode) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	if err = n.fs.enter(ctx, OpRemovexattr, n); err != nil {
+		return err
+	}
+	if n = n.route(ctx); n == nil {
+		return fuse.Errno(syscall.EACCES)
+	}
+	defer func() { loog.Debug(logXattr, "Removexattr", "path", n.path(), "name", req.Name, "error", err) }()
+	return n.changeXattr(ctx, req.Name, "removexattr", func(xb XattrBackend) error {
+		return xb.RemoveXattr(ctx, n.path(), req.Name)
+	})
+}
+
+// changeXattr changes the xattr name of n with change if the backend is an
+// XattrBackend and denies it otherwise
+func (n *remoteNode) changeXattr(ctx context.Context, name string, op string, change func(xb XattrBackend) error) error {
+	xb, ok := n.backend.(XattrBackend)
+	if !ok {
+		return n.denyXattr(ctx, name)
+	}
+	if err := n.fs.retry(ctx, RetryNamespace, op, n.path(), func() error {
+		return change(xb)
+	}); err != nil {
+		return translateError(err)
+	}
+	n.invalidate()
+	return nil
+}
+
+// denyXattr returns EPERM for the virtual xattrs and ENOTSUP for others
+func (n *remoteNode) denyXattr(ctx context.Context, name string) error {
+	x, err := n.xattrs(ctx)
+	if err != nil {
+		return translateError(err)
+	}
+	if _, ok := x[name]; ok {
+		return fuse.Errno(syscall.EPERM)
+	}
+	return fuse.Errno(syscall.ENOTSUP)
+}
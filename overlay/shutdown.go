@@ -0,0 +1,106 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// errShutdown is returned for requests that arrive after Shutdown started
+var errShutdown = fuse.Errno(syscall.ESHUTDOWN)
+
+// shuttingDown reports whether Shutdown was called
+func (f *FS) shuttingDown() bool {
+	return atomic.LoadInt32(&f.closing) != 0
+}
+
+// Shutdown shuts the filesystem down cleanly: new requests fail with
+// ESHUTDOWN, the backing files of open handles are synced, pending remote
+// uploads are pushed, etags are propagated and in-memory xattrs persisted.
+// Then the mountpoint is unmounted and Shutdown waits for Serve to finish
+// the requests in flight and return. If ctx is done first its error is
+// returned, unmounting fails with EBUSY as long as files are open.
+func (f *FS) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&f.closing, 1)
+	loog.Info(logFS, "shutting down", "mountpoint", f.mountpoint)
+
+	f.syncHandles(ctx)
+	for _, root := range f.remoteRoots() {
+		root.uploadTree(ctx)
+	}
+	f.flushPropagation()
+	f.saveXattrs()
+	f.saveDedup()
+
+	if f.server == nil {
+		return nil
+	}
+	if err := fuse.Unmount(f.mountpoint); err != nil {
+		atomic.StoreInt32(&f.closing, 0)
+		return err
+	}
+	select {
+	case <-f.served:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// syncHandles flushes the backing files of all open handles to disk
+func (f *FS) syncHandles(ctx context.Context) {
+	for _, n := range f.registry.all() {
+		n.lock.RLock()
+		handles := make([]*Handle, 0, len(n.flushers))
+		for h := range n.flushers {
+			handles = append(handles, h)
+		}
+		n.lock.RUnlock()
+		for _, h := range handles {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := h.sync(); err != nil {
+				loog.Warn(logFS, "buffered write failed on shutdown", "path", n.getRealPath(), "error", err)
+			}
+			file, err := h.file()
+			if err != nil {
+				continue
+			}
+			if err = file.Sync(); err != nil {
+				loog.Warn(logFS, "could not sync on shutdown", "path", n.getRealPath(), "error", err)
+			}
+			h.release()
+		}
+	}
+}
+
+// uploadTree pushes the changes of the open writers of n and of all known
+// nodes below it
+func (n *remoteNode) uploadTree(ctx context.Context) {
+	n.lock.Lock()
+	writers := make([]*remoteHandle, 0, len(n.writers))
+	for h := range n.writers {
+		writers = append(writers, h)
+	}
+	n.lock.Unlock()
+	for _, h := range writers {
+		if err := h.upload(ctx, true); err != nil {
+			loog.Warn(logRemote, "could not upload on shutdown", "path", n.path(), "error", err)
+		}
+	}
+	n.fs.rtree.RLock()
+	kids := make([]*remoteNode, 0, len(n.kids))
+	for _, c := range n.kids {
+		kids = append(kids, c)
+	}
+	n.fs.rtree.RUnlock()
+	for _, c := range kids {
+		c.uploadTree(ctx)
+	}
+}
@@ -0,0 +1,363 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	smb2 "github.com/hirochachacha/go-smb2"
+)
+
+const (
+	// smbUploadPrefix starts the names of the files uploads are written to
+	// before they replace the file, they are not listed
+	smbUploadPrefix = ".~upload-"
+	// smbDialTimeout limits connecting to the server
+	smbDialTimeout = 30 * time.Second
+	// smbGuest logs in without credentials
+	smbGuest = "Guest"
+)
+
+func init() {
+	RegisterBackend("smb", func(u *url.URL, creds *Credentials) (Backend, error) {
+		return NewSMB(u, creds)
+	})
+}
+
+// SMB is a Backend for a directory of an SMB2/3 share, e.g. a Windows file
+// share or a NAS. It talks to the server with the userspace client of
+// go-smb2 and logs in with NTLM, the share does not need to be mounted.
+// The session is established on the first call and again after the
+// connection broke or the session expired.
+type SMB struct {
+	addr string
+	// share is \\server\share, root the directory in it, slash separated
+	share  string
+	root   string
+	dialer *smb2.Dialer
+
+	// lock guards the session, mounted is nil while there is none
+	lock    sync.Mutex
+	conn    net.Conn
+	session *smb2.Session
+	mounted *smb2.Share
+}
+
+// NewSMB returns a Backend for smb://server[:port]/share/path and logs in.
+// The user of creds may be given as DOMAIN\user, without creds it logs in
+// as guest.
+func NewSMB(u *url.URL, creds *Credentials) (*SMB, error) {
+	elems := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || elems[0] == "" {
+		return nil, fmt.Errorf("invalid SMB backend %q, expected smb://server/share/path", u.String())
+	}
+	ntlm := &smb2.NTLMInitiator{User: smbGuest}
+	if creds != nil {
+		if creds.token != "" || creds.refreshToken != "" {
+			return nil, fmt.Errorf("SMB logs in with -backend-user and -backend-password, not a token")
+		}
+		if creds.User != "" {
+			ntlm.User, ntlm.Password = creds.User, creds.Password
+		}
+		if i := strings.Index(ntlm.User, `\`); i >= 0 {
+			ntlm.Domain, ntlm.User = ntlm.User[:i], ntlm.User[i+1:]
+		}
+	}
+	s := &SMB{
+		addr:   u.Host,
+		share:  `\\` + u.Hostname() + `\` + elems[0],
+		dialer: &smb2.Dialer{Initiator: ntlm},
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "445")
+	}
+	if len(elems) > 1 {
+		s.root = strings.Trim(path.Clean("/"+elems[1]), "/")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), smbDialTimeout)
+	defer cancel()
+	fi, err := s.Stat(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s on %s: %v", s.root, s.share, err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s on %s is not a directory", s.root, s.share)
+	}
+	return s, nil
+}
+
+// path returns the path of name in the share
+func (s *SMB) path(name string) string {
+	return strings.TrimPrefix(path.Join("/", s.root, name), "/")
+}
+
+// connect logs in and mounts the share, the lock must be held
+func (s *SMB) connect(ctx context.Context) error {
+	d := net.Dialer{Timeout: smbDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	session, err := s.dialer.DialContext(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return smbError(&os.PathError{Op: "login", Path: s.share, Err: err})
+	}
+	share, err := session.WithContext(ctx).Mount(s.share)
+	if err != nil {
+		session.Logoff()
+		conn.Close()
+		return smbError(&os.PathError{Op: "mount", Path: s.share, Err: err})
+	}
+	s.conn, s.session, s.mounted = conn, session, share
+	return nil
+}
+
+// do calls call with the share and returns its error as errno. A broken
+// connection or an expired session is dropped, so the retry of the call
+// logs in again.
+func (s *SMB) do(ctx context.Context, call func(share *smb2.Share) error) error {
+	s.lock.Lock()
+	if s.mounted == nil {
+		if err := s.connect(ctx); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+	}
+	mounted := s.mounted
+	s.lock.Unlock()
+
+	err := smbError(call(mounted.WithContext(ctx)))
+	if errnoOf(err) == syscall.ECONNRESET {
+		s.lock.Lock()
+		if s.mounted == mounted {
+			s.conn.Close()
+			s.conn, s.session, s.mounted = nil, nil, nil
+		}
+		s.lock.Unlock()
+	}
+	return err
+}
+
+// Stat implements Backend for *SMB
+func (s *SMB) Stat(ctx context.Context, name string) (fi os.FileInfo, err error) {
+	err = s.do(ctx, func(share *smb2.Share) error {
+		fi, err = share.Stat(s.path(name))
+		return err
+	})
+	return fi, err
+}
+
+// ReadDir implements Backend for *SMB
+func (s *SMB) ReadDir(ctx context.Context, name string) (infos []os.FileInfo, err error) {
+	err = s.do(ctx, func(share *smb2.Share) error {
+		fis, err := share.ReadDir(s.path(name))
+		if err != nil {
+			return err
+		}
+		infos = make([]os.FileInfo, 0, len(fis))
+		for _, fi := range fis {
+			if !strings.HasPrefix(fi.Name(), smbUploadPrefix) {
+				infos = append(infos, fi)
+			}
+		}
+		return nil
+	})
+	return infos, err
+}
+
+// ReadAt implements Backend for *SMB
+func (s *SMB) ReadAt(ctx context.Context, name string, p []byte, off int64) (n int, err error) {
+	err = s.do(ctx, func(share *smb2.Share) error {
+		file, err := share.Open(s.path(name))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		n, err = file.ReadAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+// Upload implements Backend for *SMB. The content is written to a new file
+// next to name that replaces it when it is complete, so readers on other
+// clients of the share never see a partial file.
+func (s *SMB) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	p := s.path(name)
+	tmp := smbAside(p)
+	return s.do(ctx, func(share *smb2.Share) (err error) {
+		file, err := share.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				share.Remove(tmp)
+			}
+		}()
+		n, err := io.Copy(file, &ctxReader{ctx: ctx, r: r})
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return &os.PathError{Op: "upload", Path: name, Err: syscall.EIO}
+		}
+		return smbReplace(share, tmp, p)
+	})
+}
+
+// Mkdir implements Backend for *SMB
+func (s *SMB) Mkdir(ctx context.Context, name string) error {
+	return s.do(ctx, func(share *smb2.Share) error {
+		return share.Mkdir(s.path(name), 0755)
+	})
+}
+
+// Remove implements Backend for *SMB
+func (s *SMB) Remove(ctx context.Context, name string) error {
+	return s.do(ctx, func(share *smb2.Share) error {
+		return share.Remove(s.path(name))
+	})
+}
+
+// Rename implements Backend for *SMB
+func (s *SMB) Rename(ctx context.Context, oldName string, newName string) error {
+	return s.do(ctx, func(share *smb2.Share) error {
+		return smbReplace(share, s.path(oldName), s.path(newName))
+	})
+}
+
+// Quota implements QuotaBackend for *SMB with the size of the share
+func (s *SMB) Quota(ctx context.Context) (used int64, available int64, err error) {
+	err = s.do(ctx, func(share *smb2.Share) error {
+		st, err := share.Statfs(s.path(""))
+		if err != nil {
+			return err
+		}
+		unit := int64(st.BlockSize() * st.FragmentSize())
+		used = int64(st.TotalBlockCount()-st.FreeBlockCount()) * unit
+		available = int64(st.AvailableBlockCount()) * unit
+		return nil
+	})
+	return used, available, err
+}
+
+// smbAside returns a name next to the path p that is not listed
+func smbAside(p string) string {
+	return path.Join(path.Dir(p), smbUploadPrefix+newUUID()[:8]+"-"+path.Base(p))
+}
+
+// smbReplace renames oldPath to newPath, replacing it like rename(2). SMB
+// renames fail if newPath exists: an empty directory is removed first, a
+// file is moved aside and removed once oldPath took its place, so other
+// clients never see a partial file, only for a moment none.
+func smbReplace(share *smb2.Share, oldPath string, newPath string) error {
+	err := share.Rename(oldPath, newPath)
+	if errnoOf(smbError(err)) != syscall.EEXIST {
+		return err
+	}
+	fi, err := share.Stat(newPath)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if err = share.Remove(newPath); err != nil {
+			return err
+		}
+		return share.Rename(oldPath, newPath)
+	}
+	aside := smbAside(newPath)
+	if err = share.Rename(newPath, aside); err != nil {
+		return err
+	}
+	if err = share.Rename(oldPath, newPath); err != nil {
+		share.Rename(aside, newPath)
+		return err
+	}
+	share.Remove(aside)
+	return nil
+}
+
+// ntStatusErrnos maps the NTSTATUS codes of SMB responses to errnos. A
+// deleted or expired session is a reset connection, the retries of the
+// overlay log in again.
+var ntStatusErrnos = map[uint32]syscall.Errno{
+	0xC000000F: syscall.ENOENT,     // STATUS_NO_SUCH_FILE
+	0xC0000022: syscall.EACCES,     // STATUS_ACCESS_DENIED
+	0xC0000033: syscall.EINVAL,     // STATUS_OBJECT_NAME_INVALID
+	0xC0000034: syscall.ENOENT,     // STATUS_OBJECT_NAME_NOT_FOUND
+	0xC0000035: syscall.EEXIST,     // STATUS_OBJECT_NAME_COLLISION
+	0xC000003A: syscall.ENOENT,     // STATUS_OBJECT_PATH_NOT_FOUND
+	0xC0000043: syscall.EBUSY,      // STATUS_SHARING_VIOLATION
+	0xC0000044: syscall.EDQUOT,     // STATUS_QUOTA_EXCEEDED
+	0xC0000056: syscall.ENOENT,     // STATUS_DELETE_PENDING
+	0xC000006D: syscall.EACCES,     // STATUS_LOGON_FAILURE
+	0xC000007F: syscall.ENOSPC,     // STATUS_DISK_FULL
+	0xC00000B5: syscall.ETIMEDOUT,  // STATUS_IO_TIMEOUT
+	0xC00000BA: syscall.EISDIR,     // STATUS_FILE_IS_A_DIRECTORY
+	0xC00000BB: syscall.ENOTSUP,    // STATUS_NOT_SUPPORTED
+	0xC00000C9: syscall.ECONNRESET, // STATUS_NETWORK_NAME_DELETED
+	0xC00000CC: syscall.ENOENT,     // STATUS_BAD_NETWORK_NAME
+	0xC0000101: syscall.ENOTEMPTY,  // STATUS_DIRECTORY_NOT_EMPTY
+	0xC0000103: syscall.ENOTDIR,    // STATUS_NOT_A_DIRECTORY
+	0xC0000121: syscall.EPERM,      // STATUS_CANNOT_DELETE
+	0xC0000203: syscall.ECONNRESET, // STATUS_USER_SESSION_DELETED
+	0xC0000205: syscall.EAGAIN,     // STATUS_INSUFF_SERVER_RESOURCES
+	0xC000035C: syscall.ECONNRESET, // STATUS_NETWORK_SESSION_EXPIRED
+}
+
+// smbErrno returns the errno of an error of the SMB client, 0 for other
+// errors
+func smbErrno(err error) syscall.Errno {
+	switch e := err.(type) {
+	case *smb2.ResponseError:
+		if errno, ok := ntStatusErrnos[e.Code]; ok {
+			return errno
+		}
+		return syscall.EIO
+	case *smb2.TransportError:
+		return syscall.ECONNRESET
+	case *smb2.ContextError:
+		if e.Timeout() {
+			return syscall.ETIMEDOUT
+		}
+		return syscall.EINTR
+	case *smb2.InvalidResponseError, *smb2.InternalError:
+		return syscall.EIO
+	}
+	return 0
+}
+
+// smbError returns err of the SMB client with the errno of its cause, like
+// the os package returns them
+func smbError(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		if errno := smbErrno(e.Err); errno != 0 {
+			return &os.PathError{Op: e.Op, Path: e.Path, Err: errno}
+		}
+	case *os.LinkError:
+		if errno := smbErrno(e.Err); errno != 0 {
+			return &os.LinkError{Op: e.Op, Old: e.Old, New: e.New, Err: errno}
+		}
+	default:
+		if errno := smbErrno(err); errno != 0 {
+			return errno
+		}
+	}
+	return err
+}
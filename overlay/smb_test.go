@@ -0,0 +1,68 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	smb2 "github.com/hirochachacha/go-smb2"
+)
+
+func TestSMBErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"not found", &os.PathError{Op: "stat", Path: "a", Err: &smb2.ResponseError{Code: 0xC0000034}}, fuse.ENOENT},
+		{"collision", &os.LinkError{Op: "rename", Old: "a", New: "b", Err: &smb2.ResponseError{Code: 0xC0000035}}, fuse.EEXIST},
+		{"unknown status", &os.PathError{Op: "open", Path: "a", Err: &smb2.ResponseError{Code: 0xC0000001}}, fuse.EIO},
+		{"session expired", &os.PathError{Op: "open", Path: "a", Err: &smb2.ResponseError{Code: 0xC000035C}}, fuse.Errno(syscall.ECONNRESET)},
+		{"connection", &smb2.TransportError{Err: io.ErrUnexpectedEOF}, fuse.Errno(syscall.ECONNRESET)},
+	} {
+		err := smbError(tc.err)
+		if got := translateError(err); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+		if tc.want == fuse.Errno(syscall.ECONNRESET) && !retryable(err) {
+			t.Errorf("%s: %v is not retried", tc.name, err)
+		}
+	}
+	if err := smbError(io.EOF); err != io.EOF {
+		t.Errorf("io.EOF became %v", err)
+	}
+}
+
+// TestSMBLoginFails checks that a server that drops the connection fails
+// the mount instead of hanging it
+func TestSMBLoginFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	creds, err := NewCredentials("DOMAIN\\einstein", "relativity", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewBackend("smb://"+l.Addr().String()+"/share/dir", creds); err == nil {
+		t.Error("logging in to a server that drops the connection succeeded")
+	}
+	if _, err = NewBackend("smb://server", nil); err == nil {
+		t.Error("a URL without share was accepted")
+	}
+}
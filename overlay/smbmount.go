@@ -0,0 +1,232 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/xattr"
+)
+
+func init() {
+	RegisterBackend("smb+mount", func(u *url.URL, creds *Credentials) (Backend, error) {
+		return NewMountedSMB(u, creds)
+	})
+}
+
+// smbMount is a mounted SMB share, source is //server/share
+type smbMount struct {
+	source string
+	dir    string
+}
+
+// MountedSMB is a Backend for a directory of an SMB share mounted by the
+// CIFS client of the kernel: mount.cifs on linux, mount_smbfs on macOS. It
+// is a local directory to the overlay, unlike SMB it does not talk to the
+// server itself, but going through the backend instead of mounting the share
+// as ROOT gives it the behavior of a remote store, cached attributes and
+// blocks, buffered uploads and retries, and the xattrs of the server.
+type MountedSMB struct {
+	share string
+	root  string
+}
+
+// NewMountedSMB returns a Backend for smb+mount://server/share/path. The
+// share must be mounted, the credentials are the ones it was mounted with.
+func NewMountedSMB(u *url.URL, creds *Credentials) (*MountedSMB, error) {
+	elems := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || elems[0] == "" {
+		return nil, fmt.Errorf("invalid SMB backend %q, expected smb+mount://server/share/path", u.String())
+	}
+	if creds != nil && (creds.User != "" || creds.Password != "" || creds.token != "") {
+		return nil, fmt.Errorf("smb+mount:// uses the credentials the share was mounted with, use smb:// to log in with -backend-user")
+	}
+	share := "//" + u.Hostname() + "/" + elems[0]
+	mounts, err := smbMounts()
+	if err != nil {
+		return nil, err
+	}
+	s := &MountedSMB{share: share}
+	for _, m := range mounts {
+		if sameShare(m.source, share) {
+			s.root = m.dir
+			break
+		}
+	}
+	if s.root == "" {
+		return nil, fmt.Errorf("share %s is not mounted, mount it with mount.cifs or mount_smbfs first", share)
+	}
+	if len(elems) > 1 {
+		s.root = filepath.Join(s.root, filepath.FromSlash(elems[1]))
+	}
+	fi, err := os.Stat(s.root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", s.root)
+	}
+	return s, nil
+}
+
+// sameShare reports whether the mount source src is the share //server/share.
+// Server and share names are case insensitive, macOS adds the user to the
+// source, //user@server/share.
+func sameShare(src string, share string) bool {
+	src = strings.TrimPrefix(src, "//")
+	if i := strings.Index(src, "@"); i >= 0 && i < strings.Index(src, "/") {
+		src = src[i+1:]
+	}
+	return strings.EqualFold(strings.TrimRight("//"+src, "/"), share)
+}
+
+// path returns the path of name in the mount of the share
+func (s *MountedSMB) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// smbInfo is the os.FileInfo of a file of the share with its xattrs, the
+// share has no etags
+type smbInfo struct {
+	os.FileInfo
+	p      string
+	once   sync.Once
+	xattrs map[string][]byte
+}
+
+// Xattrs implements xattrInfo for *smbInfo, the user xattrs are the
+// extended attributes of the file on the server
+func (i *smbInfo) Xattrs() map[string][]byte {
+	i.once.Do(func() {
+		names, err := xattr.LList(i.p)
+		if err != nil || len(names) == 0 {
+			return
+		}
+		i.xattrs = make(map[string][]byte, len(names))
+		for _, name := range names {
+			if v, err := xattr.LGet(i.p, name); err == nil {
+				i.xattrs[name] = v
+			}
+		}
+	})
+	return i.xattrs
+}
+
+// Stat implements Backend for *MountedSMB
+func (s *MountedSMB) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p := s.path(name)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return &smbInfo{FileInfo: fi, p: p}, nil
+}
+
+// ReadDir implements Backend for *MountedSMB
+func (s *MountedSMB) ReadDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	p := s.path(name)
+	fis, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(fis))
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), smbUploadPrefix) {
+			infos = append(infos, &smbInfo{FileInfo: fi, p: filepath.Join(p, fi.Name())})
+		}
+	}
+	return infos, nil
+}
+
+// ReadAt implements Backend for *MountedSMB
+func (s *MountedSMB) ReadAt(ctx context.Context, name string, p []byte, off int64) (int, error) {
+	file, err := os.Open(s.path(name))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(p, off)
+}
+
+// Upload implements Backend for *MountedSMB. The content is written to a new
+// file next to name that replaces it when it is complete, so readers on
+// other clients of the share never see a partial file.
+func (s *MountedSMB) Upload(ctx context.Context, name string, r io.Reader, size int64) (err error) {
+	p := s.path(name)
+	tmp := filepath.Join(filepath.Dir(p), smbUploadPrefix+newUUID()[:8]+"-"+filepath.Base(p))
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	n, err := io.Copy(file, &ctxReader{ctx: ctx, r: r})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return &os.PathError{Op: "upload", Path: name, Err: syscall.EIO}
+	}
+	return os.Rename(tmp, p)
+}
+
+// Mkdir implements Backend for *MountedSMB
+func (s *MountedSMB) Mkdir(ctx context.Context, name string) error {
+	return os.Mkdir(s.path(name), 0755)
+}
+
+// Remove implements Backend for *MountedSMB
+func (s *MountedSMB) Remove(ctx context.Context, name string) error {
+	return os.Remove(s.path(name))
+}
+
+// Rename implements Backend for *MountedSMB
+func (s *MountedSMB) Rename(ctx context.Context, oldName string, newName string) error {
+	return os.Rename(s.path(oldName), s.path(newName))
+}
+
+// Quota implements QuotaBackend for *MountedSMB with the size of the share
+func (s *MountedSMB) Quota(ctx context.Context) (int64, int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.root, &st); err != nil {
+		return 0, 0, &os.PathError{Op: "statfs", Path: s.root, Err: err}
+	}
+	bsize := int64(st.Bsize)
+	return (int64(st.Blocks) - int64(st.Bfree)) * bsize, int64(st.Bavail) * bsize, nil
+}
+
+// SetXattr implements XattrBackend for *MountedSMB, the server must support
+// extended attributes
+func (s *MountedSMB) SetXattr(ctx context.Context, name string, attr string, value []byte) error {
+	return xattrPathError(name, xattr.LSet(s.path(name), attr, value))
+}
+
+// RemoveXattr implements XattrBackend for *MountedSMB
+func (s *MountedSMB) RemoveXattr(ctx context.Context, name string, attr string) error {
+	return xattrPathError(name, xattr.LRemove(s.path(name), attr))
+}
+
+// xattrPathError returns an error of the xattr package as the
+// *os.PathError backends return
+func xattrPathError(name string, err error) error {
+	if e, ok := err.(*xattr.Error); ok {
+		return &os.PathError{Op: e.Op, Path: name, Err: e.Err}
+	}
+	return err
+}
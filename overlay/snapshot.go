@@ -0,0 +1,312 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+const (
+	// snapshotsName in the root lists the snapshots
+	snapshotsName = ".snapshots"
+	// snapshotsDir is the directory below the metaDir the snapshots are
+	// kept in
+	snapshotsDir = "snapshots"
+)
+
+// SnapshotInfo describes a snapshot of the upper layer
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// snapshots tracks the files of the upper layer that snapshots share. Files
+// are reflinked where the backing file system supports it and hard linked
+// otherwise, the hard linked ones get an inode of their own before they are
+// changed, see unshareSnapshot.
+type snapshots struct {
+	lock   sync.Mutex
+	linked map[fileID]bool
+}
+
+// any reports whether files are shared with snapshots
+func (s *snapshots) any() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.linked) > 0
+}
+
+func (s *snapshots) isLinked(id fileID) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.linked[id]
+}
+
+func (s *snapshots) link(id fileID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.linked == nil {
+		s.linked = make(map[fileID]bool)
+	}
+	s.linked[id] = true
+}
+
+// statID returns the id of the file of fi
+func statID(fi os.FileInfo) (id fileID, nlink uint64, ok bool) {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	return fileID{dev: uint64(s.Dev), ino: uint64(s.Ino)}, uint64(s.Nlink), true
+}
+
+// loadSnapshots records the files the snapshots of an earlier mount share
+// with the upper layer
+func (f *FS) loadSnapshots() {
+	linked := make(map[fileID]bool)
+	filepath.Walk(f.metaPath(snapshotsDir), func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		if id, nlink, ok := statID(fi); ok && nlink > 1 {
+			linked[id] = true
+		}
+		return nil
+	})
+	f.snaps.lock.Lock()
+	f.snaps.linked = linked
+	f.snaps.lock.Unlock()
+}
+
+// validSnapshotName reports whether name can name a snapshot
+func validSnapshotName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsRune(name, filepath.Separator)
+}
+
+// snapshotInfos lists the snapshots by name
+func (f *FS) snapshotInfos() []SnapshotInfo {
+	fis, _ := ioutil.ReadDir(f.metaPath(snapshotsDir))
+	infos := make([]SnapshotInfo, 0, len(fis))
+	for _, fi := range fis {
+		if fi.IsDir() && validSnapshotName(fi.Name()) {
+			infos = append(infos, SnapshotInfo{Name: fi.Name(), Created: fi.ModTime()})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// createSnapshot captures the upper layer as snapshot name. It is built
+// under a hidden name and renamed when complete, changes made meanwhile may
+// or may not be in it.
+func (f *FS) createSnapshot(ctx context.Context, name string) error {
+	if f.backend != nil {
+		return fmt.Errorf("snapshots need a local mount")
+	}
+	if !validSnapshotName(name) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	dst := f.metaPath(snapshotsDir, name)
+	if exists(dst) {
+		return fmt.Errorf("snapshot %s exists", name)
+	}
+	if err := os.MkdirAll(f.metaPath(snapshotsDir), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(f.metaPath(snapshotsDir), "."+name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	// directories get their times once their entries are in place
+	var dirs []string
+	err = filepath.Walk(f.rootPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = interrupted(ctx); err != nil {
+			return err
+		}
+		if p == f.rootPath {
+			return nil
+		}
+		if f.isMetaDir(filepath.Dir(p), fi.Name()) {
+			return filepath.SkipDir
+		}
+		target := filepath.Join(tmp, p)
+		switch {
+		case fi.IsDir():
+			if err = os.Mkdir(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			dirs = append(dirs, p)
+			return nil
+		case fi.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(p); err == nil {
+				err = os.Symlink(link, target)
+			}
+		case fi.Mode().IsRegular():
+			err = f.snapshotFile(ctx, target, p, fi)
+		default:
+			s, ok := fi.Sys().(*syscall.Stat_t)
+			if !ok {
+				return nil
+			}
+			err = syscall.Mknod(target, modeToSyscall(fi.Mode()), int(s.Rdev))
+		}
+		if err != nil {
+			return err
+		}
+		copyMetadata(target, p, fi)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if fi, err := os.Lstat(dirs[i]); err == nil {
+			copyMetadata(filepath.Join(tmp, dirs[i]), dirs[i], fi)
+		}
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	loog.Info(logFS, "created snapshot", "name", name)
+	return nil
+}
+
+// snapshotFile captures the regular file src as dst: as a reflink where the
+// file system supports them, as a hard link otherwise. Files that are open
+// are copied, their handles would change a hard linked snapshot.
+func (f *FS) snapshotFile(ctx context.Context, dst string, src string, fi os.FileInfo) error {
+	if !f.openFile(src) {
+		if err := cloneFile(dst, src, fi.Mode().Perm()); err == nil {
+			f.copyxattrs(dst, src)
+			return nil
+		}
+		if err := os.Link(src, dst); err == nil {
+			if id, _, ok := statID(fi); ok {
+				f.snaps.link(id)
+			}
+			return nil
+		}
+	}
+	if err := copyFile(ctx, dst, src, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	f.copyxattrs(dst, src)
+	return nil
+}
+
+// openFile reports whether a handle of the file at the upper path p is open
+func (f *FS) openFile(p string) bool {
+	for _, n := range f.registry.get(p) {
+		n.lock.RLock()
+		open := len(n.flushers) > 0
+		n.lock.RUnlock()
+		if open {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneFile creates dst as a reflink of src
+func cloneFile(dst string, src string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err = reflink(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// deleteSnapshot removes snapshot name
+func (f *FS) deleteSnapshot(name string) error {
+	if !validSnapshotName(name) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	dst := f.metaPath(snapshotsDir, name)
+	if !exists(dst) {
+		return fmt.Errorf("no snapshot %s", name)
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	f.loadSnapshots()
+	loog.Info(logFS, "deleted snapshot", "name", name)
+	return nil
+}
+
+// unshareSnapshot gives the upper file p an inode of its own if it is hard
+// linked into a snapshot, so changing it leaves the snapshot as it was.
+// f.clock must be held.
+func (f *FS) unshareSnapshot(ctx context.Context, p string) error {
+	if !f.snaps.any() {
+		return nil
+	}
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	id, nlink, ok := statID(fi)
+	if !ok || nlink < 2 || !f.snaps.isLinked(id) {
+		return nil
+	}
+	tmpDir := f.metaPath(copyUpTmp)
+	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(tmpDir, newUUID())
+	if err = copyFile(ctx, tmp, p, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	copyMetadata(tmp, p, fi)
+	f.copyxattrs(tmp, p)
+	if err = os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	loog.Debug(logFS, "unshared file from snapshot", "path", p)
+	return nil
+}
+
+// snapshotsView lists the snapshots for the .snapshots directory
+func (f *FS) snapshotsView() map[string]string {
+	m := make(map[string]string)
+	for _, s := range f.snapshotInfos() {
+		m[s.Name] = f.metaPath(snapshotsDir, s.Name)
+	}
+	return m
+}
+
+// dirView lists all entries of dir
+func dirView(dir string) map[string]string {
+	m := make(map[string]string)
+	fis, _ := ioutil.ReadDir(dir)
+	for _, fi := range fis {
+		m[fi.Name()] = filepath.Join(dir, fi.Name())
+	}
+	return m
+}
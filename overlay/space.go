@@ -0,0 +1,161 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// Space simulates a nearly full disk or an exhausted quota: Statfs reports
+// Limit as the size of the filesystem with the bytes written since as used,
+// writes that do not fit anymore and creates once nothing is left fail with
+// Err. The backing store is not filled.
+type Space struct {
+	Limit int64
+	Err   syscall.Errno
+}
+
+func (s Space) String() string {
+	return fmt.Sprintf("%d:%s", s.Limit, errnoName(s.Err))
+}
+
+// sizeSuffixes are the binary units a size may end with
+var sizeSuffixes = []struct {
+	suffix string
+	factor int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+}
+
+// ParseSize parses a positive size in bytes, e.g. 4096, or with a binary
+// unit, e.g. 64KiB or 1G
+func ParseSize(spec string) (int64, error) {
+	size, factor := spec, int64(1)
+	for _, u := range sizeSuffixes {
+		if strings.HasSuffix(size, u.suffix) {
+			size, factor = strings.TrimSuffix(size, u.suffix), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", spec)
+	}
+	return n * factor, nil
+}
+
+// ParseSpace parses size[:errno], e.g. 10MiB or 1G:EDQUOT. The size is in
+// bytes or has a binary unit, the errno defaults to ENOSPC. An empty spec
+// disables the simulation.
+func ParseSpace(spec string) (Space, error) {
+	if spec == "" {
+		return Space{}, nil
+	}
+	s := Space{Err: syscall.ENOSPC}
+	parts := strings.SplitN(spec, ":", 2)
+	var err error
+	if s.Limit, err = ParseSize(parts[0]); err != nil {
+		return s, fmt.Errorf("invalid space limit %q, expected size[:errno]", spec)
+	}
+	if len(parts) == 2 {
+		if s.Err, err = ParseErrno(parts[1]); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// spaceLimit counts the bytes written against a Space
+type spaceLimit struct {
+	// used is first for the alignment of atomic operations
+	used int64
+	Space
+}
+
+// spaceLimit returns the simulated space, nil if disabled
+func (f *FS) spaceLimit() *spaceLimit {
+	f.ctl.RLock()
+	defer f.ctl.RUnlock()
+	return f.space
+}
+
+// setSpace replaces the simulated space with a ParseSpace spec and starts
+// counting from 0 again, "off" disables it
+func (f *FS) setSpace(value string) error {
+	if value == "off" {
+		value = ""
+	}
+	s, err := ParseSpace(value)
+	if err != nil {
+		return err
+	}
+	f.ctl.Lock()
+	defer f.ctl.Unlock()
+	f.space = nil
+	if s.Limit > 0 {
+		f.space = &spaceLimit{Space: s}
+	}
+	return nil
+}
+
+// reserveSpace accounts for a write of n bytes, it fails if they do not fit
+// into the simulated space
+func (f *FS) reserveSpace(n int64) error {
+	s := f.spaceLimit()
+	if s == nil {
+		return nil
+	}
+	if atomic.AddInt64(&s.used, n) > s.Limit {
+		atomic.AddInt64(&s.used, -n)
+		loog.Debug(logFault, "simulated space exhausted", "op", OpWrite, "size", n, "error", s.Err)
+		return fuse.Errno(s.Err)
+	}
+	return nil
+}
+
+// spaceFault fails creating a file, directory or link once the simulated
+// space is used up
+func (f *FS) spaceFault(op Op) error {
+	switch op {
+	case OpCreate, OpMkdir, OpMknod, OpSymlink:
+	default:
+		return nil
+	}
+	s := f.spaceLimit()
+	if s == nil || atomic.LoadInt64(&s.used) < s.Limit {
+		return nil
+	}
+	loog.Debug(logFault, "simulated space exhausted", "op", op, "error", s.Err)
+	return fuse.Errno(s.Err)
+}
+
+// limitStatfs reports the simulated space in resp
+func (f *FS) limitStatfs(resp *fuse.StatfsResponse) {
+	s := f.spaceLimit()
+	if s == nil {
+		return
+	}
+	// df counts in fragments if their size is set
+	unit := uint64(resp.Frsize)
+	if unit == 0 {
+		unit = uint64(resp.Bsize)
+	}
+	if unit == 0 {
+		unit = 4096
+	}
+	free := s.Limit - atomic.LoadInt64(&s.used)
+	if free < 0 {
+		free = 0
+	}
+	resp.Blocks = uint64(s.Limit) / unit
+	resp.Bfree = uint64(free) / unit
+	resp.Bavail = resp.Bfree
+}
@@ -0,0 +1,315 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// spacesRefresh is how long the list of spaces is cached
+const spacesRefresh = 10 * time.Second
+
+// drive is a storage space as returned by the libregraph API of oCIS
+type drive struct {
+	ID                   string    `json:"id"`
+	Name                 string    `json:"name"`
+	DriveType            string    `json:"driveType"`
+	LastModifiedDateTime time.Time `json:"lastModifiedDateTime"`
+	Root                 struct {
+		WebDavURL string `json:"webDavUrl"`
+	} `json:"root"`
+	Quota struct {
+		Total     int64 `json:"total"`
+		Used      int64 `json:"used"`
+		Remaining int64 `json:"remaining"`
+	} `json:"quota"`
+}
+
+// driveTypeOrder sorts the spaces, the personal space comes first
+var driveTypeOrder = map[string]int{"personal": 0, "project": 1, "virtual": 2, "mountpoint": 3}
+
+// space is a storage space mounted as a top level directory
+type space struct {
+	drive
+	dav *WebDAV
+}
+
+// Spaces is a Backend for the storage spaces of an oCIS user: the personal
+// space, project spaces and received shares. The root lists them as
+// directories, everything below is stored in the WebDAV collection of the
+// space.
+type Spaces struct {
+	graph *WebDAV
+
+	lock   sync.Mutex
+	spaces map[string]*space
+	expiry time.Time
+}
+
+func init() {
+	newSpaces := func(u *url.URL, creds *Credentials) (Backend, error) {
+		return NewSpaces(u, creds)
+	}
+	RegisterBackend("ocis", newSpaces)
+	RegisterBackend("ocis+http", newSpaces)
+}
+
+// NewSpaces returns a Backend for the spaces of the oCIS instance at u, an
+// ocis:// URL uses https, ocis+http:// plain http. All spaces are accessed
+// with creds.
+func NewSpaces(u *url.URL, creds *Credentials) (*Spaces, error) {
+	base := *u
+	base.Scheme = "https"
+	if u.Scheme == "ocis+http" {
+		base.Scheme = "http"
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/graph/v1.0"
+	graph, err := NewWebDAV(base.String(), creds)
+	if err != nil {
+		return nil, err
+	}
+	return &Spaces{graph: graph}, nil
+}
+
+// list returns the spaces by directory name
+func (s *Spaces) list(ctx context.Context) (map[string]*space, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.spaces != nil && time.Now().Before(s.expiry) {
+		return s.spaces, nil
+	}
+	resp, err := s.graph.do(ctx, "GET", "me/drives", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var drives struct {
+		Value []drive `json:"value"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&drives); err != nil {
+		return nil, &os.PathError{Op: "GET", Path: "me/drives", Err: err}
+	}
+	sort.Slice(drives.Value, func(i, j int) bool {
+		a, b := drives.Value[i], drives.Value[j]
+		if driveTypeOrder[a.DriveType] != driveTypeOrder[b.DriveType] {
+			return driveTypeOrder[a.DriveType] < driveTypeOrder[b.DriveType]
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	spaces := make(map[string]*space, len(drives.Value))
+	for _, d := range drives.Value {
+		if d.Root.WebDavURL == "" {
+			continue
+		}
+		name := spaceDirName(d)
+		for i := 2; spaces[name] != nil; i++ {
+			name = fmt.Sprintf("%s (%d)", spaceDirName(d), i)
+		}
+		sp := &space{drive: d}
+		if old := s.spaces[name]; old != nil && old.ID == d.ID {
+			sp.dav = old.dav
+		} else if sp.dav, err = NewWebDAV(d.Root.WebDavURL, s.graph.creds); err != nil {
+			return nil, err
+		} else {
+			// the spaces share the connections, and the simulated flakiness
+			sp.dav.client = s.graph.client
+		}
+		spaces[name] = sp
+	}
+	s.spaces = spaces
+	s.expiry = time.Now().Add(spacesRefresh)
+	return spaces, nil
+}
+
+// spaceDirName returns the directory name of a space, names must not
+// contain slashes
+func spaceDirName(d drive) string {
+	name := d.Name
+	switch d.DriveType {
+	case "personal":
+		name = "Personal"
+	case "virtual":
+		name = "Shares"
+	}
+	return strings.Replace(name, "/", "_", -1)
+}
+
+// resolve returns the space of name and the name within the space. The root
+// has no space.
+func (s *Spaces) resolve(ctx context.Context, name string) (*space, string, error) {
+	if name == "" {
+		return nil, "", nil
+	}
+	elems := strings.SplitN(name, "/", 2)
+	spaces, err := s.list(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	sp := spaces[elems[0]]
+	if sp == nil {
+		return nil, "", &os.PathError{Op: "stat", Path: name, Err: syscall.ENOENT}
+	}
+	if len(elems) == 1 {
+		return sp, "", nil
+	}
+	return sp, elems[1], nil
+}
+
+// resolveBelow is resolve for files within a space. Top level entries are
+// the spaces themselves, they cannot be changed through the mount.
+func (s *Spaces) resolveBelow(ctx context.Context, op string, name string) (*space, string, error) {
+	if !strings.Contains(name, "/") {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.EACCES}
+	}
+	return s.resolve(ctx, name)
+}
+
+func (sp *space) info(name string) os.FileInfo {
+	return &davInfo{name: name, mtime: sp.LastModifiedDateTime, isDir: true, id: sp.ID}
+}
+
+// Stat implements Backend for *Spaces
+func (s *Spaces) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	sp, rel, err := s.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if sp == nil {
+		return &davInfo{name: "/", isDir: true}, nil
+	}
+	if rel == "" {
+		return sp.info(name), nil
+	}
+	return sp.dav.Stat(ctx, rel)
+}
+
+// ReadDir implements Backend for *Spaces
+func (s *Spaces) ReadDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	sp, rel, err := s.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if sp != nil {
+		return sp.dav.ReadDir(ctx, rel)
+	}
+	spaces, err := s.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fis := make([]os.FileInfo, 0, len(spaces))
+	for name, sp := range spaces {
+		fis = append(fis, sp.info(name))
+	}
+	return fis, nil
+}
+
+// ReadAt implements Backend for *Spaces
+func (s *Spaces) ReadAt(ctx context.Context, name string, p []byte, off int64) (int, error) {
+	sp, rel, err := s.resolveBelow(ctx, "read", name)
+	if err != nil {
+		return 0, err
+	}
+	return sp.dav.ReadAt(ctx, rel, p, off)
+}
+
+// Upload implements Backend for *Spaces
+func (s *Spaces) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	sp, rel, err := s.resolveBelow(ctx, "upload", name)
+	if err != nil {
+		return err
+	}
+	return sp.dav.Upload(ctx, rel, r, size)
+}
+
+// UploadResumable implements ResumableBackend for *Spaces
+func (s *Spaces) UploadResumable(ctx context.Context, name string,
+	r io.ReaderAt, size int64, progress func(int64)) error {
+	sp, rel, err := s.resolveBelow(ctx, "upload", name)
+	if err != nil {
+		return err
+	}
+	return sp.dav.UploadResumable(ctx, rel, r, size, progress)
+}
+
+// Mkdir implements Backend for *Spaces
+func (s *Spaces) Mkdir(ctx context.Context, name string) error {
+	sp, rel, err := s.resolveBelow(ctx, "mkdir", name)
+	if err != nil {
+		return err
+	}
+	return sp.dav.Mkdir(ctx, rel)
+}
+
+// Remove implements Backend for *Spaces
+func (s *Spaces) Remove(ctx context.Context, name string) error {
+	sp, rel, err := s.resolveBelow(ctx, "remove", name)
+	if err != nil {
+		return err
+	}
+	return sp.dav.Remove(ctx, rel)
+}
+
+// Rename implements Backend for *Spaces, files cannot be moved between
+// spaces
+func (s *Spaces) Rename(ctx context.Context, oldName string, newName string) error {
+	sp, oldRel, err := s.resolveBelow(ctx, "rename", oldName)
+	if err != nil {
+		return err
+	}
+	newSpace, newRel, err := s.resolveBelow(ctx, "rename", newName)
+	if err != nil {
+		return err
+	}
+	if newSpace.ID != sp.ID {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: syscall.EXDEV}
+	}
+	return sp.dav.Rename(ctx, oldRel, newRel)
+}
+
+// Quota implements QuotaBackend for *Spaces with the quota of the personal
+// space
+func (s *Spaces) Quota(ctx context.Context) (used int64, available int64, err error) {
+	spaces, err := s.list(ctx)
+	if err != nil {
+		return 0, -1, err
+	}
+	for _, sp := range spaces {
+		if sp.DriveType == "personal" {
+			return sp.quota()
+		}
+	}
+	return 0, -1, nil
+}
+
+// QuotaOf implements PathQuotaBackend for *Spaces
+func (s *Spaces) QuotaOf(ctx context.Context, name string) (used int64, available int64, err error) {
+	sp, _, err := s.resolve(ctx, name)
+	if err != nil {
+		return 0, -1, err
+	}
+	if sp == nil {
+		return s.Quota(ctx)
+	}
+	return sp.quota()
+}
+
+// quota returns the quota of the space, a total of 0 is unlimited
+func (sp *space) quota() (used int64, available int64, err error) {
+	if sp.Quota.Total <= 0 {
+		return sp.Quota.Used, -1, nil
+	}
+	return sp.Quota.Used, sp.Quota.Remaining, nil
+}
@@ -0,0 +1,307 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// statsName in the metaDir is a read-only file with the Stats as JSON. The
+// metaDir is not listed in the root, but can be looked up, so scripts on the
+// machine can read .ocis-overlay/stats in the mount.
+const statsName = "stats"
+
+// Stats are counters of the requests answered by an overlay since it was
+// mounted
+type Stats struct {
+	Since time.Time `json:"since"`
+	// Ops and Errors count the answered and the failed requests by the
+	// fuse operation, e.g. Lookup or Read
+	Ops    map[string]uint64 `json:"ops"`
+	Errors map[string]uint64 `json:"errors"`
+	// BytesRead and BytesWritten sum up the I/O through file handles
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+	// Caches are the hits and misses of the caches of the overlay: listings
+	// answer lookups after a directory read, page_cache counts the opens
+	// that kept the kernel page cache, fds the uses of handles that found
+	// their backing file still open and blocks the reads of remote blocks
+	Caches map[string]CacheStats `json:"caches"`
+}
+
+// CacheStats are the hits and misses of a cache
+type CacheStats struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// cacheCounter counts hits and misses, the counters are first for the
+// alignment of atomic operations
+type cacheCounter struct {
+	hits   uint64
+	misses uint64
+}
+
+func (c *cacheCounter) count(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *cacheCounter) stats() CacheStats {
+	s := CacheStats{Hits: atomic.LoadUint64(&c.hits), Misses: atomic.LoadUint64(&c.misses)}
+	if s.Hits+s.Misses > 0 {
+		s.HitRate = float64(s.Hits) / float64(s.Hits+s.Misses)
+	}
+	return s
+}
+
+// opCounter counts the requests of an operation
+type opCounter struct {
+	ops    uint64
+	errors uint64
+}
+
+// stats collects the counters of an FS
+type stats struct {
+	// bytesRead and bytesWritten are first for the alignment of atomic
+	// operations
+	bytesRead    int64
+	bytesWritten int64
+
+	listings  cacheCounter
+	pageCache cacheCounter
+	fds       cacheCounter
+	blocks    cacheCounter
+	blockDisk cacheCounter
+
+	since time.Time
+
+	lock sync.RWMutex
+	ops  map[string]*opCounter
+}
+
+func newStats() *stats {
+	return &stats{since: time.Now().UTC(), ops: make(map[string]*opCounter)}
+}
+
+// answered counts a request of op, errno is empty for successful ones
+func (s *stats) answered(op string, errno string) {
+	s.lock.RLock()
+	c := s.ops[op]
+	s.lock.RUnlock()
+	if c == nil {
+		s.lock.Lock()
+		if c = s.ops[op]; c == nil {
+			c = &opCounter{}
+			s.ops[op] = c
+		}
+		s.lock.Unlock()
+	}
+	atomic.AddUint64(&c.ops, 1)
+	if errno != "" {
+		atomic.AddUint64(&c.errors, 1)
+	}
+}
+
+// Stats returns the counters of the overlay
+func (f *FS) Stats() *Stats {
+	s := &Stats{
+		Since:        f.stats.since,
+		Ops:          make(map[string]uint64),
+		Errors:       make(map[string]uint64),
+		BytesRead:    atomic.LoadInt64(&f.stats.bytesRead),
+		BytesWritten: atomic.LoadInt64(&f.stats.bytesWritten),
+		Caches: map[string]CacheStats{
+			"listings":   f.stats.listings.stats(),
+			"page_cache": f.stats.pageCache.stats(),
+			"fds":        f.stats.fds.stats(),
+		},
+	}
+	if f.backend != nil {
+		s.Caches["blocks"] = f.stats.blocks.stats()
+		if f.blocks.disk != nil {
+			s.Caches["block_disk"] = f.stats.blockDisk.stats()
+		}
+	}
+	f.stats.lock.RLock()
+	defer f.stats.lock.RUnlock()
+	for op, c := range f.stats.ops {
+		s.Ops[op] = atomic.LoadUint64(&c.ops)
+		if e := atomic.LoadUint64(&c.errors); e > 0 {
+			s.Errors[op] = e
+		}
+	}
+	return s
+}
+
+// debug receives the debug messages of the fuse server. Responses are
+// counted and end the span of their request. The message types are not
+// exported, their fields are read by reflection.
+func (f *FS) debug(msg interface{}) {
+	fuse.Debug(msg)
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	op, errno, hdr := v.FieldByName("Op"), v.FieldByName("Errno"), v.FieldByName("Request")
+	if op.Kind() != reflect.String || errno.Kind() != reflect.String || hdr.Kind() != reflect.Struct {
+		// not a response
+		return
+	}
+	id := hdr.FieldByName("ID")
+	if id.Kind() != reflect.Uint64 {
+		return
+	}
+	e := errno.String()
+	if m := v.FieldByName("Error"); e == "" && m.Kind() == reflect.String {
+		// requests for forgotten nodes only carry the errno name here
+		e = m.String()
+	}
+	f.answered(fuse.RequestID(id.Uint()), op.String(), e)
+	if f.tracer != nil {
+		var out interface{}
+		if o := v.FieldByName("Out"); o.IsValid() {
+			out = o.Interface()
+		}
+		f.tracer.answered(fuse.RequestID(id.Uint()), e, out)
+	}
+}
+
+// metaView is the metaDir as seen through the mount, it only has the stats
+// file
+type metaView struct {
+	fs *FS
+}
+
+// metaLookup returns the node of the metaDir
+func (f *FS) metaLookup(resp *fuse.LookupResponse) fs.Node {
+	metaViewAttr(&resp.Attr)
+	resp.EntryValid = 0
+	return &metaView{fs: f}
+}
+
+func metaViewAttr(a *fuse.Attr) {
+	a.Mode = os.ModeDir | 0555
+	a.Mtime = time.Now()
+	a.Valid = 0
+}
+
+var _ fs.Node = (*metaView)(nil)
+
+// Attr implements fs.Node interface for *metaView
+func (d *metaView) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	if err = d.fs.enter(ctx, OpAttr, d); err != nil {
+		return err
+	}
+	metaViewAttr(a)
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*metaView)(nil)
+
+// Lookup implements fs.NodeRequestLookuper interface for *metaView
+func (d *metaView) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (ret fs.Node, err error) {
+	if err = d.fs.enter(ctx, OpLookup, d); err != nil {
+		return nil, err
+	}
+	if req.Name != statsName {
+		return nil, fuse.ENOENT
+	}
+	statsAttr(&resp.Attr)
+	resp.EntryValid = 0
+	return &statsFile{fs: d.fs}, nil
+}
+
+var _ fs.HandleReadDirAller = (*metaView)(nil)
+
+// ReadDirAll implements fs.HandleReadDirAller interface for *metaView
+func (d *metaView) ReadDirAll(ctx context.Context) (dirs []fuse.Dirent, err error) {
+	if err = d.fs.enter(ctx, OpReadDir, d); err != nil {
+		return nil, err
+	}
+	return []fuse.Dirent{{Name: statsName, Type: fuse.DT_File}}, nil
+}
+
+// statsFile is the node of the stats file
+type statsFile struct {
+	fs *FS
+}
+
+func statsAttr(a *fuse.Attr) {
+	a.Mode = 0444
+	a.Mtime = time.Now()
+	a.Valid = 0
+}
+
+var _ fs.Node = (*statsFile)(nil)
+
+// Attr implements fs.Node interface for *statsFile
+func (n *statsFile) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	if err = n.fs.enter(ctx, OpAttr, n); err != nil {
+		return err
+	}
+	statsAttr(a)
+	return nil
+}
+
+var _ fs.NodeOpener = (*statsFile)(nil)
+
+// Open implements fs.NodeOpener interface for *statsFile. Every open reads a
+// snapshot of the counters, direct I/O keeps the size of 0 from cutting it
+// off.
+func (n *statsFile) Open(ctx context.Context,
+	req *fuse.OpenRequest, resp *fuse.OpenResponse) (h fs.Handle, err error) {
+	if err = n.fs.enter(ctx, OpOpen, n); err != nil {
+		return nil, err
+	}
+	defer func() { loog.Debug(logFS, "Open", "path", metaDir+"/"+statsName, "error", err) }()
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	b, err := json.MarshalIndent(n.fs.Stats(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return &statsHandle{fs: n.fs, data: append(b, '\n')}, nil
+}
+
+// statsHandle is an open stats file
+type statsHandle struct {
+	fs   *FS
+	data []byte
+}
+
+var _ fs.HandleReader = (*statsHandle)(nil)
+
+// Read implements fs.HandleReader interface for *statsHandle
+func (h *statsHandle) Read(ctx context.Context,
+	req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	if err = h.fs.enter(ctx, OpRead, h); err != nil {
+		return err
+	}
+	if req.Offset < int64(len(h.data)) {
+		end := req.Offset + int64(req.Size)
+		if end > int64(len(h.data)) {
+			end = int64(len(h.data))
+		}
+		resp.Data = append(resp.Data[:0], h.data[req.Offset:end]...)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
+)
+
+// Store holds the files of a local mount, the upper directory and its lower
+// layers. Node and Handle do their I/O through it, names are the backing
+// paths. Errors are returned like the os package returns them, so
+// translateError can map them.
+type Store interface {
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	OpenFile(name string, flags int, perm os.FileMode) (File, error)
+	Mkdir(name string, perm os.FileMode) error
+	// Mknod creates a special file, mode carries its type
+	Mknod(name string, mode os.FileMode, dev int) error
+	Symlink(target string, name string) error
+	Readlink(name string) (string, error)
+	Link(oldName string, newName string) error
+	// Remove removes the empty directory name if dir is set, like rmdir,
+	// and the file name otherwise, like unlink
+	Remove(name string, dir bool) error
+	Rename(oldName string, newName string) error
+	Truncate(name string, size int64) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid int, gid int) error
+	// Utimens sets the times of name without following symlinks, nil
+	// times are left alone
+	Utimens(name string, atime *time.Time, mtime *time.Time) error
+
+	GetXattr(name string, attr string) ([]byte, error)
+	ListXattr(name string) ([]string, error)
+	SetXattr(name string, attr string, value []byte, flags int) error
+	RemoveXattr(name string, attr string) error
+
+	// OpenDir opens the directory name for the operations on its entries
+	OpenDir(name string) (StoreDir, error)
+}
+
+// StoreDir is a directory opened in a Store. Its operations keep working on
+// the same directory when it is renamed or replaced while they run. They
+// take the name of the entry in the directory and p, the current path of
+// the entry, for errors and for stores that cannot address every entry
+// through the directory.
+type StoreDir interface {
+	OpenFile(name string, p string, flags int, perm os.FileMode) (File, error)
+	Lstat(name string, p string) (os.FileInfo, error)
+	Mkdir(name string, p string, perm os.FileMode) error
+	Symlink(target string, name string, p string) error
+	// Link creates name as a hard link to the path oldName of the store
+	Link(oldName string, name string, p string) error
+	Remove(name string, p string, dir bool) error
+	// Rename renames oldName, at the path op, to newName in newDir, a
+	// directory opened in the same store
+	Rename(oldName string, op string, newDir StoreDir, newName string) error
+	Close() error
+}
+
+// File is a file opened in a Store, *os.File implements it
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Readdir(n int) ([]os.FileInfo, error)
+	Sync() error
+}
+
+// osStore is the Store of the backing file system
+type osStore struct{}
+
+var _ Store = osStore{}
+
+func (osStore) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osStore) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osStore) OpenFile(name string, flags int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flags, perm)
+	if err != nil {
+		// not a File holding a nil *os.File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osStore) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (osStore) Mknod(name string, mode os.FileMode, dev int) error {
+	return syscall.Mknod(name, modeToSyscall(mode), dev)
+}
+
+func (osStore) Symlink(target string, name string) error {
+	return os.Symlink(target, name)
+}
+
+func (osStore) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osStore) Link(oldName string, newName string) error {
+	return os.Link(oldName, newName)
+}
+
+func (osStore) Remove(name string, dir bool) error {
+	if dir {
+		return atError("rmdir", name, unix.Rmdir(name))
+	}
+	return atError("unlink", name, unix.Unlink(name))
+}
+
+func (osStore) Rename(oldName string, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osStore) Truncate(name string, size int64) error {
+	return syscall.Truncate(name, size)
+}
+
+func (osStore) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osStore) Chown(name string, uid int, gid int) error {
+	return os.Chown(name, uid, gid)
+}
+
+func (osStore) Utimens(name string, atime *time.Time, mtime *time.Time) error {
+	return utimens(name, atime, mtime)
+}
+
+func (osStore) GetXattr(name string, attr string) ([]byte, error) {
+	return xattr.Get(name, attr)
+}
+
+func (osStore) ListXattr(name string) ([]string, error) {
+	return xattr.List(name)
+}
+
+func (osStore) SetXattr(name string, attr string, value []byte, flags int) error {
+	return xattr.SetWithFlags(name, attr, value, flags)
+}
+
+func (osStore) RemoveXattr(name string, attr string) error {
+	return xattr.Remove(name, attr)
+}
+
+func (osStore) OpenDir(name string) (StoreDir, error) {
+	fd, err := unix.Open(name, openDirFlags, 0)
+	if err != nil {
+		return nil, atError("open", name, err)
+	}
+	return osDir(fd), nil
+}
+
+// osDir is a directory descriptor for the *at syscalls
+type osDir int
+
+func atError(op string, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+func (d osDir) OpenFile(name string, p string, flags int, perm os.FileMode) (File, error) {
+	fd, err := unix.Openat(int(d), name, flags|unix.O_CLOEXEC, permToSyscall(perm))
+	if err != nil {
+		return nil, atError("openat", p, err)
+	}
+	return os.NewFile(uintptr(fd), p), nil
+}
+
+func (d osDir) Lstat(name string, p string) (os.FileInfo, error) {
+	return lstatAt(int(d), p, name)
+}
+
+func (d osDir) Mkdir(name string, p string, perm os.FileMode) error {
+	return atError("mkdirat", p, unix.Mkdirat(int(d), name, permToSyscall(perm)))
+}
+
+func (d osDir) Symlink(target string, name string, p string) error {
+	return atError("symlinkat", p, unix.Symlinkat(target, int(d), name))
+}
+
+func (d osDir) Link(oldName string, name string, p string) error {
+	return atError("linkat", p, unix.Linkat(unix.AT_FDCWD, oldName, int(d), name, 0))
+}
+
+func (d osDir) Remove(name string, p string, dir bool) error {
+	flags := 0
+	if dir {
+		flags = unix.AT_REMOVEDIR
+	}
+	return atError("unlinkat", p, unix.Unlinkat(int(d), name, flags))
+}
+
+func (d osDir) Rename(oldName string, op string, newDir StoreDir, newName string) error {
+	nd, ok := newDir.(osDir)
+	if !ok {
+		return atError("renameat", op, unix.EXDEV)
+	}
+	return atError("renameat", op, unix.Renameat(int(d), oldName, int(nd), newName))
+}
+
+func (d osDir) Close() error {
+	return unix.Close(int(d))
+}
@@ -0,0 +1,107 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// recordingStore is the backing file system, recording the operations
+// called on it
+type recordingStore struct {
+	osStore
+	lock sync.Mutex
+	ops  map[string]int
+}
+
+func (s *recordingStore) record(op string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ops[op]++
+}
+
+func (s *recordingStore) called(op string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ops[op]
+}
+
+func (s *recordingStore) OpenDir(name string) (StoreDir, error) {
+	s.record("opendir")
+	return s.osStore.OpenDir(name)
+}
+
+func (s *recordingStore) OpenFile(name string, flags int, perm os.FileMode) (File, error) {
+	s.record("open")
+	return s.osStore.OpenFile(name, flags, perm)
+}
+
+func (s *recordingStore) Truncate(name string, size int64) error {
+	s.record("truncate")
+	return s.osStore.Truncate(name, size)
+}
+
+func (s *recordingStore) Chmod(name string, mode os.FileMode) error {
+	s.record("chmod")
+	return s.osStore.Chmod(name, mode)
+}
+
+func (s *recordingStore) Readlink(name string) (string, error) {
+	s.record("readlink")
+	return s.osStore.Readlink(name)
+}
+
+func (s *recordingStore) SetXattr(name string, attr string, value []byte, flags int) error {
+	s.record("setxattr")
+	return s.osStore.SetXattr(name, attr, value, flags)
+}
+
+// TestStoreRoutesNodeIO checks that nodes and handles reach the backing
+// file system through the store of the FS.
+func TestStoreRoutesNodeIO(t *testing.T) {
+	f, root := stressFS(t, Options{})
+	s := &recordingStore{ops: make(map[string]int)}
+	f.store = s
+	ctx := context.Background()
+
+	created, h, err := root.Create(ctx,
+		&fuse.CreateRequest{Name: "a", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := created.(*Node)
+	if err = h.(*Handle).Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "l", Target: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "l"}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = link.(*Node).Readlink(ctx, &fuse.ReadlinkRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	h2, err := n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2.(*Handle).Release(ctx, &fuse.ReleaseRequest{})
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrMode, Size: 3, Mode: 0600}
+	if err = n.Setattr(ctx, req, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	n.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.test", Xattr: []byte("v")})
+
+	for _, op := range []string{"opendir", "open", "readlink", "truncate", "chmod", "setxattr"} {
+		if s.called(op) == 0 {
+			t.Errorf("%s did not go through the store", op)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// stressRounds is how often every goroutine of the stress tests repeats its
+// operation, run them with go test -race
+const stressRounds = 200
+
+// stressFS returns an overlay of a new temporary directory and its root. The
+// overlay reaches its backing directory through the working directory.
+func stressFS(t *testing.T, o Options) (*FS, *Node) {
+	dir, err := ioutil.TempDir("", "ocis-overlay-stress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	f, err := NewFS(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := f.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, root.(*Node)
+}
+
+// TestStressSameNode runs reads, writes, truncates, chmods, flushes and
+// renames of the same file concurrently, through one shared handle and
+// handles of their own, like the kernel does with parallel dispatch.
+func TestStressSameNode(t *testing.T) {
+	_, root := stressFS(t, Options{})
+	ctx := context.Background()
+	created, shared, err := root.Create(ctx,
+		&fuse.CreateRequest{Name: "a", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := created.(*Node)
+	handles := []*Handle{shared.(*Handle)}
+	for i := 0; i < 3; i++ {
+		h, err := n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, h.(*Handle))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	run := func(name string, op func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < stressRounds; i++ {
+				if err := op(i); err != nil {
+					errs <- fmt.Errorf("%s %d: %v", name, i, err)
+					return
+				}
+			}
+		}()
+	}
+	for j, h := range handles {
+		h := h
+		data := []byte(fmt.Sprintf("handle %d|", j))
+		run(fmt.Sprintf("write %d", j), func(i int) error {
+			return h.Write(ctx, &fuse.WriteRequest{Offset: int64(i%16) * 64, Data: data}, &fuse.WriteResponse{})
+		})
+		run(fmt.Sprintf("read %d", j), func(i int) error {
+			return h.Read(ctx, &fuse.ReadRequest{Offset: int64(i%16) * 64, Size: 128}, &fuse.ReadResponse{})
+		})
+	}
+	run("truncate", func(i int) error {
+		return n.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: uint64(i%8) * 128}, &fuse.SetattrResponse{})
+	})
+	run("chmod", func(i int) error {
+		return n.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: os.FileMode(0600 | i%2*0044)}, &fuse.SetattrResponse{})
+	})
+	run("flush", func(i int) error {
+		return handles[i%len(handles)].Flush(ctx, &fuse.FlushRequest{})
+	})
+	run("attr", func(i int) error {
+		var a fuse.Attr
+		return n.Attr(ctx, &a)
+	})
+	// one goroutine renames the file back and forth, the others keep using
+	// the node and handles while its path changes
+	run("rename", func(i int) error {
+		from, to := "a", "b"
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		return root.Rename(ctx, &fuse.RenameRequest{OldName: from, NewName: to}, root)
+	})
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, h := range handles {
+		if err := h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+			t.Error(err)
+		}
+	}
+	var a fuse.Attr
+	if err := n.Attr(ctx, &a); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(fi.Size()) != a.Size {
+		t.Errorf("the node has size %d, its file %d", a.Size, fi.Size())
+	}
+}
+
+// TestStressSameDir creates, renames and removes files of the same
+// directory concurrently while it is listed
+func TestStressSameDir(t *testing.T) {
+	_, root := stressFS(t, Options{})
+	ctx := context.Background()
+	dir, err := root.Open(ctx, &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for j := 0; j < 4; j++ {
+		j := j
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < stressRounds; i++ {
+				name, moved := fmt.Sprintf("f%d-%d", j, i), fmt.Sprintf("g%d-%d", j, i)
+				_, h, err := root.Create(ctx,
+					&fuse.CreateRequest{Name: name, Flags: fuse.OpenWriteOnly | fuse.OpenCreate | fuse.OpenExclusive, Mode: 0644}, &fuse.CreateResponse{})
+				if err == nil {
+					err = h.(*Handle).Release(ctx, &fuse.ReleaseRequest{})
+				}
+				if err == nil {
+					err = root.Rename(ctx, &fuse.RenameRequest{OldName: name, NewName: moved}, root)
+				}
+				if err == nil && i%2 == 0 {
+					err = root.Remove(ctx, &fuse.RemoveRequest{Name: moved})
+				}
+				if err != nil {
+					errs <- fmt.Errorf("goroutine %d round %d: %v", j, i, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < stressRounds; i++ {
+			if _, err := dir.(*Handle).ReadDirAll(ctx); err != nil {
+				errs <- fmt.Errorf("listing %d: %v", i, err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	dirs, err := dir.(*Handle).ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 4 * stressRounds / 2; len(dirs) != want {
+		t.Errorf("listed %d entries, want %d", len(dirs), want)
+	}
+}
+
+// TestSerialInterrupt checks that a request waiting for its turn under
+// -serialize can be interrupted and gets it once the request before it was
+// answered.
+func TestSerialInterrupt(t *testing.T) {
+	f, _ := stressFS(t, Options{Serialize: true})
+	i := serialInterceptor{f}
+	first, second := &Request{ID: 1}, &Request{ID: 2}
+	firstCtx := context.WithValue(context.Background(), requestKey{}, first)
+	if err := i.Before(firstCtx, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Before(firstCtx, first); err != nil {
+		t.Fatalf("entering a second handler of the request: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), requestKey{}, second))
+	cancel()
+	if err := i.Before(ctx, second); err != errInterrupted {
+		t.Fatalf("an interrupted request waiting for its turn returned %v, want EINTR", err)
+	}
+	i.After(ctx, second, "EINTR")
+	i.After(firstCtx, first, "")
+	if err := i.Before(context.WithValue(context.Background(), requestKey{}, second), second); err != nil {
+		t.Fatal(err)
+	}
+}
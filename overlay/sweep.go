@@ -0,0 +1,66 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// The kernel forgets nodes one by one: bazil.org/fuse negotiates protocol
+// 7.12 and FUSE_BATCH_FORGET needs 7.16, so Forget sees every node. Nodes of
+// files removed behind the back of the mount are only forgotten once the
+// kernel drops their dentries, the sweeper drops them earlier.
+
+// sweepNodesPeriodically runs sweepNodes every interval
+func (f *FS) sweepNodesPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		f.sweepNodes()
+	}
+}
+
+// sweepNodes drops the nodes of paths that vanished from the backing store
+// and tells the kernel to forget their entries. It returns the number of
+// dropped paths.
+func (f *FS) sweepNodes() (swept int) {
+	for _, n := range f.registry.all() {
+		p := n.getRealPath()
+		if p == f.rootPath {
+			continue
+		}
+		if _, err := os.Lstat(n.resolvedPath()); !os.IsNotExist(err) {
+			continue
+		}
+		f.registry.remove(p)
+		f.invalidateEntry(filepath.Dir(p), filepath.Base(p))
+		swept++
+	}
+	atomic.AddUint64(&f.sweptNodes, uint64(swept))
+	if swept > 0 {
+		loog.Debug(logFS, "swept nodes", "count", swept)
+	}
+	return swept
+}
+
+// invalidateEntry drops the kernel's dentry of name in the directory dir.
+// Like invalidateData it does not wait for the kernel.
+func (f *FS) invalidateEntry(dir string, name string) {
+	if f.server == nil {
+		return
+	}
+	parents := f.registry.get(dir)
+	if len(parents) == 0 {
+		return
+	}
+	go func() {
+		err := f.server.InvalidateEntry(parents[0], name)
+		if err != nil && err != fuse.ErrNotCached {
+			loog.Warn(logFS, "could not invalidate entry", "path", filepath.Join(dir, name), "error", err)
+		}
+	}()
+}
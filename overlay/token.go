@@ -0,0 +1,301 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+const (
+	// tokenRefreshMargin is how long before it expires a token is refreshed
+	tokenRefreshMargin = time.Minute
+	// tokenRefreshTimeout limits a request to the token endpoint
+	tokenRefreshTimeout = 30 * time.Second
+	// keyringService is the service the secrets of the overlay are stored
+	// under in the keyring
+	keyringService = "ocis-overlay"
+)
+
+// Credentials authenticate the requests to a remote backend, all WebDAV
+// clients of a backend share them. A bearer token is used instead of user
+// and password if set. With a refresh token and the token endpoint of an
+// OpenID Connect provider the token is refreshed before it expires, and
+// once more when the backend rejects it.
+type Credentials struct {
+	User     string
+	Password string
+
+	tokenURL string
+	clientID string
+	client   *http.Client
+
+	lock         sync.Mutex
+	token        string
+	expiry       time.Time
+	refreshToken string
+}
+
+// NewCredentials returns the credentials for user and password or a token,
+// token is a ReadSecret spec
+func NewCredentials(user string, password string, token string) (*Credentials, error) {
+	c := &Credentials{User: user, Password: password, client: &http.Client{Timeout: tokenRefreshTimeout}}
+	if token != "" {
+		if err := c.SetToken(token); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// ReadSecret returns the secret of a spec: "env:NAME" reads the environment
+// variable NAME, "keyring:ACCOUNT" looks up ACCOUNT of the ocis-overlay
+// service in the keyring of the user, secret-tool on linux and the login
+// keychain on darwin. Anything else is the secret itself.
+func ReadSecret(spec string) (string, error) {
+	switch {
+	case strings.HasPrefix(spec, "env:"):
+		name := strings.TrimPrefix(spec, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(spec, "keyring:"):
+		account := strings.TrimPrefix(spec, "keyring:")
+		out, err := keyringCommand(account).Output()
+		if err != nil {
+			return "", fmt.Errorf("could not read %s from the keyring: %v", account, err)
+		}
+		v := strings.TrimSpace(string(out))
+		if v == "" {
+			return "", fmt.Errorf("no secret for %s in the keyring", account)
+		}
+		return v, nil
+	default:
+		return spec, nil
+	}
+}
+
+// SetRefresh refreshes the token with the refresh token grant at the token
+// endpoint tokenURL, refreshToken is a ReadSecret spec
+func (c *Credentials) SetRefresh(tokenURL string, clientID string, refreshToken string) error {
+	if u, err := url.Parse(tokenURL); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid token endpoint %q", tokenURL)
+	}
+	rt, err := ReadSecret(refreshToken)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tokenURL, c.clientID, c.refreshToken = tokenURL, clientID, rt
+	return nil
+}
+
+// SetToken replaces the token with the one of a ReadSecret spec
+func (c *Credentials) SetToken(spec string) error {
+	token, err := ReadSecret(spec)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.token, c.expiry = token, tokenExpiry(token)
+	return nil
+}
+
+// Refresh gets a new token with the refresh token
+func (c *Credentials) Refresh(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.refresh(ctx)
+}
+
+// refresh is Refresh, c.lock must be held
+func (c *Credentials) refresh(ctx context.Context) error {
+	if c.refreshToken == "" {
+		return fmt.Errorf("no refresh token")
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {c.refreshToken},
+	}
+	if c.clientID != "" {
+		form.Set("client_id", c.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var tr struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil && resp.StatusCode == http.StatusOK {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		return fmt.Errorf("token refresh failed: %s %s", resp.Status, tr.Error)
+	}
+	c.token, c.expiry = tr.AccessToken, tokenExpiry(tr.AccessToken)
+	if tr.ExpiresIn > 0 {
+		c.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	// providers may rotate the refresh token
+	if tr.RefreshToken != "" {
+		c.refreshToken = tr.RefreshToken
+	}
+	loog.Info(logRemote, "refreshed token", "expiry", c.expiry)
+	return nil
+}
+
+// authorize sets the Authorization header of req, the token is refreshed
+// first if it is about to expire
+func (c *Credentials) authorize(req *http.Request) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	if c.refreshToken != "" && (c.token == "" || !c.expiry.IsZero() && time.Until(c.expiry) < tokenRefreshMargin) {
+		if err := c.refresh(req.Context()); err != nil {
+			loog.Warn(logRemote, "could not refresh token", "error", err)
+		}
+	}
+	token := c.token
+	c.lock.Unlock()
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case c.User != "":
+		req.SetBasicAuth(c.User, c.Password)
+	}
+}
+
+// rejected is called when the backend answered req with 401. It returns
+// true if there is a different token to retry req with: another request
+// got one in the meantime, or the token could be refreshed.
+func (c *Credentials) rejected(req *http.Request) bool {
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.token != "" && req.Header.Get("Authorization") != "Bearer "+c.token {
+		return true
+	}
+	if c.refreshToken != "" {
+		err := c.refresh(req.Context())
+		if err == nil {
+			return true
+		}
+		loog.Warn(logRemote, "could not refresh rejected token", "error", err)
+	}
+	loog.Warn(logRemote, "backend rejected the credentials, set a new token with the token control command",
+		"url", req.URL.String())
+	return false
+}
+
+// tokenExpiry returns the expiry in the exp claim of a JWT, without
+// verifying it, or the zero time for opaque tokens
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp json.Number `json:"exp"`
+	}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err = d.Decode(&claims); err != nil {
+		return time.Time{}
+	}
+	exp, err := claims.Exp.Float64()
+	if err != nil || exp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(exp), 0)
+}
+
+// backendCredentials returns the credentials of backend, nil for backends
+// without
+func backendCredentials(backend Backend) *Credentials {
+	switch b := backend.(type) {
+	case *WebDAV:
+		return b.creds
+	case *Spaces:
+		return b.graph.creds
+	default:
+		return nil
+	}
+}
+
+// setToken replaces the token of the backend with a ReadSecret spec, an
+// empty value or "refresh" refreshes it with the refresh token. On a
+// multi-user mount the value may start with the uid of the user whose token
+// it is.
+func (f *FS) setToken(value string) error {
+	backend := f.backend
+	if fields := strings.Fields(value); f.userRoots != nil && len(fields) > 0 {
+		if uid, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+			root := f.userRoots[uint32(uid)]
+			if root == nil {
+				return fmt.Errorf("no backend for uid %d", uid)
+			}
+			backend, value = root.backend, strings.Join(fields[1:], " ")
+		}
+	}
+	c := backendCredentials(backend)
+	if c == nil {
+		return fmt.Errorf("no remote backend")
+	}
+	if value == "" || value == "refresh" {
+		ctx, cancel := context.WithTimeout(context.Background(), tokenRefreshTimeout)
+		defer cancel()
+		return c.Refresh(ctx)
+	}
+	return c.SetToken(value)
+}
+
+// redactToken returns the value of a token control command for the log,
+// tokens given as they are must not end up there
+func redactToken(value string) string {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return value
+	}
+	spec := fields[len(fields)-1]
+	if spec == "refresh" || strings.HasPrefix(spec, "env:") || strings.HasPrefix(spec, "keyring:") {
+		return value
+	}
+	if _, err := strconv.ParseUint(spec, 10, 32); err == nil && len(fields) == 1 {
+		return value
+	}
+	fields[len(fields)-1] = "***"
+	return strings.Join(fields, " ")
+}
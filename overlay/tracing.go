@@ -0,0 +1,452 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// Every fuse request is traced as a span, the calls to the remote backend
+// made while handling it as its children. The backend gets the trace context
+// in a W3C traceparent header. Spans are exported to an OpenTelemetry
+// collector with OTLP over HTTP in its JSON encoding. Requests taking longer
+// than the slow operation threshold are logged, with or without an export.
+
+const (
+	// spanQueueSize is the number of finished spans buffered for the
+	// exporter, more are dropped while the collector is slow or unreachable
+	spanQueueSize = 8192
+	// spanBatchSize spans are exported in one request, pending spans at
+	// least every spanBatchDelay
+	spanBatchSize  = 512
+	spanBatchDelay = 5 * time.Second
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+	statusError    = 2
+)
+
+type spanKey struct{}
+
+// traced is implemented by the nodes and handles, the path is only looked up
+// for traced requests
+type traced interface {
+	tracePath() string
+}
+
+func (n *Node) tracePath() string         { return n.getRealPath() }
+func (h *Handle) tracePath() string       { return h.node.getRealPath() }
+func (n *remoteNode) tracePath() string   { return n.path() }
+func (h *remoteHandle) tracePath() string { return h.node.path() }
+func (d *virtualDir) tracePath() string   { return d.name }
+func (n *healthFile) tracePath() string   { return healthName }
+func (h *healthHandle) tracePath() string { return healthName }
+func (d *metaView) tracePath() string     { return metaDir }
+func (n *statsFile) tracePath() string    { return metaDir + "/" + statsName }
+func (h *statsHandle) tracePath() string  { return metaDir + "/" + statsName }
+func (f *FS) tracePath() string           { return "" }
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	// IntValue is an int64, encoded as a string like all 64 bit integers
+	// of OTLP
+	IntValue *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func stringAttr(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+type otlpStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// span is a traced fuse request or backend call
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	kind     int
+	name     string
+	start    time.Time
+	// queue is the number of requests in flight when the request came in
+	queue int
+
+	// req is kept for the recorder
+	req fuse.Request
+
+	lock  sync.Mutex
+	op    Op
+	path  string
+	attrs []otlpAttribute
+	// target is the new path of a rename or link, the target of a symlink
+	// or the name of a changed xattr, reported by the handler with the
+	// path it changed
+	target string
+}
+
+// spanOf returns the span of the request of ctx, nil if it is not traced
+func spanOf(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// setOp records the overlay operation and the path of the node a request
+// is handled by
+func (s *span) setOp(op Op, p string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.op, s.path = op, p
+}
+
+// setAudit records the path and target a handler changed, see FS.audit
+func (s *span) setAudit(p string, target string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.path, s.target = p, target
+}
+
+// traceparent returns the W3C trace context of s
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// end logs s if it was slow and queues it for the export, errno is empty
+// for successful operations
+func (s *span) end(errno string) {
+	end := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d := end.Sub(s.start); s.kind == spanKindServer && s.tracer.slowOp > 0 && d >= s.tracer.slowOp {
+		loog.Warn(logFS, "slow operation", "op", s.op, "request", s.name, "path", s.path,
+			"duration", d, "queue", s.queue, "error", errno)
+	}
+	if s.tracer.spans == nil {
+		return
+	}
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.op != "" {
+		o.Attributes = append(o.Attributes, stringAttr("fuse.op", string(s.op)), stringAttr("fuse.path", s.path))
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if errno != "" {
+		o.Attributes = append(o.Attributes, stringAttr("fuse.errno", errno))
+		o.Status = &otlpStatus{Code: statusError, Message: errno}
+	}
+	select {
+	case s.tracer.spans <- o:
+	default:
+		atomic.AddInt64(&s.tracer.dropped, 1)
+	}
+}
+
+// startCall starts a child span for a backend call made while handling the
+// request of ctx, nil if the request is not traced or spans are not exported
+func startCall(ctx context.Context, name string) *span {
+	parent := spanOf(ctx)
+	if parent == nil || parent.tracer.spans == nil {
+		return nil
+	}
+	s := &span{tracer: parent.tracer, traceID: parent.traceID, parentID: parent.spanID,
+		kind: spanKindClient, name: name, start: time.Now()}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// endCall ends the span of a backend call for the remote path p
+func (s *span) endCall(p string, err error) {
+	s.lock.Lock()
+	s.attrs = append(s.attrs, stringAttr("backend.path", p))
+	s.lock.Unlock()
+	errno := ""
+	if err != nil {
+		errno = fuse.ToErrno(translateError(err)).ErrnoName()
+	}
+	s.end(errno)
+}
+
+// tracer starts a span for every fuse request, it logs the slow ones and
+// exports them all if an endpoint is configured
+type tracer struct {
+	// dropped counts the spans dropped since the last export, first for the
+	// alignment of atomic operations
+	dropped int64
+
+	slowOp time.Duration
+	// recorder writes every answered request to a file, nil if disabled
+	recorder *recorder
+
+	// spans is nil without an endpoint
+	url      string
+	client   *http.Client
+	resource otlpResource
+	spans    chan otlpSpan
+	flushes  chan chan struct{}
+
+	lock   sync.Mutex
+	active map[fuse.RequestID]*span
+}
+
+// newTracer returns a tracer exporting to the OTLP/HTTP endpoint, e.g.
+// http://localhost:4318, logging requests taking slowOp or longer and
+// recording them to the file record. The path of the endpoint defaults to
+// /v1/traces. Without an endpoint spans are only timed, 0 does not log slow
+// requests and an empty record does not record them.
+func newTracer(endpoint string, slowOp time.Duration, record string) (*tracer, error) {
+	t := &tracer{slowOp: slowOp, active: make(map[fuse.RequestID]*span)}
+	if record != "" {
+		r, err := newRecorder(record)
+		if err != nil {
+			return nil, err
+		}
+		t.recorder = r
+	}
+	if endpoint == "" {
+		return t, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported OTLP endpoint %q, expected http:// or https://", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	t.url = u.String()
+	t.client = &http.Client{Timeout: 10 * time.Second}
+	t.spans = make(chan otlpSpan, spanQueueSize)
+	t.flushes = make(chan chan struct{})
+	t.resource.Attributes = []otlpAttribute{stringAttr("service.name", "ocis-overlay")}
+	if host, err := os.Hostname(); err == nil {
+		t.resource.Attributes = append(t.resource.Attributes, stringAttr("host.name", host))
+	}
+	go t.run()
+	return t, nil
+}
+
+// withSpan starts the span of req, it is the WithContext function of the
+// fuse server when tracing. The attributes are only collected for the
+// export.
+func (t *tracer) withSpan(ctx context.Context, req fuse.Request) context.Context {
+	ctx = withCaller(ctx, req)
+	h := req.Hdr()
+	s := &span{tracer: t, kind: spanKindServer, start: time.Now(),
+		name: "fuse." + requestName(req)}
+	if t.recorder != nil {
+		s.req = req
+	}
+	ctx = context.WithValue(ctx, spanKey{}, s)
+	t.lock.Lock()
+	s.queue = len(t.active)
+	t.active[h.ID] = s
+	t.lock.Unlock()
+	if t.spans == nil {
+		return ctx
+	}
+	ids := make([]byte, len(s.traceID)+len(s.spanID))
+	rand.Read(ids)
+	copy(s.traceID[:], ids)
+	copy(s.spanID[:], ids[len(s.traceID):])
+	s.attrs = []otlpAttribute{
+		intAttr("fuse.request_id", int64(h.ID)),
+		intAttr("fuse.node_id", int64(h.Node)),
+		intAttr("fuse.uid", int64(h.Uid)),
+		intAttr("fuse.gid", int64(h.Gid)),
+		intAttr("fuse.pid", int64(h.Pid)),
+	}
+	switch r := req.(type) {
+	case *fuse.ReadRequest:
+		s.attrs = append(s.attrs, intAttr("fuse.offset", r.Offset), intAttr("fuse.size", int64(r.Size)))
+	case *fuse.WriteRequest:
+		s.attrs = append(s.attrs, intAttr("fuse.offset", r.Offset), intAttr("fuse.size", int64(len(r.Data))))
+	case *fuse.SetattrRequest:
+		if r.Valid.Size() {
+			s.attrs = append(s.attrs, intAttr("fuse.size", int64(r.Size)))
+		}
+	case *fuse.LookupRequest:
+		s.attrs = append(s.attrs, stringAttr("fuse.name", r.Name))
+	case *fuse.CreateRequest:
+		s.attrs = append(s.attrs, stringAttr("fuse.name", r.Name))
+	case *fuse.MkdirRequest:
+		s.attrs = append(s.attrs, stringAttr("fuse.name", r.Name))
+	case *fuse.MknodRequest:
+		s.attrs = append(s.attrs, stringAttr("fuse.name", r.Name))
+	case *fuse.SymlinkRequest:
+		s.attrs = append(s.attrs, stringAttr("fuse.name", r.NewName))
+	case *fuse.LinkRequest:
+		s.attrs = append(s.attrs, stringAttr("fuse.name", r.NewName))
+	case *fuse.RemoveRequest:
+		s.attrs = append(s.attrs, stringAttr("fuse.name", r.Name))
+	case *fuse.RenameRequest:
+		s.attrs = append(s.attrs, stringAttr("fuse.name", r.OldName), stringAttr("fuse.new_name", r.NewName))
+	}
+	return ctx
+}
+
+// answered ends the span of the request id and records it, out is the
+// response
+func (t *tracer) answered(id fuse.RequestID, errno string, out interface{}) {
+	t.lock.Lock()
+	s := t.active[id]
+	delete(t.active, id)
+	t.lock.Unlock()
+	if s == nil {
+		return
+	}
+	s.end(errno)
+	if t.recorder != nil {
+		t.recorder.record(s, errno, out)
+	}
+}
+
+func (t *tracer) run() {
+	var batch []otlpSpan
+	tick := time.NewTicker(spanBatchDelay)
+	defer tick.Stop()
+	for {
+		var flushed chan struct{}
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) < spanBatchSize {
+				continue
+			}
+		case <-tick.C:
+		case flushed = <-t.flushes:
+		drain:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					break drain
+				}
+			}
+		}
+		if len(batch) > 0 {
+			if err := t.export(batch); err != nil {
+				loog.Warn(logTrace, "could not export spans", "spans", len(batch), "error", err)
+			}
+			batch = nil
+		}
+		if n := atomic.SwapInt64(&t.dropped, 0); n > 0 {
+			loog.Warn(logTrace, "span queue full, dropped spans", "spans", n)
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+func (t *tracer) export(spans []otlpSpan) error {
+	b, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: t.resource,
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/butonic/ocis-overlay"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// flushTraces exports the finished spans and closes the recording
+func (f *FS) flushTraces() {
+	if f.tracer == nil {
+		return
+	}
+	if f.tracer.recorder != nil {
+		f.tracer.recorder.close()
+	}
+	if f.tracer.spans == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	f.tracer.flushes <- flushed
+	<-flushed
+}
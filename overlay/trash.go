@@ -0,0 +1,214 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// xattrs of a trash entry
+const (
+	trashOriginAttr    = "user.ocis.trash.origin"
+	trashTimestampAttr = "user.ocis.trash.timestamp"
+	trashSizeAttr      = "user.ocis.trash.size"
+)
+
+// trashEntry is a removed file in the trash of a user. Every entry is a
+// directory named by a random id that holds the file under its original name.
+type trashEntry struct {
+	path    string
+	origin  string
+	deleted time.Time
+	size    int64
+}
+
+// trashDir returns the trash directory of uid
+func (f *FS) trashDir(uid uint32) string {
+	return f.metaPath("trash", strconv.FormatUint(uint64(uid), 10))
+}
+
+// trashChild moves the upper file name into the trash of uid instead of
+// unlinking it. It reports false if there is no upper file to move, e.g.
+// because it only exists in a lower layer, which keeps its content anyway.
+// Directories are never trashed, rmdir only removes empty ones.
+func (n *Node) trashChild(ctx context.Context, name string, uid uint32) (trashed bool, err error) {
+	rp := n.getRealPath()
+	p := filepath.Join(rp, name)
+	fi, err := os.Lstat(p)
+	if err != nil || fi.IsDir() {
+		return false, nil
+	}
+	entry := filepath.Join(n.fs.trashDir(uid), newUUID())
+	if err = os.MkdirAll(entry, 0700); err != nil {
+		return false, err
+	}
+	tp := filepath.Join(entry, name)
+	if err = os.Rename(p, tp); err != nil {
+		os.Remove(entry)
+		return false, err
+	}
+	for attr, value := range map[string]string{
+		trashOriginAttr:    p,
+		trashTimestampAttr: time.Now().UTC().Format(time.RFC3339Nano),
+		trashSizeAttr:      strconv.FormatInt(fi.Size(), 10),
+	} {
+		if err := n.fs.writeXattr(entry, attr, []byte(value)); err != nil {
+			loog.Warn(logRemove, "could not record trash metadata", "path", entry, "error", err)
+		}
+	}
+	loog.Debug(logRemove, "moved to trash", "path", p, "trash", tp)
+	n.fs.purgeTrash(n.fs.trashDir(uid))
+
+	if n.fs.overlay() {
+		if _, lfi := n.fs.lowerChildren(rp, n.getLowerPaths(), name); lfi != nil {
+			if err = n.copyUp(ctx); err != nil {
+				return true, err
+			}
+			return true, createWhiteout(rp, name)
+		}
+	}
+	return true, nil
+}
+
+// trashEntries returns the entries of the trash directory dir, oldest first
+func (f *FS) trashEntries(dir string) []trashEntry {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	entries := make([]trashEntry, 0, len(fis))
+	for _, fi := range fis {
+		e := trashEntry{path: filepath.Join(dir, fi.Name()), deleted: fi.ModTime()}
+		if v, err := f.readXattr(e.path, trashOriginAttr); err == nil {
+			e.origin = string(v)
+		}
+		if v, err := f.readXattr(e.path, trashTimestampAttr); err == nil {
+			if t, err := time.Parse(time.RFC3339Nano, string(v)); err == nil {
+				e.deleted = t
+			}
+		}
+		if v, err := f.readXattr(e.path, trashSizeAttr); err == nil {
+			e.size, _ = strconv.ParseInt(string(v), 10, 64)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].deleted.Before(entries[j].deleted) })
+	return entries
+}
+
+// purgeTrash deletes the entries of the trash directory dir that are older
+// than the maximum age, and the oldest ones while the trash exceeds the
+// maximum size
+func (f *FS) purgeTrash(dir string) {
+	if f.trashMaxAge <= 0 && f.trashMaxSize <= 0 {
+		return
+	}
+	entries := f.trashEntries(dir)
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	now := time.Now()
+	for _, e := range entries {
+		expired := f.trashMaxAge > 0 && now.Sub(e.deleted) > f.trashMaxAge
+		if !expired && (f.trashMaxSize <= 0 || total <= f.trashMaxSize) {
+			continue
+		}
+		if err := os.RemoveAll(e.path); err != nil {
+			loog.Warn(logRemove, "could not purge trash entry", "path", e.path, "error", err)
+			continue
+		}
+		total -= e.size
+		loog.Debug(logRemove, "purged trash entry", "path", e.path, "origin", e.origin)
+		f.emit(EventItemPurged, e.origin, "")
+	}
+}
+
+// purgeTrashPeriodically applies the maximum age to the trash of all users
+func (f *FS) purgeTrashPeriodically() {
+	interval := f.trashMaxAge / 10
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		fis, err := ioutil.ReadDir(f.metaPath("trash"))
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			f.purgeTrash(f.metaPath("trash", fi.Name()))
+		}
+	}
+}
+
+// TrashInfo describes an entry in the trash of a user
+type TrashInfo struct {
+	// Name is the name of the entry in the .trash directory
+	Name    string    `json:"name"`
+	Origin  string    `json:"origin"`
+	Deleted time.Time `json:"deleted"`
+	Size    int64     `json:"size"`
+}
+
+// trashInfos lists the trash of uid, oldest first
+func (f *FS) trashInfos(uid uint32) []TrashInfo {
+	entries := f.trashEntries(f.trashDir(uid))
+	infos := make([]TrashInfo, 0, len(entries))
+	for _, e := range entries {
+		fis, err := ioutil.ReadDir(e.path)
+		if err != nil || len(fis) != 1 {
+			continue
+		}
+		infos = append(infos, TrashInfo{
+			Name:    fis[0].Name() + "@" + e.deleted.UTC().Format(versionTimeFormat),
+			Origin:  e.origin,
+			Deleted: e.deleted,
+			Size:    e.size,
+		})
+	}
+	return infos
+}
+
+// restoreTrash moves the entry name of the trash of uid back to where it was
+// removed from. It fails if something else took its place in the meantime.
+func (f *FS) restoreTrash(uid uint32, name string) error {
+	p, ok := f.trashView(f.trashDir(uid))[name]
+	if !ok {
+		return fmt.Errorf("no trash entry %q", name)
+	}
+	entry := filepath.Dir(p)
+	v, err := f.readXattr(entry, trashOriginAttr)
+	if err != nil {
+		return fmt.Errorf("unknown origin of trash entry %q: %v", name, err)
+	}
+	origin := string(v)
+	if exists(origin) {
+		return fmt.Errorf("cannot restore %q, %s exists", name, origin)
+	}
+	if err = os.Rename(p, origin); err != nil {
+		return err
+	}
+	dir, base := filepath.Dir(origin), filepath.Base(origin)
+	if f.overlay() {
+		if err := os.Remove(whiteoutPath(dir, base)); err != nil && !os.IsNotExist(err) {
+			loog.Warn(logRemove, "could not remove whiteout of restored file", "path", origin, "error", err)
+		}
+	}
+	os.Remove(entry)
+	f.forgetListings(dir)
+	f.invalidateEntry(dir, base)
+	loog.Info(logRemove, "restored from trash", "path", origin, "trash", p)
+	return nil
+}
@@ -0,0 +1,180 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// Uploads with the TUS resumable upload protocol, https://tus.io/protocols/resumable-upload.html
+const (
+	tusVersion = "1.0.0"
+	// tusMinSize is the size from which files are uploaded with TUS, smaller
+	// ones are sent with a single PUT
+	tusMinSize = 10 << 20
+	// tusChunkSize is the size of a PATCH request
+	tusChunkSize = 10 << 20
+	// tusRetries is how often an upload is resumed without progress before
+	// it fails
+	tusRetries = 5
+	// tusBackoff is the wait before the first resume, it doubles with every
+	// failed attempt
+	tusBackoff = time.Second
+)
+
+// errOffsetMismatch is returned for a PATCH that does not continue at the
+// offset the server has, the upload resumes at the server's offset
+var errOffsetMismatch = errors.New("upload offset mismatch")
+
+// supportsTUS asks the server once whether it accepts TUS uploads
+func (w *WebDAV) supportsTUS(ctx context.Context) bool {
+	w.tusOnce.Do(func() {
+		resp, err := w.do(ctx, "OPTIONS", "", nil, nil)
+		if err != nil {
+			loog.Warn(logRemote, "could not detect TUS support", "error", err)
+			return
+		}
+		resp.Body.Close()
+		w.tus = resp.Header.Get("Tus-Resumable") != "" &&
+			strings.Contains(resp.Header.Get("Tus-Extension"), "creation")
+		loog.Info(logRemote, "detected TUS support", "tus", w.tus)
+	})
+	return w.tus
+}
+
+// UploadResumable implements ResumableBackend for *WebDAV. Large files are
+// uploaded with TUS if the server supports it, in chunks, and resumed after
+// network failures and server errors.
+func (w *WebDAV) UploadResumable(ctx context.Context, name string,
+	r io.ReaderAt, size int64, progress func(int64)) error {
+	if size < tusMinSize || !w.supportsTUS(ctx) {
+		if err := w.Upload(ctx, name, io.NewSectionReader(r, 0, size), size); err != nil {
+			return err
+		}
+		progress(size)
+		return nil
+	}
+	loc, err := w.tusCreate(ctx, name, size)
+	if err != nil {
+		return err
+	}
+	var off int64
+	for failures := 0; off < size; {
+		n, err := w.tusPatch(ctx, loc, name, r, off, size)
+		if err == nil {
+			off = n
+			failures = 0
+			progress(off)
+			continue
+		}
+		if failures++; failures > tusRetries || !transient(err) || ctx.Err() != nil {
+			return err
+		}
+		wait := tusBackoff << uint(failures-1)
+		loog.Warn(logRemote, "upload interrupted, resuming", "path", name, "offset", off, "wait", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return errInterrupted
+		}
+		if n, err := w.tusOffset(ctx, loc, name); err == nil {
+			off = n
+		}
+	}
+	return nil
+}
+
+// transient reports whether a failed chunk may succeed when retried, TUS
+// uploads also retry server errors and all network errors
+func transient(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return !ok || errno == syscall.EIO || retryable(errno)
+}
+
+// tusCreate creates an upload for name and returns its URL
+func (w *WebDAV) tusCreate(ctx context.Context, name string, size int64) (string, error) {
+	header := http.Header{
+		"Tus-Resumable":   {tusVersion},
+		"Upload-Length":   {strconv.FormatInt(size, 10)},
+		"Upload-Metadata": {"filename " + base64.StdEncoding.EncodeToString([]byte(path.Base(name)))},
+	}
+	req, err := w.request(ctx, "POST", path.Dir(name), nil, header)
+	if err != nil {
+		return "", err
+	}
+	resp, err := w.send(req, name)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	loc, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return "", &os.PathError{Op: "POST", Path: name, Err: syscall.EIO}
+	}
+	return loc.String(), nil
+}
+
+// tusPatch sends the next chunk from off and returns the new offset
+func (w *WebDAV) tusPatch(ctx context.Context, loc string, name string,
+	r io.ReaderAt, off int64, size int64) (int64, error) {
+	n := size - off
+	if n > tusChunkSize {
+		n = tusChunkSize
+	}
+	header := http.Header{
+		"Tus-Resumable": {tusVersion},
+		"Upload-Offset": {strconv.FormatInt(off, 10)},
+		"Content-Type":  {"application/offset+octet-stream"},
+	}
+	req, err := w.requestURL(ctx, "PATCH", loc, io.NewSectionReader(r, off, n), header)
+	if err != nil {
+		return off, err
+	}
+	req.ContentLength = n
+	resp, err := w.send(req, name, http.StatusConflict)
+	if err != nil {
+		return off, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return off, &os.PathError{Op: "PATCH", Path: name, Err: errOffsetMismatch}
+	}
+	return w.tusOffsetOf(resp, name)
+}
+
+// tusOffset asks the server how much of an upload it has
+func (w *WebDAV) tusOffset(ctx context.Context, loc string, name string) (int64, error) {
+	req, err := w.requestURL(ctx, "HEAD", loc, nil, http.Header{"Tus-Resumable": {tusVersion}})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := w.send(req, name)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return w.tusOffsetOf(resp, name)
+}
+
+func (w *WebDAV) tusOffsetOf(resp *http.Response, name string) (int64, error) {
+	off, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, &os.PathError{Op: resp.Request.Method, Path: name, Err: syscall.EIO}
+	}
+	return off, nil
+}
@@ -0,0 +1,109 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// LoadUserCredentials reads the credentials of the users of a multi-user
+// mount from the file at p. Every line is "uid token" or "uid user
+// password", token and password are ReadSecret specs. Empty lines and lines
+// starting with # are ignored.
+func LoadUserCredentials(p string) (map[uint32]*Credentials, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := make(map[uint32]*Credentials)
+	s := bufio.NewScanner(file)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid uid %q", p, line, fields[0])
+		}
+		if users[uint32(uid)] != nil {
+			return nil, fmt.Errorf("%s:%d: duplicate uid %d", p, line, uid)
+		}
+		var c *Credentials
+		switch len(fields) {
+		case 2:
+			c, err = NewCredentials("", "", fields[1])
+		case 3:
+			var password string
+			if password, err = ReadSecret(fields[2]); err == nil {
+				c, err = NewCredentials(fields[1], password, "")
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: expected uid token or uid user password", p, line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", p, line, err)
+		}
+		users[uint32(uid)] = c
+	}
+	return users, s.Err()
+}
+
+// newUserRoots returns the roots of the trees of the users of a multi-user
+// mount, nil if there are no user backends. The user running the overlay
+// keeps the tree of the main backend unless it has a backend of its own.
+func (f *FS) newUserRoots(backends map[uint32]Backend) map[uint32]*remoteNode {
+	if len(backends) == 0 {
+		return nil
+	}
+	roots := make(map[uint32]*remoteNode, len(backends)+1)
+	for uid, b := range backends {
+		roots[uid] = newRemoteRoot(f, b, uid)
+	}
+	if _, ok := roots[f.remoteRoot.uid]; !ok {
+		roots[f.remoteRoot.uid] = f.remoteRoot
+	}
+	loog.Info(logRemote, "multi-user mount", "users", len(roots))
+	return roots
+}
+
+// remoteRoots returns the roots of all remote trees
+func (f *FS) remoteRoots() []*remoteNode {
+	if f.userRoots == nil {
+		if f.remoteRoot == nil {
+			return nil
+		}
+		return []*remoteNode{f.remoteRoot}
+	}
+	roots := make([]*remoteNode, 0, len(f.userRoots))
+	for _, root := range f.userRoots {
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// route returns the node the caller of ctx works on. On a multi-user mount
+// the root the kernel knows stands for the root of the caller's tree, and
+// the trees of other users are off limits: route returns nil for them and
+// for callers without a tree.
+func (n *remoteNode) route(ctx context.Context) *remoteNode {
+	if n.fs.userRoots == nil {
+		return n
+	}
+	uid := callerOf(ctx).Uid
+	if n == n.fs.remoteRoot {
+		return n.fs.userRoots[uid]
+	}
+	if n.uid != uid {
+		return nil
+	}
+	return n
+}
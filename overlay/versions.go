@@ -0,0 +1,100 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// versionTimeFormat names versions by the mtime of their content. It has a
+// fixed width, so versions sort by name.
+const versionTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// versionsDir returns the directory holding the versions of the upper path
+// p. It mirrors the tree of the mount, so renaming a directory moves the
+// versions of everything below it along.
+func (f *FS) versionsDir(p string) string {
+	return f.metaPath("versions", p)
+}
+
+// snapshot keeps the current content of the regular upper file p as a
+// version before it is overwritten. Empty files are not kept.
+func (f *FS) snapshot(ctx context.Context, p string) {
+	if !f.versions {
+		return
+	}
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return
+	}
+	dir := f.versionsDir(p)
+	v := filepath.Join(dir, fi.ModTime().UTC().Format(versionTimeFormat))
+	if exists(v) {
+		// the content did not change since the last version
+		return
+	}
+	if err = os.MkdirAll(dir, 0700); err == nil {
+		err = copyFile(ctx, v, p, fi.Mode().Perm())
+	}
+	if err != nil {
+		loog.Warn(logIO, "could not keep version", "path", p, "version", v, "error", err)
+		return
+	}
+	os.Chtimes(v, fi.ModTime(), fi.ModTime())
+	loog.Debug(logIO, "kept version", "path", p, "version", v)
+	f.pruneVersions(dir)
+}
+
+// pruneVersions deletes the versions in dir that exceed the retention
+// limits, oldest first
+func (f *FS) pruneVersions(dir string) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var versions []os.FileInfo
+	for _, fi := range fis {
+		// subdirectories hold the versions of children of a directory
+		if fi.Mode().IsRegular() {
+			versions = append(versions, fi)
+		}
+	}
+	now := time.Now()
+	for i, fi := range versions {
+		tooMany := f.versionsMax > 0 && len(versions)-i > f.versionsMax
+		tooOld := f.versionsMaxAge > 0 && now.Sub(fi.ModTime()) > f.versionsMaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		v := filepath.Join(dir, fi.Name())
+		if err := os.Remove(v); err != nil {
+			loog.Warn(logIO, "could not prune version", "version", v, "error", err)
+		}
+	}
+}
+
+// moveVersions moves the versions of a renamed upper path along with it
+func (f *FS) moveVersions(oldPath string, newPath string) {
+	if !f.versions {
+		return
+	}
+	od, nd := f.versionsDir(oldPath), f.versionsDir(newPath)
+	if !exists(od) {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(nd), 0700)
+	if err == nil {
+		// versions of an overwritten target are replaced
+		os.RemoveAll(nd)
+		err = os.Rename(od, nd)
+	}
+	if err != nil {
+		loog.Warn(logRename, "could not move versions", "old", oldPath, "new", newPath, "error", err)
+	}
+}
@@ -0,0 +1,172 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// names of the virtual directories
+const (
+	// trashName in the root lists the trash of the calling user
+	trashName = ".trash"
+	// versionsSuffix appended to the name of a file lists its versions
+	versionsSuffix = ".versions"
+)
+
+// virtualDir is a read-only directory synthesized by the overlay. Its
+// entries are files in the metaDir, they can be read and copied out to
+// restore them. Directories among them, e.g. of snapshots, are listed as
+// virtualDirs as well.
+type virtualDir struct {
+	fs   *FS
+	name string
+	// entries maps the names of the entries to their backing paths
+	entries func() map[string]string
+}
+
+// virtualChild returns the virtual directory name in the directory n, or nil
+func (n *Node) virtualChild(req *fuse.LookupRequest) *virtualDir {
+	rp := n.getRealPath()
+	switch {
+	case n.fs.trash && rp == n.fs.rootPath && req.Name == trashName:
+		dir := n.fs.trashDir(req.Header.Uid)
+		return &virtualDir{fs: n.fs, name: trashName, entries: func() map[string]string {
+			return n.fs.trashView(dir)
+		}}
+	case n.fs.backend == nil && rp == n.fs.rootPath && req.Name == snapshotsName:
+		if len(n.fs.snapshotInfos()) == 0 {
+			return nil
+		}
+		return &virtualDir{fs: n.fs, name: snapshotsName, entries: n.fs.snapshotsView}
+	case n.fs.versions && strings.HasSuffix(req.Name, versionsSuffix):
+		p := filepath.Join(rp, strings.TrimSuffix(req.Name, versionsSuffix))
+		dir := n.fs.versionsDir(p)
+		if !exists(dir) && !exists(p) {
+			return nil
+		}
+		return &virtualDir{fs: n.fs, name: req.Name, entries: func() map[string]string {
+			return versionsView(dir)
+		}}
+	}
+	return nil
+}
+
+// trashView names the entries of a trash directory by their original name
+// and deletion time, e.g. report.txt@2020-04-01T12:00:00.000000000Z
+func (f *FS) trashView(dir string) map[string]string {
+	m := make(map[string]string)
+	for _, e := range f.trashEntries(dir) {
+		fis, err := ioutil.ReadDir(e.path)
+		if err != nil || len(fis) != 1 {
+			continue
+		}
+		name := fis[0].Name() + "@" + e.deleted.UTC().Format(versionTimeFormat)
+		m[name] = filepath.Join(e.path, fis[0].Name())
+	}
+	return m
+}
+
+// versionsView lists the versions in dir by their timestamp
+func versionsView(dir string) map[string]string {
+	m := make(map[string]string)
+	fis, _ := ioutil.ReadDir(dir)
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			m[fi.Name()] = filepath.Join(dir, fi.Name())
+		}
+	}
+	return m
+}
+
+var _ fs.Node = (*virtualDir)(nil)
+
+// Attr implements fs.Node interface for *virtualDir
+func (d *virtualDir) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	if err = d.fs.enter(ctx, OpAttr, d); err != nil {
+		return err
+	}
+	a.Mode = os.ModeDir | 0555
+	a.Mtime = time.Now()
+	a.Valid = 0
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*virtualDir)(nil)
+
+// Lookup implements fs.NodeRequestLookuper interface for *virtualDir
+func (d *virtualDir) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (ret fs.Node, err error) {
+	if err = d.fs.enter(ctx, OpLookup, d); err != nil {
+		return nil, err
+	}
+	defer func() { loog.Debug(logLookup, "Lookup", "path", d.name, "name", req.Name, "error", err) }()
+	p, ok := d.entries()[req.Name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if fi.IsDir() {
+		return &virtualDir{fs: d.fs, name: filepath.Join(d.name, req.Name), entries: func() map[string]string {
+			return dirView(p)
+		}}, nil
+	}
+	nn := d.fs.newNode(&Node{realPath: p, readOnly: true, inode: d.fs.inodeOf(fi), fs: d.fs})
+	nn.fillAttr(&resp.Attr, fi)
+	resp.EntryValid = d.fs.attrTimeout
+	return nn, nil
+}
+
+var _ fs.HandleReadDirAller = (*virtualDir)(nil)
+
+// ReadDirAll implements fs.HandleReadDirAller interface for *virtualDir
+func (d *virtualDir) ReadDirAll(ctx context.Context) (dirs []fuse.Dirent, err error) {
+	if err = d.fs.enter(ctx, OpReadDir, d); err != nil {
+		return nil, err
+	}
+	defer func() { loog.Debug(logDir, "ReadDirAll", "path", d.name, "entries", len(dirs), "error", err) }()
+	for name, p := range d.entries() {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			continue
+		}
+		dirent := d.fs.getDirentsWithFileInfos([]os.FileInfo{fi})[0]
+		dirent.Name = name
+		dirs = append(dirs, dirent)
+	}
+	return dirs, nil
+}
+
+// withVirtualDirs adds the virtual directories listed in the root, unless
+// a real entry shadows them
+func (f *FS) withVirtualDirs(dirs []fuse.Dirent) []fuse.Dirent {
+	var names []string
+	if f.trash {
+		names = append(names, trashName)
+	}
+	if len(f.snapshotInfos()) > 0 {
+		names = append(names, snapshotsName)
+	}
+next:
+	for _, name := range names {
+		for _, d := range dirs {
+			if d.Name == name {
+				continue next
+			}
+		}
+		dirs = append(dirs, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+	return dirs
+}
@@ -0,0 +1,121 @@
+// +build linux
+
+package overlay
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/butonic/ocis-overlay/loog"
+	"golang.org/x/sys/unix"
+)
+
+// watchMask are the inotify events that change what the kernel has cached.
+// Writes are noticed on close, every single write would drop the page cache.
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_ATTRIB | unix.IN_CLOSE_WRITE | unix.IN_ONLYDIR
+
+// watcher watches the backing directories the kernel knows nodes for with
+// inotify, so changes made by other clients of the backing store drop the
+// cached entries and attributes right away instead of after the attribute
+// timeout
+type watcher struct {
+	fd int
+
+	lock  sync.Mutex
+	wds   map[int]string
+	paths map[string]int
+}
+
+func newWatcher() (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &watcher{fd: fd, wds: make(map[int]string), paths: make(map[string]int)}, nil
+}
+
+// add watches the directory p, watching it again is a no-op
+func (w *watcher) add(p string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.paths[p]; ok {
+		return
+	}
+	wd, err := unix.InotifyAddWatch(w.fd, p, watchMask)
+	if err != nil {
+		loog.Debug(logFS, "could not watch directory", "path", p, "error", err)
+		return
+	}
+	w.wds[wd] = p
+	w.paths[p] = wd
+}
+
+// remove stops watching the directory p
+func (w *watcher) remove(p string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	wd, ok := w.paths[p]
+	if !ok {
+		return
+	}
+	unix.InotifyRmWatch(w.fd, uint32(wd))
+	delete(w.wds, wd)
+	delete(w.paths, p)
+}
+
+// rename updates the paths of oldPath and of the directories below it, the
+// watches follow the directories
+func (w *watcher) rename(oldPath string, newPath string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for p, wd := range w.paths {
+		if p != oldPath && !strings.HasPrefix(p, oldPath+string(filepath.Separator)) {
+			continue
+		}
+		np := newPath + p[len(oldPath):]
+		delete(w.paths, p)
+		w.paths[np] = wd
+		w.wds[wd] = np
+	}
+}
+
+// run reads events until the watcher fails and calls changed with the
+// directory and the name of every changed entry, or with empty strings if
+// events were lost
+func (w *watcher) run(changed func(dir string, name string)) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			loog.Error(logFS, "watching the backing store failed", "error", err)
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := string(buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)])
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+			w.lock.Lock()
+			dir, ok := w.wds[int(ev.Wd)]
+			if ev.Mask&unix.IN_IGNORED != 0 {
+				delete(w.wds, int(ev.Wd))
+				if ok && w.paths[dir] == int(ev.Wd) {
+					delete(w.paths, dir)
+				}
+			}
+			w.lock.Unlock()
+			switch {
+			case ev.Mask&unix.IN_Q_OVERFLOW != 0:
+				// events were lost, everything may have changed
+				changed("", "")
+			case ok && ev.Mask&unix.IN_IGNORED == 0:
+				changed(dir, strings.TrimRight(name, "\x00"))
+			}
+		}
+	}
+}
@@ -0,0 +1,470 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// propfind requests the properties needed for file infos, the oc: ones are
+// answered by ownCloud and oCIS
+const propfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns"><d:prop>
+<d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getetag/>
+<oc:fileid/><oc:permissions/><oc:share-types/>
+</d:prop></d:propfind>`
+
+// propfindQuota requests the quota of a collection, RFC 4331
+const propfindQuota = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop>
+<d:quota-used-bytes/><d:quota-available-bytes/>
+</d:prop></d:propfind>`
+
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength  string `xml:"DAV: getcontentlength"`
+				LastModified   string `xml:"DAV: getlastmodified"`
+				ETag           string `xml:"DAV: getetag"`
+				QuotaUsed      string `xml:"DAV: quota-used-bytes"`
+				QuotaAvailable string `xml:"DAV: quota-available-bytes"`
+				FileID         string `xml:"http://owncloud.org/ns fileid"`
+				Permissions    string `xml:"http://owncloud.org/ns permissions"`
+				ShareTypes     []int  `xml:"http://owncloud.org/ns share-types>share-type"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// davInfo is the os.FileInfo of a WebDAV resource
+type davInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	isDir bool
+	etag  string
+
+	id          string
+	permissions string
+	shareTypes  []int
+}
+
+func (i *davInfo) Name() string       { return i.name }
+func (i *davInfo) Size() int64        { return i.size }
+func (i *davInfo) ModTime() time.Time { return i.mtime }
+func (i *davInfo) IsDir() bool        { return i.isDir }
+func (i *davInfo) Sys() interface{}   { return nil }
+func (i *davInfo) ETag() string       { return i.etag }
+
+// Xattrs implements xattrInfo for *davInfo
+func (i *davInfo) Xattrs() map[string][]byte {
+	x := make(map[string][]byte)
+	if i.etag != "" {
+		x[EtagAttr] = []byte(strings.Trim(i.etag, `"`))
+	}
+	if i.id != "" {
+		x[ocisIDAttr] = []byte(i.id)
+	}
+	if i.permissions != "" {
+		x[PermissionsAttr] = []byte(i.permissions)
+	}
+	if len(i.shareTypes) > 0 {
+		types := make([]string, 0, len(i.shareTypes))
+		for _, t := range i.shareTypes {
+			types = append(types, shareTypeName(t))
+		}
+		x[ShareTypesAttr] = []byte(strings.Join(types, ","))
+	}
+	return x
+}
+
+func (i *davInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func init() {
+	// dav:// and davs:// select WebDAV over http and https
+	newDAV := func(u *url.URL, creds *Credentials) (Backend, error) {
+		dav := *u
+		dav.Scheme = "http"
+		if u.Scheme == "davs" {
+			dav.Scheme = "https"
+		}
+		return NewWebDAV(dav.String(), creds)
+	}
+	RegisterBackend("dav", newDAV)
+	RegisterBackend("davs", newDAV)
+}
+
+// WebDAV is a Backend for a WebDAV server, e.g. the files endpoint of
+// ownCloud or oCIS: https://host/remote.php/dav/files/<user>
+type WebDAV struct {
+	base   *url.URL
+	client *http.Client
+	creds  *Credentials
+
+	// tus is set if the server supports resumable uploads, see tus.go
+	tusOnce sync.Once
+	tus     bool
+}
+
+// NewWebDAV returns a Backend for the WebDAV collection at endpoint,
+// requests are authenticated with creds if not nil
+func NewWebDAV(endpoint string, creds *Credentials) (*WebDAV, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid WebDAV endpoint %q", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &WebDAV{base: u, client: &http.Client{}, creds: creds}, nil
+}
+
+func (w *WebDAV) url(name string) string {
+	u := *w.base
+	u.Path = path.Join("/", w.base.Path, name)
+	if name == "" {
+		// the root is a collection
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	}
+	return u.String()
+}
+
+// statusErrno maps HTTP status codes to errnos
+func statusErrno(code int) syscall.Errno {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return syscall.EACCES
+	case http.StatusNotFound, http.StatusConflict:
+		// 409 is returned if the parent collection is missing
+		return syscall.ENOENT
+	case http.StatusMethodNotAllowed, http.StatusPreconditionFailed:
+		// 405 is returned by MKCOL on an existing resource
+		return syscall.EEXIST
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		return syscall.ENOSPC
+	case http.StatusLocked:
+		return syscall.EBUSY
+	case http.StatusNotImplemented:
+		return syscall.ENOTSUP
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		// transient, see retry.go
+		return syscall.EAGAIN
+	case http.StatusGatewayTimeout:
+		return syscall.ETIMEDOUT
+	default:
+		return syscall.EIO
+	}
+}
+
+// request returns an authenticated request for name
+func (w *WebDAV) request(ctx context.Context, method string, name string,
+	body io.Reader, header http.Header) (*http.Request, error) {
+	return w.requestURL(ctx, method, w.url(name), body, header)
+}
+
+// requestURL returns an authenticated request for u
+func (w *WebDAV) requestURL(ctx context.Context, method string, u string,
+	body io.Reader, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w.creds.authorize(req)
+	return req, nil
+}
+
+// send sends req for name. Responses with status codes of 300 and above
+// are returned as errors, unless they are in ok. A request rejected with 401
+// is sent once more if the credentials got a new token and the body can be
+// sent again.
+func (w *WebDAV) send(req *http.Request, name string, ok ...int) (resp *http.Response, err error) {
+	if s := startCall(req.Context(), "webdav."+req.Method); s != nil {
+		req.Header.Set("traceparent", s.traceparent())
+		defer func() { s.endCall(name, err) }()
+	}
+	resp, err = w.client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized &&
+		(req.Body == nil || req.GetBody != nil) && w.creds.rejected(req) {
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				resp.Body.Close()
+				return nil, &os.PathError{Op: req.Method, Path: name, Err: err}
+			}
+		}
+		w.creds.authorize(retry)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		resp, err = w.client.Do(retry)
+	}
+	if err != nil {
+		if req.Context().Err() != nil {
+			return nil, errInterrupted
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = syscall.ETIMEDOUT
+		}
+		return nil, &os.PathError{Op: req.Method, Path: name, Err: err}
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil, &os.PathError{Op: req.Method, Path: name, Err: statusErrno(resp.StatusCode)}
+}
+
+// do sends a request for name, see send
+func (w *WebDAV) do(ctx context.Context, method string, name string,
+	body io.Reader, header http.Header, ok ...int) (*http.Response, error) {
+	req, err := w.request(ctx, method, name, body, header)
+	if err != nil {
+		return nil, err
+	}
+	return w.send(req, name, ok...)
+}
+
+// propfind returns the multistatus response for name
+func (w *WebDAV) propfind(ctx context.Context, name string, depth string, body string) (*multistatus, error) {
+	header := http.Header{
+		"Depth":        {depth},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := w.do(ctx, "PROPFIND", name, strings.NewReader(body), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, &os.PathError{Op: "PROPFIND", Path: name, Err: syscall.EIO}
+	}
+	var ms multistatus
+	if err = xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, &os.PathError{Op: "PROPFIND", Path: name, Err: err}
+	}
+	return &ms, nil
+}
+
+// infos converts the responses of a PROPFIND to file infos by name relative
+// to the base URL
+func (w *WebDAV) infos(ms *multistatus) map[string]*davInfo {
+	infos := make(map[string]*davInfo, len(ms.Responses))
+	for _, r := range ms.Responses {
+		u, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		rel := strings.Trim(strings.TrimPrefix(u.Path, w.base.Path), "/")
+		i := &davInfo{name: path.Base("/" + rel)}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200") {
+				continue
+			}
+			p := ps.Prop
+			if p.ResourceType.Collection != nil {
+				i.isDir = true
+			}
+			if p.ContentLength != "" {
+				i.size, _ = strconv.ParseInt(p.ContentLength, 10, 64)
+			}
+			if p.LastModified != "" {
+				i.mtime, _ = http.ParseTime(p.LastModified)
+			}
+			if p.ETag != "" {
+				i.etag = p.ETag
+			}
+			if p.FileID != "" {
+				i.id = p.FileID
+			}
+			if p.Permissions != "" {
+				i.permissions = p.Permissions
+			}
+			if len(p.ShareTypes) > 0 {
+				i.shareTypes = p.ShareTypes
+			}
+		}
+		infos[rel] = i
+	}
+	return infos
+}
+
+// Stat implements Backend for *WebDAV
+func (w *WebDAV) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	ms, err := w.propfind(ctx, name, "0", propfind)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range w.infos(ms) {
+		return i, nil
+	}
+	return nil, &os.PathError{Op: "PROPFIND", Path: name, Err: syscall.ENOENT}
+}
+
+// ReadDir implements Backend for *WebDAV
+func (w *WebDAV) ReadDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	ms, err := w.propfind(ctx, name, "1", propfind)
+	if err != nil {
+		return nil, err
+	}
+	self := strings.Trim(name, "/")
+	var fis []os.FileInfo
+	for rel, i := range w.infos(ms) {
+		if rel != self {
+			fis = append(fis, i)
+		}
+	}
+	return fis, nil
+}
+
+// ReadAt implements Backend for *WebDAV with a ranged GET
+func (w *WebDAV) ReadAt(ctx context.Context, name string, p []byte, off int64) (int, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)}}
+	resp, err := w.do(ctx, "GET", name, nil, header, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return 0, io.EOF
+	}
+	return readRange(resp, name, p, off)
+}
+
+// readRange reads the answer of a ranged GET at off into p. Servers that
+// ignore the range send the whole file, it is read up to off. io.EOF is
+// only returned if the body ended where its length said, a body that broke
+// off is an error.
+func readRange(resp *http.Response, name string, p []byte, off int64) (int, error) {
+	length := resp.ContentLength
+	if resp.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, off); err == io.EOF {
+			// the body ends before off, bodies that break off fail with
+			// io.ErrUnexpectedEOF instead
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, &os.PathError{Op: "GET", Path: name, Err: err}
+		}
+		if length >= 0 {
+			length -= off
+		}
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	switch {
+	case err == nil:
+		return n, nil
+	case err != io.EOF && err != io.ErrUnexpectedEOF:
+		return n, &os.PathError{Op: "GET", Path: name, Err: err}
+	case length >= 0 && int64(n) < length:
+		return n, &os.PathError{Op: "GET", Path: name, Err: io.ErrUnexpectedEOF}
+	}
+	return n, io.EOF
+}
+
+// Upload implements Backend for *WebDAV with a PUT
+func (w *WebDAV) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	req, err := w.request(ctx, "PUT", name, r, nil)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := w.send(req, name)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Mkdir implements Backend for *WebDAV with a MKCOL
+func (w *WebDAV) Mkdir(ctx context.Context, name string) error {
+	resp, err := w.do(ctx, "MKCOL", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Remove implements Backend for *WebDAV with a DELETE
+func (w *WebDAV) Remove(ctx context.Context, name string) error {
+	resp, err := w.do(ctx, "DELETE", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename implements Backend for *WebDAV with a MOVE
+func (w *WebDAV) Rename(ctx context.Context, oldName string, newName string) error {
+	header := http.Header{
+		"Destination": {w.url(newName)},
+		"Overwrite":   {"T"},
+	}
+	resp, err := w.do(ctx, "MOVE", oldName, nil, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Quota implements QuotaBackend for *WebDAV
+func (w *WebDAV) Quota(ctx context.Context) (used int64, available int64, err error) {
+	ms, err := w.propfind(ctx, "", "0", propfindQuota)
+	if err != nil {
+		return 0, -1, err
+	}
+	available = -1
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200") {
+				continue
+			}
+			if v, err := strconv.ParseInt(ps.Prop.QuotaUsed, 10, 64); err == nil {
+				used = v
+			}
+			if v, err := strconv.ParseInt(ps.Prop.QuotaAvailable, 10, 64); err == nil {
+				available = v
+			}
+		}
+	}
+	return used, available, nil
+}
@@ -0,0 +1,77 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokenBody answers with a body that breaks off after half of its length
+func brokenBody(w http.ResponseWriter, content string) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(content[:len(content)/2]))
+	if hj, ok := w.(http.Hijacker); ok {
+		c, _, _ := hj.Hijack()
+		c.Close()
+	}
+}
+
+func TestWebDAVReadAt(t *testing.T) {
+	const content = "0123456789abcdefghijklmnopqrstuvwxyz"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ranged":
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+		case "/whole":
+			// ignores the range
+			w.Write([]byte(content))
+		case "/broken":
+			brokenBody(w, content)
+		}
+	}))
+	defer srv.Close()
+	w, err := NewWebDAV(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		off     int64
+		size    int
+		want    string
+		wantErr error
+	}{
+		{"ranged", 10, 5, "abcde", nil},
+		{"ranged", 30, 10, "uvwxyz", io.EOF},
+		{"ranged", 40, 10, "", io.EOF},
+		{"whole", 10, 5, "abcde", nil},
+		{"whole", 30, 10, "uvwxyz", io.EOF},
+		{"whole", 40, 10, "", io.EOF},
+		{"broken", 0, 30, "", io.ErrUnexpectedEOF},
+		{"broken", 20, 5, "", io.ErrUnexpectedEOF},
+	} {
+		p := make([]byte, tc.size)
+		n, err := w.ReadAt(context.Background(), tc.name, p, tc.off)
+		switch {
+		case tc.wantErr == io.EOF && err != io.EOF,
+			tc.wantErr == nil && err != nil:
+			t.Errorf("%s at %d: got error %v, want %v", tc.name, tc.off, err, tc.wantErr)
+		case tc.wantErr == io.ErrUnexpectedEOF:
+			if err == nil || err == io.EOF {
+				t.Errorf("%s at %d: a body that broke off returned %v", tc.name, tc.off, err)
+			}
+			continue
+		}
+		if string(p[:n]) != tc.want {
+			t.Errorf("%s at %d: read %q, want %q", tc.name, tc.off, p[:n], tc.want)
+		}
+	}
+}
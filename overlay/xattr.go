@@ -0,0 +1,226 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// XattrMode selects where extended attributes are stored
+type XattrMode string
+
+const (
+	// XattrPassthrough stores xattrs on the backing filesystem and falls back
+	// to the in-memory store if the backing filesystem does not support them
+	XattrPassthrough XattrMode = "passthrough"
+	// XattrMemory only keeps xattrs in memory, they are lost on remount
+	XattrMemory XattrMode = "memory"
+)
+
+// XattrPolicy selects how the security.* and trusted.* xattrs are handled,
+// e.g. SELinux labels, regardless of the XattrMode
+type XattrPolicy string
+
+const (
+	// XattrPolicyPassthrough always stores them on the backing filesystem,
+	// errors like ENOTSUP or EPERM are returned instead of falling back to
+	// the in-memory store
+	XattrPolicyPassthrough XattrPolicy = "passthrough"
+	// XattrPolicyDeny does not list them and refuses to set them with
+	// ENOTSUP
+	XattrPolicyDeny XattrPolicy = "deny"
+	// XattrPolicySynthesize keeps them in the in-memory store only, so
+	// setting them always succeeds but they are lost on remount
+	XattrPolicySynthesize XattrPolicy = "synthesize"
+)
+
+// ParseXattrPolicy parses a policy, empty is XattrPolicyPassthrough
+func ParseXattrPolicy(s string) (XattrPolicy, error) {
+	switch p := XattrPolicy(s); p {
+	case "":
+		return XattrPolicyPassthrough, nil
+	case XattrPolicyPassthrough, XattrPolicyDeny, XattrPolicySynthesize:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown xattr policy %q", s)
+}
+
+// xattrStores returns whether the xattr name goes to the backing file and
+// whether it goes to the in-memory store, alone or as fallback. The xattrs
+// of the overlay itself go to neither.
+func (f *FS) xattrStores(name string) (backing bool, memory bool) {
+	if strings.HasPrefix(name, overlayXattrPrefix) {
+		return false, false
+	}
+	if !strings.HasPrefix(name, "security.") && !strings.HasPrefix(name, "trusted.") {
+		return f.passthroughXattrs(), true
+	}
+	switch f.xattrSecurity {
+	case XattrPolicyDeny:
+		return false, false
+	case XattrPolicySynthesize:
+		return false, true
+	}
+	return true, false
+}
+
+// xattrTooBig reports whether a value of size bytes exceeds the limit for
+// xattr values
+func (f *FS) xattrTooBig(size int) bool {
+	if f.maxXattrSize > 0 {
+		return size > f.maxXattrSize
+	}
+	return size > xattrSizeMax
+}
+
+// xattrUnsupported reports whether err indicates that the backing filesystem
+// has no xattr support
+func xattrUnsupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	errno := unpackSysErr(err)
+	return errno == syscall.ENOTSUP || errno == syscall.EOPNOTSUPP
+}
+
+// translateXattrError translates errors returned by the xattr package
+func translateXattrError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return translateError(unpackSysErr(err))
+}
+
+// passthroughXattrs reports whether xattr calls should go to the backing
+// filesystem first
+func (f *FS) passthroughXattrs() bool {
+	return f.xattrMode != XattrMemory
+}
+
+func (f *FS) xattrFallback(realPath string) {
+	loog.Warn(logXattr, "backing filesystem does not support xattrs, using in-memory store", "path", realPath)
+}
+
+// xattrKey returns the file the in-memory xattrs of realPath are stored for
+func xattrKey(realPath string) (fileID, error) {
+	fi, err := os.Lstat(realPath)
+	if err != nil {
+		return fileID{}, translateError(err)
+	}
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, fuse.Errno(syscall.ENOTSUP)
+	}
+	return fileID{dev: uint64(s.Dev), ino: uint64(s.Ino)}, nil
+}
+
+func (f *FS) getxattr(realPath string, name string) ([]byte, error) {
+	key, err := xattrKey(realPath)
+	if err != nil {
+		return nil, err
+	}
+	f.xlock.RLock()
+	defer f.xlock.RUnlock()
+	v, ok := f.xattrs[key][name]
+	if !ok {
+		return nil, fuse.ErrNoXattr
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (f *FS) listxattr(realPath string) (names []string) {
+	key, err := xattrKey(realPath)
+	if err != nil {
+		return nil
+	}
+	f.xlock.RLock()
+	defer f.xlock.RUnlock()
+	for name := range f.xattrs[key] {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (f *FS) setxattr(realPath string, name string, value []byte, flags uint32) error {
+	key, err := xattrKey(realPath)
+	if err != nil {
+		return err
+	}
+	f.xlock.Lock()
+	defer f.xlock.Unlock()
+	attrs := f.xattrs[key]
+	if attrs == nil {
+		attrs = make(map[string][]byte)
+		f.xattrs[key] = attrs
+	}
+	_, exists := attrs[name]
+	switch {
+	case flags&xattrCreate != 0 && exists:
+		return fuse.EEXIST
+	case flags&xattrReplace != 0 && !exists:
+		return fuse.ErrNoXattr
+	}
+	attrs[name] = append([]byte(nil), value...)
+	f.xattrsChanged()
+	return nil
+}
+
+func (f *FS) removexattr(realPath string, name string) error {
+	key, err := xattrKey(realPath)
+	if err != nil {
+		return err
+	}
+	f.xlock.Lock()
+	defer f.xlock.Unlock()
+	if _, ok := f.xattrs[key][name]; !ok {
+		return fuse.ErrNoXattr
+	}
+	delete(f.xattrs[key], name)
+	f.xattrsChanged()
+	return nil
+}
+
+// copyxattrs copies the in-memory xattrs of src to dst, e.g. on copy-up
+func (f *FS) copyxattrs(dst string, src string) {
+	from, err := xattrKey(src)
+	if err != nil {
+		return
+	}
+	to, err := xattrKey(dst)
+	if err != nil {
+		return
+	}
+	f.xlock.Lock()
+	defer f.xlock.Unlock()
+	if len(f.xattrs[from]) == 0 {
+		return
+	}
+	attrs := make(map[string][]byte, len(f.xattrs[from]))
+	for name, value := range f.xattrs[from] {
+		attrs[name] = value
+	}
+	f.xattrs[to] = attrs
+	f.xattrsChanged()
+}
+
+// unlinkedXattrs drops the in-memory xattrs of a file that was removed or
+// replaced, fi was taken before. Other hard links keep them.
+func (f *FS) unlinkedXattrs(fi os.FileInfo) {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.IsDir() && s.Nlink > 1 {
+		return
+	}
+	key := fileID{dev: uint64(s.Dev), ino: uint64(s.Ino)}
+	f.xlock.Lock()
+	defer f.xlock.Unlock()
+	if _, ok := f.xattrs[key]; ok {
+		delete(f.xattrs, key)
+		f.xattrsChanged()
+	}
+}
@@ -0,0 +1,87 @@
+// +build linux darwin
+
+package overlay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+const (
+	// xattrStoreFile is the file below the metaDir the in-memory xattrs are
+	// persisted in
+	xattrStoreFile = "xattrs.json"
+	// xattrSaveDelay collects changes for this long before they are written
+	xattrSaveDelay = time.Second
+)
+
+// persistedXattrs are the in-memory xattrs of one file in the xattrStoreFile
+type persistedXattrs struct {
+	Dev    uint64            `json:"dev"`
+	Ino    uint64            `json:"ino"`
+	Xattrs map[string][]byte `json:"xattrs"`
+}
+
+// loadXattrs fills the in-memory store with the xattrs persisted by an
+// earlier mount
+func (f *FS) loadXattrs() {
+	b, err := ioutil.ReadFile(f.metaPath(xattrStoreFile))
+	if os.IsNotExist(err) {
+		return
+	}
+	var files []persistedXattrs
+	if err == nil {
+		err = json.Unmarshal(b, &files)
+	}
+	for _, p := range files {
+		f.xattrs[fileID{dev: p.Dev, ino: p.Ino}] = p.Xattrs
+	}
+	if err != nil {
+		loog.Error(logXattr, "could not load persisted xattrs", "path", f.metaPath(xattrStoreFile), "error", err)
+	}
+}
+
+// xattrsChanged schedules writing the in-memory store, f.xlock must be held
+func (f *FS) xattrsChanged() {
+	if f.persistXattrs && f.xattrSave == nil {
+		f.xattrSave = time.AfterFunc(xattrSaveDelay, f.saveXattrs)
+	}
+}
+
+// saveXattrs writes the in-memory store if it changed. It is written to a
+// temporary file first, so a crash leaves the previous version.
+func (f *FS) saveXattrs() {
+	f.xlock.Lock()
+	if f.xattrSave == nil {
+		f.xlock.Unlock()
+		return
+	}
+	f.xattrSave.Stop()
+	f.xattrSave = nil
+	files := make([]persistedXattrs, 0, len(f.xattrs))
+	for id, a := range f.xattrs {
+		if len(a) > 0 {
+			files = append(files, persistedXattrs{Dev: id.dev, Ino: id.ino, Xattrs: a})
+		}
+	}
+	b, err := json.Marshal(files)
+	f.xlock.Unlock()
+
+	p := f.metaPath(xattrStoreFile)
+	if err == nil {
+		err = os.MkdirAll(f.metaPath(), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(p+".tmp", b, 0600)
+	}
+	if err == nil {
+		err = os.Rename(p+".tmp", p)
+	}
+	if err != nil {
+		loog.Error(logXattr, "could not persist xattrs", "path", p, "error", err)
+	}
+}
@@ -0,0 +1,61 @@
+// +build linux darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/butonic/ocis-overlay/overlay"
+)
+
+// replayMismatch is printed for a record the replay answered differently
+type replayMismatch struct {
+	*overlay.Record
+	Replayed string `json:"replayed"`
+}
+
+// replay runs the replay subcommand and returns the exit code: 0 if every
+// request was answered like in the recording, 1 if not and 2 for usage
+// errors. The mismatches are printed as JSON lines.
+func replay(args []string) int {
+	fset := newCommandFlags("replay", "-dir DIR [-timing] RECORDING")
+	dir := fset.String("dir", "", "backing directory to replay the recording against, usually a copy of the one recorded")
+	timing := fset.Bool("timing", false, "start the requests at their recorded times instead of as fast as possible")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" || fset.NArg() != 1 {
+		fset.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fset.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	replayed, skipped, mismatches := 0, 0, 0
+	err = overlay.Replay(f, *dir, *timing, func(r *overlay.ReplayResult) {
+		switch {
+		case r.Skipped:
+			skipped++
+		case r.Mismatch():
+			mismatches++
+			printJSON(replayMismatch{Record: r.Record, Replayed: r.Errno})
+			fallthrough
+		default:
+			replayed++
+		}
+	})
+	fmt.Fprintf(os.Stderr, "replayed %d requests, skipped %d, %d mismatches\n", replayed, skipped, mismatches)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if mismatches > 0 {
+		return 1
+	}
+	return 0
+}
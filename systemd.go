@@ -0,0 +1,117 @@
+// +build linux darwin
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/butonic/ocis-overlay/loog"
+)
+
+// listenFdsStart is the first file descriptor systemd passes sockets on
+const listenFdsStart = 3
+
+var errStatTimeout = errors.New("stat timed out")
+
+// sdNotify sends state, e.g. READY=1, to systemd. It is a noop when not
+// started by systemd with Type=notify.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		// abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err == nil {
+		_, err = conn.Write([]byte(state))
+		conn.Close()
+	}
+	if err != nil {
+		loog.Warn("main", "could not notify systemd", "state", state, "error", err)
+	}
+}
+
+// watchdog pings the systemd watchdog at half the WatchdogSec of the unit as
+// long as stat on the mountpoint goes through the kernel mount and returns in
+// time. A hung mount stops the pings and systemd restarts the service.
+func watchdog(mountpoint string) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	loog.Info("main", "pinging the systemd watchdog", "interval", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if err := statWithin(mountpoint, interval); err != nil {
+				loog.Warn("main", "mount is unhealthy, not pinging the watchdog", "mountpoint", mountpoint, "error", err)
+				continue
+			}
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
+
+// statWithin stats p and gives up after timeout. The stat keeps hanging in
+// the background if the mount does.
+func statWithin(p string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(p)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errStatTimeout
+	}
+}
+
+// activatedListeners returns the sockets passed by systemd socket activation
+// by their FileDescriptorName, e.g. control. A single socket is the control
+// socket whatever its name.
+func activatedListeners() map[string]net.Listener {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string]net.Listener, n)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "control"
+		if n > 1 && i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			loog.Warn("main", "ignoring activated socket", "name", name, "error", err)
+			continue
+		}
+		listeners[name] = l
+	}
+	return listeners
+}